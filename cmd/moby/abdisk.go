@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"unicode/utf16"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	sectorSize = 512
+	// gptEntries is the number of partition entries in each GPT, which take 32 sectors
+	gptEntries   = 128
+	gptEntrySize = 128
+	gptSectors   = 1 + gptEntries*gptEntrySize/sectorSize
+	// partitions are aligned to 1MiB, which leaves room for the GPT at each end
+	alignSectors = 1024 * 1024 / sectorSize
+	// abConfigSize is the size of the config partition of an A/B disk in MB
+	abConfigSize = 8
+	// abRootfsLabel is the label of the root filesystem in each slot
+	abRootfsLabel = "MOBY-ROOT"
+	// abMinRootfs is the smallest root filesystem, above the FAT16 minimum
+	abMinRootfs = 4 * 1024 * 1024
+	// fatMaxSize is the largest FAT16 filesystem, with 32KiB clusters
+	fatMaxSize = fatMaxClusters * 64 * sectorSize
+)
+
+// linuxFilesystemGUID is the GPT partition type for Linux data, in on disk byte order
+var linuxFilesystemGUID = [16]byte{0xaf, 0x3d, 0xc6, 0x0f, 0x83, 0x84, 0x72, 0x47, 0x8e, 0x79, 0x3d, 0x69, 0xd8, 0x47, 0x7d, 0xe4}
+
+// gptPartition is a partition of a disk, in sectors with last inclusive
+type gptPartition struct {
+	name  string
+	first uint64
+	last  uint64
+	guid  [16]byte
+}
+
+// abLayout lays out a disk of sizeMB with two equal slots for a root
+// filesystem of rootfs bytes followed by the config partition
+func abLayout(sizeMB int, rootfs int64) ([]gptPartition, error) {
+	// the slots need whole MB, with a MB at each end for the GPT
+	needMB := int((rootfs + 1024*1024 - 1) / (1024 * 1024))
+	if needMB == 0 {
+		needMB = 1
+	}
+	minMB := 2*needMB + abConfigSize + 2
+	if sizeMB < minMB {
+		return nil, fmt.Errorf("Disk size %dM is too small for two %dM root filesystem slots and a %dM config partition, it must be at least %dM", sizeMB, needMB, abConfigSize, minMB)
+	}
+	slot := uint64((sizeMB-abConfigSize-2)/2) * alignSectors
+	start := uint64(alignSectors)
+	parts := []gptPartition{
+		{name: "root-a", first: start, last: start + slot - 1},
+		{name: "root-b", first: start + slot, last: start + 2*slot - 1},
+		{name: "config", first: start + 2*slot, last: start + 2*slot + abConfigSize*alignSectors - 1},
+	}
+	return parts, nil
+}
+
+// abRootfs formats the root filesystem of the slots of an A/B disk, a FAT16
+// filesystem with the kernel, initrd and cmdline for the bootloader of the
+// device to load, sized to fit them
+func abRootfs(kernel, initrd []byte, cmdline string) ([]byte, error) {
+	files := []fatFile{
+		{path: "kernel", contents: kernel},
+		{path: "initrd.img", contents: initrd},
+		{path: "cmdline", contents: []byte(cmdline)},
+	}
+	// with room for the FATs, the root directory and the last cluster of each file
+	size := int64(len(kernel) + len(initrd) + len(cmdline))
+	size += size/64 + 1024*1024
+	size = (size + 1024*1024 - 1) / (1024 * 1024) * 1024 * 1024
+	if size < abMinRootfs {
+		size = abMinRootfs
+	}
+	if size > fatMaxSize {
+		return nil, fmt.Errorf("The kernel and initrd are too large for a FAT16 root filesystem of at most %d bytes", int64(fatMaxSize))
+	}
+	return fatFilesystem(size, abRootfsLabel, files)
+}
+
+// gptGUID derives a stable random GUID from the root filesystem and a name,
+// so the same image always gives the same disk
+func gptGUID(rootfs []byte, name string) [16]byte {
+	sum := sha256.Sum256(append(append([]byte{}, rootfs...), name...))
+	var guid [16]byte
+	copy(guid[:], sum[:16])
+	guid[7] = guid[7]&0x0f | 0x40
+	guid[8] = guid[8]&0x3f | 0x80
+	return guid
+}
+
+// gptEntryArray encodes the partition entries
+func gptEntryArray(parts []gptPartition) []byte {
+	entries := make([]byte, gptEntries*gptEntrySize)
+	for i, p := range parts {
+		e := entries[i*gptEntrySize:]
+		copy(e[0:16], linuxFilesystemGUID[:])
+		copy(e[16:32], p.guid[:])
+		binary.LittleEndian.PutUint64(e[32:], p.first)
+		binary.LittleEndian.PutUint64(e[40:], p.last)
+		for j, c := range utf16.Encode([]rune(p.name)) {
+			binary.LittleEndian.PutUint16(e[56+2*j:], c)
+		}
+	}
+	return entries
+}
+
+// gptHeader encodes a GPT header at current, with the other copy at backup
+func gptHeader(current, backup, entriesLBA, sectors uint64, disk [16]byte, entries []byte) []byte {
+	h := make([]byte, sectorSize)
+	copy(h[0:8], "EFI PART")
+	binary.LittleEndian.PutUint32(h[8:], 0x00010000)
+	binary.LittleEndian.PutUint32(h[12:], 92)
+	binary.LittleEndian.PutUint64(h[24:], current)
+	binary.LittleEndian.PutUint64(h[32:], backup)
+	binary.LittleEndian.PutUint64(h[40:], 1+gptSectors)
+	binary.LittleEndian.PutUint64(h[48:], sectors-1-gptSectors)
+	copy(h[56:72], disk[:])
+	binary.LittleEndian.PutUint64(h[72:], entriesLBA)
+	binary.LittleEndian.PutUint32(h[80:], gptEntries)
+	binary.LittleEndian.PutUint32(h[84:], gptEntrySize)
+	binary.LittleEndian.PutUint32(h[88:], crc32.ChecksumIEEE(entries))
+	binary.LittleEndian.PutUint32(h[16:], crc32.ChecksumIEEE(h[:92]))
+	return h
+}
+
+// protectiveMBR marks the whole disk as in use by a GPT for tools that do not know of it
+func protectiveMBR(sectors uint64) []byte {
+	mbr := make([]byte, sectorSize)
+	p := mbr[446:]
+	copy(p[1:4], []byte{0x00, 0x02, 0x00})
+	p[4] = 0xee
+	copy(p[5:8], []byte{0xff, 0xff, 0xff})
+	binary.LittleEndian.PutUint32(p[8:], 1)
+	size := sectors - 1
+	if size > 0xffffffff {
+		size = 0xffffffff
+	}
+	binary.LittleEndian.PutUint32(p[12:], uint32(size))
+	mbr[510], mbr[511] = 0x55, 0xaa
+	return mbr
+}
+
+// outputABDisk writes a GPT disk image of o.size with the same root
+// filesystem in both the A and B slots and a config partition, with the seed
+// of the config in it if there is one. There is no bootloader on the disk, the
+// bootloader of the device loads the kernel and initrd from the slot it boots.
+func outputABDisk(filename string, rootfs []byte, o *outputOpts) error {
+	log.Debugf("output ab disk: %s size %d", filename, o.size)
+	parts, err := abLayout(o.size, int64(len(rootfs)))
+	if err != nil {
+		return err
+	}
+	size := int64(o.size) * 1024 * 1024
+	if o.maxSize > 0 && o.written+size > o.maxSize {
+		return o.errTooLarge(filename)
+	}
+	sectors := uint64(size / sectorSize)
+	disk := gptGUID(rootfs, "disk")
+	for i := range parts {
+		parts[i].guid = gptGUID(rootfs, parts[i].name)
+	}
+	entries := gptEntryArray(parts)
+	var seed []byte
+	if o.seed != nil {
+		seed, err = o.seed.filesystem()
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	// the disk is sparse apart from the GPT and the slots
+	writes := []struct {
+		lba  uint64
+		data []byte
+	}{
+		{0, protectiveMBR(sectors)},
+		{1, gptHeader(1, sectors-1, 2, sectors, disk, entries)},
+		{2, entries},
+		{parts[0].first, rootfs},
+		{parts[1].first, rootfs},
+		{parts[2].first, seed},
+		{sectors - gptSectors, entries},
+		{sectors - 1, gptHeader(sectors-1, 1, sectors-gptSectors, sectors, disk, entries)},
+	}
+	err = f.Truncate(size)
+	for _, w := range writes {
+		if err == nil {
+			_, err = f.WriteAt(w.data, int64(w.lba)*sectorSize)
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(filename)
+		return err
+	}
+	o.addFile(filename)
+	return o.account(filename, size)
+}
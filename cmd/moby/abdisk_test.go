@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// readGPT checks the GPT header at lba and returns the partitions it lists
+func readGPT(t *testing.T, disk []byte, lba uint64) []gptPartition {
+	h := append([]byte{}, disk[lba*sectorSize:lba*sectorSize+92]...)
+	if string(h[0:8]) != "EFI PART" {
+		t.Fatalf("No GPT header at LBA %d", lba)
+	}
+	crc := binary.LittleEndian.Uint32(h[16:])
+	binary.LittleEndian.PutUint32(h[16:], 0)
+	if crc32.ChecksumIEEE(h) != crc {
+		t.Errorf("GPT header at LBA %d has a bad checksum", lba)
+	}
+	if current := binary.LittleEndian.Uint64(h[24:]); current != lba {
+		t.Errorf("GPT header at LBA %d says it is at %d", lba, current)
+	}
+	start := binary.LittleEndian.Uint64(h[72:]) * sectorSize
+	entries := disk[start : start+gptEntries*gptEntrySize]
+	if crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(h[88:]) {
+		t.Errorf("GPT entries for the header at LBA %d have a bad checksum", lba)
+	}
+	parts := []gptPartition{}
+	for i := 0; i < gptEntries; i++ {
+		e := entries[i*gptEntrySize : (i+1)*gptEntrySize]
+		if bytes.Equal(e[0:16], make([]byte, 16)) {
+			continue
+		}
+		name := make([]uint16, 36)
+		for j := range name {
+			name[j] = binary.LittleEndian.Uint16(e[56+2*j:])
+		}
+		parts = append(parts, gptPartition{
+			name:  strings.TrimRight(string(utf16.Decode(name)), "\x00"),
+			first: binary.LittleEndian.Uint64(e[32:]),
+			last:  binary.LittleEndian.Uint64(e[40:]),
+		})
+	}
+	return parts
+}
+
+func TestOutputABDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := testImage(t)
+	base := filepath.Join(dir, "test")
+	o := &outputOpts{size: 24}
+	if err := outFuns["ab-raw"](base, image, o); err != nil {
+		t.Fatal(err)
+	}
+	disk, err := ioutil.ReadFile(base + "-ab-raw.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(disk) != 24*1024*1024 {
+		t.Fatalf("Expected a 24M disk, got %d bytes", len(disk))
+	}
+	if disk[510] != 0x55 || disk[511] != 0xaa || disk[446+4] != 0xee {
+		t.Error("Expected a protective MBR")
+	}
+	sectors := uint64(len(disk) / sectorSize)
+	parts := readGPT(t, disk, 1)
+	backup := readGPT(t, disk, sectors-1)
+	if len(parts) != 3 || parts[0].name != "root-a" || parts[1].name != "root-b" || parts[2].name != "config" {
+		t.Fatalf("Expected root-a, root-b and config partitions, got %+v", parts)
+	}
+	for i := range parts {
+		if parts[i] != backup[i] {
+			t.Errorf("Expected the backup GPT to match, got %+v and %+v", parts[i], backup[i])
+		}
+	}
+	if parts[0].last-parts[0].first != parts[1].last-parts[1].first {
+		t.Errorf("Expected slots of equal size, got %+v", parts[:2])
+	}
+	if parts[2].last >= sectors-gptSectors {
+		t.Errorf("Expected the config partition to end before the backup GPT, got %+v", parts[2])
+	}
+
+	kernel, initrd, cmdline, err := tarToInitrd(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slot := func(p gptPartition) []byte {
+		return disk[p.first*sectorSize : (p.last+1)*sectorSize]
+	}
+	a, b := slot(parts[0]), slot(parts[1])
+	if !bytes.Equal(a, b) {
+		t.Error("Expected slots A and B to have identical contents")
+	}
+	// each slot has a root filesystem with the kernel, initrd and cmdline
+	label, files := readFAT(t, a)
+	expected := map[string]string{"kernel": string(kernel), "initrd.img": string(initrd), "cmdline": cmdline}
+	if label != abRootfsLabel || !reflect.DeepEqual(files, expected) {
+		t.Errorf("Expected a %s filesystem with the kernel, initrd and cmdline, got %s with %d files", abRootfsLabel, label, len(files))
+	}
+
+	o = &outputOpts{size: 16}
+	err = outFuns["ab-raw"](filepath.Join(dir, "small"), image, o)
+	if err == nil || !strings.Contains(err.Error(), "too small for two 4M root filesystem slots") {
+		t.Errorf("Expected an error for a disk too small for both slots, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "small-ab-raw.img")); !os.IsNotExist(err) {
+		t.Errorf("Expected no output for a disk that is too small, got %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// archiveSums is the name of the checksums file in an archive, in the format
+// of sha256sum so it can be checked with sha256sum -c
+const archiveSums = "SHA256SUMS"
+
+// archiveAdd adds a file to an archive under its base name, returning its
+// checksum line
+func archiveAdd(tw *tar.Writer, filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Base(filename)
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tw, h), f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x  %s\n", h.Sum(nil), name), nil
+}
+
+// writeArchive writes the files of each output, and any extra files such as a
+// manifest, to a compressed tarball with their checksums
+func writeArchive(filename string, out outputList, o *outputOpts, extra ...string) error {
+	log.Debugf("archive: %s", filename)
+	files := []string{}
+	for _, output := range out {
+		files = append(files, o.files[output]...)
+	}
+	files = append(files, extra...)
+
+	seen := map[string]bool{}
+	for _, file := range files {
+		name := filepath.Base(file)
+		if seen[name] || name == archiveSums {
+			return fmt.Errorf("More than one file named %s to archive", name)
+		}
+		seen[name] = true
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	zw, err := gzip.NewWriterLevel(f, o.compressLevel)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	tw := tar.NewWriter(zw)
+	sums := ""
+	for _, file := range files {
+		sum, err := archiveAdd(tw, file)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		sums += sum
+	}
+	err = tw.WriteHeader(&tar.Header{Name: archiveSums, Mode: 0644, Size: int64(len(sums))})
+	if err == nil {
+		_, err = io.WriteString(tw, sums)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	log.Infof("  %s", filename)
+	return nil
+}
+
+// removeOutputs removes the files written by the outputs once they are archived
+func removeOutputs(out outputList, o *outputOpts) error {
+	for _, output := range out {
+		for _, file := range o.files[output] {
+			if err := os.Remove(file); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
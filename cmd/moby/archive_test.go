@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := filepath.Join(dir, "test.yml")
+	if err := ioutil.WriteFile(conf, []byte("files:\n  - path: etc/motd\n    contents: hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, archiveOnly := range []bool{false, true} {
+		out := filepath.Join(dir, fmt.Sprintf("out-%v", archiveOnly))
+		if err := os.Mkdir(out, 0755); err != nil {
+			t.Fatal(err)
+		}
+		c := &buildCommand{
+			name:           "test",
+			out:            outputList{"tar", "kernel+initrd", "manifest"},
+			packerManifest: filepath.Join(out, "packer.json"),
+			archive:        filepath.Join(dir, fmt.Sprintf("test-%v.tar.gz", archiveOnly)),
+			archiveOnly:    archiveOnly,
+			compressLevel:  defaultCompressLevel,
+		}
+		if err := c.run(conf, out); err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := os.Open(c.archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(zr)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, contents := readTar(t, bytes.NewBuffer(b))
+
+		names := []string{}
+		for name := range contents {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		expected := []string{archiveSums, "packer.json", "test-cmdline", "test-initrd.img", "test-kernel", "test-manifest.json", "test.tar"}
+		if strings.Join(names, " ") != strings.Join(expected, " ") {
+			t.Errorf("Expected the archive to contain %v, got %v", expected, names)
+		}
+		for _, name := range expected[1:] {
+			line := fmt.Sprintf("%x  %s\n", sha256.Sum256([]byte(contents[name])), name)
+			if !strings.Contains(contents[archiveSums], line) {
+				t.Errorf("Expected a checksum for %s in %s, got:\n%s", name, archiveSums, contents[archiveSums])
+			}
+		}
+
+		files, err := ioutil.ReadDir(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		remaining := []string{}
+		for _, fi := range files {
+			remaining = append(remaining, fi.Name())
+		}
+		if archiveOnly && strings.Join(remaining, " ") != "packer.json" {
+			t.Errorf("Expected only the Packer manifest to remain with archive only, got %v", remaining)
+		}
+		if !archiveOnly && len(remaining) != len(expected)-1 {
+			t.Errorf("Expected the outputs to remain, got %v", remaining)
+		}
+	}
+}
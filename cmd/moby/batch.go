@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// batchResult is the outcome of building one config in batch mode
+type batchResult struct {
+	config string
+	err    error
+}
+
+// errBatchSkipped is the result of a config not built after an earlier failure
+var errBatchSkipped = errors.New("skipped after an earlier failure")
+
+// batchConfigs lists the configs in a directory
+func batchConfigs(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	configs := []string{}
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if e.IsDir() || !(ext == ".yml" || ext == ".yaml") {
+			continue
+		}
+		configs = append(configs, filepath.Join(dir, e.Name()))
+	}
+	sort.Strings(configs)
+	return configs, nil
+}
+
+// buildBatchDir builds every config in configDir, up to jobs at a time, each
+// with its outputs in a subdirectory of outDir named after the config. Unless
+// keep going is set, configs not yet started when one fails are skipped.
+func buildBatchDir(c *buildCommand, configDir, outDir string, jobs int) ([]batchResult, error) {
+	configs, err := batchConfigs(configDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no configs found in %s", configDir)
+	}
+	if c.name != "" {
+		return nil, fmt.Errorf("cannot set a name for a batch build")
+	}
+
+	results := make([]batchResult, len(configs))
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := false
+	for i, conf := range configs {
+		// take a slot before starting so configs are started in order
+		sem <- struct{}{}
+		mu.Lock()
+		skip := failed && !c.keepGoing
+		mu.Unlock()
+		if skip {
+			<-sem
+			results[i] = batchResult{config: conf, err: errBatchSkipped}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, conf string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := c.runBatch(conf, outDir)
+			if err != nil {
+				mu.Lock()
+				failed = true
+				mu.Unlock()
+			}
+			results[i] = batchResult{config: conf, err: err}
+		}(i, conf)
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// runBatch builds one config of a batch into its own output directory
+func (c *buildCommand) runBatch(conf, outDir string) error {
+	log.Infof("Build %s", conf)
+	name := strings.TrimSuffix(filepath.Base(conf), filepath.Ext(conf))
+	dir := filepath.Join(outDir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// each config gets its own SBOM, manifest, archive, provenance and summary in its output directory
+	bc := *c
+	if bc.sbom != "" {
+		bc.sbom = filepath.Join(dir, filepath.Base(bc.sbom))
+	}
+	if bc.packerManifest != "" {
+		bc.packerManifest = filepath.Join(dir, filepath.Base(bc.packerManifest))
+	}
+	if bc.archive != "" {
+		bc.archive = filepath.Join(dir, filepath.Base(bc.archive))
+	}
+	if bc.provenance != "" {
+		bc.provenance = filepath.Join(dir, filepath.Base(bc.provenance))
+	}
+	if bc.summaryFile != "" {
+		bc.summaryFile = filepath.Join(dir, filepath.Base(bc.summaryFile))
+	}
+	// the containers of configs built at once can have the same paths
+	if bc.opts.dumpOCI != "" {
+		bc.opts.dumpOCI = filepath.Join(bc.opts.dumpOCI, name)
+	}
+	return bc.run(conf, dir)
+}
+
+// batchSummary logs the outcome of each config, returning false if any failed
+func batchSummary(results []batchResult) bool {
+	failed := 0
+	log.Infof("Batch summary:")
+	for _, r := range results {
+		if r.err == errBatchSkipped {
+			failed++
+			log.Warnf("  SKIP %s", r.config)
+		} else if r.err != nil {
+			failed++
+			log.Errorf("  FAIL %s: %v", r.config, r.err)
+		} else {
+			log.Infof("  OK   %s", r.config)
+		}
+	}
+	log.Infof("%d of %d configs built successfully", len(results)-failed, len(results))
+	return failed == 0
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+func TestBuildBatchDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configDir := filepath.Join(dir, "configs")
+	outDir := filepath.Join(dir, "out")
+	if err := os.Mkdir(configDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	configs := map[string]string{
+		"good.yml":   "files:\n  - path: etc/motd\n    contents: hello\noutputs:\n  - tar\n",
+		"broken.yml": "files:\n  - path: etc/motd\n    contents: hello\nnotakey: true\n",
+		"README.md":  "not a config",
+	}
+	for name, contents := range configs {
+		if err := ioutil.WriteFile(filepath.Join(configDir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// without keep going the good config is skipped after the broken one fails
+	results, err := buildBatchDir(&buildCommand{}, configDir, outDir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if filepath.Base(r.config) == "good.yml" && r.err != errBatchSkipped {
+			t.Errorf("Expected good config to be skipped without keep going, got %v", r.err)
+		}
+	}
+
+	results, err = buildBatchDir(&buildCommand{keepGoing: true}, configDir, outDir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(results))
+	}
+	for _, r := range results {
+		switch filepath.Base(r.config) {
+		case "good.yml":
+			if r.err != nil {
+				t.Errorf("Expected good config to build, got %v", r.err)
+			}
+		case "broken.yml":
+			if r.err == nil {
+				t.Error("Expected broken config to fail")
+			}
+		default:
+			t.Errorf("Unexpected config built: %s", r.config)
+		}
+	}
+	if batchSummary(results) {
+		t.Error("Expected batch summary to report a failure")
+	}
+
+	if _, err := os.Stat(filepath.Join(outDir, "good", "good.tar")); err != nil {
+		t.Errorf("Expected output in per config directory: %v", err)
+	}
+}
+
+func TestBatchDumpOCI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(source imageSource) { Images = source }(Images)
+	Images = &fakeImages{
+		exports: map[string][]byte{"linuxkit/getty:v1": makeTar(t, []tarEntry{{name: "bin", typeflag: tar.TypeDir}}).Bytes()},
+		inspects: map[string]types.ImageInspect{
+			"linuxkit/getty:v1": {Os: "linux", Config: &container.Config{Cmd: []string{"/bin/getty"}}},
+		},
+	}
+
+	configDir := filepath.Join(dir, "configs")
+	if err := os.Mkdir(configDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"a", "b"}
+	for _, name := range names {
+		config := "services:\n  - name: getty\n    image: linuxkit/getty:v1\n    env:\n      - TERM=" + name + "\noutputs:\n  - tar\n"
+		if err := ioutil.WriteFile(filepath.Join(configDir, name+".yml"), []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dump := filepath.Join(dir, "oci")
+	c := &buildCommand{opts: buildOpts{dumpOCI: dump}}
+	results, err := buildBatchDir(c, configDir, filepath.Join(dir, "out"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !batchSummary(results) {
+		t.Fatalf("Expected the batch to build, got %v", results)
+	}
+
+	// each config dumps its containers under its own name
+	for _, name := range names {
+		b, err := ioutil.ReadFile(filepath.Join(dump, name, "containers/services/getty/config.json"))
+		if err != nil {
+			t.Fatalf("Expected the config.json of %s to be dumped: %v", name, err)
+		}
+		if !strings.Contains(string(b), `"TERM=`+name+`"`) {
+			t.Errorf("Expected the dumped config.json of %s to have its env, got %s", name, b)
+		}
+	}
+}
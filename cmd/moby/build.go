@@ -3,22 +3,30 @@ package main
 import (
 	"archive/tar"
 	"bytes"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/agl/ed25519"
+	"github.com/opencontainers/runtime-spec/specs-go"
 )
 
 const defaultNameForStdin = "moby"
 
+// defaultNameEnv overrides defaultNameForStdin
+const defaultNameEnv = "MOBY_DEFAULT_NAME"
+
 type outputList []string
 
 func (o *outputList) String() string {
@@ -33,9 +41,58 @@ func (o *outputList) Set(value string) error {
 	return nil
 }
 
+// buildCommand holds the options of the build command that apply to each config built
+type buildCommand struct {
+	name            string
+	outputPrefix    string
+	out             outputList
+	noDefaultOutput bool
+	only            outputList
+	size            int
+	maxOutputSize   int
+	bootInitrdLimit int
+	hyperkit        bool
+	disableTrust    bool
+	printConfigHash bool
+	sbom            string
+	provenance      string
+	summaryFile     string
+	secretsDir      string
+	force           bool
+	packerManifest  string
+	archive         string
+	archiveOnly     bool
+	keepGoing       bool
+	ociVersion      string
+	compressLevel   int
+	outputMode      os.FileMode
+	efiStub         string
+	manifestFormat  string
+	profiles        []string
+	embedConfig     bool
+	osRelease       bool
+	env             map[string]string
+	verifyFiles     string
+	capture         string
+	policy          string
+	remoteCache     remoteStore
+	smokeTest       *smokeTest
+	fatSplit        bool
+	deltaAgainst    string
+	// embedBuildLog adds the log of each build to its image, captured at
+	// buildLogLevel
+	embedBuildLog bool
+	buildLogLevel log.Level
+	opts          buildOpts
+}
+
 // Process the build arguments and execute build
 func build(args []string) {
 	var buildOut outputList
+	var buildOnly outputList
+	var buildProfiles outputList
+	var buildRegistryCAs outputList
+	var buildInsecureRegistries outputList
 
 	outputTypes := []string{}
 	for k := range outFuns {
@@ -45,35 +102,99 @@ func build(args []string) {
 
 	buildCmd := flag.NewFlagSet("build", flag.ExitOnError)
 	buildCmd.Usage = func() {
-		fmt.Printf("USAGE: %s build [options] <file>[.yml] | -\n\n", os.Args[0])
+		fmt.Printf("USAGE: %s build [options] <file>[.yml] | git://<repo>//<file>[.yml][@ref] | -\n", os.Args[0])
+		fmt.Printf("       %s build [options] --batch <directory>\n\n", os.Args[0])
 		fmt.Printf("Options:\n")
 		buildCmd.PrintDefaults()
 	}
-	buildName := buildCmd.String("name", "", "Name to use for output files")
-	buildDir := buildCmd.String("dir", "", "Directory for output files, default current directory")
+	buildName := buildCmd.String("name", "", "Name to use for output files, overriding the name in the config, which overrides the config file name, or for stdin $"+defaultNameEnv+" then "+defaultNameForStdin)
+	buildOutputPrefix := buildCmd.String("output-prefix", "", "Prefix for the names of output files, added before the name")
+	buildDir := buildCmd.String("dir", "", "Directory for output files, overriding outputDir in the config, default current directory")
 	buildSize := buildCmd.String("size", "1024M", "Size for output image, if supported and fixed size")
 	buildPull := buildCmd.Bool("pull", false, "Always pull images")
 	buildDisableTrust := buildCmd.Bool("disable-content-trust", false, "Skip image trust verification specified in trust section of config (default false)")
+	buildReproducible := buildCmd.Bool("reproducible", false, "Reset timestamps in the image so identical inputs produce identical images")
+	buildPullRetries := buildCmd.Int("pull-retries", 0, "Retry a failed pull this many times, the layers the Docker daemon fetched in full are not downloaded again")
+	buildWaitOnRateLimit := buildCmd.Bool("wait-on-ratelimit", false, "Wait for the rate limit of a registry to pass and retry, for up to "+rateLimitMaxWait.String()+", rather than failing")
+	buildPullConcurrency := buildCmd.Int("pull-concurrency", 0, "Most pulls from one registry at once, across a batch, unless set by -registry-concurrency, 0 for no limit")
+	var buildRegistryConcurrency outputList
+	buildCmd.Var(&buildRegistryConcurrency, "registry-concurrency", "Most pulls at once from a registry, across a batch, as host=N")
+	buildNormalizeTar := buildCmd.String("normalize-tar", "", "Normalize the image tarball, dirs drops directory headers that repeat an earlier one with the same permissions and owner, all also drops empty entries without a path [ "+strings.Join(normalizeModes, " ")+" ]")
+	buildApplyWhiteouts := buildCmd.Bool("apply-whiteouts", false, "Apply overlay whiteouts in images, removing the deleted paths of earlier images rather than adding the markers")
+	buildSignKey := buildCmd.String("sign-key", "", "Sign the image with this ed25519 private key file, raw or base64 encoded, the signature covers the initrd and not the kernel or cmdline")
+	buildSignPath := buildCmd.String("sign-path", defaultSignPath, "Path in the image for the signature, the public key is added alongside with a .pub extension")
+	buildStrict := buildCmd.Bool("strict", false, "Fail the build on problems that are otherwise warnings, such as an image with an empty root filesystem or a file replacing a path in an image")
+	buildStrictExtract := buildCmd.Bool("strict-extract", false, "Fail the build on anomalies in an image, such as a missing image config or entries outside its root filesystem, implied by -strict")
+	buildTrustSoftFail := buildCmd.Bool("trust-soft-fail", false, "Pull without verification if content trust data is unavailable, verification failures are still errors")
+	var buildTrustRootKeys outputList
+	buildCmd.Var(&buildTrustRootKeys, "trust-root-key", "Pin the content trust root key ID of an image repository, as image=keyid, a new root signed by it replaces the cached root")
 	buildHyperkit := buildCmd.Bool("hyperkit", false, "Use hyperkit for LinuxKit based builds where possible")
+	buildPrintConfigHash := buildCmd.Bool("print-config-hash", false, "Print a hash of the parsed config and exit without building")
+	buildSBOM := buildCmd.String("sbom", "", "Write a CycloneDX software bill of materials for the image to this file")
+	buildForce := buildCmd.Bool("force", false, "Replace the directory written by the dir output if it is not empty")
+	buildSecretsDir := buildCmd.String("secrets-dir", "", "Directory with the secrets used by files in the config, read at build time")
+	buildProvenance := buildCmd.String("provenance", "", "Write a SLSA provenance attestation of the images used and the files written to this file")
+	buildSummaryFile := buildCmd.String("summary-file", "", "Write a JSON summary of the images, their digests, the outputs and the timings of a successful build to this file")
+	buildPackerManifest := buildCmd.String("packer-manifest", "", "Write a Packer compatible manifest of the outputs to this file")
+	buildArchive := buildCmd.String("archive", "", "Write all the outputs, their checksums and any Packer manifest to this compressed tarball")
+	buildArchiveOnly := buildCmd.Bool("archive-only", false, "Remove the outputs once they are in the -archive tarball")
+	buildCmdlineLimit := buildCmd.Int("cmdline-limit", defaultCmdlineLimit, "COMMAND_LINE_SIZE of the kernel in bytes, warning when the cmdline does not fit or failing with -strict, 0 for no limit")
+	buildMaxImageAge := buildCmd.String("max-image-age", "", "Warn about images created longer ago than this, such as 30d or 2w, failing with -strict, default no limit")
+	buildMaxLayers := buildCmd.Int("max-layers", 0, "Maximum number of kernel, init, onboot and service images, default no limit")
+	buildMaxFiles := buildCmd.Int("max-files", 0, "Maximum number of files in the image, default no limit")
+	buildBootInitrdLimit := buildCmd.String("boot-initrd-limit", "", "Largest initrd the boot method can load, in M or G, warning when outputs that boot the initrd exceed it or failing with -strict, default no limit")
+	buildMaxOutputSize := buildCmd.String("max-output-size", "", "Maximum combined size of all outputs, in M or G, default no limit")
+	buildBatch := buildCmd.Bool("batch", false, "Build every config in a directory, with the outputs for each in a subdirectory of -dir")
+	buildBatchJobs := buildCmd.Int("batch-jobs", 1, "Number of configs to build in parallel in batch mode")
+	buildOCIVersion := buildCmd.String("oci-version", "", "OCI runtime spec version to emit in config.json, overriding the config, default "+specs.Version)
+	buildProgress := buildCmd.String("progress", progressAuto, "Progress output [ "+strings.Join(progressModes, " ")+" ], auto is plain unless writing to a terminal")
+	buildTimings := buildCmd.String("timings", "", "Write how long the pull, extract, assemble and output phases took to stdout at the end, overall and by image and output [ "+strings.Join(timingsModes, " ")+" ]")
+	buildKeepGoing := buildCmd.Bool("keep-going", false, "Continue with the remaining outputs or batch configs after a failure, exiting non-zero at the end")
+	buildOutputMode := buildCmd.String("output-mode", "", "Octal permissions of the output files, such as 0644, default as written")
+	buildCompressLevel := buildCmd.Int("compress-level", defaultCompressLevel, "Gzip compression level of compressed outputs, from 0 for none to 9 for the smallest")
+	buildManifestFormat := buildCmd.String("manifest-format", manifestJSON, "Format of the manifest output [ "+strings.Join(manifestFormats, " ")+" ], csv has the columns "+strings.Join(manifestColumns, ","))
+	buildEFIStub := buildCmd.String("efi-stub", "", "EFI stub for the efi output, such as linuxx64.efi.stub from systemd-boot, which the kernel, initrd and cmdline are added to")
+	buildSchema := buildCmd.String("schema", "", "Check the config matches this JSON schema before building")
+	buildEmbedConfig := buildCmd.Bool("embed-config", false, "Add the resolved config to the image as /"+embedConfigPath)
+	buildEnvFile := buildCmd.String("env-file", "", "File of KEY=VALUE lines for the variables in the cmdline, the environment overrides the file")
+	buildCapture := buildCmd.String("capture", "", "Write the config, images and options of the build to this bundle, for it to be replayed with -replay")
+	buildReplay := buildCmd.String("replay", "", "Rebuild from a bundle written by -capture without Docker, instead of a config file")
+	buildVerifyFiles := buildCmd.String("verify-files", "", "Fail unless the files in this JSON object of paths to sha256 hashes match in the image")
+	buildRemoteCache := buildCmd.String("remote-cache", "", "HTTP URL of a cache shared between machines, outputs of a build already stored there are downloaded instead of built, and new ones stored with PUT")
+	buildOSRelease := buildCmd.Bool("os-release", false, "Add /"+osReleasePath+" named after the build, unless an image provides one")
+	buildForceOSRelease := buildCmd.Bool("force-os-release", false, "Replace /"+osReleasePath+" from an image with the one added by -os-release")
+	buildFATSplit := buildCmd.Bool("fat-split", false, "Write an initrd of the kernel+initrd or initrd output that is too large for FAT32 in numbered parts, other outputs with a FAT boot partition fail if the kernel or initrd is too large")
+	buildDumpOCI := buildCmd.String("dump-oci", "", "Write the generated config.json of each onboot and service container to this directory, at the path of its bundle in the image, below the name of each config with -batch")
+	buildDeltaAgainst := buildCmd.String("delta-against", "", "Tar or tar-gz output of a previous build to write the delta output against, only the entries that changed and a list of those removed")
+	buildSmokeTest := buildCmd.Bool("smoke-test", false, "Boot the kernel+initrd output under qemu after building, failing unless the console shows -smoke-marker before -smoke-timeout")
+	buildSmokeMarker := buildCmd.String("smoke-marker", defaultSmokeMarker, "Text the console must show for the smoke test to pass")
+	buildSmokeTimeout := buildCmd.Duration("smoke-timeout", defaultSmokeTimeout, "How long the smoke test waits for the marker")
+	buildEmbedBuildLog := buildCmd.Bool("embed-build-log", false, "Add the log of the build to the image as /"+buildLogPath+", with the paths and contents of sensitive files redacted")
+	buildEmbedBuildLogLevel := buildCmd.String("embed-build-log-level", "info", "Level of the log added by -embed-build-log, it can be more detailed than the log shown [ debug info warning error ]")
+	buildEmbedLabels := buildCmd.Bool("embed-labels", false, "Add the labels of the images to the image as /"+imageLabelsPath)
+	buildCmd.Var(&buildRegistryCAs, "registry-ca", "CA certificate file to trust for content trust servers, in addition to the system CAs, pulls use the CAs configured in the docker daemon")
+	buildCmd.Var(&buildInsecureRegistries, "insecure-registry", "Registry host[:port] to connect to without verifying TLS certificates or over plain HTTP, for development only")
+	buildCmd.Var(&buildProfiles, "profile", "Profiles to activate, images with profiles are only included if one of them is active")
 	buildCmd.Var(&buildOut, "output", "Output types to create [ "+strings.Join(outputTypes, " ")+" ]")
+	buildCmd.Var(&buildOnly, "only", "Build only these of the outputs selected by -output or the config")
+	buildNoDefaultOutput := buildCmd.Bool("no-default-output", false, "Fail if no outputs are given with -output or in the config, rather than defaulting to kernel+initrd")
 
 	if err := buildCmd.Parse(args); err != nil {
 		log.Fatal("Unable to parse args")
 	}
 	remArgs := buildCmd.Args()
 
-	if len(remArgs) == 0 {
+	if *buildReplay != "" {
+		if len(remArgs) != 0 || *buildBatch {
+			log.Fatalf("-replay builds the config in the bundle, do not give a config file or -batch")
+		}
+	} else if len(remArgs) == 0 {
 		fmt.Println("Please specify a configuration file")
 		buildCmd.Usage()
 		os.Exit(1)
 	}
 
-	if len(buildOut) == 0 {
-		buildOut = outputList{"kernel+initrd"}
-	}
-
-	log.Debugf("Outputs selected: %s", buildOut.String())
-
+	// check the output types before doing any work, the config may supply more
 	err := validateOutputs(buildOut)
 	if err != nil {
 		log.Errorf("Error parsing outputs: %v", err)
@@ -86,48 +207,779 @@ func build(args []string) {
 		log.Fatalf("Unable to parse disk size: %v", err)
 	}
 
-	name := *buildName
-	var config []byte
-	if conf := remArgs[0]; conf == "-" {
-		var err error
-		config, err = ioutil.ReadAll(os.Stdin)
+	maxOutputSize, err := getDiskSizeMB(*buildMaxOutputSize)
+	if err != nil {
+		log.Fatalf("Unable to parse maximum output size: %v", err)
+	}
+
+	bootInitrdLimit, err := getDiskSizeMB(*buildBootInitrdLimit)
+	if err != nil {
+		log.Fatalf("Unable to parse boot initrd limit: %v", err)
+	}
+
+	err = validOCIVersion(*buildOCIVersion)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = validProgressMode(*buildProgress)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	outputMode, err := parseOutputMode(*buildOutputMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = validCompressLevel(*buildCompressLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = validTimingsMode(*buildTimings)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = validNormalizeMode(*buildNormalizeTar)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var maxImageAge time.Duration
+	if *buildMaxImageAge != "" {
+		maxImageAge, err = parseAge(*buildMaxImageAge)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var buildLogLevel log.Level
+	if *buildEmbedBuildLog {
+		buildLogLevel, err = log.ParseLevel(*buildEmbedBuildLogLevel)
+		if err != nil {
+			log.Fatalf("Invalid -embed-build-log-level: %v", err)
+		}
+	}
+
+	err = validManifestFormat(*buildManifestFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	policy := ""
+	if *buildSchema != "" {
+		s, err := ioutil.ReadFile(*buildSchema)
+		if err != nil {
+			log.Fatalf("Cannot read schema: %v", err)
+		}
+		policy = string(s)
+	}
+
+	if *buildMaxLayers < 0 || *buildMaxFiles < 0 {
+		log.Fatalf("Maximum layers and files must not be negative")
+	}
+	if *buildCmdlineLimit < 0 {
+		log.Fatalf("Cmdline limit must not be negative")
+	}
+
+	if strings.Contains(*buildOutputPrefix, "/") {
+		log.Fatalf("Invalid output prefix %s: must not be a path", *buildOutputPrefix)
+	}
+
+	for _, host := range buildInsecureRegistries {
+		if err := validInsecureRegistry(host); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var remoteCache remoteStore
+	if *buildRemoteCache != "" {
+		if *buildReplay != "" || *buildCapture != "" || *buildVerifyFiles != "" {
+			log.Fatalf("-remote-cache cannot be used with -replay, -capture or -verify-files, which need the image to be built")
+		}
+		remoteCache, err = newRemoteStore(*buildRemoteCache)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var smoke *smokeTest
+	if *buildSmokeTest {
+		if *buildArchiveOnly {
+			log.Fatalf("-smoke-test boots the kernel+initrd output, which -archive-only removes")
+		}
+		if *buildSmokeMarker == "" || *buildSmokeTimeout <= 0 {
+			log.Fatalf("The smoke test needs a marker and a timeout greater than zero")
+		}
+		s := newSmokeTest(*buildSmokeMarker, *buildSmokeTimeout)
+		if err := checkSmokeTest(s, buildOut, buildOnly); err != nil {
+			log.Fatal(err)
+		}
+		smoke = &s
+	}
+
+	if *buildForceOSRelease && !*buildOSRelease {
+		log.Fatalf("-force-os-release replaces the file added by -os-release, which is not set")
+	}
+
+	if *buildArchiveOnly && *buildArchive == "" {
+		log.Fatalf("-archive-only needs an -archive to write the outputs to")
+	}
+
+	if *buildPullRetries < 0 {
+		log.Fatalf("Pull retries cannot be negative")
+	}
+	if *buildPullConcurrency < 0 {
+		log.Fatalf("Pull concurrency cannot be negative")
+	}
+	registryConcurrency, err := parseRegistryConcurrency(buildRegistryConcurrency)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var env map[string]string
+	if *buildEnvFile != "" {
+		env, err = readEnvFile(*buildEnvFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var signKey *[ed25519.PrivateKeySize]byte
+	if *buildSignKey != "" {
+		signKey, err = readSignKey(*buildSignKey)
+		if err != nil {
+			log.Fatalf("Unable to read signing key: %v", err)
+		}
+		err = validRelativePath(*buildSignPath)
+		if err != nil {
+			log.Fatalf("Invalid signature path: %v", err)
+		}
+	}
+
+	trustRootKeys, err := parseTrustRootKeys(buildTrustRootKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
+	TrustSoftFail = *buildTrustSoftFail
+	TrustRootKeys = trustRootKeys
+	RegistryCAs = buildRegistryCAs
+	InsecureRegistries = buildInsecureRegistries
+	warnInsecureRegistries()
+	StrictExtract = *buildStrictExtract || *buildStrict
+	PullRetries = *buildPullRetries
+	WaitOnRateLimit = *buildWaitOnRateLimit
+	PullConcurrency = *buildPullConcurrency
+	RegistryConcurrency = registryConcurrency
+	ProgressMode = *buildProgress
+
+	c := &buildCommand{
+		name:            *buildName,
+		outputPrefix:    *buildOutputPrefix,
+		out:             buildOut,
+		noDefaultOutput: *buildNoDefaultOutput,
+		only:            buildOnly,
+		size:            size,
+		maxOutputSize:   maxOutputSize,
+		bootInitrdLimit: bootInitrdLimit,
+		hyperkit:        *buildHyperkit,
+		disableTrust:    *buildDisableTrust,
+		printConfigHash: *buildPrintConfigHash,
+		sbom:            *buildSBOM,
+		provenance:      *buildProvenance,
+		summaryFile:     *buildSummaryFile,
+		secretsDir:      *buildSecretsDir,
+		force:           *buildForce,
+		packerManifest:  *buildPackerManifest,
+		archive:         *buildArchive,
+		archiveOnly:     *buildArchiveOnly,
+		keepGoing:       *buildKeepGoing,
+		ociVersion:      *buildOCIVersion,
+		compressLevel:   *buildCompressLevel,
+		outputMode:      outputMode,
+		efiStub:         *buildEFIStub,
+		manifestFormat:  *buildManifestFormat,
+		profiles:        buildProfiles,
+		embedConfig:     *buildEmbedConfig,
+		osRelease:       *buildOSRelease,
+		env:             env,
+		verifyFiles:     *buildVerifyFiles,
+		capture:         *buildCapture,
+		policy:          policy,
+		remoteCache:     remoteCache,
+		smokeTest:       smoke,
+		fatSplit:        *buildFATSplit,
+		deltaAgainst:    *buildDeltaAgainst,
+		embedBuildLog:   *buildEmbedBuildLog,
+		buildLogLevel:   buildLogLevel,
+		opts: buildOpts{
+			pull:           *buildPull,
+			reproducible:   *buildReproducible,
+			applyWhiteouts: *buildApplyWhiteouts,
+			normalizeTar:   *buildNormalizeTar,
+			strict:         *buildStrict,
+			signKey:        signKey,
+			signPath:       *buildSignPath,
+			maxLayers:      *buildMaxLayers,
+			maxImageAge:    maxImageAge,
+			maxFiles:       *buildMaxFiles,
+			embedLabels:    *buildEmbedLabels,
+			forceOSRelease: *buildForceOSRelease,
+			cmdlineLimit:   *buildCmdlineLimit,
+			dumpOCI:        *buildDumpOCI,
+		},
+	}
+
+	if *buildBatch {
+		if *buildCapture != "" {
+			log.Fatalf("-capture records a single build and cannot be used with -batch")
+		}
+		if *buildBatchJobs < 1 {
+			log.Fatalf("Batch jobs must be at least 1")
+		}
+		if *buildEmbedBuildLog && *buildBatchJobs > 1 {
+			log.Fatalf("-embed-build-log captures the log of one build at a time and cannot be used with -batch-jobs above 1")
+		}
+		results, err := buildBatchDir(c, remArgs[0], *buildDir, *buildBatchJobs)
 		if err != nil {
-			log.Fatalf("Cannot read stdin: %v", err)
+			log.Fatalf("Batch build failed: %v", err)
 		}
-		if name == "" {
-			name = defaultNameForStdin
+		ok := batchSummary(results)
+		writeTimings(*buildTimings)
+		if !ok {
+			os.Exit(1)
 		}
+		return
+	}
+
+	if *buildReplay != "" {
+		err = c.replay(*buildReplay, *buildDir)
 	} else {
-		if !(filepath.Ext(conf) == ".yml" || filepath.Ext(conf) == ".yaml") {
-			conf = conf + ".yml"
+		err = c.run(remArgs[0], *buildDir)
+	}
+	// the timings are written for failed builds too, to show where the time went
+	writeTimings(*buildTimings)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// writeTimings writes the phase timings of the builds to stdout, if mode is set
+func writeTimings(mode string) {
+	if mode == "" {
+		return
+	}
+	err := Timings.write(os.Stdout, mode)
+	if err != nil {
+		log.Errorf("Cannot write timings: %v", err)
+	}
+}
+
+// configSource is a config read by readConfig
+type configSource struct {
+	config []byte
+	// name is the default name for the outputs
+	name string
+	// path is the config file, that includes are relative to, empty for stdin
+	path string
+	// uri is where the config was read from as it was given, empty for stdin
+	uri string
+	// root is a checked out repository that relative paths in the config are
+	// resolved against, which the caller must remove if it is set
+	root string
+	// includes are the configs included by the config, once resolved
+	includes []string
+}
+
+// readConfig reads a config from a file, a git reference or stdin if conf is "-"
+func readConfig(conf string) (configSource, error) {
+	if conf == "-" {
+		name := defaultNameForStdin
+		if env := os.Getenv(defaultNameEnv); env != "" {
+			if strings.Contains(env, "/") || env == "." || env == ".." {
+				return configSource{}, fmt.Errorf("Invalid %s %s: must not be a path", defaultNameEnv, env)
+			}
+			name = env
 		}
-		var err error
-		config, err = ioutil.ReadFile(conf)
+		config, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return configSource{}, fmt.Errorf("Cannot read stdin: %v", err)
+		}
+		return configSource{config: config, name: name}, nil
+	}
+	if isGitConfig(conf) {
+		g, err := parseGitConfig(conf)
 		if err != nil {
-			log.Fatalf("Cannot open config file: %v", err)
+			return configSource{}, fmt.Errorf("Invalid git config reference: %v", err)
 		}
-		if name == "" {
-			name = strings.TrimSuffix(filepath.Base(conf), filepath.Ext(conf))
+		if !(filepath.Ext(g.path) == ".yml" || filepath.Ext(g.path) == ".yaml") {
+			g.path = g.path + ".yml"
 		}
+		config, root, err := gitFetchConfig(g)
+		if err != nil {
+			return configSource{}, fmt.Errorf("Cannot fetch config from git: %v", err)
+		}
+		return configSource{
+			config: config,
+			name:   strings.TrimSuffix(filepath.Base(g.path), filepath.Ext(g.path)),
+			path:   filepath.Join(root, g.path),
+			uri:    conf,
+			root:   root,
+		}, nil
 	}
+	if !(filepath.Ext(conf) == ".yml" || filepath.Ext(conf) == ".yaml") {
+		conf = conf + ".yml"
+	}
+	config, err := ioutil.ReadFile(conf)
+	if err != nil {
+		return configSource{}, fmt.Errorf("Cannot open config file: %v", err)
+	}
+	return configSource{
+		config: config,
+		name:   strings.TrimSuffix(filepath.Base(conf), filepath.Ext(conf)),
+		path:   conf,
+		uri:    conf,
+	}, nil
+}
 
-	m, err := NewConfig(config)
+// run builds a single config, writing the outputs to dir
+func (c *buildCommand) run(conf, dir string) error {
+	src, err := readConfig(conf)
+	if err != nil {
+		return err
+	}
+	if src.root != "" {
+		defer os.RemoveAll(src.root)
+	}
+	name := src.name
+	m, err := NewConfig(src.config)
+	if err != nil {
+		return fmt.Errorf("Invalid config: %v", err)
+	}
+	src.includes, err = resolveIncludes(&m, src.path)
 	if err != nil {
-		log.Fatalf("Invalid config: %v", err)
+		return fmt.Errorf("Invalid config: %v", err)
 	}
+	// onboot containers of every profile are ordered so after is checked in full
+	err = orderOnboot(&m)
+	if err != nil {
+		return fmt.Errorf("Invalid config: %v", err)
+	}
+	selectProfiles(&m, c.profiles)
+	if c.policy != "" {
+		err = ValidateSchema(m, c.policy)
+		if err != nil {
+			return err
+		}
+	}
+	// the command line overrides the name and dir in the config
+	if c.name != "" {
+		name = c.name
+	} else if m.Name != "" {
+		name = m.Name
+	}
+	if dir == "" && m.OutputDir != "" {
+		dir = m.OutputDir
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return fmt.Errorf("Cannot create output directory: %v", err)
+		}
+	}
+	// hash and embed the config before sources are resolved to a temporary checkout
+	if c.printConfigHash {
+		hash, err := ConfigHash(m)
+		if err != nil {
+			return fmt.Errorf("Cannot hash config: %v", err)
+		}
+		fmt.Println(hash)
+		return nil
+	}
+	var embedded []byte
+	if c.embedConfig {
+		embedded, err = CanonicalConfig(m)
+		if err != nil {
+			return fmt.Errorf("Cannot embed config: %v", err)
+		}
+	}
+	if src.root != "" {
+		if err := resolveFiles(&m, src.root); err != nil {
+			return err
+		}
+	}
+	if embedded != nil {
+		m.Files = append(m.Files, File{Path: embedConfigPath, Contents: string(embedded)})
+	}
+
+	out, err := selectOutputs(c.out, m, c.noDefaultOutput)
+	if err != nil {
+		return err
+	}
+	out = withDelta(out, c.deltaAgainst)
+	out, err = onlyOutputs(out, c.only)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Outputs selected: %s", out.String())
 
-	if *buildDisableTrust {
+	err = validateOutputs(out)
+	if err != nil {
+		return fmt.Errorf("Error parsing outputs: %v", err)
+	}
+	err = checkPassthrough(m.Kernel, out)
+	if err != nil {
+		return err
+	}
+	selectFiles(&m, out)
+	// only the secrets of the files selected are needed
+	err = resolveSecrets(&m, c.secretsDir)
+	if err != nil {
+		return err
+	}
+
+	if c.ociVersion != "" {
+		m.OCIVersion = c.ociVersion
+	}
+
+	if c.disableTrust {
 		log.Debugf("Disabling content trust checks for this build")
 		m.Trust = TrustConfig{}
 	}
 
-	image := buildInternal(m, *buildPull)
+	m.Kernel.Cmdline, err = expandCmdline(m.Kernel.Cmdline, envLookup(c.env), buildTokens(name, src))
+	if err != nil {
+		return fmt.Errorf("Invalid config: %v", err)
+	}
+
+	return c.buildConfig(name, dir, src, m, out)
+}
+
+// buildConfig builds a config read from src, prepared by run or replayed
+// from a bundle, writing the outputs to dir
+func (c *buildCommand) buildConfig(name, dir string, src configSource, m Moby, out outputList) error {
+	start := time.Now()
+	base := filepath.Join(dir, c.outputPrefix+name)
+	o := &outputOpts{
+		size:           c.size,
+		hyperkit:       c.hyperkit,
+		maxSize:        int64(c.maxOutputSize) * 1024 * 1024,
+		keepGoing:      c.keepGoing,
+		sensitive:      sensitivePaths(m),
+		compressLevel:  c.compressLevel,
+		efiStub:        c.efiStub,
+		manifestFormat: c.manifestFormat,
+		mode:           c.outputMode,
+		force:          c.force,
+		fatSplit:       c.fatSplit,
+		deltaAgainst:   c.deltaAgainst,
+		seed:           newConfigSeed(m),
+	}
+	if m.Kernel.NoCmdlineFile {
+		o.cmdline = kernelCmdline(m.Kernel)
+	}
+
+	opts := c.opts
+	opts.timings = Timings.child()
+	o.timings = opts.timings
+	// the digest printed by stdout-sha is only of use if it is repeatable
+	if hasOutput(out, "stdout-sha") {
+		opts.reproducible = true
+	}
+	if c.embedBuildLog {
+		opts.buildLog = captureBuildLog(c.buildLogLevel)
+		defer opts.buildLog.stop()
+	}
+	fifo, err := fifoOutput(base, out)
+	if err != nil {
+		return err
+	}
+	if fifo != "" && c.archive != "" {
+		return fmt.Errorf("The %s output is streamed to a named pipe, so cannot be added to the -archive", fifo)
+	}
+	key := ""
+	if c.remoteCache != nil && !cachedOutputs(out) {
+		log.Infof("Not using the remote cache, the outputs %s include a directory or a digest on stdout", out.String())
+	} else if c.remoteCache != nil && (opts.dumpOCI != "" || opts.buildLog != nil) {
+		log.Infof("Not using the remote cache, -dump-oci and -embed-build-log need the image to be built")
+	} else if c.remoteCache != nil && fifo != "" {
+		log.Infof("Not using the remote cache, the %s output is streamed to a named pipe", fifo)
+	} else if c.remoteCache != nil && usesSecrets(m) {
+		// the key only has the names of secrets, and the outputs contain them
+		log.Infof("Not using the remote cache, the files include secrets")
+	} else if c.remoteCache != nil {
+		// the images are pulled first for their digests to be part of the key
+		for _, ci := range configImages(m) {
+			trust := contentTrust(ci.image, &m.Trust)
+			if _, err := Images.inspect(ci.image); err == nil && !opts.pull && !trust.verify {
+				continue
+			}
+			d, err := Images.pull(ci.image, trust)
+			opts.timings.add(phasePull, ci.image, d)
+			if err != nil {
+				return err
+			}
+		}
+		opts.pull = false
+		if err := checkImageDigests(m, Images.inspect); err != nil {
+			return err
+		}
+		// the outputs fetched are checked as if they were built
+		if err := checkImages(m, opts); err != nil {
+			return err
+		}
+		opts.checked = true
+		key, err = c.remoteCacheKey(name, m, out, imageRepoDigest)
+		if err != nil {
+			return fmt.Errorf("Cannot compute remote cache key: %v", err)
+		}
+		log.Infof("Remote cache key: %s", key)
+		found, err := fetchOutputs(c.remoteCache, key, base, o)
+		if err != nil {
+			log.Warnf("Cannot fetch outputs from the remote cache, building them: %v", err)
+		}
+		if found && err == nil {
+			return c.finishOutputs(name, src, m, out, o, start, nil)
+		}
+		// the outputs fetched before a failure are written again
+		o.files, o.written = nil, 0
+	}
+
+	image, modules, err := c.buildImage(name, m, out, opts)
+	if err != nil {
+		return err
+	}
+
+	o.modules = modules
+	o.kernelVersion = kernelVersion(modules)
+	if o.kernelVersion != "" {
+		log.Infof("Kernel version: %s", o.kernelVersion)
+	}
 
 	log.Infof("Create outputs:")
-	err = outputs(filepath.Join(*buildDir, name), image, buildOut, size, *buildHyperkit)
+	outErr := outputs(base, image, out, o)
+	if outErr != nil && !c.keepGoing {
+		return fmt.Errorf("Error writing outputs: %v", outErr)
+	}
+	if key != "" && outErr == nil {
+		log.Infof("Store outputs in the remote cache")
+		err = storeOutputs(c.remoteCache, key, base, out, o)
+		if err != nil {
+			log.Warnf("Cannot store outputs in the remote cache: %v", err)
+		}
+	}
+	return c.finishOutputs(name, src, m, out, o, start, outErr)
+}
+
+// buildImage builds the image of a config, checking it before the outputs
+// are created from it
+func (c *buildCommand) buildImage(name string, m Moby, out outputList, opts buildOpts) ([]byte, []byte, error) {
+	var hashes map[string]string
+	if c.verifyFiles != "" {
+		var err error
+		hashes, err = readFileHashes(c.verifyFiles)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var capture *captureImages
+	if c.capture != "" {
+		b, err := newBundle(name, m, out, c)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Cannot capture build: %v", err)
+		}
+		capture = &captureImages{source: Images, bundle: b}
+		Images = capture
+		defer func() { Images = capture.source }()
+	}
+
+	if c.osRelease {
+		var err error
+		opts.osRelease, err = generateOSRelease(name, m)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Cannot create os-release: %v", err)
+		}
+	}
+
+	image, modules, err := buildInternal(m, opts)
 	if err != nil {
-		log.Fatalf("Error writing outputs: %v", err)
+		return nil, nil, err
+	}
+
+	if capture != nil {
+		log.Infof("Write bundle: %s", c.capture)
+		err = writeBundle(c.capture, capture.bundle)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error writing bundle: %v", err)
+		}
+	}
+
+	if hashes != nil {
+		log.Infof("Verify files: %s", c.verifyFiles)
+		diff, err := checkFileHashes(image, hashes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Cannot verify files: %v", err)
+		}
+		if len(diff) != 0 {
+			return nil, nil, fmt.Errorf("Files in the image do not match %s:\n  %s", c.verifyFiles, strings.Join(diff, "\n  "))
+		}
+	}
+
+	if c.bootInitrdLimit > 0 && bootsInitrd(out) {
+		_, initrd, _, err := tarToInitrd(image)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error converting to initrd: %v", err)
+		}
+		err = checkInitrdLimit(int64(len(initrd)), int64(c.bootInitrdLimit)*1024*1024, c.opts.strict)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return image, modules, nil
+}
+
+// finishOutputs writes the files that describe the outputs of a build, once
+// they are written, returning outErr if some outputs failed, then runs the
+// smoke test if there is one
+func (c *buildCommand) finishOutputs(name string, src configSource, m Moby, out outputList, o *outputOpts, start time.Time, outErr error) error {
+	var err error
+	if c.sbom != "" {
+		log.Infof("Write SBOM: %s", c.sbom)
+		// the images have all been pulled by the build so are available locally
+		labels, err := imageLabels(m, Images.inspect)
+		if err != nil {
+			return fmt.Errorf("Error creating SBOM: %v", err)
+		}
+		bom, err := sbom(name, m, imageRepoDigest, labels)
+		if err != nil {
+			return fmt.Errorf("Error creating SBOM: %v", err)
+		}
+		err = ioutil.WriteFile(c.sbom, bom, 0644)
+		if err != nil {
+			return fmt.Errorf("Error writing SBOM: %v", err)
+		}
+	}
+
+	// with keep going the manifest covers the outputs that were written
+	if c.packerManifest != "" {
+		err = writePackerManifest(c.packerManifest, out, o)
+		if err != nil {
+			return fmt.Errorf("Error writing Packer manifest: %v", err)
+		}
+	}
+	if c.archive != "" {
+		extra := []string{}
+		if c.packerManifest != "" {
+			extra = append(extra, c.packerManifest)
+		}
+		err = writeArchive(c.archive, out, o, extra...)
+		if err != nil {
+			return fmt.Errorf("Error writing archive: %v", err)
+		}
+		if c.archiveOnly {
+			err = removeOutputs(out, o)
+			if err != nil {
+				return fmt.Errorf("Error removing archived outputs: %v", err)
+			}
+		}
+	}
+	if c.provenance != "" {
+		// the archive replaces the outputs it removes
+		files := []string{}
+		if !c.archiveOnly {
+			for _, output := range out {
+				files = append(files, o.files[output]...)
+			}
+		}
+		if c.archive != "" {
+			files = append(files, c.archive)
+		}
+		log.Infof("Write provenance: %s", c.provenance)
+		p, err := provenance(name, src, m, files, imageRepoDigest, start, c.opts.reproducible)
+		if err != nil {
+			return fmt.Errorf("Error creating provenance: %v", err)
+		}
+		err = ioutil.WriteFile(c.provenance, p, 0644)
+		if err != nil {
+			return fmt.Errorf("Error writing provenance: %v", err)
+		}
+	}
+	// the summary is only of builds that succeeded
+	if c.summaryFile != "" && outErr == nil {
+		log.Infof("Write summary: %s", c.summaryFile)
+		s, err := summary(name, m, out, o, c.archive, c.archiveOnly, imageRepoDigest, start)
+		if err != nil {
+			return fmt.Errorf("Error creating summary: %v", err)
+		}
+		err = ioutil.WriteFile(c.summaryFile, s, 0644)
+		if err != nil {
+			return fmt.Errorf("Error writing summary: %v", err)
+		}
+		err = o.setMode(c.summaryFile)
+		if err != nil {
+			return fmt.Errorf("Error setting output mode: %v", err)
+		}
+	}
+	// the SBOM, Packer manifest, archive and provenance are written with the outputs
+	for _, file := range []string{c.sbom, c.packerManifest, c.archive, c.provenance} {
+		if file == "" {
+			continue
+		}
+		err = o.setMode(file)
+		if err != nil {
+			return fmt.Errorf("Error setting output mode: %v", err)
+		}
 	}
+	if outErr != nil {
+		return fmt.Errorf("Error writing outputs: %v", outErr)
+	}
+	if c.smokeTest != nil {
+		return c.smokeTest.run(o)
+	}
+	return nil
+}
+
+// selectOutputs returns the outputs to build, the command line overrides
+// the outputs in the config, which override the default of kernel+initrd
+// unless noDefault requires the outputs to be given
+func selectOutputs(cli outputList, m Moby, noDefault bool) (outputList, error) {
+	if len(cli) != 0 {
+		return cli, nil
+	}
+	if len(m.Outputs) != 0 {
+		return outputList(m.Outputs), nil
+	}
+	if noDefault {
+		return nil, errors.New("No outputs selected, use -output or outputs in the config")
+	}
+	return outputList{"kernel+initrd"}, nil
+}
+
+// onlyOutputs restricts the selected outputs to those in only, if it is set,
+// each of which must be one of the selected outputs
+func onlyOutputs(out, only outputList) (outputList, error) {
+	if len(only) == 0 {
+		return out, nil
+	}
+	selected := map[string]bool{}
+	for _, o := range out {
+		selected[o] = true
+	}
+	wanted := map[string]bool{}
+	for _, o := range only {
+		if !selected[o] {
+			return nil, fmt.Errorf("Output %s is not one of the selected outputs %s", o, out.String())
+		}
+		wanted[o] = true
+	}
+	restricted := outputList{}
+	for _, o := range out {
+		if wanted[o] {
+			restricted = append(restricted, o)
+		}
+	}
+	return restricted, nil
 }
 
 // Parse a string which is either a number in MB, or a number with
@@ -151,37 +1003,237 @@ func getDiskSizeMB(s string) (int, error) {
 	return strconv.Atoi(s)
 }
 
-func initrdAppend(iw *tar.Writer, r io.Reader) {
+// appendOpts control how the entries of a tarball are rewritten as they are added to the image
+type appendOpts struct {
+	// reproducible resets the timestamps to the epoch
+	reproducible bool
+	// uidMap and gidMap set the user and group names by numeric id
+	uidMap map[int]string
+	gidMap map[int]string
+	// remap gives the users and groups of the config their ids, nil to keep the ids
+	remap *idRemap
+	// whiteouts records overlay whiteouts to apply, nil to add them as files
+	whiteouts *whiteouts
+	// paths records the paths added as belonging to layer, nil to not record them
+	paths layerPaths
+	layer string
+	// files counts the entries added to the image against a limit, nil for no limit
+	files *fileLimit
+	// timings are the timings of the build, nil to only add to Timings
+	timings *buildTimings
+}
+
+// fileLimit is the maximum number of entries in the image and the number added so far
+type fileLimit struct {
+	max   int
+	count int
+}
+
+// checkPassthrough checks that a kernel that is passed through, so stays in the
+// image, is not used by outputs that boot the kernel from /boot
+func checkPassthrough(kc KernelConfig, out outputList) error {
+	if !kc.Passthrough || kc.Image == "" {
+		return nil
+	}
+	for _, o := range out {
+		if bootOutputs[o] {
+			return fmt.Errorf("The %s output boots the kernel from /boot, which a kernel with passthrough is not moved to", o)
+		}
+	}
+	return nil
+}
+
+// checkInitrdLimit warns if the initrd is larger than the boot method can
+// load, failing instead if strict is set
+func checkInitrdLimit(size, limit int64, strict bool) error {
+	if limit == 0 || size <= limit {
+		return nil
+	}
+	msg := fmt.Sprintf("The initrd is %d bytes, over the boot initrd limit of %d bytes", size, limit)
+	if strict {
+		return errors.New(msg)
+	}
+	log.Warnf("%s, it may not boot", msg)
+	return nil
+}
+
+// defaultCmdlineLimit is the COMMAND_LINE_SIZE assumed for the kernel, which
+// is no larger than that of most kernels
+const defaultCmdlineLimit = 1024
+
+// checkImages checks the cmdline of a config and the ages of its images,
+// which have been pulled
+func checkImages(m Moby, opts buildOpts) error {
+	if m.Kernel.Image != "" {
+		if err := checkCmdlineLimit(m.Kernel.Cmdline, opts.cmdlineLimit, opts.strict); err != nil {
+			return err
+		}
+	}
+	return checkImageAges(m, opts.maxImageAge, time.Now(), opts.strict, Images.inspect)
+}
+
+// checkCmdlineLimit warns if the cmdline does not fit in the COMMAND_LINE_SIZE
+// of the kernel, which includes the terminating NUL and truncates a longer
+// cmdline at boot, failing instead if strict is set
+func checkCmdlineLimit(cmdline string, limit int, strict bool) error {
+	if limit == 0 || len(cmdline) < limit {
+		return nil
+	}
+	msg := fmt.Sprintf("The kernel cmdline is %d bytes, it must be less than the cmdline limit of %d bytes", len(cmdline), limit)
+	if strict {
+		return errors.New(msg)
+	}
+	log.Warnf("%s or the kernel truncates it at boot", msg)
+	return nil
+}
+
+// checkLayers returns an error naming the image that takes the number of
+// kernel, init, onboot and service images over max, if max is not 0
+func checkLayers(m Moby, max int) error {
+	if max == 0 {
+		return nil
+	}
+	images := []string{}
+	if m.Kernel.Image != "" {
+		images = append(images, m.Kernel.Image)
+	}
+	images = append(images, m.Init...)
+	for _, image := range m.Onboot {
+		images = append(images, image.Name)
+	}
+	for _, image := range m.Services {
+		images = append(images, image.Name)
+	}
+	if len(images) > max {
+		return fmt.Errorf("Image %s exceeds the maximum of %d layers, the config has %d", images[max], max, len(images))
+	}
+	return nil
+}
+
+// initrdAppend copies the entries of a tarball into the image
+func initrdAppend(iw *tar.Writer, r io.Reader, opts appendOpts) error {
+	if opts.whiteouts != nil {
+		opts.whiteouts.startLayer()
+	}
+	var remap *layerRemap
+	if opts.remap != nil {
+		// the passwd and group files are read before the entries they own
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		remap, err = opts.remap.layer(b, opts.layer)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
 	tr := tar.NewReader(r)
+	// last is the previous entry, to locate read errors in the tarball
+	last := ""
 	for {
 		hdr, err := tr.Next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			log.Fatalln(err)
+			return tarReadError(err, last)
+		}
+		last = hdr.Name
+		if opts.whiteouts != nil && !opts.whiteouts.add(hdr) {
+			continue
+		}
+		if opts.files != nil {
+			opts.files.count++
+			if opts.files.count > opts.files.max {
+				return fmt.Errorf("%s exceeds the maximum of %d files in the image at %s", opts.layer, opts.files.max, hdr.Name)
+			}
+		}
+		if opts.paths != nil {
+			opts.paths.add(opts.layer, hdr)
+		}
+		if remap != nil {
+			if err := remap.header(hdr, opts.layer); err != nil {
+				return err
+			}
+		}
+		contents, rewritten := remap.contents(hdr.Name)
+		if rewritten {
+			hdr.Size = int64(len(contents))
+		}
+		if name, ok := opts.uidMap[hdr.Uid]; ok {
+			hdr.Uname = name
+		}
+		if name, ok := opts.gidMap[hdr.Gid]; ok {
+			hdr.Gname = name
+		}
+		if opts.reproducible {
+			hdr.ModTime = time.Unix(0, 0)
+			hdr.AccessTime = time.Time{}
+			hdr.ChangeTime = time.Time{}
+			for _, k := range []string{"mtime", "atime", "ctime"} {
+				delete(hdr.PAXRecords, k)
+			}
 		}
 		err = iw.WriteHeader(hdr)
 		if err != nil {
-			log.Fatalln(err)
+			return fmt.Errorf("Cannot add %s: %v", hdr.Name, err)
+		}
+		if rewritten {
+			if _, err := iw.Write(contents); err != nil {
+				return fmt.Errorf("Cannot add %s: %v", hdr.Name, err)
+			}
+			continue
+		}
+		n, err := io.Copy(iw, tr)
+		if err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("Tarball is truncated in the contents of %s, read %d of %d bytes", hdr.Name, n, hdr.Size)
 		}
-		_, err = io.Copy(iw, tr)
 		if err != nil {
-			log.Fatalln(err)
+			return fmt.Errorf("Cannot add %s: %v", hdr.Name, err)
 		}
 	}
+	return nil
 }
 
+// tarReadError describes an error reading the header of the entry after last
+func tarReadError(err error, last string) error {
+	if err == io.ErrUnexpectedEOF {
+		if last == "" {
+			return errors.New("Tarball is truncated in the first header")
+		}
+		return fmt.Errorf("Tarball is truncated in the header after %s", last)
+	}
+	if last == "" {
+		return fmt.Errorf("Cannot read the first header: %v", err)
+	}
+	return fmt.Errorf("Cannot read the header after %s: %v", last, err)
+}
+
+// enforceContentTrust returns whether the content trust of an image is
+// verified, by the policy of its registry if the config has one, otherwise
+// by the image and org lists of the config
 func enforceContentTrust(fullImageName string, config *TrustConfig) bool {
-	for _, img := range config.Image {
+	if policy := config.registryPolicy(fullImageName); policy != nil {
+		return policy.Enforce || matchContentTrust(fullImageName, policy.Image, policy.Org, config.defaultOrg())
+	}
+	return matchContentTrust(fullImageName, config.Image, config.Org, config.defaultOrg())
+}
+
+// matchContentTrust returns whether an image is one of the images, or in one
+// of the orgs, given, with single names like nginx in defaultOrg
+func matchContentTrust(fullImageName string, images, orgs []string, defaultOrg string) bool {
+	for _, img := range images {
 		// First check for an exact name match
 		if img == fullImageName {
 			return true
 		}
 		// Also check for an image name only match
-		// by removing a possible tag (with possibly added digest):
-		imgAndTag := strings.Split(fullImageName, ":")
-		if len(imgAndTag) >= 2 && img == imgAndTag[0] {
+		// by removing a possible tag (with possibly added digest),
+		// which is after the last / so a registry port is kept:
+		repo := fullImageName[:strings.LastIndex(fullImageName, "/")+1]
+		imgAndTag := strings.Split(strings.TrimPrefix(fullImageName, repo), ":")
+		if len(imgAndTag) >= 2 && img == repo+imgAndTag[0] {
 			return true
 		}
 		// and by removing a possible digest:
@@ -191,7 +1243,7 @@ func enforceContentTrust(fullImageName string, config *TrustConfig) bool {
 		}
 	}
 
-	for _, org := range config.Org {
+	for _, org := range orgs {
 		var imgOrg string
 		splitName := strings.Split(fullImageName, "/")
 		switch len(splitName) {
@@ -199,8 +1251,8 @@ func enforceContentTrust(fullImageName string, config *TrustConfig) bool {
 			// if the image is empty, return false
 			return false
 		case 1:
-			// for single names like nginx, use library
-			imgOrg = "library"
+			// for single names like nginx, use the default org
+			imgOrg = defaultOrg
 		case 2:
 			// for names that assume docker hub, like linxukit/alpine, take the first split
 			imgOrg = splitName[0]
@@ -215,39 +1267,114 @@ func enforceContentTrust(fullImageName string, config *TrustConfig) bool {
 	return false
 }
 
+// bundlePath returns where the OCI bundle for an image is placed in the image,
+// which is the default unless overridden by rootfsPath in the config
+func bundlePath(def string, image MobyImage) string {
+	if image.RootfsPath != "" {
+		return path.Clean(image.RootfsPath)
+	}
+	return def
+}
+
+// buildOpts are the options that affect how an image is assembled
+type buildOpts struct {
+	pull           bool
+	reproducible   bool
+	applyWhiteouts bool
+	// normalizeTar is how the image tarball is normalized, one of
+	// normalizeModes, or empty to leave it as assembled
+	normalizeTar string
+	// strict makes problems with the image that are otherwise warnings errors
+	strict bool
+	// signKey signs the image, with the signature added at signPath
+	signKey  *[ed25519.PrivateKeySize]byte
+	signPath string
+	// maxLayers and maxFiles limit the images and entries in the image, 0 for no limit
+	maxLayers int
+	maxFiles  int
+	// maxImageAge is the age of an image over which it is a problem, 0 for no limit
+	maxImageAge time.Duration
+	// embedLabels adds the labels of the images at imageLabelsPath
+	embedLabels bool
+	// cmdlineLimit is the COMMAND_LINE_SIZE of the kernel, 0 for no limit
+	cmdlineLimit int
+	// osRelease is added at osReleasePath unless an image has it and
+	// forceOSRelease is not set, nothing is added if it is empty
+	osRelease      string
+	forceOSRelease bool
+	// dumpOCI is a directory the config.json of each container is also
+	// written to, nothing is written if it is empty
+	dumpOCI string
+	// buildLog is the log of the build, added at buildLogPath if it is set
+	buildLog *buildLog
+	// checked is set once the cmdline and the ages of the images have been
+	// checked, before looking for the outputs in the remote cache
+	checked bool
+	// timings are the timings of the build, nil to only add to Timings
+	timings *buildTimings
+}
+
 // Perform the actual build process
-// TODO return error not panic
-func buildInternal(m Moby, pull bool) []byte {
+func buildInternal(m Moby, opts buildOpts) ([]byte, []byte, error) {
 	w := new(bytes.Buffer)
 	iw := tar.NewWriter(w)
+	var modules []byte
+
+	uids, err := idMap(m.UIDMap)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid uidMap: %v", err)
+	}
+	gids, err := idMap(m.GIDMap)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid gidMap: %v", err)
+	}
+	err = checkLayers(m, opts.maxLayers)
+	if err != nil {
+		return nil, nil, err
+	}
+	if m.Kernel.Image != "" && !opts.checked {
+		err = checkCmdlineLimit(m.Kernel.Cmdline, opts.cmdlineLimit, opts.strict)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	remap, err := newIDRemap(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	ao := appendOpts{reproducible: opts.reproducible, uidMap: uids, gidMap: gids, remap: remap, paths: layerPaths{}, timings: opts.timings}
+	if opts.maxFiles != 0 {
+		ao.files = &fileLimit{max: opts.maxFiles}
+	}
+	if opts.applyWhiteouts {
+		ao.whiteouts = &whiteouts{}
+	}
 
-	if pull || enforceContentTrust(m.Kernel.Image, &m.Trust) {
-		log.Infof("Pull kernel image: %s", m.Kernel.Image)
-		err := dockerPull(m.Kernel.Image, enforceContentTrust(m.Kernel.Image, &m.Trust))
+	if opts.pull || enforceContentTrust(m.Kernel.Image, &m.Trust) {
+		d, err := Images.pull(m.Kernel.Image, contentTrust(m.Kernel.Image, &m.Trust))
+		opts.timings.add(phasePull, m.Kernel.Image, d)
 		if err != nil {
-			log.Fatalf("Could not pull image %s: %v", m.Kernel.Image, err)
+			return nil, nil, err
 		}
 	}
 	if m.Kernel.Image != "" {
 		// get kernel and initrd tarball from container
 		log.Infof("Extract kernel image: %s", m.Kernel.Image)
-		const (
-			kernelName    = "kernel"
-			kernelAltName = "bzImage"
-			ktarName      = "kernel.tar"
-		)
-		out, err := ImageExtract(m.Kernel.Image, "", enforceContentTrust(m.Kernel.Image, &m.Trust), pull)
+		out, err := ImageExtract(m.Kernel.Image, "", contentTrust(m.Kernel.Image, &m.Trust), opts.pull, opts.timings)
 		if err != nil {
-			log.Fatalf("Failed to extract kernel image and tarball: %v", err)
+			return nil, nil, fmt.Errorf("Failed to extract kernel image and tarball: %v", err)
 		}
-		buf := bytes.NewBuffer(out)
-
-		kernel, ktar, err := untarKernel(buf, kernelName, kernelAltName, ktarName, m.Kernel.Cmdline)
+		ao.layer = m.Kernel.Image
+		start := time.Now()
+		modules, err = addKernel(iw, out, m.Kernel, ao)
+		opts.timings.since(phaseAssemble, m.Kernel.Image, start)
 		if err != nil {
-			log.Fatalf("Could not extract kernel image and filesystem from tarball. %v", err)
+			return nil, nil, err
+		}
+		err = addKernelModules(&m, modules)
+		if err != nil {
+			return nil, nil, err
 		}
-		initrdAppend(iw, kernel)
-		initrdAppend(iw, ktar)
 	}
 
 	// convert init images to tarballs
@@ -256,12 +1383,16 @@ func buildInternal(m Moby, pull bool) []byte {
 	}
 	for _, ii := range m.Init {
 		log.Infof("Process init image: %s", ii)
-		init, err := ImageExtract(ii, "", enforceContentTrust(ii, &m.Trust), pull)
+		ao.layer = ii
+		extractErr, err := appendStream(iw, ao, ii, func(w io.Writer) error {
+			return ImageExtractTo(w, ii, "", contentTrust(ii, &m.Trust), opts.pull, opts.timings)
+		})
+		if extractErr != nil {
+			return nil, nil, fmt.Errorf("Failed to build init tarball from %s: %v", ii, extractErr)
+		}
 		if err != nil {
-			log.Fatalf("Failed to build init tarball from %s: %v", ii, err)
+			return nil, nil, fmt.Errorf("Failed to add init image %s: %v", ii, err)
 		}
-		buffer := bytes.NewBuffer(init)
-		initrdAppend(iw, buffer)
 	}
 
 	if len(m.Onboot) != 0 {
@@ -269,18 +1400,35 @@ func buildInternal(m Moby, pull bool) []byte {
 	}
 	for i, image := range m.Onboot {
 		log.Infof("  Create OCI config for %s", image.Image)
-		config, err := ConfigToOCI(image)
+		config, err := ConfigToOCI(image, m.OCIVersion)
 		if err != nil {
-			log.Fatalf("Failed to create config.json for %s: %v", image.Image, err)
+			return nil, nil, fmt.Errorf("Failed to create config.json for %s: %v", image.Image, err)
 		}
 		so := fmt.Sprintf("%03d", i)
-		path := "containers/onboot/" + so + "-" + image.Name
-		out, err := ImageBundle(path, image.Image, config, enforceContentTrust(image.Image, &m.Trust), pull)
+		path := bundlePath("containers/onboot/"+so+"-"+image.Name, image)
+		if opts.dumpOCI != "" {
+			if err := dumpOCIConfig(opts.dumpOCI, path, config); err != nil {
+				return nil, nil, err
+			}
+		}
+		ao.layer = image.Name
+		var files int
+		extractErr, err := appendStream(iw, ao, image.Image, func(w io.Writer) error {
+			var err error
+			files, err = ImageBundleTo(w, path, image.Image, config, contentTrust(image.Image, &m.Trust), opts.pull, opts.timings)
+			return err
+		})
+		if extractErr != nil {
+			return nil, nil, fmt.Errorf("Failed to extract root filesystem for %s: %v", image.Image, extractErr)
+		}
 		if err != nil {
-			log.Fatalf("Failed to extract root filesystem for %s: %v", image.Image, err)
+			return nil, nil, fmt.Errorf("Failed to add %s: %v", image.Image, err)
+		}
+		if files == 0 {
+			if err := emptyRootfs(image.Name, opts.strict); err != nil {
+				return nil, nil, err
+			}
 		}
-		buffer := bytes.NewBuffer(out)
-		initrdAppend(iw, buffer)
 	}
 
 	if len(m.Services) != 0 {
@@ -288,36 +1436,186 @@ func buildInternal(m Moby, pull bool) []byte {
 	}
 	for _, image := range m.Services {
 		log.Infof("  Create OCI config for %s", image.Image)
-		config, err := ConfigToOCI(image)
+		config, err := ConfigToOCI(image, m.OCIVersion)
 		if err != nil {
-			log.Fatalf("Failed to create config.json for %s: %v", image.Image, err)
+			return nil, nil, fmt.Errorf("Failed to create config.json for %s: %v", image.Image, err)
+		}
+		path := bundlePath("containers/services/"+image.Name, image)
+		if opts.dumpOCI != "" {
+			if err := dumpOCIConfig(opts.dumpOCI, path, config); err != nil {
+				return nil, nil, err
+			}
+		}
+		ao.layer = image.Name
+		var files int
+		extractErr, err := appendStream(iw, ao, image.Image, func(w io.Writer) error {
+			var err error
+			files, err = ImageBundleTo(w, path, image.Image, config, contentTrust(image.Image, &m.Trust), opts.pull, opts.timings)
+			return err
+		})
+		if extractErr != nil {
+			return nil, nil, fmt.Errorf("Failed to extract root filesystem for %s: %v", image.Image, extractErr)
 		}
-		path := "containers/services/" + image.Name
-		out, err := ImageBundle(path, image.Image, config, enforceContentTrust(image.Image, &m.Trust), pull)
 		if err != nil {
-			log.Fatalf("Failed to extract root filesystem for %s: %v", image.Image, err)
+			return nil, nil, fmt.Errorf("Failed to add %s: %v", image.Image, err)
+		}
+		if files == 0 {
+			if err := emptyRootfs(image.Name, opts.strict); err != nil {
+				return nil, nil, err
+			}
 		}
-		buffer := bytes.NewBuffer(out)
-		initrdAppend(iw, buffer)
 	}
 
-	// add files
+	if opts.embedLabels {
+		// the images have all been pulled so their configs are available locally
+		labels, err := imageLabels(m, Images.inspect)
+		if err != nil {
+			return nil, nil, err
+		}
+		b, err := json.MarshalIndent(labels, "", "  ")
+		if err != nil {
+			return nil, nil, err
+		}
+		m.Files = append(m.Files, File{Path: imageLabelsPath, Contents: string(b) + "\n"})
+	}
+	if opts.osRelease != "" {
+		err = addOSRelease(&m, opts.osRelease, ao.paths, opts.forceOSRelease)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// the images have all been pulled by now
+	err = checkImageDigests(m, Images.inspect)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !opts.checked {
+		err = checkImageAges(m, opts.maxImageAge, time.Now(), opts.strict, Images.inspect)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if opts.buildLog != nil {
+		log.Infof("Add build log: %s", buildLogPath)
+		m.Files = append(m.Files, File{Path: buildLogPath, Contents: opts.buildLog.contents(m)})
+	}
+
+	// add files, then finish the image
+	assembleStart := time.Now()
+	defer opts.timings.since(phaseAssemble, "", assembleStart)
+	err = checkFileConflicts(m.Files, ao.paths, opts.strict)
+	if err != nil {
+		return nil, nil, err
+	}
 	buffer, err := filesystem(m)
 	if err != nil {
-		log.Fatalf("failed to add filesystem parts: %v", err)
+		return nil, nil, fmt.Errorf("failed to add filesystem parts: %v", err)
+	}
+	// file entries only carry a timestamp when one is set in the config, which
+	// takes precedence over resetting timestamps for a reproducible build
+	fo := ao
+	fo.reproducible = false
+	// the files were already checked against the image paths above, and their
+	// uid and gid come from the config rather than an image's /etc/passwd
+	fo.paths = nil
+	fo.remap = nil
+	fo.layer = "files section"
+	err = initrdAppend(iw, buffer, fo)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to add files: %v", err)
 	}
-	initrdAppend(iw, buffer)
 	err = iw.Close()
 	if err != nil {
-		log.Fatalf("initrd close error: %v", err)
+		return nil, nil, fmt.Errorf("initrd close error: %v", err)
 	}
 
-	return w.Bytes()
+	image := w.Bytes()
+	if ao.whiteouts != nil {
+		image, err = ao.whiteouts.apply(image)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to apply whiteouts: %v", err)
+		}
+	}
+	image, err = normalizeTar(image, opts.normalizeTar)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to normalize image: %v", err)
+	}
+	if opts.signKey != nil {
+		log.Infof("Sign image: %s", opts.signPath)
+		image, err = signImage(image, opts.signKey, opts.signPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to sign image: %v", err)
+		}
+	}
+	return image, modules, nil
+}
+
+// kernelVersion returns the kernel version from the lib/modules/<version>
+// directory of a kernel filesystem tarball, or "" if there is none
+func kernelVersion(modules []byte) string {
+	tr := tar.NewReader(bytes.NewReader(modules))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			return ""
+		}
+		parts := strings.Split(cleanPath(hdr.Name), "/")
+		if len(parts) >= 3 && parts[0] == "lib" && parts[1] == "modules" {
+			return parts[2]
+		}
+	}
 }
 
-func untarKernel(buf *bytes.Buffer, kernelName, kernelAltName, ktarName string, cmdline string) (*bytes.Buffer, *bytes.Buffer, error) {
+// addKernel adds the kernel and its filesystem from a kernel image tarball to
+// the image, returning the filesystem as a tarball for the modules output
+func addKernel(iw *tar.Writer, image []byte, kc KernelConfig, ao appendOpts) ([]byte, error) {
+	const (
+		kernelName    = "kernel"
+		kernelAltName = "bzImage"
+		ktarName      = "kernel.tar"
+	)
+	kernel, ktar, err := untarKernel(bytes.NewBuffer(image), kernelName, kernelAltName, ktarName, kc)
+	if err != nil {
+		return nil, fmt.Errorf("Could not extract kernel image and filesystem from tarball. %v", err)
+	}
+	err = initrdAppend(iw, kernel, ao)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to add kernel from %s: %v", kc.Image, err)
+	}
+	ktarBytes := ktar.Bytes()
+	err = initrdAppend(iw, bytes.NewReader(ktarBytes), ao)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to add kernel filesystem from %s: %v", kc.Image, err)
+	}
+	// rewrite the filesystem on its own so the headers match those in the image
+	modules := new(bytes.Buffer)
+	mw := tar.NewWriter(modules)
+	mo := ao
+	mo.whiteouts = nil
+	mo.paths = nil
+	mo.files = nil
+	err = initrdAppend(mw, bytes.NewReader(ktarBytes), mo)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to add kernel filesystem: %v", err)
+	}
+	err = mw.Close()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to add kernel filesystem: %v", err)
+	}
+	return modules.Bytes(), nil
+}
+
+func untarKernel(buf *bytes.Buffer, kernelName, kernelAltName, ktarName string, kc KernelConfig) (*bytes.Buffer, *bytes.Buffer, error) {
 	tr := tar.NewReader(buf)
 
+	cmdline := kernelCmdline(kc)
+
+	if kc.Passthrough {
+		return passthroughKernel(tr, ktarName, cmdline, kc.CmdlinePath)
+	}
+
 	var kernel, ktar *bytes.Buffer
 	foundKernel := false
 
@@ -327,20 +1625,45 @@ func untarKernel(buf *bytes.Buffer, kernelName, kernelAltName, ktarName string,
 			break
 		}
 		if err != nil {
-			log.Fatalln(err)
+			return nil, nil, err
+		}
+		isKernel := hdr.Name == kernelName || hdr.Name == kernelAltName
+		if kc.Variant != "" {
+			// a variant selects the kernel by name pattern instead
+			isKernel, err = path.Match(kc.Variant, hdr.Name)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid kernel variant %s: %v", kc.Variant, err)
+			}
+			isKernel = isKernel && hdr.Name != ktarName && hdr.Typeflag != tar.TypeDir
 		}
-		switch hdr.Name {
-		case kernelName, kernelAltName:
+		switch {
+		case isKernel:
 			if foundKernel {
+				if kc.Variant != "" {
+					return nil, nil, fmt.Errorf("found more than one kernel image matching variant %s", kc.Variant)
+				}
 				return nil, nil, errors.New("found more than one possible kernel image")
 			}
 			foundKernel = true
+			// the boot files keep their default modes unless configured
+			bootMode, err := parseMode(kc.BootMode, 0700)
+			if err != nil {
+				return nil, nil, err
+			}
+			kernelMode, err := parseMode(kc.BootFileMode, hdr.Mode)
+			if err != nil {
+				return nil, nil, err
+			}
+			cmdlineMode, err := parseMode(kc.BootFileMode, 0700)
+			if err != nil {
+				return nil, nil, err
+			}
 			kernel = new(bytes.Buffer)
 			// make a new tarball with kernel in /boot/kernel
 			tw := tar.NewWriter(kernel)
 			whdr := &tar.Header{
 				Name:     "boot",
-				Mode:     0700,
+				Mode:     bootMode,
 				Typeflag: tar.TypeDir,
 			}
 			if err := tw.WriteHeader(whdr); err != nil {
@@ -348,7 +1671,7 @@ func untarKernel(buf *bytes.Buffer, kernelName, kernelAltName, ktarName string,
 			}
 			whdr = &tar.Header{
 				Name: "boot/kernel",
-				Mode: hdr.Mode,
+				Mode: kernelMode,
 				Size: hdr.Size,
 			}
 			if err := tw.WriteHeader(whdr); err != nil {
@@ -358,24 +1681,26 @@ func untarKernel(buf *bytes.Buffer, kernelName, kernelAltName, ktarName string,
 			if err != nil {
 				return nil, nil, err
 			}
-			// add the cmdline in /boot/cmdline
-			whdr = &tar.Header{
-				Name: "boot/cmdline",
-				Mode: 0700,
-				Size: int64(len(cmdline)),
-			}
-			if err := tw.WriteHeader(whdr); err != nil {
-				return nil, nil, err
-			}
-			buf := bytes.NewBufferString(cmdline)
-			_, err = io.Copy(tw, buf)
-			if err != nil {
-				return nil, nil, err
+			// add the cmdline in /boot/cmdline, unless the bootloader gives it
+			if !kc.NoCmdlineFile {
+				whdr = &tar.Header{
+					Name: "boot/cmdline",
+					Mode: cmdlineMode,
+					Size: int64(len(cmdline)),
+				}
+				if err := tw.WriteHeader(whdr); err != nil {
+					return nil, nil, err
+				}
+				buf := bytes.NewBufferString(cmdline)
+				_, err = io.Copy(tw, buf)
+				if err != nil {
+					return nil, nil, err
+				}
 			}
 			if err := tw.Close(); err != nil {
 				return nil, nil, err
 			}
-		case ktarName:
+		case hdr.Name == ktarName:
 			ktar = new(bytes.Buffer)
 			_, err := io.Copy(ktar, tr)
 			if err != nil {
@@ -395,3 +1720,84 @@ func untarKernel(buf *bytes.Buffer, kernelName, kernelAltName, ktarName string,
 
 	return kernel, ktar, nil
 }
+
+// kernelCmdline returns the cmdline as it is written to the image
+func kernelCmdline(kc KernelConfig) string {
+	cmdline := kc.Cmdline
+	if kc.CmdlineNewline && !strings.HasSuffix(cmdline, "\n") {
+		cmdline += "\n"
+	}
+	return cmdline
+}
+
+// passthroughKernel copies the entries of a kernel image tarball unchanged
+// apart from the kernel filesystem in ktarName, which is returned to be
+// extracted, and adds the cmdline at cmdlinePath
+func passthroughKernel(tr *tar.Reader, ktarName, cmdline, cmdlinePath string) (*bytes.Buffer, *bytes.Buffer, error) {
+	if cmdlinePath == "" {
+		cmdlinePath = defaultCmdlinePath
+	}
+	cmdlinePath = path.Clean(cmdlinePath)
+	kernel := new(bytes.Buffer)
+	tw := tar.NewWriter(kernel)
+	var ktar *bytes.Buffer
+	names := map[string]bool{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if hdr.Name == ktarName {
+			ktar = new(bytes.Buffer)
+			if _, err := io.Copy(ktar, tr); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		names[path.Clean(hdr.Name)] = true
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, nil, err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return nil, nil, err
+		}
+	}
+	if ktar == nil {
+		return nil, nil, errors.New("did not find kernel.tar in kernel image")
+	}
+	if names[cmdlinePath] {
+		return nil, nil, fmt.Errorf("cmdline path %s is already in the kernel image", cmdlinePath)
+	}
+
+	// the directories of the cmdline that are not in the image
+	dirs := []string{}
+	for dir := path.Dir(cmdlinePath); dir != "."; dir = path.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+	}
+	for _, dir := range dirs {
+		if names[dir] {
+			continue
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: dir, Mode: 0755, Typeflag: tar.TypeDir}); err != nil {
+			return nil, nil, err
+		}
+	}
+	hdr := &tar.Header{
+		Name: cmdlinePath,
+		Mode: 0644,
+		Size: int64(len(cmdline)),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.WriteString(tw, cmdline); err != nil {
+		return nil, nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, nil, err
+	}
+	return kernel, ktar, nil
+}
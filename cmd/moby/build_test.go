@@ -0,0 +1,865 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	contents string
+}
+
+// makeTar creates a tarball in memory from a list of entries
+func makeTar(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Mode:     0644,
+			Size:     int64(len(e.contents)),
+		}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// readTar reads a tarball into a map of headers and a map of contents by name
+func readTar(t *testing.T, buf *bytes.Buffer) (map[string]*tar.Header, map[string]string) {
+	hdrs := map[string]*tar.Header{}
+	contents := map[string]string{}
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdrs[hdr.Name] = hdr
+		contents[hdr.Name] = string(b)
+	}
+	return hdrs, contents
+}
+
+// kernelImageTar creates a kernel image tarball with the given kernel entries and a kernel.tar
+func kernelImageTar(t *testing.T, kernels ...tarEntry) *bytes.Buffer {
+	if len(kernels) == 0 {
+		kernels = []tarEntry{{name: "kernel", typeflag: tar.TypeReg, contents: "kernel image"}}
+	}
+	ktar := makeTar(t, []tarEntry{{name: "lib/modules/4.9.0/", typeflag: tar.TypeDir}})
+	return makeTar(t, append(kernels, tarEntry{name: "kernel.tar", typeflag: tar.TypeReg, contents: ktar.String()}))
+}
+
+func TestUntarKernelCmdlineNewline(t *testing.T) {
+	testCases := []struct {
+		newline  bool
+		cmdline  string
+		expected string
+	}{
+		{false, "console=ttyS0", "console=ttyS0"},
+		{true, "console=ttyS0", "console=ttyS0\n"},
+		{true, "console=ttyS0\n", "console=ttyS0\n"},
+	}
+	for _, testCase := range testCases {
+		kc := KernelConfig{Cmdline: testCase.cmdline, CmdlineNewline: testCase.newline}
+		kernel, _, err := untarKernel(kernelImageTar(t), "kernel", "bzImage", "kernel.tar", kc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdrs, contents := readTar(t, kernel)
+		hdr, ok := hdrs["boot/cmdline"]
+		if !ok {
+			t.Fatal("boot/cmdline not found in kernel tarball")
+		}
+		if contents["boot/cmdline"] != testCase.expected {
+			t.Errorf("expected cmdline %q, got %q", testCase.expected, contents["boot/cmdline"])
+		}
+		if hdr.Size != int64(len(testCase.expected)) {
+			t.Errorf("expected cmdline header size %d, got %d", len(testCase.expected), hdr.Size)
+		}
+	}
+}
+
+func TestUntarKernelNoCmdlineFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kc := KernelConfig{Cmdline: "console=ttyS0", CmdlineNewline: true, NoCmdlineFile: true}
+	kernel, _, err := untarKernel(kernelImageTar(t), "kernel", "bzImage", "kernel.tar", kc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, contents := readTar(t, kernel)
+	if _, ok := contents["boot/cmdline"]; ok {
+		t.Error("Expected no boot/cmdline with noCmdlineFile")
+	}
+	if contents["boot/kernel"] != "kernel image" {
+		t.Errorf("Expected the kernel in boot/kernel, got %v", contents)
+	}
+
+	// the outputs that boot the kernel still use the cmdline
+	base := filepath.Join(dir, "test")
+	o := &outputOpts{cmdline: kernelCmdline(kc)}
+	if err := outputs(base, kernel.Bytes(), outputList{"kernel+initrd"}, o); err != nil {
+		t.Fatal(err)
+	}
+	cmdline, err := ioutil.ReadFile(base + "-cmdline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cmdline) != "console=ttyS0\n" {
+		t.Errorf("Expected the kernel+initrd output to have the cmdline, got %q", cmdline)
+	}
+
+	if _, err := NewConfig([]byte("kernel:\n  image: linuxkit/kernel:4.9.x\n  noCmdlineFile: true\n")); err != nil {
+		t.Errorf("Expected noCmdlineFile to be valid: %v", err)
+	}
+	if _, err := NewConfig([]byte("kernel:\n  image: linuxkit/kernel:4.9.x\n  noCmdlineFile: true\n  passthrough: true\n")); err == nil {
+		t.Error("Expected noCmdlineFile with passthrough to be rejected")
+	}
+}
+
+func TestUntarKernelVariant(t *testing.T) {
+	kernels := []tarEntry{
+		{name: "bzImage", typeflag: tar.TypeReg, contents: "production kernel"},
+		{name: "kernel-dbg", typeflag: tar.TypeReg, contents: "debug kernel"},
+		{name: "kernel", typeflag: tar.TypeReg, contents: "production kernel"},
+	}
+
+	// without a variant both kernel and bzImage match
+	_, _, err := untarKernel(kernelImageTar(t, kernels...), "kernel", "bzImage", "kernel.tar", KernelConfig{})
+	if err == nil {
+		t.Error("expected error for multiple kernel images without a variant")
+	}
+
+	testCases := []struct {
+		variant  string
+		expected string
+	}{
+		{"kernel-dbg", "debug kernel"},
+		{"*-dbg", "debug kernel"},
+		{"bzImage", "production kernel"},
+	}
+	for _, testCase := range testCases {
+		kc := KernelConfig{Variant: testCase.variant}
+		kernel, _, err := untarKernel(kernelImageTar(t, kernels...), "kernel", "bzImage", "kernel.tar", kc)
+		if err != nil {
+			t.Errorf("unexpected error for variant %s: %v", testCase.variant, err)
+			continue
+		}
+		_, contents := readTar(t, kernel)
+		if contents["boot/kernel"] != testCase.expected {
+			t.Errorf("expected %q for variant %s, got %q", testCase.expected, testCase.variant, contents["boot/kernel"])
+		}
+	}
+
+	// a variant matching several kernels is still ambiguous
+	_, _, err = untarKernel(kernelImageTar(t, kernels...), "kernel", "bzImage", "kernel.tar", KernelConfig{Variant: "kernel*"})
+	if err == nil {
+		t.Error("expected error for variant matching more than one kernel image")
+	}
+}
+
+func TestUntarKernelPassthrough(t *testing.T) {
+	kernels := []tarEntry{
+		{name: "kernel", typeflag: tar.TypeReg, contents: "kernel image"},
+		{name: "System.map", typeflag: tar.TypeReg, contents: "symbols"},
+		{name: "dtbs/", typeflag: tar.TypeDir},
+		{name: "dtbs/board.dtb", typeflag: tar.TypeReg, contents: "device tree"},
+	}
+	kc := KernelConfig{Cmdline: "console=ttyS0"}
+	rewritten, rewrittenKtar, err := untarKernel(kernelImageTar(t, kernels...), "kernel", "bzImage", "kernel.tar", kc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kc.Passthrough = true
+	passed, passedKtar, err := untarKernel(kernelImageTar(t, kernels...), "kernel", "bzImage", "kernel.tar", kc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the default moves the kernel to /boot and drops the rest
+	_, contents := readTar(t, rewritten)
+	expected := map[string]string{"boot": "", "boot/kernel": "kernel image", "boot/cmdline": "console=ttyS0"}
+	if !reflect.DeepEqual(contents, expected) {
+		t.Errorf("Expected the rewritten kernel %v, got %v", expected, contents)
+	}
+
+	// passthrough keeps the image as it is, apart from the kernel filesystem
+	hdrs, contents := readTar(t, passed)
+	expected = map[string]string{
+		"kernel":         "kernel image",
+		"System.map":     "symbols",
+		"dtbs/":          "",
+		"dtbs/board.dtb": "device tree",
+		"boot":           "",
+		"boot/cmdline":   "console=ttyS0",
+	}
+	if !reflect.DeepEqual(contents, expected) {
+		t.Errorf("Expected the kernel image passed through %v, got %v", expected, contents)
+	}
+	if hdrs["dtbs/"].Mode != 0755 || hdrs["kernel"].Mode != 0644 {
+		t.Errorf("Expected the headers of the kernel image to be kept, got %v %v", hdrs["dtbs/"], hdrs["kernel"])
+	}
+	if !bytes.Equal(rewrittenKtar.Bytes(), passedKtar.Bytes()) {
+		t.Error("Expected the same kernel filesystem with and without passthrough")
+	}
+
+	// the cmdline can be written elsewhere, but not over the kernel image
+	kc.CmdlinePath = "dtbs/cmdline.txt"
+	passed, _, err = untarKernel(kernelImageTar(t, kernels...), "kernel", "bzImage", "kernel.tar", kc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdrs, contents := readTar(t, passed); contents["dtbs/cmdline.txt"] != "console=ttyS0" || hdrs["boot"] != nil {
+		t.Errorf("Expected the cmdline in dtbs/cmdline.txt only, got %v", contents)
+	}
+	kc.CmdlinePath = "System.map"
+	if _, _, err := untarKernel(kernelImageTar(t, kernels...), "kernel", "bzImage", "kernel.tar", kc); err == nil || !strings.Contains(err.Error(), "already in the kernel image") {
+		t.Errorf("Expected an error for a cmdline path in the kernel image, got %v", err)
+	}
+
+	for _, config := range []string{
+		"kernel:\n  image: k\n  cmdlinePath: etc/cmdline",
+		"kernel:\n  image: k\n  passthrough: true\n  cmdlinePath: /etc/cmdline",
+		"kernel:\n  image: k\n  passthrough: true\n  variant: kernel-dbg",
+	} {
+		if _, err := NewConfig([]byte(config)); err == nil {
+			t.Errorf("Expected an error for config %q", config)
+		}
+	}
+	kc = KernelConfig{Image: "k", Passthrough: true}
+	if err := checkPassthrough(kc, outputList{"tar", "docker-archive"}); err != nil {
+		t.Errorf("Expected outputs that do not boot the kernel to be allowed with passthrough, got %v", err)
+	}
+	if err := checkPassthrough(kc, outputList{"tar", "kernel+initrd"}); err == nil {
+		t.Error("Expected an error for an output that boots the kernel with passthrough")
+	}
+}
+
+func TestReproducibleMtime(t *testing.T) {
+	image := new(bytes.Buffer)
+	tw := tar.NewWriter(image)
+	hdr := &tar.Header{
+		Name:    "bin/sh",
+		Mode:    0755,
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filesystem(Moby{Files: []File{{Path: "etc/issue", Contents: "moby", Mtime: "1500000000"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// image contents are reset to the epoch, the configured mtime is kept
+	out := new(bytes.Buffer)
+	iw := tar.NewWriter(out)
+	if err := initrdAppend(iw, image, appendOpts{reproducible: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := initrdAppend(iw, files, appendOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := iw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	hdrs, _ := readTar(t, out)
+
+	if hdrs["bin/sh"].ModTime.Unix() != 0 {
+		t.Errorf("Expected image entry to be reset to the epoch, got %v", hdrs["bin/sh"].ModTime)
+	}
+	if hdrs["etc/issue"].ModTime.Unix() != 1500000000 {
+		t.Errorf("Expected configured mtime to take precedence, got %v", hdrs["etc/issue"].ModTime)
+	}
+}
+
+func TestConfigNameAndDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// outputDir is relative to the current directory
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+
+	config := "name: custom\noutputDir: out/images\nfiles:\n  - path: etc/motd\n    contents: hello\noutputs:\n  - tar\n"
+	if err := ioutil.WriteFile("test.yml", []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name     string
+		dir      string
+		expected string
+	}{
+		{"", "", "out/images/custom.tar"},
+		{"cli", "", "out/images/cli.tar"},
+		{"", ".", "custom.tar"},
+		{"cli", ".", "cli.tar"},
+	}
+	for _, testCase := range testCases {
+		c := &buildCommand{name: testCase.name}
+		if err := c.run("test.yml", testCase.dir); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(testCase.expected); err != nil {
+			t.Errorf("Expected output %s for name %q and dir %q: %v", testCase.expected, testCase.name, testCase.dir, err)
+		}
+	}
+
+	for _, invalid := range []string{"name: ../escape\n", "outputDir: ../escape\n", "outputDir: /tmp\n"} {
+		if _, err := NewConfig([]byte(invalid)); err == nil {
+			t.Errorf("Expected config %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestStdinName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stdin := os.Stdin
+	defer func() { os.Stdin = stdin }()
+	env, hadEnv := os.LookupEnv(defaultNameEnv)
+	defer func() {
+		if hadEnv {
+			os.Setenv(defaultNameEnv, env)
+		} else {
+			os.Unsetenv(defaultNameEnv)
+		}
+	}()
+
+	files := "files:\n  - path: etc/motd\n    contents: hello\n"
+	testCases := []struct {
+		config   string
+		env      string
+		name     string
+		expected string
+	}{
+		{files, "", "", "moby.tar"},
+		{files, "ci-env", "", "ci-env.tar"},
+		{"name: config\n" + files, "ci-env", "", "config.tar"},
+		{"name: config\n" + files, "ci-env", "cli", "cli.tar"},
+	}
+	for i, testCase := range testCases {
+		in := filepath.Join(dir, fmt.Sprintf("stdin-%d", i))
+		if err := ioutil.WriteFile(in, []byte(testCase.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Stdin = f
+		os.Setenv(defaultNameEnv, testCase.env)
+		out := filepath.Join(dir, fmt.Sprintf("out-%d", i))
+		if err := os.Mkdir(out, 0755); err != nil {
+			t.Fatal(err)
+		}
+		c := &buildCommand{name: testCase.name, out: outputList{"tar"}}
+		err = c.run("-", out)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(out, testCase.expected)); err != nil {
+			t.Errorf("Expected output %s with %s=%q and name %q: %v", testCase.expected, defaultNameEnv, testCase.env, testCase.name, err)
+		}
+	}
+
+	f, err := os.Open(filepath.Join(dir, "stdin-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	os.Stdin = f
+	os.Setenv(defaultNameEnv, "../escape")
+	if _, err := readConfig("-"); err == nil || !strings.Contains(err.Error(), "must not be a path") {
+		t.Errorf("Expected %s that is a path to be rejected, got %v", defaultNameEnv, err)
+	}
+}
+
+func TestOutputPrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := filepath.Join(dir, "test.yml")
+	if err := ioutil.WriteFile(conf, []byte("name: myimg\nfiles:\n  - path: etc/motd\n    contents: hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out")
+	if err := os.Mkdir(out, 0755); err != nil {
+		t.Fatal(err)
+	}
+	c := &buildCommand{
+		outputPrefix: "ci123-",
+		out:          outputList{"tar", "kernel+initrd", "docker-archive", "manifest", "tar-split"},
+	}
+	if err := c.run(conf, out); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ioutil.ReadDir(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < len(c.out) {
+		t.Errorf("Expected at least %d outputs, got %d", len(c.out), len(files))
+	}
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name(), "ci123-myimg") {
+			t.Errorf("Expected output %s to have the prefix ci123- before the name", f.Name())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(out, "ci123-myimg.tar")); err != nil {
+		t.Errorf("Expected tar output ci123-myimg.tar: %v", err)
+	}
+}
+
+func TestIDMap(t *testing.T) {
+	m, err := NewConfig([]byte("uidMap:\n  0: root\n  \"1000\": builder\ngidMap:\n  100: users\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uids, err := idMap(m.UIDMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gids, err := idMap(m.GIDMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := new(bytes.Buffer)
+	tw := tar.NewWriter(in)
+	for _, hdr := range []*tar.Header{
+		{Name: "root", Mode: 0644, Uid: 0, Gid: 100, Uname: "wheel"},
+		{Name: "builder", Mode: 0644, Uid: 1000, Gid: 1000, Uname: "user", Gname: "user"},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	out := new(bytes.Buffer)
+	iw := tar.NewWriter(out)
+	if err := initrdAppend(iw, in, appendOpts{uidMap: uids, gidMap: gids}); err != nil {
+		t.Fatal(err)
+	}
+	if err := iw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	hdrs, _ := readTar(t, out)
+
+	testCases := []struct {
+		name  string
+		uname string
+		gname string
+	}{
+		{"root", "root", "users"},
+		// gid 1000 is not mapped so the name is kept
+		{"builder", "builder", "user"},
+	}
+	for _, testCase := range testCases {
+		hdr := hdrs[testCase.name]
+		if hdr.Uname != testCase.uname || hdr.Gname != testCase.gname {
+			t.Errorf("Expected %s to be owned by %s:%s, got %s:%s", testCase.name, testCase.uname, testCase.gname, hdr.Uname, hdr.Gname)
+		}
+	}
+
+	if _, err := NewConfig([]byte("uidMap:\n  root: root\n")); err == nil {
+		t.Error("Expected non-numeric uidMap id to be rejected")
+	}
+}
+
+func TestKernelVersion(t *testing.T) {
+	testCases := []struct {
+		entries  []tarEntry
+		expected string
+	}{
+		{[]tarEntry{{name: "lib/modules/4.9.0/", typeflag: tar.TypeDir}}, "4.9.0"},
+		{[]tarEntry{
+			{name: "lib/", typeflag: tar.TypeDir},
+			{name: "lib/modules/", typeflag: tar.TypeDir},
+			{name: "./lib/modules/4.11.1-linuxkit/kernel/fs/fuse.ko", typeflag: tar.TypeReg, contents: "module"},
+		}, "4.11.1-linuxkit"},
+		{[]tarEntry{{name: "lib/firmware/", typeflag: tar.TypeDir}}, ""},
+	}
+	for _, testCase := range testCases {
+		if v := kernelVersion(makeTar(t, testCase.entries).Bytes()); v != testCase.expected {
+			t.Errorf("Expected kernel version %q, got %q", testCase.expected, v)
+		}
+	}
+
+	// the version is found in the modules split out of a kernel image
+	iw := tar.NewWriter(new(bytes.Buffer))
+	modules, err := addKernel(iw, kernelImageTar(t).Bytes(), KernelConfig{}, appendOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := kernelVersion(modules); v != "4.9.0" {
+		t.Errorf("Expected kernel version 4.9.0 from the kernel image, got %q", v)
+	}
+}
+
+func TestUntarKernelBootMode(t *testing.T) {
+	testCases := []struct {
+		kc      KernelConfig
+		boot    int64
+		kernel  int64
+		cmdline int64
+	}{
+		// the kernel keeps the mode from the kernel image by default
+		{KernelConfig{}, 0700, 0644, 0700},
+		{KernelConfig{BootMode: "0755"}, 0755, 0644, 0700},
+		{KernelConfig{BootMode: "755", BootFileMode: "0444"}, 0755, 0444, 0444},
+	}
+	for _, testCase := range testCases {
+		kernel, _, err := untarKernel(kernelImageTar(t), "kernel", "bzImage", "kernel.tar", testCase.kc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdrs, _ := readTar(t, kernel)
+		for name, mode := range map[string]int64{"boot": testCase.boot, "boot/kernel": testCase.kernel, "boot/cmdline": testCase.cmdline} {
+			if hdrs[name].Mode != mode {
+				t.Errorf("Expected mode %04o for %s with %+v, got %04o", mode, name, testCase.kc, hdrs[name].Mode)
+			}
+		}
+	}
+
+	if _, err := NewConfig([]byte("kernel:\n  bootMode: \"0999\"\n")); err == nil {
+		t.Error("Expected invalid bootMode to be rejected")
+	}
+}
+
+func TestEmbedConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := filepath.Join(dir, "test.yml")
+	config := `
+kernel:
+  cmdline: "console=ttyS0"
+files:
+  - path: etc/motd
+    contents: hello
+  - path: etc/secret
+    contents: hunter2
+    sensitive: true
+uidMap:
+  1000: user
+`
+	if err := ioutil.WriteFile(conf, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	images := []string{}
+	for _, name := range []string{"first", "second"} {
+		c := &buildCommand{name: name, out: outputList{"tar"}, embedConfig: true, opts: buildOpts{reproducible: true}}
+		if err := c.run(conf, dir); err != nil {
+			t.Fatal(err)
+		}
+		image, err := ioutil.ReadFile(filepath.Join(dir, name+".tar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, contents := readTar(t, bytes.NewBuffer(image))
+		embedded, ok := contents[embedConfigPath]
+		if !ok {
+			t.Fatalf("Expected %s in the image", embedConfigPath)
+		}
+		images = append(images, embedded)
+	}
+	if images[0] != images[1] {
+		t.Errorf("Expected the embedded config to be stable, got:\n%s\nand:\n%s", images[0], images[1])
+	}
+	if strings.Contains(images[0], "hunter2") {
+		t.Errorf("Expected sensitive file contents to be redacted, got:\n%s", images[0])
+	}
+
+	expected, err := NewConfig([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected.Files[1].Contents = redacted
+	m, err := NewConfig([]byte(images[0]))
+	if err != nil {
+		t.Fatalf("Embedded config is not valid: %v\n%s", err, images[0])
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("Expected the embedded config to match the resolved config, got:\n%s", images[0])
+	}
+}
+
+func TestInitrdAppendTruncated(t *testing.T) {
+	image := makeTar(t, []tarEntry{
+		{name: "etc/motd", typeflag: tar.TypeReg, contents: "hello"},
+		{name: "bin/busybox", typeflag: tar.TypeReg, contents: strings.Repeat("x", 4096)},
+	}).Bytes()
+
+	// each entry is a 512 byte header followed by its contents padded to 512 bytes
+	testCases := []struct {
+		length   int
+		expected string
+	}{
+		{100, "Tarball is truncated in the first header"},
+		{1024 + 100, "Tarball is truncated in the header after etc/motd"},
+		{1024 + 512 + 1000, "Tarball is truncated in the contents of bin/busybox, read 1000 of 4096 bytes"},
+	}
+	for _, testCase := range testCases {
+		iw := tar.NewWriter(ioutil.Discard)
+		err := initrdAppend(iw, bytes.NewReader(image[:testCase.length]), appendOpts{})
+		if err == nil || err.Error() != testCase.expected {
+			t.Errorf("Expected error %q for a tarball truncated to %d bytes, got %v", testCase.expected, testCase.length, err)
+		}
+	}
+
+	iw := tar.NewWriter(ioutil.Discard)
+	if err := initrdAppend(iw, bytes.NewReader(image), appendOpts{}); err != nil {
+		t.Errorf("Unexpected error for a complete tarball: %v", err)
+	}
+}
+
+func TestMaxLayers(t *testing.T) {
+	m, err := NewConfig([]byte(`
+kernel:
+  image: "linuxkit/kernel:4.9.x"
+init:
+  - "linuxkit/init:latest"
+services:
+  - name: dhcpcd
+    image: "linuxkit/dhcpcd:latest"
+  - name: nginx
+    image: "nginx:alpine"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkLayers(m, 0); err != nil {
+		t.Errorf("Unexpected error with no limit: %v", err)
+	}
+	if err := checkLayers(m, 4); err != nil {
+		t.Errorf("Unexpected error at the limit: %v", err)
+	}
+	err = checkLayers(m, 3)
+	if err == nil || !strings.Contains(err.Error(), "Image nginx exceeds the maximum of 3 layers") {
+		t.Errorf("Expected error naming nginx over the limit, got %v", err)
+	}
+	// the limit is checked before any images are pulled
+	_, _, err = buildInternal(m, buildOpts{maxLayers: 1})
+	if err == nil || !strings.Contains(err.Error(), "Image linuxkit/init:latest exceeds the maximum of 1 layers") {
+		t.Errorf("Expected build to fail on the layer limit, got %v", err)
+	}
+}
+
+func TestMaxFiles(t *testing.T) {
+	limit := &fileLimit{max: 3}
+	iw := tar.NewWriter(ioutil.Discard)
+	first := makeTar(t, []tarEntry{{name: "etc/", typeflag: tar.TypeDir}, {name: "etc/motd", typeflag: tar.TypeReg, contents: "hello"}})
+	if err := initrdAppend(iw, first, appendOpts{files: limit, layer: "linuxkit/init:latest"}); err != nil {
+		t.Fatal(err)
+	}
+	second := makeTar(t, []tarEntry{{name: "bin/", typeflag: tar.TypeDir}, {name: "bin/nginx", typeflag: tar.TypeReg, contents: "nginx"}})
+	err := initrdAppend(iw, second, appendOpts{files: limit, layer: "nginx"})
+	if err == nil || err.Error() != "nginx exceeds the maximum of 3 files in the image at bin/nginx" {
+		t.Errorf("Expected error naming nginx over the limit, got %v", err)
+	}
+
+	m, err := NewConfig([]byte("files:\n  - path: etc/motd\n    contents: hello\n  - path: etc/issue\n    contents: moby\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each file also adds its leading directory
+	if _, _, err := buildInternal(m, buildOpts{maxFiles: 4}); err != nil {
+		t.Errorf("Unexpected error at the limit: %v", err)
+	}
+	_, _, err = buildInternal(m, buildOpts{maxFiles: 3})
+	if err == nil || !strings.Contains(err.Error(), "files section exceeds the maximum of 3 files") {
+		t.Errorf("Expected build to fail on the file limit, got %v", err)
+	}
+}
+
+func TestFileOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := filepath.Join(dir, "test.yml")
+	config := `
+files:
+  - path: etc/motd
+    contents: hello
+  - path: etc/cloud/seed
+    contents: cloud
+    outputs: [gcp-img, vhd]
+  - path: etc/tarball
+    contents: tar
+    outputs: [tar, docker-archive]
+`
+	if err := ioutil.WriteFile(conf, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &buildCommand{name: "test", out: outputList{"tar"}}
+	if err := c.run(conf, dir); err != nil {
+		t.Fatal(err)
+	}
+	image, err := ioutil.ReadFile(filepath.Join(dir, "test.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, contents := readTar(t, bytes.NewBuffer(image))
+	for _, path := range []string{"etc/motd", "etc/tarball"} {
+		if _, ok := contents[path]; !ok {
+			t.Errorf("Expected %s in the tar output", path)
+		}
+	}
+	if _, ok := contents["etc/cloud/seed"]; ok {
+		t.Error("Expected etc/cloud/seed, which is only for cloud outputs, not to be in the tar output")
+	}
+
+	if _, err := NewConfig([]byte("files:\n  - path: etc/seed\n    contents: x\n    outputs: [aws]\n")); err == nil {
+		t.Error("Expected an unknown output type in the outputs of a file to be rejected")
+	}
+}
+
+func TestBootInitrdLimit(t *testing.T) {
+	logs := new(bytes.Buffer)
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	if err := checkInitrdLimit(1024, 2048, true); err != nil || logs.Len() != 0 {
+		t.Errorf("Expected no warning or error for an initrd within the limit, got %v %q", err, logs.String())
+	}
+	if err := checkInitrdLimit(4096, 0, true); err != nil {
+		t.Errorf("Expected no limit by default, got %v", err)
+	}
+	if !bootsInitrd(outputList{"tar", "iso-efi"}) || bootsInitrd(outputList{"tar", "docker-archive"}) {
+		t.Error("Expected only outputs that boot the initrd to be checked")
+	}
+
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// random data does not compress, so the initrd is over 1M
+	big := make([]byte, 2*1024*1024)
+	if _, err := rand.Read(big); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "big"), big, 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, "test.yml")
+	config := fmt.Sprintf("files:\n  - path: data/big\n    source: %s\n", filepath.Join(dir, "big"))
+	if err := ioutil.WriteFile(conf, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, strict := range []bool{false, true} {
+		logs.Reset()
+		c := &buildCommand{name: "test", out: outputList{"kernel+initrd"}, bootInitrdLimit: 1, opts: buildOpts{strict: strict}}
+		err := c.run(conf, dir)
+		if strict && (err == nil || !strings.Contains(err.Error(), "over the boot initrd limit of 1048576 bytes")) {
+			t.Errorf("Expected an error for an initrd over the limit when strict, got %v", err)
+		}
+		if !strict && (err != nil || !strings.Contains(logs.String(), "over the boot initrd limit")) {
+			t.Errorf("Expected a warning for an initrd over the limit, got %v %q", err, logs.String())
+		}
+	}
+}
+
+func TestCmdlineLimit(t *testing.T) {
+	logs := new(bytes.Buffer)
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	// the limit includes the terminating NUL
+	if err := checkCmdlineLimit(strings.Repeat("x", 255), 256, true); err != nil || logs.Len() != 0 {
+		t.Errorf("Expected no warning or error for a cmdline within the limit, got %v %q", err, logs.String())
+	}
+	if err := checkCmdlineLimit(strings.Repeat("x", 4096), 0, true); err != nil {
+		t.Errorf("Expected no limit when it is 0, got %v", err)
+	}
+	if err := checkCmdlineLimit(strings.Repeat("x", 256), 256, true); err == nil || !strings.Contains(err.Error(), "256 bytes, it must be less than the cmdline limit of 256 bytes") {
+		t.Errorf("Expected an error for a cmdline over the limit when strict, got %v", err)
+	}
+
+	defer func(source imageSource) { Images = source }(Images)
+	Images = &fakeImages{
+		exports:  map[string][]byte{"linuxkit/kernel:4.9.x": kernelImageTar(t).Bytes()},
+		inspects: map[string]types.ImageInspect{},
+	}
+	m, err := NewConfig([]byte(fmt.Sprintf("kernel:\n  image: linuxkit/kernel:4.9.x\n  cmdline: console=ttyS0 %s\n", strings.Repeat("x", defaultCmdlineLimit))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, strict := range []bool{false, true} {
+		logs.Reset()
+		_, _, err := buildInternal(m, buildOpts{strict: strict, cmdlineLimit: defaultCmdlineLimit})
+		if strict && (err == nil || !strings.Contains(err.Error(), "cmdline limit")) {
+			t.Errorf("Expected an error for a cmdline over the limit when strict, got %v", err)
+		}
+		if !strict && (err != nil || !strings.Contains(logs.String(), "truncates it at boot")) {
+			t.Errorf("Expected a warning for a cmdline over the limit, got %v %q", err, logs.String())
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// buildLogPath is where the build log is written in the image by --embed-build-log
+const buildLogPath = "var/log/moby-build.log"
+
+// buildLog captures the log of a build at a level, which may be more
+// detailed than the log shown, to embed in the image
+type buildLog struct {
+	level     log.Level
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	formatter log.Formatter
+	// restore undoes the changes to the logger made to capture the log
+	restore func()
+}
+
+// quietFormatter drops the entries more detailed than the level of the log
+// shown, which the logger passes to the hooks at the level of a buildLog
+type quietFormatter struct {
+	log.Formatter
+	level log.Level
+}
+
+func (f *quietFormatter) Format(entry *log.Entry) ([]byte, error) {
+	if entry.Level > f.level {
+		return nil, nil
+	}
+	return f.Formatter.Format(entry)
+}
+
+// captureBuildLog starts capturing the log at level until stop is called
+func captureBuildLog(level log.Level) *buildLog {
+	b := &buildLog{
+		level: level,
+		// timestamps are left out so the log changes less between builds
+		formatter: &log.TextFormatter{DisableColors: true, DisableTimestamp: true},
+	}
+	logger := log.StandardLogger()
+	hooks, formatter, shown := logger.Hooks, logger.Formatter, logger.Level
+	captured := log.LevelHooks{}
+	for l, h := range hooks {
+		captured[l] = h
+	}
+	captured.Add(b)
+	logger.Hooks = captured
+	if level > shown {
+		logger.Formatter = &quietFormatter{Formatter: formatter, level: shown}
+		logger.Level = level
+	}
+	b.restore = func() {
+		logger.Hooks, logger.Formatter, logger.Level = hooks, formatter, shown
+	}
+	return b
+}
+
+// Levels are the levels of the entries captured
+func (b *buildLog) Levels() []log.Level {
+	levels := []log.Level{}
+	for _, l := range log.AllLevels {
+		if l <= b.level {
+			levels = append(levels, l)
+		}
+	}
+	return levels
+}
+
+// Fire captures an entry, with info entries as just their message as they are shown
+func (b *buildLog) Fire(entry *log.Entry) error {
+	line := []byte(entry.Message + "\n")
+	if entry.Level != log.InfoLevel {
+		var err error
+		line, err = b.formatter.Format(entry)
+		if err != nil {
+			return err
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Write(line)
+	return nil
+}
+
+// stop stops capturing the log
+func (b *buildLog) stop() {
+	if b.restore != nil {
+		b.restore()
+		b.restore = nil
+	}
+}
+
+// contents returns the log captured so far, with the paths, sources and
+// contents of sensitive files redacted
+func (b *buildLog) contents(m Moby) string {
+	b.mu.Lock()
+	s := b.buf.String()
+	b.mu.Unlock()
+	replace := []string{}
+	for _, f := range m.Files {
+		if !f.Sensitive {
+			continue
+		}
+		for _, v := range []string{f.Contents, f.Source, f.Path} {
+			if v != "" {
+				replace = append(replace, v, redacted)
+			}
+		}
+	}
+	return strings.NewReplacer(replace...).Replace(s)
+}
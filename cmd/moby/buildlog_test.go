@@ -0,0 +1,88 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+func TestEmbedBuildLog(t *testing.T) {
+	rootfs := makeTar(t, []tarEntry{{name: "bin", typeflag: tar.TypeDir}, {name: "bin/sh", typeflag: tar.TypeReg, contents: "sh"}}).Bytes()
+	images := &fakeImages{
+		exports: map[string][]byte{
+			"linuxkit/init:v1":   rootfs,
+			"linuxkit/sysctl:v1": rootfs,
+			"linuxkit/getty:v1":  rootfs,
+		},
+		inspects: map[string]types.ImageInspect{
+			"linuxkit/init:v1":   {Os: "linux"},
+			"linuxkit/sysctl:v1": {Os: "linux", Config: &container.Config{Cmd: []string{"/bin/sysctl"}}},
+			"linuxkit/getty:v1":  {Os: "linux", Config: &container.Config{Cmd: []string{"/bin/getty"}}},
+		},
+	}
+	defer func(source imageSource) { Images = source }(Images)
+	Images = images
+
+	logger := log.StandardLogger()
+	defer func(out io.Writer, level log.Level) {
+		logger.Out, logger.Level = out, level
+	}(logger.Out, logger.Level)
+	shown := new(bytes.Buffer)
+	logger.Out, logger.Level = shown, log.InfoLevel
+
+	m, err := NewConfig([]byte(`
+init:
+  - linuxkit/init:v1
+onboot:
+  - name: sysctl
+    image: linuxkit/sysctl:v1
+services:
+  - name: getty
+    image: linuxkit/getty:v1
+files:
+  - path: etc/secret-token
+    contents: hunter2
+    sensitive: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := captureBuildLog(log.DebugLevel)
+	image, _, err := buildInternal(m, buildOpts{buildLog: bl})
+	bl.stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Debugf("after the build")
+
+	_, contents := readTar(t, bytes.NewBuffer(image))
+	embedded, ok := contents[buildLogPath]
+	if !ok {
+		t.Fatalf("Expected the build log at %s", buildLogPath)
+	}
+	for _, marker := range []string{"Add init containers:", "Add onboot containers:", "Add service containers:", "level=debug"} {
+		if !strings.Contains(embedded, marker) {
+			t.Errorf("Expected the build log to contain %q, got:\n%s", marker, embedded)
+		}
+	}
+	if strings.Contains(embedded, "hunter2") || strings.Contains(embedded, "secret-token") {
+		t.Errorf("Expected the sensitive file to be redacted in the build log, got:\n%s", embedded)
+	}
+	if strings.Contains(embedded, "after the build") {
+		t.Error("Expected the log after the build not to be captured")
+	}
+
+	// the log shown stays at its level and the logger is restored
+	if !strings.Contains(shown.String(), "Add onboot containers:") || strings.Contains(shown.String(), "level=debug") {
+		t.Errorf("Expected the log shown to be at info level, got:\n%s", shown.String())
+	}
+	if logger.Level != log.InfoLevel || len(logger.Hooks[log.InfoLevel]) != 0 {
+		t.Error("Expected the logger to be restored after the build log is captured")
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/agl/ed25519"
+	"github.com/docker/docker/api/types"
+	"gopkg.in/yaml.v2"
+)
+
+// A bundle records a build so it can be replayed without Docker or network
+// access. It is a tarball of the config as it was built, with file sources
+// inlined, the options of the build that affect the outputs and the images
+// the build used, exported as Docker exports them.
+const (
+	bundleConfig  = "config.yml"
+	bundleOptions = "build.json"
+	bundleImages  = "images.json"
+)
+
+// bundleBuild are the options of a captured build that affect its outputs,
+// which replace the command line options when it is replayed
+type bundleBuild struct {
+	Name           string   `json:"name"`
+	Outputs        []string `json:"outputs"`
+	Size           int      `json:"size,omitempty"`
+	CompressLevel  int      `json:"compressLevel"`
+	Reproducible   bool     `json:"reproducible,omitempty"`
+	ApplyWhiteouts bool     `json:"applyWhiteouts,omitempty"`
+	NormalizeTar   string   `json:"normalizeTar,omitempty"`
+	Strict         bool     `json:"strict,omitempty"`
+	MaxLayers      int      `json:"maxLayers,omitempty"`
+	MaxFiles       int      `json:"maxFiles,omitempty"`
+	EmbedLabels    bool     `json:"embedLabels,omitempty"`
+	OSRelease      bool     `json:"osRelease,omitempty"`
+	ForceOSRelease bool     `json:"forceOSRelease,omitempty"`
+	FATSplit       bool     `json:"fatSplit,omitempty"`
+	ManifestFormat string   `json:"manifestFormat,omitempty"`
+	OutputPrefix   string   `json:"outputPrefix,omitempty"`
+	CmdlineLimit   int      `json:"cmdlineLimit,omitempty"`
+	Hyperkit       bool     `json:"hyperkit,omitempty"`
+	// SignKey is the digest of the public key a signed image is signed with
+	SignKey      string       `json:"signKey,omitempty"`
+	SignPath     string       `json:"signPath,omitempty"`
+	EFIStub      *bundleInput `json:"efiStub,omitempty"`
+	DeltaAgainst *bundleInput `json:"deltaAgainst,omitempty"`
+}
+
+// bundleInput is a file read by a captured build, which must be unchanged
+// for it to be replayed
+type bundleInput struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// newBundleInput records a file read by a build, nil if path is empty
+func newBundleInput(path string) (*bundleInput, error) {
+	if path == "" {
+		return nil, nil
+	}
+	sum, err := sha256File(path)
+	if err != nil {
+		return nil, err
+	}
+	return &bundleInput{Path: path, SHA256: sum}, nil
+}
+
+// check returns the path of a file read by a captured build, failing if it
+// has changed since
+func (i *bundleInput) check(what string) (string, error) {
+	if i == nil {
+		return "", nil
+	}
+	sum, err := sha256File(i.Path)
+	if err != nil {
+		return "", fmt.Errorf("Cannot read the %s of the captured build: %v", what, err)
+	}
+	if sum != i.SHA256 {
+		return "", fmt.Errorf("The %s %s has changed since the build was captured, its sha256 is %s not %s", what, i.Path, sum, i.SHA256)
+	}
+	return i.Path, nil
+}
+
+// signKeyDigest returns the digest of the public key of a signing key, empty
+// if there is none
+func signKeyDigest(key *[ed25519.PrivateKeySize]byte) string {
+	if key == nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(key[32:]))
+}
+
+// bundleImage is an image used by a captured build
+type bundleImage struct {
+	// Export is the name of the exported filesystem in the bundle, if it was exported
+	Export  string              `json:"export,omitempty"`
+	Inspect *types.ImageInspect `json:"inspect,omitempty"`
+}
+
+// buildBundle is a captured build
+type buildBundle struct {
+	config   Moby
+	options  bundleBuild
+	exports  map[string][]byte
+	inspects map[string]types.ImageInspect
+}
+
+// inlineSources returns a config with the sources of its files read into
+// their contents, so it no longer depends on them. Secrets are kept by name
+// and never read into the bundle.
+func inlineSources(m Moby) (Moby, error) {
+	m.Files = append([]File{}, m.Files...)
+	for i, f := range m.Files {
+		if f.Secret != "" {
+			// only the name of a secret is kept, a replay reads it from -secrets-dir
+			m.Files[i].Source = ""
+			continue
+		}
+		if !f.Directory && f.Contents == "" && f.Symlink == "" && f.Source != "" {
+			contents, err := ioutil.ReadFile(f.Source)
+			if err != nil {
+				return m, err
+			}
+			m.Files[i].Contents = string(contents)
+			m.Files[i].Source = ""
+		}
+	}
+	return m, nil
+}
+
+// bundleOptions returns the options of a build of a config that affect its
+// outputs, with the digests of the files it reads
+func (c *buildCommand) bundleOptions(name string, out outputList) (bundleBuild, error) {
+	var err error
+	o := bundleBuild{
+		Name:           name,
+		Outputs:        out,
+		Size:           c.size,
+		CompressLevel:  c.compressLevel,
+		Reproducible:   c.opts.reproducible,
+		ApplyWhiteouts: c.opts.applyWhiteouts,
+		NormalizeTar:   c.opts.normalizeTar,
+		Strict:         c.opts.strict,
+		MaxLayers:      c.opts.maxLayers,
+		MaxFiles:       c.opts.maxFiles,
+		EmbedLabels:    c.opts.embedLabels,
+		OSRelease:      c.osRelease,
+		ForceOSRelease: c.opts.forceOSRelease,
+		FATSplit:       c.fatSplit,
+		ManifestFormat: c.manifestFormat,
+		OutputPrefix:   c.outputPrefix,
+		CmdlineLimit:   c.opts.cmdlineLimit,
+		Hyperkit:       c.hyperkit,
+		SignKey:        signKeyDigest(c.opts.signKey),
+	}
+	if c.opts.signKey != nil {
+		o.SignPath = c.opts.signPath
+	}
+	o.EFIStub, err = newBundleInput(c.efiStub)
+	if err != nil {
+		return o, err
+	}
+	o.DeltaAgainst, err = newBundleInput(c.deltaAgainst)
+	return o, err
+}
+
+// newBundle starts capturing a build of a config, with the sources of the
+// files read so the bundle does not depend on them
+func newBundle(name string, m Moby, out outputList, c *buildCommand) (*buildBundle, error) {
+	m, err := inlineSources(m)
+	if err != nil {
+		return nil, err
+	}
+	options, err := c.bundleOptions(name, out)
+	if err != nil {
+		return nil, err
+	}
+	if !c.opts.reproducible {
+		log.Warnf("The captured build is not reproducible, so a replay will not be identical")
+	}
+	return &buildBundle{
+		config:   m,
+		options:  options,
+		exports:  map[string][]byte{},
+		inspects: map[string]types.ImageInspect{},
+	}, nil
+}
+
+// export returns an image from a bundle being replayed, the content trust
+// of the images was checked when they were captured
+func (b *buildBundle) export(image string, trust imageTrust, pull bool) ([]byte, time.Duration, error) {
+	contents, ok := b.exports[image]
+	if !ok {
+		return nil, 0, fmt.Errorf("Image %s is not in the replayed bundle", image)
+	}
+	return contents, 0, nil
+}
+
+func (b *buildBundle) inspect(image string) (types.ImageInspect, error) {
+	inspect, ok := b.inspects[image]
+	if !ok {
+		return types.ImageInspect{}, fmt.Errorf("Image %s is not in the replayed bundle", image)
+	}
+	return inspect, nil
+}
+
+// pull does nothing, a replay only uses the images captured in the bundle
+func (b *buildBundle) pull(image string, trust imageTrust) (time.Duration, error) {
+	return 0, nil
+}
+
+// captureImages records the images a build gets from source in a bundle
+type captureImages struct {
+	source imageSource
+	bundle *buildBundle
+}
+
+func (c *captureImages) export(image string, trust imageTrust, pull bool) ([]byte, time.Duration, error) {
+	contents, pulled, err := c.source.export(image, trust, pull)
+	if err == nil {
+		c.bundle.exports[image] = contents
+	}
+	return contents, pulled, err
+}
+
+func (c *captureImages) inspect(image string) (types.ImageInspect, error) {
+	inspect, err := c.source.inspect(image)
+	if err == nil {
+		c.bundle.inspects[image] = inspect
+	}
+	return inspect, err
+}
+
+func (c *captureImages) pull(image string, trust imageTrust) (time.Duration, error) {
+	return c.source.pull(image, trust)
+}
+
+// bundleAdd adds a file to a bundle, without a timestamp so that the same
+// build always gives the same bundle
+func bundleAdd(tw *tar.Writer, name string, contents []byte) error {
+	hdr := &tar.Header{
+		Name: name,
+		Mode: 0644,
+		Size: int64(len(contents)),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(contents)
+	return err
+}
+
+// writeBundle writes a captured build to a file
+func writeBundle(filename string, b *buildBundle) error {
+	log.Debugf("bundle: %s", filename)
+	config, err := yaml.Marshal(b.config)
+	if err != nil {
+		return err
+	}
+	options, err := json.MarshalIndent(b.options, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	names := []string{}
+	for image := range b.exports {
+		names = append(names, image)
+	}
+	for image := range b.inspects {
+		if _, ok := b.exports[image]; !ok {
+			names = append(names, image)
+		}
+	}
+	sort.Strings(names)
+	images := map[string]bundleImage{}
+	exports := []string{}
+	for i, image := range names {
+		bi := bundleImage{}
+		if _, ok := b.exports[image]; ok {
+			bi.Export = fmt.Sprintf("images/%d.tar", i)
+			exports = append(exports, image)
+		}
+		if inspect, ok := b.inspects[image]; ok {
+			bi.Inspect = &inspect
+		}
+		images[image] = bi
+	}
+	index, err := json.MarshalIndent(images, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	err = bundleAdd(tw, bundleConfig, config)
+	if err == nil {
+		err = bundleAdd(tw, bundleOptions, options)
+	}
+	if err == nil {
+		err = bundleAdd(tw, bundleImages, index)
+	}
+	for _, image := range exports {
+		if err == nil {
+			err = bundleAdd(tw, images[image].Export, b.exports[image])
+		}
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, buf.Bytes(), 0644)
+}
+
+// readBundle reads a bundle written by writeBundle
+func readBundle(filename string) (*buildBundle, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries := map[string][]byte{}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid bundle %s: %v", filename, err)
+		}
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid bundle %s: %v", filename, err)
+		}
+		entries[hdr.Name] = contents
+	}
+	for _, name := range []string{bundleConfig, bundleOptions, bundleImages} {
+		if _, ok := entries[name]; !ok {
+			return nil, fmt.Errorf("Invalid bundle %s: it has no %s", filename, name)
+		}
+	}
+
+	b := &buildBundle{
+		exports:  map[string][]byte{},
+		inspects: map[string]types.ImageInspect{},
+	}
+	if err := yaml.Unmarshal(entries[bundleConfig], &b.config); err != nil {
+		return nil, fmt.Errorf("Invalid bundle %s: %v", filename, err)
+	}
+	if err := json.Unmarshal(entries[bundleOptions], &b.options); err != nil {
+		return nil, fmt.Errorf("Invalid bundle %s: %v", filename, err)
+	}
+	images := map[string]bundleImage{}
+	if err := json.Unmarshal(entries[bundleImages], &images); err != nil {
+		return nil, fmt.Errorf("Invalid bundle %s: %v", filename, err)
+	}
+	for image, bi := range images {
+		if bi.Export != "" {
+			contents, ok := entries[bi.Export]
+			if !ok {
+				return nil, fmt.Errorf("Invalid bundle %s: the export %s of %s is missing", filename, bi.Export, image)
+			}
+			b.exports[image] = contents
+		}
+		if bi.Inspect != nil {
+			b.inspects[image] = *bi.Inspect
+		}
+	}
+	return b, nil
+}
+
+// replay rebuilds the config captured in a bundle with its images and
+// options, writing the outputs to dir
+func (c *buildCommand) replay(filename, dir string) error {
+	b, err := readBundle(filename)
+	if err != nil {
+		return err
+	}
+	log.Infof("Replay bundle: %s", filename)
+	o := b.options
+	c.name = o.Name
+	c.size = o.Size
+	c.compressLevel = o.CompressLevel
+	c.opts.reproducible = o.Reproducible
+	c.opts.applyWhiteouts = o.ApplyWhiteouts
+	c.opts.normalizeTar = o.NormalizeTar
+	c.opts.strict = o.Strict
+	c.opts.maxLayers = o.MaxLayers
+	c.opts.maxFiles = o.MaxFiles
+	c.opts.embedLabels = o.EmbedLabels
+	c.osRelease = o.OSRelease
+	c.opts.forceOSRelease = o.ForceOSRelease
+	c.fatSplit = o.FATSplit
+	c.manifestFormat = o.ManifestFormat
+	c.outputPrefix = o.OutputPrefix
+	c.opts.cmdlineLimit = o.CmdlineLimit
+	c.hyperkit = o.Hyperkit
+	c.opts.signPath = o.SignPath
+	// the key is not in the bundle, only which key signed the captured build
+	if signKeyDigest(c.opts.signKey) != o.SignKey {
+		if o.SignKey == "" {
+			return fmt.Errorf("The captured build was not signed, replay it without -sign-key")
+		}
+		return fmt.Errorf("The captured build was signed with the key with digest %s, use the same -sign-key to replay it", o.SignKey)
+	}
+	c.efiStub, err = o.EFIStub.check("EFI stub")
+	if err != nil {
+		return err
+	}
+	c.deltaAgainst, err = o.DeltaAgainst.check("delta base")
+	if err != nil {
+		return err
+	}
+
+	// the config was read from the bundle, as it was captured
+	config, err := yaml.Marshal(b.config)
+	if err != nil {
+		return err
+	}
+	src := configSource{config: config, name: o.Name, uri: filename}
+
+	// the secrets are not in the bundle
+	err = resolveSecrets(&b.config, c.secretsDir)
+	if err != nil {
+		return err
+	}
+
+	source := Images
+	Images = b
+	defer func() { Images = source }()
+	return c.buildConfig(o.Name, dir, src, b.config, outputList(o.Outputs))
+}
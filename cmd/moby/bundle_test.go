@@ -0,0 +1,322 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/agl/ed25519"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// fakeImages is an image source of fixed images, which records the images used
+type fakeImages struct {
+	exports  map[string][]byte
+	inspects map[string]types.ImageInspect
+	used     []string
+}
+
+func (f *fakeImages) export(image string, trust imageTrust, pull bool) ([]byte, time.Duration, error) {
+	f.used = append(f.used, image)
+	contents, ok := f.exports[image]
+	if !ok {
+		return nil, 0, errors.New("No such image: " + image)
+	}
+	return contents, 0, nil
+}
+
+func (f *fakeImages) inspect(image string) (types.ImageInspect, error) {
+	f.used = append(f.used, image)
+	inspect, ok := f.inspects[image]
+	if !ok {
+		return types.ImageInspect{}, errors.New("No such image: " + image)
+	}
+	return inspect, nil
+}
+
+func (f *fakeImages) pull(image string, trust imageTrust) (time.Duration, error) {
+	f.used = append(f.used, image)
+	return 0, nil
+}
+
+func TestCaptureReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "motd")
+	if err := ioutil.WriteFile(source, []byte("captured"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, "test.yml")
+	config := `
+kernel:
+  image: linuxkit/kernel:4.9.x
+  cmdline: console=ttyS0
+init:
+  - linuxkit/init:v1
+onboot:
+  - name: sysctl
+    image: linuxkit/sysctl:v1
+services:
+  - name: getty
+    image: linuxkit/getty:v1
+files:
+  - path: etc/motd
+    source: ` + source + `
+trust:
+  image:
+    - linuxkit/kernel
+    - linuxkit/getty
+`
+	if err := ioutil.WriteFile(conf, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rootfs := func(name string) []byte {
+		return makeTar(t, []tarEntry{
+			{name: "bin", typeflag: tar.TypeDir},
+			{name: "bin/" + name, typeflag: tar.TypeReg, contents: name},
+		}).Bytes()
+	}
+	images := &fakeImages{
+		exports: map[string][]byte{
+			"linuxkit/kernel:4.9.x": kernelImageTar(t).Bytes(),
+			"linuxkit/init:v1":      rootfs("init"),
+			"linuxkit/sysctl:v1":    rootfs("sysctl"),
+			"linuxkit/getty:v1":     rootfs("getty"),
+		},
+		inspects: map[string]types.ImageInspect{
+			"linuxkit/kernel:4.9.x": {Os: "linux"},
+			"linuxkit/init:v1":      {Os: "linux"},
+			"linuxkit/sysctl:v1":    {Os: "linux", Config: &container.Config{Cmd: []string{"/bin/sysctl"}}},
+			"linuxkit/getty:v1":     {Os: "linux", Config: &container.Config{Cmd: []string{"/bin/getty"}, Labels: map[string]string{"maintainer": "linuxkit"}}},
+		},
+	}
+	defer func(source imageSource) { Images = source }(Images)
+	Images = images
+
+	captured := filepath.Join(dir, "captured")
+	replayed := filepath.Join(dir, "replayed")
+	for _, d := range []string{captured, replayed} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bundle := filepath.Join(dir, "bundle.tar")
+	c := &buildCommand{
+		out:           outputList{"tar", "kernel+initrd"},
+		capture:       bundle,
+		compressLevel: defaultCompressLevel,
+		opts:          buildOpts{reproducible: true, embedLabels: true},
+	}
+	if err := c.run(conf, captured); err != nil {
+		t.Fatal(err)
+	}
+	if Images != images {
+		t.Error("Expected the image source to be restored after the capture")
+	}
+
+	// the replay needs neither the images nor the file source, and does not
+	// pull even with -pull or trust for the kernel
+	images.used = nil
+	images.exports, images.inspects = nil, nil
+	if err := os.Remove(source); err != nil {
+		t.Fatal(err)
+	}
+	r := &buildCommand{opts: buildOpts{pull: true}}
+	if err := r.replay(bundle, replayed); err != nil {
+		t.Fatal(err)
+	}
+	if len(images.used) != 0 {
+		t.Errorf("Expected the replay not to use the image source, used %v", images.used)
+	}
+
+	for _, name := range []string{"test.tar", "test-kernel", "test-initrd.img", "test-cmdline"} {
+		want, err := ioutil.ReadFile(filepath.Join(captured, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadFile(filepath.Join(replayed, name))
+		if err != nil {
+			t.Fatalf("Expected the replay to write %s: %v", name, err)
+		}
+		if !bytes.Equal(want, got) {
+			t.Errorf("Expected the replayed %s to be identical to the captured build", name)
+		}
+	}
+	image, err := ioutil.ReadFile(filepath.Join(replayed, "test.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, contents := readTar(t, bytes.NewBuffer(image))
+	if contents["etc/motd"] != "captured" || contents["containers/services/getty/rootfs/bin/getty"] != "getty" {
+		t.Error("Expected the replayed image to have the captured files and images")
+	}
+	if !strings.Contains(contents[imageLabelsPath], `"maintainer": "linuxkit"`) {
+		t.Errorf("Expected the captured labels in the replayed image, got %s", contents[imageLabelsPath])
+	}
+
+	// a bundle missing an image cannot be replayed
+	b, err := readBundle(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(b.exports, "linuxkit/sysctl:v1")
+	if err := writeBundle(bundle, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.replay(bundle, replayed); err == nil || !strings.Contains(err.Error(), "linuxkit/sysctl:v1 is not in the replayed bundle") {
+		t.Errorf("Expected an error for an image missing from the bundle, got %v", err)
+	}
+	if err := ioutil.WriteFile(bundle, []byte("not a bundle"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.replay(bundle, replayed); err == nil {
+		t.Error("Expected an error replaying an invalid bundle")
+	}
+}
+
+func TestCaptureSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secrets := filepath.Join(dir, "secrets")
+	if err := os.Mkdir(secrets, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(secrets, "token"), []byte("hunter2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, "test.yml")
+	if err := ioutil.WriteFile(conf, []byte("files:\n  - path: etc/token\n    secret: token\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(source imageSource) { Images = source }(Images)
+	Images = &fakeImages{}
+
+	bundle := filepath.Join(dir, "bundle.tar")
+	c := &buildCommand{
+		out:           outputList{"tar"},
+		capture:       bundle,
+		secretsDir:    secrets,
+		compressLevel: defaultCompressLevel,
+		opts:          buildOpts{reproducible: true},
+	}
+	if err := c.run(conf, dir); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadFile(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("hunter2")) || bytes.Contains(raw, []byte(secrets)) {
+		t.Error("Expected the secret not to be captured in the bundle")
+	}
+	b, err := readBundle(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.config.Files) != 1 || b.config.Files[0].Secret != "token" || b.config.Files[0].Source != "" {
+		t.Errorf("Expected the bundle to keep the secret by name, got %+v", b.config.Files)
+	}
+
+	replayed := filepath.Join(dir, "replayed")
+	if err := os.Mkdir(replayed, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&buildCommand{}).replay(bundle, replayed); err == nil || !strings.Contains(err.Error(), "use -secrets-dir") {
+		t.Errorf("Expected a replay without -secrets-dir to be an error, got %v", err)
+	}
+	if err := (&buildCommand{secretsDir: secrets}).replay(bundle, replayed); err != nil {
+		t.Fatal(err)
+	}
+	image, err := ioutil.ReadFile(filepath.Join(replayed, "test.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, contents := readTar(t, bytes.NewBuffer(image)); contents["etc/token"] != "hunter2" {
+		t.Errorf("Expected the replay to add the secret from -secrets-dir, got %q", contents["etc/token"])
+	}
+}
+
+func TestReplayOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := filepath.Join(dir, "test.yml")
+	if err := ioutil.WriteFile(conf, []byte("files:\n  - path: etc/motd\n    contents: replayed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	prev := filepath.Join(dir, "prev.tar")
+	if err := ioutil.WriteFile(prev, makeTar(t, []tarEntry{{name: "etc/issue", typeflag: tar.TypeReg, contents: "old"}}).Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(source imageSource) { Images = source }(Images)
+	Images = &fakeImages{}
+
+	captured := filepath.Join(dir, "captured")
+	replayed := filepath.Join(dir, "replayed")
+	for _, d := range []string{captured, replayed} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bundle := filepath.Join(dir, "bundle.tar")
+	c := &buildCommand{
+		out:            outputList{"tar", "manifest"},
+		outputPrefix:   "v1-",
+		manifestFormat: manifestCSV,
+		deltaAgainst:   prev,
+		capture:        bundle,
+		compressLevel:  defaultCompressLevel,
+		opts:           buildOpts{reproducible: true, cmdlineLimit: 100},
+	}
+	if err := c.run(conf, captured); err != nil {
+		t.Fatal(err)
+	}
+
+	// the replay takes the options from the bundle, not the command line
+	if err := (&buildCommand{manifestFormat: manifestJSON}).replay(bundle, replayed); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"v1-test.tar", "v1-test-manifest.csv", "v1-test-delta.tar"} {
+		want, err := ioutil.ReadFile(filepath.Join(captured, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadFile(filepath.Join(replayed, name))
+		if err != nil {
+			t.Fatalf("Expected the replay to write %s: %v", name, err)
+		}
+		if !bytes.Equal(want, got) {
+			t.Errorf("Expected the replayed %s to be identical to the captured build", name)
+		}
+	}
+
+	// a file the build read that has changed cannot be replayed
+	if err := ioutil.WriteFile(prev, makeTar(t, []tarEntry{{name: "etc/issue", typeflag: tar.TypeReg, contents: "new"}}).Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&buildCommand{}).replay(bundle, replayed); err == nil || !strings.Contains(err.Error(), "has changed since the build was captured") {
+		t.Errorf("Expected a changed delta base to be an error, got %v", err)
+	}
+
+	// nor can an unsigned build be replayed signed
+	key := new([ed25519.PrivateKeySize]byte)
+	if err := (&buildCommand{opts: buildOpts{signKey: key}}).replay(bundle, replayed); err == nil || !strings.Contains(err.Error(), "was not signed") {
+		t.Errorf("Expected a replay with another signing key to be an error, got %v", err)
+	}
+}
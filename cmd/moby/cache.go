@@ -0,0 +1,270 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The cache is the LinuxKit images in the linuxkit directory of MobyDir,
+// built to create some outputs, which builds rebuild when they are removed.
+// The trust data in MobyDir is not a cache and is never removed.
+
+// cacheLockName is the file in the cache locked by builds using it, shared,
+// and by a clean, exclusive
+const cacheLockName = ".lock"
+
+// cacheSuffixes are the files of a LinuxKit image in the cache
+var cacheSuffixes = []string{"-kernel", "-initrd.img", "-cmdline"}
+
+// cacheDir is the directory of the cache
+func cacheDir() string {
+	return filepath.Join(MobyDir, "linuxkit")
+}
+
+// cacheEntry is an image in the cache
+type cacheEntry struct {
+	name  string
+	files []string
+	size  int64
+	// used is when the image was last built or used by a build
+	used time.Time
+}
+
+// lockCache locks the cache in dir, returning the function that unlocks it
+func lockCache(dir string, exclusive bool) (func(), error) {
+	f, err := openCacheLock(dir, exclusive)
+	if err != nil {
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
+
+// openCacheLock opens the lock file of the cache in dir and locks it, the
+// lock is held until the file is closed
+func openCacheLock(dir string, exclusive bool) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, cacheLockName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f, exclusive); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Cannot lock the cache %s: %v", dir, err)
+	}
+	return f, nil
+}
+
+// cacheHeld is the lock file of the cache once a build holds a shared lock
+// of it, which it keeps until it exits as the outputs use the images in the
+// cache. It is kept here so the file is never closed by its finalizer.
+var cacheHeld *os.File
+
+// holdCache takes a shared lock of the cache for the rest of the process
+func holdCache(dir string) error {
+	if cacheHeld != nil {
+		return nil
+	}
+	f, err := openCacheLock(dir, false)
+	if err != nil {
+		return err
+	}
+	cacheHeld = f
+	return nil
+}
+
+// listCache returns the images in the cache in dir in order of name, files
+// that are not part of an image are ignored
+func listCache(dir string) ([]cacheEntry, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := map[string]*cacheEntry{}
+	for _, fi := range infos {
+		if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		for _, suffix := range cacheSuffixes {
+			if !strings.HasSuffix(fi.Name(), suffix) {
+				continue
+			}
+			name := strings.TrimSuffix(fi.Name(), suffix)
+			e, ok := entries[name]
+			if !ok {
+				e = &cacheEntry{name: name}
+				entries[name] = e
+			}
+			e.files = append(e.files, filepath.Join(dir, fi.Name()))
+			e.size += fi.Size()
+			if fi.ModTime().After(e.used) {
+				e.used = fi.ModTime()
+			}
+		}
+	}
+	list := []cacheEntry{}
+	for _, e := range entries {
+		list = append(list, *e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list, nil
+}
+
+// touchCache marks the files of an image as used now, so a clean by size
+// removes the images used least recently first
+func touchCache(files ...string) error {
+	now := time.Now()
+	for _, f := range files {
+		if err := os.Chtimes(f, now, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneCache returns the images to remove, those used more than maxAge ago
+// and then the least recently used until the rest are at most maxSize bytes.
+// A maxAge or maxSize of 0 is no limit, a negative maxSize removes them all.
+func pruneCache(entries []cacheEntry, maxAge time.Duration, maxSize int64, now time.Time) []cacheEntry {
+	byUse := append([]cacheEntry{}, entries...)
+	sort.SliceStable(byUse, func(i, j int) bool { return byUse[i].used.Before(byUse[j].used) })
+	total := int64(0)
+	for _, e := range byUse {
+		total += e.size
+	}
+	prune := []cacheEntry{}
+	for _, e := range byUse {
+		old := maxAge != 0 && now.Sub(e.used) > maxAge
+		large := maxSize != 0 && total > maxSize
+		if !old && !large {
+			continue
+		}
+		prune = append(prune, e)
+		total -= e.size
+	}
+	return prune
+}
+
+// formatCacheSize gives a size in MB, the unit of -max-size
+func formatCacheSize(n int64) string {
+	return fmt.Sprintf("%.1fM", float64(n)/(1024*1024))
+}
+
+// writeCacheList writes the images in the cache as text columns
+func writeCacheList(w io.Writer, entries []cacheEntry, now time.Time) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSIZE\tLAST USED")
+	total := int64(0)
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%s\t%s\t%s ago\n", e.name, formatCacheSize(e.size), formatImageAge(now.Sub(e.used)))
+		total += e.size
+	}
+	fmt.Fprintf(tw, "%d images\t%s\n", len(entries), formatCacheSize(total))
+	return tw.Flush()
+}
+
+// cleanCache removes images from the cache in dir by age and total size,
+// waiting for the builds using the cache to finish
+func cleanCache(dir string, maxAge time.Duration, maxSize int64, now time.Time) ([]cacheEntry, error) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil, nil
+	}
+	unlock, err := lockCache(dir, true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	entries, err := listCache(dir)
+	if err != nil {
+		return nil, err
+	}
+	prune := pruneCache(entries, maxAge, maxSize, now)
+	for _, e := range prune {
+		for _, f := range e.files {
+			if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+	}
+	return prune, nil
+}
+
+// Process the cache arguments and list or clean the cache
+func cache(args []string) {
+	usage := func() {
+		fmt.Printf("USAGE: %s cache ls | clean [options]\n\n", os.Args[0])
+		fmt.Printf("List or remove the LinuxKit images cached in %s to create some outputs\n", cacheDir())
+	}
+	if len(args) < 1 {
+		usage()
+		os.Exit(1)
+	}
+	switch args[0] {
+	case "ls":
+		lsCmd := flag.NewFlagSet("cache ls", flag.ExitOnError)
+		if err := lsCmd.Parse(args[1:]); err != nil {
+			log.Fatal("Unable to parse args")
+		}
+		entries, err := listCache(cacheDir())
+		if err != nil {
+			log.Fatalf("Cannot list the cache: %v", err)
+		}
+		if err := writeCacheList(os.Stdout, entries, time.Now()); err != nil {
+			log.Fatal(err)
+		}
+	case "clean":
+		cleanCmd := flag.NewFlagSet("cache clean", flag.ExitOnError)
+		cleanCmd.Usage = func() {
+			usage()
+			fmt.Printf("\nOptions:\n")
+			cleanCmd.PrintDefaults()
+		}
+		cleanMaxAge := cleanCmd.String("max-age", "", "Remove the images last used longer ago than this, such as 30d or 2w")
+		cleanMaxSize := cleanCmd.String("max-size", "", "Remove the images used least recently until the cache is at most this size, such as 500M or 2G")
+		if err := cleanCmd.Parse(args[1:]); err != nil {
+			log.Fatal("Unable to parse args")
+		}
+		var maxAge time.Duration
+		var err error
+		if *cleanMaxAge != "" {
+			maxAge, err = parseAge(*cleanMaxAge)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		maxSize, err := getDiskSizeMB(*cleanMaxSize)
+		if err != nil || maxSize < 0 {
+			log.Fatalf("Invalid -max-size %s, expected a size such as 500M or 2G", *cleanMaxSize)
+		}
+		limit := int64(maxSize) * 1024 * 1024
+		if *cleanMaxSize == "" && *cleanMaxAge == "" {
+			log.Infof("Removing all the cached images, give -max-age or -max-size to keep some")
+			limit = -1
+		}
+		removed, err := cleanCache(cacheDir(), maxAge, limit, time.Now())
+		if err != nil {
+			log.Fatalf("Cannot clean the cache: %v", err)
+		}
+		freed := int64(0)
+		for _, e := range removed {
+			log.Infof("  Removed %s", e.name)
+			freed += e.size
+		}
+		log.Infof("Removed %d images, %s", len(removed), formatCacheSize(freed))
+	default:
+		fmt.Printf("%q is not a valid cache command.\n\n", args[0])
+		usage()
+		os.Exit(1)
+	}
+}
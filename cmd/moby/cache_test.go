@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now().Truncate(time.Second)
+	for name, age := range map[string]time.Duration{"new": time.Hour, "old": 40 * 24 * time.Hour, "middle": 10 * 24 * time.Hour} {
+		for _, suffix := range cacheSuffixes {
+			f := filepath.Join(dir, name+suffix)
+			if err := ioutil.WriteFile(f, make([]byte, 1024*1024), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(f, now.Add(-age), now.Add(-age)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, f := range []string{cacheLockName, ".new-kernel123", "notes.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := listCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.name)
+		if len(e.files) != 3 || e.size != 3*1024*1024 {
+			t.Errorf("Expected %s to have 3 files of 3M, got %d of %d", e.name, len(e.files), e.size)
+		}
+	}
+	if strings.Join(names, " ") != "middle new old" {
+		t.Fatalf("Expected the images middle, new and old, got %v", names)
+	}
+	var list bytes.Buffer
+	if err := writeCacheList(&list, entries, now); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(list.String(), "old       3.0M  40 days ago") || !strings.Contains(list.String(), "3 images  9.0M") {
+		t.Errorf("Expected the list to show the sizes and ages, got\n%s", list.String())
+	}
+
+	for _, c := range []struct {
+		maxAge  time.Duration
+		maxSize int64
+		pruned  string
+	}{
+		{0, 0, ""},
+		{30 * 24 * time.Hour, 0, "old"},
+		{time.Minute, 0, "old middle new"},
+		{0, 9 * 1024 * 1024, ""},
+		{0, 7 * 1024 * 1024, "old"},
+		{0, 4 * 1024 * 1024, "old middle"},
+		{30 * 24 * time.Hour, 6 * 1024 * 1024, "old"},
+		{0, -1, "old middle new"},
+	} {
+		pruned := []string{}
+		for _, e := range pruneCache(entries, c.maxAge, c.maxSize, now) {
+			pruned = append(pruned, e.name)
+		}
+		if strings.Join(pruned, " ") != c.pruned {
+			t.Errorf("Expected a max age of %s and max size of %d to prune %q, got %v", c.maxAge, c.maxSize, c.pruned, pruned)
+		}
+	}
+
+	removed, err := cleanCache(dir, 0, 4*1024*1024, now)
+	if err != nil || len(removed) != 2 {
+		t.Fatalf("Expected to remove 2 images, got %d %v", len(removed), err)
+	}
+	entries, err = listCache(dir)
+	if err != nil || len(entries) != 1 || entries[0].name != "new" {
+		t.Errorf("Expected only the new image to be left, got %v %v", entries, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Errorf("Expected files that are not images to be kept, got %v", err)
+	}
+	if removed, err := cleanCache(filepath.Join(dir, "missing"), 0, -1, now); err != nil || len(removed) != 0 {
+		t.Errorf("Expected a missing cache to be clean, got %v %v", removed, err)
+	}
+}
+
+func TestCacheLock(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The cache is not locked on Windows")
+	}
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	unlockBuild, err := lockCache(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlockOther, err := lockCache(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlockOther()
+	cleaned := make(chan struct{})
+	go func() {
+		unlock, err := lockCache(dir, true)
+		defer close(cleaned)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		unlock()
+	}()
+	select {
+	case <-cleaned:
+		t.Fatal("Expected a clean to wait for the builds using the cache")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlockBuild()
+	select {
+	case <-cleaned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a clean to lock the cache once the builds finish")
+	}
+}
+
+func TestHoldCache(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The cache is not locked on Windows")
+	}
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(held *os.File) { cacheHeld = held }(cacheHeld)
+	cacheHeld = nil
+
+	if err := holdCache(dir); err != nil {
+		t.Fatal(err)
+	}
+	held := cacheHeld
+	if err := holdCache(dir); err != nil || cacheHeld != held {
+		t.Fatalf("Expected a build to hold the cache once, got %v", err)
+	}
+	// the lock outlives collections, which would close an unreachable file
+	for i := 0; i < 3; i++ {
+		runtime.GC()
+	}
+	cleaned := make(chan struct{})
+	go func() {
+		defer close(cleaned)
+		unlock, err := lockCache(dir, true)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		unlock()
+	}()
+	select {
+	case <-cleaned:
+		t.Fatal("Expected a clean to wait for the build holding the cache")
+	case <-time.After(100 * time.Millisecond):
+	}
+	held.Close()
+	select {
+	case <-cleaned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a clean to lock the cache once the build exits")
+	}
+}
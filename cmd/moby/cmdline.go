@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// cmdlineTokens are the build tokens that can be used in a kernel cmdline as
+// {token}, each is only looked up if it is used
+type cmdlineTokens map[string]func() (string, error)
+
+// buildTokens returns the tokens for building a config from src to outputs
+// called name, {gitsha} is the commit of the repository the config is in
+func buildTokens(name string, src configSource) cmdlineTokens {
+	return cmdlineTokens{
+		"name": func() (string, error) { return name, nil },
+		"gitsha": func() (string, error) {
+			dir := src.root
+			if dir == "" && src.path != "" {
+				dir = filepath.Dir(src.path)
+			}
+			if dir == "" {
+				return "", errors.New("the config is not from a git repository")
+			}
+			return gitCommit(dir)
+		},
+	}
+}
+
+func isNameChar(c byte, first bool) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || !first && '0' <= c && c <= '9'
+}
+
+// varName returns the name of the variable referenced after a $ at the start
+// of s and the length of the reference, which is 0 if it is not valid
+func varName(s string) (string, int) {
+	if strings.HasPrefix(s, "{") {
+		end := strings.IndexByte(s, '}')
+		if end == -1 {
+			return "", 0
+		}
+		name, n := varName(s[1:end])
+		if n == 0 || n != end-1 {
+			return "", 0
+		}
+		return name, end + 1
+	}
+	n := 0
+	for n < len(s) && isNameChar(s[n], n == 0) {
+		n++
+	}
+	return s[:n], n
+}
+
+// expandCmdline expands the $VAR and ${VAR} references to variables in a
+// kernel cmdline using lookup, and the {token} build tokens. $$ is a literal $,
+// and braces that do not name a token are left as they are.
+func expandCmdline(cmdline string, lookup func(string) (string, bool), tokens cmdlineTokens) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(cmdline); i++ {
+		switch cmdline[i] {
+		case '$':
+			if strings.HasPrefix(cmdline[i+1:], "$") {
+				b.WriteByte('$')
+				i++
+				continue
+			}
+			name, n := varName(cmdline[i+1:])
+			if n == 0 {
+				return "", fmt.Errorf("Invalid variable reference in cmdline at %q, use $$ for a literal $", cmdline[i:])
+			}
+			value, ok := lookup(name)
+			if !ok {
+				return "", fmt.Errorf("Cmdline references %s, which is not set", name)
+			}
+			b.WriteString(value)
+			i += n
+		case '{':
+			end := strings.IndexByte(cmdline[i:], '}')
+			if end == -1 {
+				b.WriteByte('{')
+				continue
+			}
+			token, ok := tokens[cmdline[i+1:i+end]]
+			if !ok {
+				b.WriteByte('{')
+				continue
+			}
+			value, err := token()
+			if err != nil {
+				return "", fmt.Errorf("Cannot expand %s in cmdline: %v", cmdline[i:i+end+1], err)
+			}
+			b.WriteString(value)
+			i += end
+		default:
+			b.WriteByte(cmdline[i])
+		}
+	}
+	return b.String(), nil
+}
+
+// readEnvFile reads the variables from a file of KEY=VALUE lines. Blank lines
+// and lines starting with # are ignored, as is an export before the key.
+// Values can be quoted, with \" and \\ escapes in double quotes and nothing
+// escaped in single quotes, and an unquoted value ends at a # after a space.
+func readEnvFile(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read env file: %v", err)
+	}
+	defer f.Close()
+	env := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, err := envLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid env file %s line %d: %v", filename, n, err)
+		}
+		env[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Cannot read env file: %v", err)
+	}
+	return env, nil
+}
+
+// envLine parses a KEY=VALUE line of an env file
+func envLine(line string) (string, string, error) {
+	line = strings.TrimPrefix(line, "export ")
+	i := strings.IndexByte(line, '=')
+	if i == -1 {
+		return "", "", errors.New("expected KEY=VALUE")
+	}
+	key := strings.TrimSpace(line[:i])
+	if name, n := varName(key); n == 0 || name != key {
+		return "", "", fmt.Errorf("invalid variable name %q", key)
+	}
+	value := strings.TrimSpace(line[i+1:])
+	if value == "" || (value[0] != '"' && value[0] != '\'') {
+		if j := strings.Index(value, " #"); j != -1 {
+			value = strings.TrimSpace(value[:j])
+		}
+		return key, value, nil
+	}
+
+	quote := value[0]
+	var b strings.Builder
+	for j := 1; j < len(value); j++ {
+		c := value[j]
+		switch {
+		case c == quote:
+			rest := strings.TrimSpace(value[j+1:])
+			if rest != "" && !strings.HasPrefix(rest, "#") {
+				return "", "", fmt.Errorf("unexpected %q after the quoted value of %s", rest, key)
+			}
+			return key, b.String(), nil
+		case c == '\\' && quote == '"' && j+1 < len(value) && (value[j+1] == '"' || value[j+1] == '\\'):
+			j++
+			b.WriteByte(value[j])
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", "", fmt.Errorf("unterminated quote in the value of %s", key)
+}
+
+// envLookup looks up variables in the process environment, then in env, so
+// the environment overrides an env file
+func envLookup(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		if value, ok := os.LookupEnv(name); ok {
+			return value, true
+		}
+		value, ok := env[name]
+		return value, ok
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpandCmdline(t *testing.T) {
+	env := map[string]string{"BUILD_ID": "42", "CONSOLE": "ttyS0", "EMPTY": ""}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+	tokens := cmdlineTokens{
+		"gitsha": func() (string, error) { return "0123abcd", nil },
+		"broken": func() (string, error) { return "", errors.New("not available") },
+	}
+	for cmdline, expected := range map[string]string{
+		"":                                      "",
+		"console=ttyS0":                         "console=ttyS0",
+		"moby.build=${BUILD_ID}":                "moby.build=42",
+		"console=$CONSOLE moby.build=$BUILD_ID": "console=ttyS0 moby.build=42",
+		"a=${EMPTY}b":                           "a=b",
+		"moby.commit={gitsha}":                  "moby.commit=0123abcd",
+		"moby.id=${BUILD_ID}-{gitsha}":          "moby.id=42-0123abcd",
+		"price=$$5 $${BUILD_ID}":                "price=$5 ${BUILD_ID}",
+		"keep={unknown} {gitsha":                "keep={unknown} {gitsha",
+		"{{gitsha}}":                            "{0123abcd}",
+	} {
+		out, err := expandCmdline(cmdline, lookup, tokens)
+		if err != nil {
+			t.Errorf("Unexpected error expanding %q: %v", cmdline, err)
+			continue
+		}
+		if out != expected {
+			t.Errorf("Expected %q to expand to %q, got %q", cmdline, expected, out)
+		}
+	}
+
+	for cmdline, message := range map[string]string{
+		"moby.build=${UNSET}": "UNSET, which is not set",
+		"moby.build=$UNSET":   "UNSET, which is not set",
+		"trailing=$":          "use $$ for a literal $",
+		"bad=${BUILD_ID":      "use $$ for a literal $",
+		"bad=${}":             "use $$ for a literal $",
+		"bad=${1X}":           "use $$ for a literal $",
+		"bad=x{broken}":       "Cannot expand {broken} in cmdline: not available",
+	} {
+		if _, err := expandCmdline(cmdline, lookup, tokens); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("Expected an error containing %q expanding %q, got %v", message, cmdline, err)
+		}
+	}
+}
+
+func TestBuildTokens(t *testing.T) {
+	src := configSource{name: "test"}
+	tokens := buildTokens("out", src)
+	if name, err := tokens["name"](); err != nil || name != "out" {
+		t.Errorf("Expected {name} to be the output name, got %q %v", name, err)
+	}
+	if _, err := tokens["gitsha"](); err == nil {
+		t.Error("Expected an error for {gitsha} with a config from stdin")
+	}
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	run := func(args ...string) string {
+		args = append([]string{"-c", "user.name=moby", "-c", "user.email=moby@example.com"}, args...)
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("git %v: %v", args, err)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	conf := filepath.Join(dir, "test.yml")
+	if err := ioutil.WriteFile(conf, []byte("kernel:\n  cmdline: moby.commit={gitsha}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	run("init", "-q")
+	run("add", ".")
+	run("commit", "-q", "-m", "test")
+	sha := run("rev-parse", "HEAD")
+
+	src, err = readConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewConfig(src.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmdline, err := expandCmdline(m.Kernel.Cmdline, os.LookupEnv, buildTokens(src.name, src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmdline != "moby.commit="+sha {
+		t.Errorf("Expected the commit of the config in the cmdline, got %q", cmdline)
+	}
+}
+
+func TestReadEnvFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	envFile := filepath.Join(dir, "build.env")
+	write := func(contents string) {
+		if err := ioutil.WriteFile(envFile, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`# build settings
+BUILD_ID=42
+export CONSOLE=ttyS0
+
+EMPTY=
+SPACED = value with spaces # a comment
+HASH=a#b
+DOUBLE="quoted \"value\" with \\ # not a comment"
+SINGLE='no \"escapes\" $here' # a comment
+`)
+	env, err := readEnvFile(envFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"BUILD_ID": "42",
+		"CONSOLE":  "ttyS0",
+		"EMPTY":    "",
+		"SPACED":   "value with spaces",
+		"HASH":     "a#b",
+		"DOUBLE":   `quoted "value" with \ # not a comment`,
+		"SINGLE":   `no \"escapes\" $here`,
+	}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("Expected env %q, got %q", expected, env)
+	}
+
+	// the process environment overrides the file
+	if err := os.Setenv("MOBY_TEST_BUILD_ID", "from-env"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("MOBY_TEST_BUILD_ID")
+	lookup := envLookup(map[string]string{"MOBY_TEST_BUILD_ID": "from-file", "MOBY_TEST_ONLY_FILE": "file"})
+	cmdline, err := expandCmdline("a=${MOBY_TEST_BUILD_ID} b=${MOBY_TEST_ONLY_FILE}", lookup, nil)
+	if err != nil || cmdline != "a=from-env b=file" {
+		t.Errorf("Expected the environment to override the env file, got %q %v", cmdline, err)
+	}
+	if _, ok := lookup("MOBY_TEST_UNSET"); ok {
+		t.Error("Expected a variable in neither the environment nor the file to be unset")
+	}
+
+	for contents, message := range map[string]string{
+		"BUILD_ID=42\nno equals\n":  "line 2: expected KEY=VALUE",
+		"=value\n":                  `line 1: invalid variable name ""`,
+		"1KEY=value\n":              `line 1: invalid variable name "1KEY"`,
+		"MY-KEY=value\n":            `line 1: invalid variable name "MY-KEY"`,
+		"KEY=\"unterminated\n":      "line 1: unterminated quote in the value of KEY",
+		"KEY='unterminated\n":       "line 1: unterminated quote in the value of KEY",
+		"KEY=\"quoted\" trailing\n": `line 1: unexpected "trailing" after the quoted value of KEY`,
+	} {
+		write(contents)
+		if _, err := readEnvFile(envFile); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("Expected an error containing %q reading %q, got %v", message, contents, err)
+		}
+	}
+	if _, err := readEnvFile(filepath.Join(dir, "missing.env")); err == nil {
+		t.Error("Expected an error reading a missing env file")
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"archive/tar"
 	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,8 +11,11 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/docker/api/types"
@@ -23,27 +27,150 @@ import (
 
 // Moby is the type of a Moby config file
 type Moby struct {
-	Kernel struct {
-		Image   string
-		Cmdline string
+	Version    int
+	Include    []string
+	Name       string
+	OutputDir  string `yaml:"outputDir"`
+	Kernel     KernelConfig
+	Init       []string
+	Onboot     []MobyImage
+	Services   []MobyImage
+	Trust      TrustConfig
+	Files      []File
+	Outputs    []string
+	OCIVersion string            `yaml:"ociVersion"`
+	UIDMap     map[string]string `yaml:"uidMap"`
+	GIDMap     map[string]string `yaml:"gidMap"`
+	Users      map[string]int    `yaml:"users"`
+	Groups     map[string]int    `yaml:"groups"`
+	CloudInit  *CloudInitConfig  `yaml:"cloudInit"`
+	Ignition   *IgnitionConfig   `yaml:"ignition"`
+}
+
+// File is the type of an entry in the files section of a config
+type File struct {
+	Path      string
+	Directory bool
+	Symlink   string
+	Contents  string
+	Source    string
+	Mtime     string
+	Sensitive bool
+	// Secret is the name of a file in the secrets directory with the
+	// contents, which is sensitive
+	Secret string
+	// Override marks a file that intentionally replaces a path in an image
+	Override bool
+	// Outputs limits the file to builds creating one of these outputs
+	Outputs []string
+}
+
+// redacted replaces the path of a sensitive file in logs and manifests
+const redacted = "[redacted]"
+
+// logPath is the path of a file as it may be shown in logs and manifests
+func (f File) logPath() string {
+	if f.Sensitive {
+		return redacted
 	}
-	Init     []string
-	Onboot   []MobyImage
-	Services []MobyImage
-	Trust    TrustConfig
-	Files    []struct {
-		Path      string
-		Directory bool
-		Symlink   string
-		Contents  string
-		Source    string
+	return f.Path
+}
+
+// sensitivePaths returns the paths of the sensitive files in a config
+func sensitivePaths(m Moby) map[string]bool {
+	paths := map[string]bool{}
+	for _, f := range m.Files {
+		if f.Sensitive {
+			paths[f.Path] = true
+		}
+	}
+	return paths
+}
+
+// resolveSecrets sets the source of each file with a secret to the secret in
+// dir, which must exist
+func resolveSecrets(m *Moby, dir string) error {
+	for i, f := range m.Files {
+		if f.Secret == "" {
+			continue
+		}
+		if dir == "" {
+			return fmt.Errorf("File %s uses secret %s, use -secrets-dir to give the directory of secrets", f.logPath(), f.Secret)
+		}
+		source := filepath.Join(dir, f.Secret)
+		fi, err := os.Stat(source)
+		if err != nil {
+			return fmt.Errorf("Secret %s of file %s is not in %s", f.Secret, f.logPath(), dir)
+		}
+		if !fi.Mode().IsRegular() {
+			return fmt.Errorf("Secret %s of file %s is not a regular file in %s", f.Secret, f.logPath(), dir)
+		}
+		m.Files[i].Source = source
 	}
+	return nil
+}
+
+// KernelConfig is the type of the kernel section of a config file
+type KernelConfig struct {
+	Image          string
+	Cmdline        string
+	CmdlineNewline bool `yaml:"cmdlineNewline"`
+	Variant        string
+	BootMode       string `yaml:"bootMode"`
+	BootFileMode   string `yaml:"bootFileMode"`
+	// Passthrough adds the kernel image as it is rather than in /boot, with
+	// the cmdline written to CmdlinePath
+	Passthrough bool
+	CmdlinePath string `yaml:"cmdlinePath"`
+	// NoCmdlineFile leaves /boot/cmdline out of the image for a cmdline
+	// given by the bootloader, the outputs that boot the kernel still use it
+	NoCmdlineFile bool `yaml:"noCmdlineFile"`
+	// Modules are the kernel modules loaded at boot, listed in modulesLoadPath
+	Modules []string
+	// Digest is the digest the kernel image must have once pulled
+	Digest string
+}
+
+// defaultCmdlinePath is where the cmdline is written in the image
+const defaultCmdlinePath = "boot/cmdline"
+
+// CloudInitConfig is the cloud-init NoCloud seed of the disk outputs
+type CloudInitConfig struct {
+	UserData string `yaml:"userData"`
+	// MetaData defaults to an instance-id derived from the user data
+	MetaData      string `yaml:"metaData"`
+	NetworkConfig string `yaml:"networkConfig"`
+}
+
+// IgnitionConfig is the Ignition config of the disk outputs, as JSON
+type IgnitionConfig struct {
+	Config string `yaml:"config"`
 }
 
 // TrustConfig is the type of a content trust config
 type TrustConfig struct {
 	Image []string
 	Org   []string
+	// DefaultOrg is the org of single names like nginx, defaultTrustOrg
+	// if it is not set
+	DefaultOrg string `yaml:"defaultOrg"`
+	// Registries are the policies of registries, each replaces the image
+	// and org lists for the images from its registry
+	Registries []RegistryTrust
+}
+
+// RegistryTrust is the content trust policy of the images from a registry
+type RegistryTrust struct {
+	Registry string
+	// Enforce verifies every image from the registry
+	Enforce bool
+	Image   []string
+	Org     []string
+	// RootKeys are the root key IDs pinned for each repository of the registry
+	RootKeys []string `yaml:"rootKeys"`
+	// Server is the URL of the notary server with the signatures of the
+	// images of the registry, which only docker.io has by default
+	Server string
 }
 
 // MobyImage is the type of an image config
@@ -51,7 +178,7 @@ type MobyImage struct {
 	Name              string             `yaml:"name" json:"name"`
 	Image             string             `yaml:"image" json:"image"`
 	Capabilities      *[]string          `yaml:"capabilities" json:"capabilities,omitempty"`
-	Mounts            *[]specs.Mount     `yaml:"mounts" json:"mounts,omitempty"`
+	Mounts            *[]Mount           `yaml:"mounts" json:"mounts,omitempty"`
 	Binds             *[]string          `yaml:"binds" json:"binds,omitempty"`
 	Tmpfs             *[]string          `yaml:"tmpfs" json:"tmpfs,omitempty"`
 	Command           *[]string          `yaml:"command" json:"command,omitempty"`
@@ -69,11 +196,69 @@ type MobyImage struct {
 	GID               *uint32            `yaml:"gid" json:"gid,omitempty"`
 	AdditionalGids    *[]uint32          `yaml:"additionalGids" json:"additionalGids,omitempty"`
 	NoNewPrivileges   *bool              `yaml:"noNewPrivileges" json:"noNewPrivileges,omitempty"`
+	Terminal          *bool              `yaml:"terminal" json:"terminal,omitempty"`
 	OOMScoreAdj       *int               `yaml:"oomScoreAdj" json:"oomScoreAdj,omitempty"`
 	DisableOOMKiller  *bool              `yaml:"disableOOMKiller" json:"disableOOMKiller,omitempty"`
 	RootfsPropagation *string            `yaml:"rootfsPropagation" json:"rootfsPropagation,omitempty"`
 	CgroupsPath       *string            `yaml:"cgroupsPath" json:"cgroupsPath,omitempty"`
 	Sysctl            *map[string]string `yaml:"sysctl" json:"sysctl,omitempty"`
+	Hooks             *specs.Hooks       `yaml:"hooks" json:"hooks,omitempty"`
+	RootfsPath        string             `yaml:"rootfsPath" json:"rootfsPath,omitempty"`
+	Profiles          []string           `yaml:"profiles" json:"profiles,omitempty"`
+	// After are the names of the onboot containers that must run before this one
+	After []string `yaml:"after" json:"after,omitempty"`
+	// Digest is the digest the image must have once pulled
+	Digest string `yaml:"digest" json:"digest,omitempty"`
+}
+
+// Mount is a mount of a container, an OCI mount with its propagation and
+// whether it is read only given apart from the other options
+type Mount struct {
+	specs.Mount `yaml:",inline"`
+	Propagation string `yaml:"propagation" json:"propagation,omitempty"`
+	Readonly    bool   `yaml:"readonly" json:"readonly,omitempty"`
+}
+
+// mountPropagations are the propagation options of a mount
+var mountPropagations = map[string]bool{
+	"private": true, "rprivate": true,
+	"shared": true, "rshared": true,
+	"slave": true, "rslave": true,
+	"unbindable": true, "runbindable": true,
+}
+
+// options returns the OCI options of a mount
+func (m Mount) options() []string {
+	opts := append([]string{}, m.Options...)
+	if m.Propagation != "" {
+		opts = append(opts, m.Propagation)
+	}
+	if m.Readonly {
+		opts = append(opts, "ro")
+	}
+	return opts
+}
+
+// validMounts checks the propagation of each mount is allowed, and that
+// the options do not also set the propagation or make it writable
+func validMounts(mounts *[]Mount) error {
+	if mounts == nil {
+		return nil
+	}
+	for _, m := range *mounts {
+		if m.Propagation != "" && !mountPropagations[m.Propagation] {
+			return fmt.Errorf("mount %s has invalid propagation %s", m.Destination, m.Propagation)
+		}
+		for _, opt := range m.Options {
+			if m.Propagation != "" && mountPropagations[opt] {
+				return fmt.Errorf("mount %s sets propagation %s and option %s", m.Destination, m.Propagation, opt)
+			}
+			if m.Readonly && opt == "rw" {
+				return fmt.Errorf("mount %s is readonly and has option rw", m.Destination)
+			}
+		}
+	}
+	return nil
 }
 
 // github.com/go-yaml/yaml treats map keys as interface{} while encoding/json
@@ -86,7 +271,8 @@ func convert(i interface{}) interface{} {
 	case map[interface{}]interface{}:
 		m2 := map[string]interface{}{}
 		for k, v := range x {
-			m2[k.(string)] = convert(v)
+			// keys such as numeric ids are not strings in yaml
+			m2[fmt.Sprint(k)] = convert(v)
 		}
 		return m2
 	case []interface{}:
@@ -97,6 +283,36 @@ func convert(i interface{}) interface{} {
 	return i
 }
 
+const (
+	// configVersion is the newest config schema version this tool
+	// understands, and the version of configs that do not set one
+	configVersion = 1
+	// minConfigVersion is the oldest config schema version still accepted
+	minConfigVersion = 1
+)
+
+// checkConfigVersion checks the version of a raw config before it is
+// validated, so that a config for a newer tool is reported as such rather
+// than as having unknown fields
+func checkConfigVersion(raw interface{}) error {
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	// other types are left for the schema to report
+	v, ok := m["version"].(int)
+	if !ok {
+		return nil
+	}
+	if v > configVersion {
+		return fmt.Errorf("Config version %d needs a newer version of this tool, which supports config versions %d to %d", v, minConfigVersion, configVersion)
+	}
+	if v < minConfigVersion {
+		return fmt.Errorf("Config version %d is no longer supported, this tool supports config versions %d to %d", v, minConfigVersion, configVersion)
+	}
+	return nil
+}
+
 // NewConfig parses a config file
 func NewConfig(config []byte) (Moby, error) {
 	m := Moby{}
@@ -111,6 +327,10 @@ func NewConfig(config []byte) (Moby, error) {
 	// Convert to raw JSON
 	rawJSON := convert(rawYaml)
 
+	if err := checkConfigVersion(rawJSON); err != nil {
+		return m, err
+	}
+
 	// Validate raw yaml with JSON schema
 	schemaLoader := gojsonschema.NewStringLoader(schema)
 	documentLoader := gojsonschema.NewGoLoader(rawJSON)
@@ -131,10 +351,498 @@ func NewConfig(config []byte) (Moby, error) {
 	if err != nil {
 		return m, err
 	}
+	if m.Version == 0 {
+		m.Version = configVersion
+	}
+
+	for _, o := range m.Outputs {
+		if outFuns[o] == nil {
+			return m, fmt.Errorf("Unknown output type %s in outputs", o)
+		}
+	}
+	for i, f := range m.Files {
+		for _, o := range f.Outputs {
+			if outFuns[o] == nil {
+				return m, fmt.Errorf("Unknown output type %s in outputs of file %s", o, f.logPath())
+			}
+		}
+		if f.Secret == "" {
+			continue
+		}
+		// a secret is redacted like any other sensitive file
+		m.Files[i].Sensitive = true
+		if f.Directory || f.Symlink != "" || f.Contents != "" || f.Source != "" {
+			return m, fmt.Errorf("File %s has a secret, so cannot also have contents, a source or a symlink, or be a directory", m.Files[i].logPath())
+		}
+		if strings.ContainsAny(f.Secret, `/\`) || f.Secret == "." || f.Secret == ".." {
+			return m, fmt.Errorf("Invalid secret %s of file %s: must be a name in the secrets directory", f.Secret, m.Files[i].logPath())
+		}
+	}
+
+	if m.Name != "" && (strings.Contains(m.Name, "/") || m.Name == "." || m.Name == "..") {
+		return m, fmt.Errorf("Invalid name %s: must not be a path", m.Name)
+	}
+	if m.OutputDir != "" {
+		clean := filepath.Clean(m.OutputDir)
+		if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return m, fmt.Errorf("Invalid outputDir %s: must be inside the current directory", m.OutputDir)
+		}
+	}
+
+	if err := validKernel(m.Kernel); err != nil {
+		return m, err
+	}
+	if err := validImageDigests(m); err != nil {
+		return m, err
+	}
+
+	if _, err := idMap(m.UIDMap); err != nil {
+		return m, fmt.Errorf("Invalid uidMap: %v", err)
+	}
+	if _, err := idMap(m.GIDMap); err != nil {
+		return m, fmt.Errorf("Invalid gidMap: %v", err)
+	}
+	if _, err := newIDRemap(m); err != nil {
+		return m, err
+	}
+
+	if err := validOCIVersion(m.OCIVersion); err != nil {
+		return m, err
+	}
+	if err := validSeed(m); err != nil {
+		return m, err
+	}
+	if err := validTrustConfig(m.Trust); err != nil {
+		return m, err
+	}
+
+	for _, image := range append(append([]MobyImage{}, m.Onboot...), m.Services...) {
+		if err := validHooks(image.Hooks); err != nil {
+			return m, fmt.Errorf("Invalid hooks for %s: %v", image.Name, err)
+		}
+		if err := validMounts(image.Mounts); err != nil {
+			return m, fmt.Errorf("Invalid mounts for %s: %v", image.Name, err)
+		}
+		if image.RootfsPath == "" {
+			continue
+		}
+		if err := validRelativePath(image.RootfsPath); err != nil {
+			return m, fmt.Errorf("Invalid rootfsPath for %s: %v", image.Name, err)
+		}
+	}
 
 	return m, nil
 }
 
+// validKernel checks the settings of the kernel section, reporting those that
+// cannot be used together or without a kernel image
+func validKernel(kc KernelConfig) error {
+	if _, err := parseMode(kc.BootMode, 0); err != nil {
+		return fmt.Errorf("Invalid kernel bootMode: %v", err)
+	}
+	if _, err := parseMode(kc.BootFileMode, 0); err != nil {
+		return fmt.Errorf("Invalid kernel bootFileMode: %v", err)
+	}
+
+	conflicts := []struct {
+		fields   string
+		conflict bool
+		reason   string
+	}{
+		{"passthrough and variant", kc.Passthrough && kc.Variant != "", "variant picks the kernel to install in /boot, which passthrough does not use"},
+		{"passthrough and bootMode", kc.Passthrough && kc.BootMode != "", "bootMode is the mode of /boot, which passthrough does not use"},
+		{"passthrough and bootFileMode", kc.Passthrough && kc.BootFileMode != "", "bootFileMode is the mode of the files in /boot, which passthrough does not use"},
+		{"passthrough and noCmdlineFile", kc.Passthrough && kc.NoCmdlineFile, "passthrough always writes the cmdline to cmdlinePath"},
+		{"cmdlinePath and noCmdlineFile", kc.CmdlinePath != "" && kc.NoCmdlineFile, "cmdlinePath is where the cmdline file is written"},
+	}
+	for _, c := range conflicts {
+		if c.conflict {
+			return fmt.Errorf("Invalid kernel: %s cannot both be set, %s", c.fields, c.reason)
+		}
+	}
+	if kc.CmdlinePath != "" {
+		if !kc.Passthrough {
+			return errors.New("Invalid kernel: cmdlinePath can only be set with passthrough")
+		}
+		if err := validRelativePath(kc.CmdlinePath); err != nil {
+			return fmt.Errorf("Invalid kernel cmdlinePath: %v", err)
+		}
+	}
+	if err := validKernelModules(kc.Modules); err != nil {
+		return err
+	}
+
+	// a cmdline is allowed without an image, it is still expanded and in the embedded config
+	if kc.Image != "" {
+		return nil
+	}
+	set := []string{}
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"variant", kc.Variant != ""},
+		{"bootMode", kc.BootMode != ""},
+		{"bootFileMode", kc.BootFileMode != ""},
+		{"passthrough", kc.Passthrough},
+		{"cmdlinePath", kc.CmdlinePath != ""},
+		{"noCmdlineFile", kc.NoCmdlineFile},
+		{"modules", len(kc.Modules) != 0},
+	} {
+		if f.set {
+			set = append(set, f.name)
+		}
+	}
+	if len(set) != 0 {
+		return fmt.Errorf("Invalid kernel: %s set without a kernel image, so would be ignored", strings.Join(set, ", "))
+	}
+	return nil
+}
+
+// ociVersions are the runtime spec versions that can be emitted in config.json,
+// they have the same config layout as the vendored spec
+var ociVersions = []string{specs.Version, "1.0.0-rc4"}
+
+// validOCIVersion checks a runtime spec version is supported, empty for the default
+func validOCIVersion(v string) error {
+	if v == "" {
+		return nil
+	}
+	for _, s := range ociVersions {
+		if v == s {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unsupported OCI runtime spec version %s, supported versions are: %s", v, strings.Join(ociVersions, ", "))
+}
+
+// resolveIncludes merges the onboot and services of the configs included by
+// the config at path into m, after its own. Include paths are relative to the
+// including config, or the current directory if path is empty. The
+// included configs are returned in the order they were read.
+func resolveIncludes(m *Moby, path string) ([]string, error) {
+	stack := []string{}
+	if path != "" {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		stack = append(stack, abs)
+	}
+	included := []string{}
+	err := includeConfigs(m, filepath.Dir(path), stack, &included)
+	return included, err
+}
+
+func includeConfigs(m *Moby, dir string, stack []string, included *[]string) error {
+	includes := m.Include
+	m.Include = nil
+	for _, inc := range includes {
+		p := inc
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(dir, p)
+		}
+		p, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		for i, s := range stack {
+			if s == p {
+				return fmt.Errorf("Include cycle: %s", strings.Join(append(stack[i:], p), " -> "))
+			}
+		}
+		log.Debugf("include: %s", p)
+		config, err := ioutil.ReadFile(p)
+		if err != nil {
+			return fmt.Errorf("Cannot open included config: %v", err)
+		}
+		*included = append(*included, p)
+		im, err := NewConfig(config)
+		if err != nil {
+			return fmt.Errorf("Invalid included config %s: %v", inc, err)
+		}
+		rest := im
+		rest.Version, rest.Include, rest.Onboot, rest.Services = 0, nil, nil, nil
+		if !reflect.DeepEqual(rest, Moby{}) {
+			return fmt.Errorf("Included config %s can only contain version, include, onboot and services", inc)
+		}
+		err = includeConfigs(&im, filepath.Dir(p), append(stack, p), included)
+		if err != nil {
+			return err
+		}
+		m.Onboot = append(m.Onboot, im.Onboot...)
+		m.Services = append(m.Services, im.Services...)
+	}
+	return nil
+}
+
+// selectFiles removes the files limited to other outputs than those being
+// created. Files without outputs are always kept.
+func selectFiles(m *Moby, out outputList) {
+	active := map[string]bool{}
+	for _, o := range out {
+		active[o] = true
+	}
+	selected := []File{}
+	for _, f := range m.Files {
+		keep := len(f.Outputs) == 0
+		for _, o := range f.Outputs {
+			if active[o] {
+				keep = true
+			}
+		}
+		if keep {
+			selected = append(selected, f)
+		} else {
+			log.Debugf("outputs: skipping file %s", f.logPath())
+		}
+	}
+	m.Files = selected
+}
+
+// orderOnboot sorts the onboot containers so that each runs after those it
+// names in after, keeping the order of the config where it is free, and
+// rejects services with after as they are all started together
+func orderOnboot(m *Moby) error {
+	for _, image := range m.Services {
+		if len(image.After) != 0 {
+			return fmt.Errorf("Service %s cannot use after, only onboot containers run in order", image.Name)
+		}
+	}
+	byName := map[string][]int{}
+	for i, image := range m.Onboot {
+		byName[image.Name] = append(byName[image.Name], i)
+	}
+	deps := make([][]int, len(m.Onboot))
+	for i, image := range m.Onboot {
+		for _, name := range image.After {
+			if _, ok := byName[name]; !ok {
+				return fmt.Errorf("Onboot %s is after %s, which is not an onboot container", image.Name, name)
+			}
+			deps[i] = append(deps[i], byName[name]...)
+		}
+	}
+
+	placed := make([]bool, len(m.Onboot))
+	ordered := []MobyImage{}
+	for len(ordered) < len(m.Onboot) {
+		next := -1
+		for i := range m.Onboot {
+			if placed[i] {
+				continue
+			}
+			ready := true
+			for _, d := range deps[i] {
+				if !placed[d] {
+					ready = false
+				}
+			}
+			if ready {
+				next = i
+				break
+			}
+		}
+		if next == -1 {
+			return fmt.Errorf("Onboot containers depend on each other in a cycle: %s", onbootCycle(m.Onboot, deps, placed))
+		}
+		placed[next] = true
+		ordered = append(ordered, m.Onboot[next])
+	}
+	m.Onboot = ordered
+	return nil
+}
+
+// onbootCycle returns a cycle of the onboot containers that are not placed,
+// each of which depends on another that is not placed
+func onbootCycle(images []MobyImage, deps [][]int, placed []bool) string {
+	start := 0
+	for placed[start] {
+		start++
+	}
+	seen := map[int]int{}
+	path := []int{}
+	for i := start; ; {
+		if at, ok := seen[i]; ok {
+			names := []string{}
+			for _, j := range append(path[at:], i) {
+				names = append(names, images[j].Name)
+			}
+			return strings.Join(names, " after ")
+		}
+		seen[i] = len(path)
+		path = append(path, i)
+		for _, d := range deps[i] {
+			if !placed[d] {
+				i = d
+				break
+			}
+		}
+	}
+}
+
+// selectProfiles removes the onboot and services images that have profiles
+// when none of them are active. Images without profiles are always kept.
+func selectProfiles(m *Moby, profiles []string) {
+	active := map[string]bool{}
+	for _, p := range profiles {
+		active[p] = true
+	}
+	used := map[string]bool{}
+	filter := func(images []MobyImage) []MobyImage {
+		selected := []MobyImage{}
+		for _, image := range images {
+			keep := len(image.Profiles) == 0
+			for _, p := range image.Profiles {
+				used[p] = true
+				if active[p] {
+					keep = true
+				}
+			}
+			if keep {
+				selected = append(selected, image)
+			} else {
+				log.Debugf("profiles: skipping %s", image.Name)
+			}
+		}
+		return selected
+	}
+	m.Onboot = filter(m.Onboot)
+	m.Services = filter(m.Services)
+	for _, p := range profiles {
+		if !used[p] {
+			log.Warnf("Profile %s is not used by any image", p)
+		}
+	}
+}
+
+// idMap converts a map of numeric ids to names from a config
+func idMap(m map[string]string) (map[int]string, error) {
+	ids := map[int]string{}
+	for k, name := range m {
+		id, err := strconv.Atoi(k)
+		if err != nil || id < 0 {
+			return nil, fmt.Errorf("%s is not a numeric id", k)
+		}
+		ids[id] = name
+	}
+	return ids, nil
+}
+
+// validRelativePath checks a path is relative and stays inside the image
+func validRelativePath(p string) error {
+	if path.IsAbs(p) {
+		return fmt.Errorf("path must be relative: %s", p)
+	}
+	clean := path.Clean(p)
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return fmt.Errorf("path must be inside the image: %s", p)
+	}
+	return nil
+}
+
+// embedConfigPath is where the config is written in the image by --embed-config
+const embedConfigPath = "etc/moby/config.yml"
+
+// imageLabelsPath is where the image labels are written in the image by --embed-labels
+const imageLabelsPath = "etc/moby/image-labels.json"
+
+// CanonicalConfig returns a parsed config as YAML with sorted keys and without
+// unset values, so that it is stable for identical configs. The contents of
+// sensitive files are redacted.
+func CanonicalConfig(m Moby) ([]byte, error) {
+	m.Files = append([]File{}, m.Files...)
+	for i, f := range m.Files {
+		if f.Sensitive && f.Contents != "" {
+			m.Files[i].Contents = redacted
+		}
+	}
+	out, err := yaml.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var raw interface{}
+	err = yaml.Unmarshal(out, &raw)
+	if err != nil {
+		return nil, err
+	}
+	// yaml.v2 writes map keys in sorted order
+	return yaml.Marshal(pruneUnset(raw))
+}
+
+// ValidateSchema checks a parsed config against a JSON schema, returning an
+// error listing the path and problem of each mismatch
+func ValidateSchema(m Moby, s string) error {
+	config, err := CanonicalConfig(m)
+	if err != nil {
+		return err
+	}
+	var raw interface{}
+	err = yaml.Unmarshal(config, &raw)
+	if err != nil {
+		return err
+	}
+	schemaLoader := gojsonschema.NewStringLoader(s)
+	documentLoader := gojsonschema.NewGoLoader(convert(raw))
+	result, err := gojsonschema.Validate(schemaLoader, documentLoader)
+	if err != nil {
+		return fmt.Errorf("Cannot validate against the schema: %v", err)
+	}
+	if !result.Valid() {
+		errs := []string{}
+		for _, desc := range result.Errors() {
+			errs = append(errs, fmt.Sprintf("- %s", desc))
+		}
+		return fmt.Errorf("The config does not match the schema:\n%s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// pruneUnset removes null, empty string and empty collection values from
+// parsed yaml. False and zero are kept as they may override an image label.
+func pruneUnset(i interface{}) interface{} {
+	switch x := i.(type) {
+	case map[interface{}]interface{}:
+		for k, v := range x {
+			v = pruneUnset(v)
+			if unset(v) {
+				delete(x, k)
+			} else {
+				x[k] = v
+			}
+		}
+	case []interface{}:
+		for i, v := range x {
+			x[i] = pruneUnset(v)
+		}
+	}
+	return i
+}
+
+func unset(i interface{}) bool {
+	switch x := i.(type) {
+	case nil:
+		return true
+	case string:
+		return x == ""
+	case map[interface{}]interface{}:
+		return len(x) == 0
+	case []interface{}:
+		return len(x) == 0
+	}
+	return false
+}
+
+// ConfigHash returns a stable hash of a parsed config, so that configs which
+// only differ in formatting or key order have the same hash
+func ConfigHash(m Moby) (string, error) {
+	// encoding/json always writes struct fields in the same order and sorts map keys
+	canonical, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(canonical)), nil
+}
+
 // NewImage validates an parses yaml or json for a MobyImage
 func NewImage(config []byte) (MobyImage, error) {
 	log.Debugf("Reading label config: %s", string(config))
@@ -197,25 +905,25 @@ func NewImage(config []byte) (MobyImage, error) {
 	if mi.Image != "" {
 		return mi, fmt.Errorf("image cannot be set in metadata label")
 	}
+	if mi.RootfsPath != "" {
+		return mi, fmt.Errorf("rootfsPath cannot be set in metadata label")
+	}
+	if err := validMounts(mi.Mounts); err != nil {
+		return mi, fmt.Errorf("invalid mounts in metadata label: %v", err)
+	}
 
 	return mi, nil
 }
 
-// ConfigToOCI converts a config specification to an OCI config file
-func ConfigToOCI(image MobyImage) ([]byte, error) {
-
-	// TODO pass through same docker client to all functions
-	cli, err := dockerClient()
+// ConfigToOCI converts a config specification to an OCI config file, for the
+// runtime spec ociVersion or the vendored spec version if it is empty
+func ConfigToOCI(image MobyImage, ociVersion string) ([]byte, error) {
+	inspect, err := Images.inspect(image.Image)
 	if err != nil {
 		return []byte{}, err
 	}
 
-	inspect, err := dockerInspectImage(cli, image.Image)
-	if err != nil {
-		return []byte{}, err
-	}
-
-	oci, err := ConfigInspectToOCI(image, inspect)
+	oci, err := ConfigInspectToOCI(image, inspect, ociVersion)
 	if err != nil {
 		return []byte{}, err
 	}
@@ -247,7 +955,12 @@ func (m mlist) Len() int {
 	return len(m)
 }
 func (m mlist) Less(i, j int) bool {
-	return m.parts(i) < m.parts(j)
+	// parents are mounted before their children, and the mounts are in a
+	// stable order so identical configs give identical OCI configs
+	if pi, pj := m.parts(i), m.parts(j); pi != pj {
+		return pi < pj
+	}
+	return m[i].Destination < m[j].Destination
 }
 func (m mlist) Swap(i, j int) {
 	m[i], m[j] = m[j], m[i]
@@ -345,14 +1058,46 @@ func assignMaps(v1, v2 *map[string]string) map[string]string {
 }
 
 // assignBinds does ordered overrides from JSON Bind array pointers
-func assignBinds(v1, v2 *[]specs.Mount) []specs.Mount {
+func assignBinds(v1, v2 *[]Mount) []Mount {
 	if v2 != nil {
 		return *v2
 	}
 	if v1 != nil {
 		return *v1
 	}
-	return []specs.Mount{}
+	return []Mount{}
+}
+
+// assignHooks does ordered overrides from JSON Hooks pointers
+func assignHooks(v1, v2 *specs.Hooks) *specs.Hooks {
+	if v2 != nil {
+		return v2
+	}
+	return v1
+}
+
+// validHooks checks the hooks for each lifecycle stage run absolute paths,
+// as they are run by the runtime rather than in the container
+func validHooks(h *specs.Hooks) error {
+	if h == nil {
+		return nil
+	}
+	stages := []struct {
+		name  string
+		hooks []specs.Hook
+	}{
+		{"prestart", h.Prestart},
+		{"poststart", h.Poststart},
+		{"poststop", h.Poststop},
+	}
+	for _, stage := range stages {
+		for _, hook := range stage.hooks {
+			if !path.IsAbs(hook.Path) {
+				return fmt.Errorf("%s hook %s must be an absolute path", stage.name, hook.Path)
+			}
+		}
+	}
+	return nil
 }
 
 // assignString does ordered overrides from JSON string pointers
@@ -403,12 +1148,19 @@ func assignStringEmpty4(v1, v2, v3, v4 string) string {
 }
 
 // ConfigInspectToOCI converts a config and the output of image inspect to an OCI config
-func ConfigInspectToOCI(yaml MobyImage, inspect types.ImageInspect) (specs.Spec, error) {
+func ConfigInspectToOCI(yaml MobyImage, inspect types.ImageInspect, ociVersion string) (specs.Spec, error) {
 	oci := specs.Spec{}
 
 	var inspectConfig container.Config
 	if inspect.Config != nil {
 		inspectConfig = *inspect.Config
+	} else if err := extractWarning(yaml.Image, "has no image config, using the defaults"); err != nil {
+		return oci, err
+	}
+	if inspect.Os != "" && inspect.Os != "linux" {
+		if err := extractWarning(yaml.Image, "is for %s rather than linux", inspect.Os); err != nil {
+			return oci, err
+		}
 	}
 
 	// look for org.mobyproject.config label
@@ -425,7 +1177,7 @@ func ConfigInspectToOCI(yaml MobyImage, inspect types.ImageInspect) (specs.Spec,
 	// command, env and cwd can be taken from image, as they are commonly specified in Dockerfile
 
 	// TODO we could handle entrypoint and cmd independently more like Docker
-	inspectCommand := append(inspectConfig.Entrypoint, inspect.Config.Cmd...)
+	inspectCommand := append(inspectConfig.Entrypoint, inspectConfig.Cmd...)
 	args := assignStrings3(inspectCommand, label.Command, yaml.Command)
 
 	env := assignStrings3(inspectConfig.Env, label.Env, yaml.Env)
@@ -489,7 +1241,7 @@ func ConfigInspectToOCI(yaml MobyImage, inspect types.ImageInspect) (specs.Spec,
 		tp := m.Type
 		src := m.Source
 		dest := m.Destination
-		opts := m.Options
+		opts := m.options()
 		if tp == "" {
 			switch src {
 			case "mqueue", "devpts", "proc", "sysfs", "cgroup":
@@ -610,6 +1362,9 @@ func ConfigInspectToOCI(yaml MobyImage, inspect types.ImageInspect) (specs.Spec,
 	}
 
 	oci.Version = specs.Version
+	if ociVersion != "" {
+		oci.Version = ociVersion
+	}
 
 	oci.Platform = specs.Platform{
 		OS:   inspect.Os,
@@ -617,7 +1372,7 @@ func ConfigInspectToOCI(yaml MobyImage, inspect types.ImageInspect) (specs.Spec,
 	}
 
 	oci.Process = specs.Process{
-		Terminal: false,
+		Terminal: assignBool(label.Terminal, yaml.Terminal),
 		//ConsoleSize
 		User: specs.User{
 			UID:            assignUint32(label.UID, yaml.UID),
@@ -651,6 +1406,11 @@ func ConfigInspectToOCI(yaml MobyImage, inspect types.ImageInspect) (specs.Spec,
 	oci.Hostname = assignStringEmpty(label.Hostname, yaml.Hostname)
 	oci.Mounts = mountList
 
+	oci.Hooks = assignHooks(label.Hooks, yaml.Hooks)
+	if err := validHooks(oci.Hooks); err != nil {
+		return oci, fmt.Errorf("Invalid hooks for %s: %v", yaml.Name, err)
+	}
+
 	oci.Linux = &specs.Linux{
 		// UIDMappings
 		// GIDMappings
@@ -679,6 +1439,30 @@ func ConfigInspectToOCI(yaml MobyImage, inspect types.ImageInspect) (specs.Spec,
 	return oci, nil
 }
 
+// parseMode parses a file mode given in octal, or returns def if it is empty
+func parseMode(s string, def int64) (int64, error) {
+	if s == "" {
+		return def, nil
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 07777 {
+		return 0, fmt.Errorf("Cannot parse mode %s, must be octal such as 0755", s)
+	}
+	return int64(mode), nil
+}
+
+// parseMtime parses a file modification time given either as RFC3339 or as seconds since the epoch
+func parseMtime(s string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("Cannot parse mtime %s, must be RFC3339 or seconds since the epoch", s)
+	}
+	return t, nil
+}
+
 func filesystem(m Moby) (*bytes.Buffer, error) {
 	buf := new(bytes.Buffer)
 	tw := tar.NewWriter(buf)
@@ -688,7 +1472,7 @@ func filesystem(m Moby) (*bytes.Buffer, error) {
 		log.Infof("Add files:")
 	}
 	for _, f := range m.Files {
-		log.Infof("  %s", f.Path)
+		log.Infof("  %s", f.logPath())
 		if f.Path == "" {
 			return buf, errors.New("Did not specify path for file")
 		}
@@ -704,6 +1488,14 @@ func filesystem(m Moby) (*bytes.Buffer, error) {
 
 			f.Contents = string(contents)
 		}
+		var mtime time.Time
+		if f.Mtime != "" {
+			var err error
+			mtime, err = parseMtime(f.Mtime)
+			if err != nil {
+				return buf, err
+			}
+		}
 		// we need all the leading directories
 		parts := strings.Split(path.Dir(f.Path), "/")
 		root := ""
@@ -735,6 +1527,7 @@ func filesystem(m Moby) (*bytes.Buffer, error) {
 				Name:     f.Path,
 				Typeflag: tar.TypeDir,
 				Mode:     0700,
+				ModTime:  mtime,
 			}
 			err := tw.WriteHeader(hdr)
 			if err != nil {
@@ -746,6 +1539,7 @@ func filesystem(m Moby) (*bytes.Buffer, error) {
 				Typeflag: tar.TypeSymlink,
 				Mode:     0600,
 				Linkname: f.Symlink,
+				ModTime:  mtime,
 			}
 			err := tw.WriteHeader(hdr)
 			if err != nil {
@@ -753,9 +1547,10 @@ func filesystem(m Moby) (*bytes.Buffer, error) {
 			}
 		} else {
 			hdr := &tar.Header{
-				Name: f.Path,
-				Mode: 0600,
-				Size: int64(len(f.Contents)),
+				Name:    f.Path,
+				Mode:    0600,
+				Size:    int64(len(f.Contents)),
+				ModTime: mtime,
 			}
 			err := tw.WriteHeader(hdr)
 			if err != nil {
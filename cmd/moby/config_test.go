@@ -1,12 +1,22 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
 	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/opencontainers/runtime-spec/specs-go"
 )
 
 func TestOverrides(t *testing.T) {
@@ -36,7 +46,7 @@ func TestOverrides(t *testing.T) {
 
 	inspect.Config = &config
 
-	oci, err := ConfigInspectToOCI(yaml, inspect)
+	oci, err := ConfigInspectToOCI(yaml, inspect, "")
 	if err != nil {
 		t.Error(err)
 	}
@@ -48,3 +58,829 @@ func TestOverrides(t *testing.T) {
 		t.Error("Expected label Cwd to be applied, got", oci.Process.Cwd)
 	}
 }
+
+func TestConfigOutputs(t *testing.T) {
+	m, err := NewConfig([]byte("outputs:\n  - tar\n  - iso-bios\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, noDefault := range []bool{false, true} {
+		if out, err := selectOutputs(outputList{}, m, noDefault); err != nil || !reflect.DeepEqual(out, outputList{"tar", "iso-bios"}) {
+			t.Error("Expected config outputs to be used by default but got", out, err)
+		}
+		if out, err := selectOutputs(outputList{"qcow2"}, m, noDefault); err != nil || !reflect.DeepEqual(out, outputList{"qcow2"}) {
+			t.Error("Expected command line outputs to override config but got", out, err)
+		}
+		if out, err := selectOutputs(outputList{"qcow2"}, Moby{}, noDefault); err != nil || !reflect.DeepEqual(out, outputList{"qcow2"}) {
+			t.Error("Expected command line outputs without config outputs but got", out, err)
+		}
+	}
+	if out, err := selectOutputs(outputList{}, Moby{}, false); err != nil || !reflect.DeepEqual(out, outputList{"kernel+initrd"}) {
+		t.Error("Expected kernel+initrd default without config outputs but got", out, err)
+	}
+	if out, err := selectOutputs(outputList{}, Moby{}, true); err == nil || !strings.Contains(err.Error(), "No outputs selected") {
+		t.Error("Expected an error without outputs when there is no default but got", out, err)
+	}
+
+	_, err = NewConfig([]byte("outputs:\n  - tar\n  - floppy\n"))
+	if err == nil {
+		t.Error("Expected error for unknown output type in config")
+	}
+}
+
+func TestOnlyOutputs(t *testing.T) {
+	m, err := NewConfig([]byte("outputs:\n  - kernel+initrd\n  - iso-efi\n  - tar\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := selectOutputs(outputList{}, m, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if only, err := onlyOutputs(out, outputList{"iso-efi"}); err != nil || !reflect.DeepEqual(only, outputList{"iso-efi"}) {
+		t.Error("Expected -only to restrict the config outputs but got", only, err)
+	}
+	// the outputs keep the order of the config
+	if only, err := onlyOutputs(out, outputList{"tar", "kernel+initrd"}); err != nil || !reflect.DeepEqual(only, outputList{"kernel+initrd", "tar"}) {
+		t.Error("Expected -only to keep the order of the config outputs but got", only, err)
+	}
+	if only, err := onlyOutputs(out, outputList{}); err != nil || !reflect.DeepEqual(only, out) {
+		t.Error("Expected all the config outputs without -only but got", only, err)
+	}
+	for _, only := range []outputList{{"qcow2"}, {"iso-efi", "iso"}} {
+		if _, err := onlyOutputs(out, only); err == nil || !strings.Contains(err.Error(), "not one of the selected outputs") {
+			t.Errorf("Expected an error for -only %v outside the config outputs, got %v", only, err)
+		}
+	}
+}
+
+func TestConfigHash(t *testing.T) {
+	config1 := `
+kernel:
+  image: "linuxkit/kernel:4.9.x"
+  cmdline: "console=ttyS0"
+init:
+  - linuxkit/init:1b8a7e394d2ec2f1fdb4d67645829d1b5bdca037
+`
+	// same config with keys in a different order and different formatting
+	config2 := `
+init: [ "linuxkit/init:1b8a7e394d2ec2f1fdb4d67645829d1b5bdca037" ]
+kernel:
+  cmdline: console=ttyS0
+  image: linuxkit/kernel:4.9.x
+`
+	config3 := `
+kernel:
+  image: "linuxkit/kernel:4.9.x"
+  cmdline: "console=tty0"
+init:
+  - linuxkit/init:1b8a7e394d2ec2f1fdb4d67645829d1b5bdca037
+`
+	hashes := []string{}
+	for _, config := range []string{config1, config2, config3} {
+		m, err := NewConfig([]byte(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash, err := ConfigHash(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	if hashes[0] != hashes[1] {
+		t.Errorf("Expected equivalent configs to have the same hash, got %s and %s", hashes[0], hashes[1])
+	}
+	if hashes[0] == hashes[2] {
+		t.Error("Expected changed config to have a different hash")
+	}
+}
+
+func TestFilesMtime(t *testing.T) {
+	m, err := NewConfig([]byte(`
+files:
+  - path: etc/epoch
+    contents: "epoch"
+    mtime: 1500000000
+  - path: etc/rfc3339
+    contents: "rfc3339"
+    mtime: "2017-07-14T02:40:00Z"
+  - path: etc/default
+    contents: "default"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := filesystem(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdrs, _ := readTar(t, buf)
+
+	expected := time.Unix(1500000000, 0)
+	if !hdrs["etc/epoch"].ModTime.Equal(expected) {
+		t.Errorf("Expected mtime %v, got %v", expected, hdrs["etc/epoch"].ModTime)
+	}
+	if !hdrs["etc/rfc3339"].ModTime.Equal(expected) {
+		t.Errorf("Expected mtime %v, got %v", expected, hdrs["etc/rfc3339"].ModTime)
+	}
+	if hdrs["etc/default"].ModTime.Unix() != 0 {
+		t.Errorf("Expected no mtime by default, got %v", hdrs["etc/default"].ModTime)
+	}
+
+	m.Files[2].Mtime = "last tuesday"
+	if _, err := filesystem(m); err == nil {
+		t.Error("Expected error for invalid mtime")
+	}
+}
+
+func mustFilesystem(t *testing.T, m Moby) *bytes.Buffer {
+	buf, err := filesystem(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestRootfsPath(t *testing.T) {
+	m, err := NewConfig([]byte(`
+onboot:
+  - name: setup
+    image: "linuxkit/setup:latest"
+    rootfsPath: sbin/init.d/setup
+services:
+  - name: nginx
+    image: "nginx:alpine"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := bundlePath("containers/onboot/000-setup", m.Onboot[0]); p != "sbin/init.d/setup" {
+		t.Errorf("Expected remapped path sbin/init.d/setup, got %s", p)
+	}
+	if p := bundlePath("containers/services/nginx", m.Services[0]); p != "containers/services/nginx" {
+		t.Errorf("Expected default path containers/services/nginx, got %s", p)
+	}
+
+	for _, p := range []string{"/sbin/init.d/setup", "../setup", "sbin/../../setup", "."} {
+		config := "services:\n  - name: nginx\n    image: nginx:alpine\n    rootfsPath: " + p + "\n"
+		if _, err := NewConfig([]byte(config)); err == nil {
+			t.Errorf("Expected error for rootfsPath %s", p)
+		}
+	}
+}
+
+func TestOCIVersion(t *testing.T) {
+	yaml := MobyImage{Name: "test", Image: "testimage"}
+	inspect := types.ImageInspect{Config: &container.Config{}}
+
+	for _, v := range []string{"", "1.0.0-rc4"} {
+		oci, err := ConfigInspectToOCI(yaml, inspect, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := v
+		if expected == "" {
+			expected = specs.Version
+		}
+		if oci.Version != expected {
+			t.Errorf("Expected ociVersion %s, got %s", expected, oci.Version)
+		}
+	}
+
+	if _, err := NewConfig([]byte("ociVersion: 1.0.0-rc4\n")); err != nil {
+		t.Errorf("Expected supported ociVersion to be accepted: %v", err)
+	}
+	if _, err := NewConfig([]byte("ociVersion: 0.6.0\n")); err == nil {
+		t.Error("Expected unsupported ociVersion to be rejected")
+	}
+}
+
+func TestKernelConflicts(t *testing.T) {
+	for _, kernel := range []string{
+		"image: k\n  cmdline: console=ttyS0",
+		"image: k\n  passthrough: true\n  cmdlinePath: dtbs/cmdline.txt",
+		"image: k\n  variant: kernel-dbg\n  bootMode: \"0700\"\n  bootFileMode: \"0600\"\n  noCmdlineFile: true",
+		"cmdline: console=ttyS0\n  cmdlineNewline: true",
+	} {
+		if _, err := NewConfig([]byte("kernel:\n  " + kernel + "\n")); err != nil {
+			t.Errorf("Expected kernel %q to be valid, got %v", kernel, err)
+		}
+	}
+
+	for kernel, expected := range map[string]string{
+		"image: k\n  passthrough: true\n  variant: kernel-dbg":                "passthrough and variant cannot both be set",
+		"image: k\n  passthrough: true\n  bootMode: \"0700\"":                 "passthrough and bootMode cannot both be set",
+		"image: k\n  passthrough: true\n  bootFileMode: \"0600\"":             "passthrough and bootFileMode cannot both be set",
+		"image: k\n  passthrough: true\n  noCmdlineFile: true":                "passthrough and noCmdlineFile cannot both be set",
+		"image: k\n  cmdlinePath: etc/cmdline\n  noCmdlineFile: true":         "cmdlinePath and noCmdlineFile cannot both be set",
+		"image: k\n  cmdlinePath: etc/cmdline":                                "cmdlinePath can only be set with passthrough",
+		"image: k\n  passthrough: true\n  cmdlinePath: /etc/cmdline":          "Invalid kernel cmdlinePath",
+		"image: k\n  bootMode: rwx":                                           "Invalid kernel bootMode",
+		"variant: kernel-dbg":                                                 "variant set without a kernel image",
+		"passthrough: true\n  cmdlinePath: etc/cmdline":                       "passthrough, cmdlinePath set without a kernel image",
+		"bootMode: \"0700\"\n  bootFileMode: \"0600\"\n  noCmdlineFile: true": "bootMode, bootFileMode, noCmdlineFile set without a kernel image",
+	} {
+		if _, err := NewConfig([]byte("kernel:\n  " + kernel + "\n")); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %q for kernel %q, got %v", expected, kernel, err)
+		}
+	}
+}
+
+func TestConfigVersion(t *testing.T) {
+	for _, config := range []string{"version: 1\n", "name: test\n"} {
+		m, err := NewConfig([]byte(config))
+		if err != nil {
+			t.Errorf("Expected %q to be accepted: %v", config, err)
+		} else if m.Version != configVersion {
+			t.Errorf("Expected %q to have version %d, got %d", config, configVersion, m.Version)
+		}
+	}
+
+	// a newer config is reported by version even if it has fields this tool does not know
+	_, err := NewConfig([]byte("version: 2\nnewField: true\n"))
+	if err == nil || !strings.Contains(err.Error(), "needs a newer version") {
+		t.Errorf("Expected a newer config version to be rejected, got %v", err)
+	}
+	if _, err := NewConfig([]byte("version: 0\n")); err == nil {
+		t.Error("Expected an older config version to be rejected")
+	}
+	if _, err := NewConfig([]byte("version: latest\n")); err == nil {
+		t.Error("Expected a version that is not a number to be rejected")
+	}
+}
+
+func TestProcessOptions(t *testing.T) {
+	m, err := NewConfig([]byte(`
+services:
+  - name: debug
+    image: "alpine:latest"
+    terminal: true
+    noNewPrivileges: true
+  - name: nginx
+    image: "nginx:alpine"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inspect := types.ImageInspect{Config: &container.Config{}}
+	for i, expected := range []bool{true, false} {
+		spec, err := ConfigInspectToOCI(m.Services[i], inspect, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := json.MarshalIndent(spec, "", "    ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var oci struct {
+			Process map[string]interface{} `json:"process"`
+		}
+		if err := json.Unmarshal(config, &oci); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"terminal", "noNewPrivileges"} {
+			v, ok := oci.Process[key]
+			if expected && v != true {
+				t.Errorf("Expected process.%s true in config.json for %s, got %v", key, m.Services[i].Name, v)
+			}
+			if !expected && ok {
+				t.Errorf("Expected process.%s omitted from config.json for %s, got %v", key, m.Services[i].Name, v)
+			}
+		}
+	}
+}
+
+func TestSensitiveFiles(t *testing.T) {
+	m, err := NewConfig([]byte(`
+files:
+  - path: etc/motd
+    contents: "hello"
+  - path: etc/secret/token
+    contents: "s3cr3t-t0k3n"
+    sensitive: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs := new(bytes.Buffer)
+	log.SetOutput(logs)
+	level := log.GetLevel()
+	log.SetLevel(log.DebugLevel)
+	defer log.SetOutput(os.Stderr)
+	defer log.SetLevel(level)
+
+	// the file is still in the image
+	_, contents := readTar(t, mustFilesystem(t, m))
+	if contents["etc/secret/token"] != "s3cr3t-t0k3n" {
+		t.Error("Expected sensitive file to be included in the image")
+	}
+
+	// but not in the logs, manifest or SBOM
+	image := testImage(t)
+	buf := new(bytes.Buffer)
+	iw := tar.NewWriter(buf)
+	for _, r := range []io.Reader{bytes.NewReader(image), mustFilesystem(t, m)} {
+		if err := initrdAppend(iw, r, appendOpts{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := iw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, initrd, _, err := tarToInitrd(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := pathManifest(initrd, sensitivePaths(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bom, err := sbom("test", m, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, out := range map[string][]byte{"logs": logs.Bytes(), "manifest": manifestJSON, "SBOM": bom} {
+		if bytes.Contains(out, []byte("etc/secret/token")) || bytes.Contains(out, []byte("s3cr3t-t0k3n")) {
+			t.Errorf("Expected sensitive file to be redacted from the %s", name)
+		}
+		if !bytes.Contains(out, []byte(redacted)) {
+			t.Errorf("Expected a redacted entry in the %s", name)
+		}
+	}
+	if !bytes.Contains(logs.Bytes(), []byte("etc/motd")) {
+		t.Error("Expected other files to be logged")
+	}
+}
+
+func TestSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "db-password"), []byte("hunter2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "certs"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	config := []byte(`
+files:
+  - path: etc/db/password
+    secret: db-password
+`)
+	m, err := NewConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Files[0].Sensitive {
+		t.Error("Expected a file with a secret to be sensitive")
+	}
+	canonical, err := CanonicalConfig(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resolveSecrets(&m, dir); err != nil {
+		t.Fatal(err)
+	}
+	_, contents := readTar(t, mustFilesystem(t, m))
+	if contents["etc/db/password"] != "hunter2" {
+		t.Errorf("Expected the secret in the image, got %q", contents["etc/db/password"])
+	}
+	bom, err := sbom("test", m, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, out := range map[string][]byte{"config": canonical, "SBOM": bom} {
+		if bytes.Contains(out, []byte("hunter2")) {
+			t.Errorf("Expected the secret to be left out of the %s", name)
+		}
+	}
+
+	// a secret that is missing, or not a file, fails the build
+	for secret, msg := range map[string]string{
+		"api-token": "Secret api-token of file [redacted] is not in " + dir,
+		"certs":     "Secret certs of file [redacted] is not a regular file in " + dir,
+	} {
+		m, err := NewConfig([]byte(strings.Replace(string(config), "db-password", secret, 1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := resolveSecrets(&m, dir); err == nil || err.Error() != msg {
+			t.Errorf("Expected %q for secret %s, got %v", msg, secret, err)
+		}
+	}
+	m, err = NewConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resolveSecrets(&m, ""); err == nil || !strings.Contains(err.Error(), "-secrets-dir") {
+		t.Errorf("Expected an error naming -secrets-dir without a secrets directory, got %v", err)
+	}
+
+	for _, invalid := range []string{
+		"files:\n  - path: etc/db/password\n    secret: ../db-password",
+		"files:\n  - path: etc/db/password\n    secret: ..",
+		"files:\n  - path: etc/db/password\n    secret: db-password\n    contents: hunter2",
+		"files:\n  - path: etc/db\n    secret: db-password\n    directory: true",
+	} {
+		if _, err := NewConfig([]byte(invalid)); err == nil {
+			t.Errorf("Expected an error for config %q", invalid)
+		}
+	}
+}
+
+func TestIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"moby.yml": "include:\n  - services/web.yml\nservices:\n  - name: rngd\n    image: linuxkit/rngd\n",
+		// nested includes are relative to the including file
+		"services/web.yml":         "include:\n  - db/postgres.yml\nservices:\n  - name: nginx\n    image: nginx:alpine\n",
+		"services/db/postgres.yml": "onboot:\n  - name: dbinit\n    image: postgres-init\nservices:\n  - name: postgres\n    image: postgres\n",
+		"cycle.yml":                "include:\n  - services/cycle.yml\n",
+		"services/cycle.yml":       "include:\n  - ../cycle.yml\n",
+		"kernel.yml":               "include:\n  - services/kernel.yml\n",
+		"services/kernel.yml":      "kernel:\n  image: linuxkit/kernel\n",
+	}
+	for name, contents := range files {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	load := func(name string) (Moby, error) {
+		path := filepath.Join(dir, name)
+		m, err := NewConfig([]byte(files[name]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = resolveIncludes(&m, path)
+		return m, err
+	}
+
+	m, err := load("moby.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, s := range m.Services {
+		names = append(names, s.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"rngd", "nginx", "postgres"}) {
+		t.Errorf("Expected included services after the config's own, got %v", names)
+	}
+	if len(m.Onboot) != 1 || m.Onboot[0].Name != "dbinit" {
+		t.Errorf("Expected included onboot to be merged, got %v", m.Onboot)
+	}
+
+	if _, err := load("cycle.yml"); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("Expected include cycle error, got %v", err)
+	}
+	if _, err := load("kernel.yml"); err == nil {
+		t.Error("Expected an included kernel to be rejected")
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	config := []byte(`
+onboot:
+  - name: dhcpcd
+    image: "linuxkit/dhcpcd:latest"
+  - name: sysctl-debug
+    image: "linuxkit/sysctl:latest"
+    profiles: [debug]
+services:
+  - name: nginx
+    image: "nginx:alpine"
+  - name: getty
+    image: "linuxkit/getty:latest"
+    profiles: [dev, debug]
+  - name: metrics
+    image: "linuxkit/node_exporter:latest"
+    profiles: [prod]
+`)
+	testCases := []struct {
+		profiles []string
+		onboot   []string
+		services []string
+	}{
+		{nil, []string{"dhcpcd"}, []string{"nginx"}},
+		{[]string{"dev"}, []string{"dhcpcd"}, []string{"nginx", "getty"}},
+		{[]string{"prod"}, []string{"dhcpcd"}, []string{"nginx", "metrics"}},
+		{[]string{"debug", "prod"}, []string{"dhcpcd", "sysctl-debug"}, []string{"nginx", "getty", "metrics"}},
+	}
+	names := func(images []MobyImage) []string {
+		n := []string{}
+		for _, image := range images {
+			n = append(n, image.Name)
+		}
+		return n
+	}
+	for _, testCase := range testCases {
+		m, err := NewConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		selectProfiles(&m, testCase.profiles)
+		if onboot := names(m.Onboot); !reflect.DeepEqual(onboot, testCase.onboot) {
+			t.Errorf("Expected onboot %v for profiles %v, got %v", testCase.onboot, testCase.profiles, onboot)
+		}
+		if services := names(m.Services); !reflect.DeepEqual(services, testCase.services) {
+			t.Errorf("Expected services %v for profiles %v, got %v", testCase.services, testCase.profiles, services)
+		}
+	}
+}
+
+func TestOrderOnboot(t *testing.T) {
+	testCases := []struct {
+		onboot   string
+		expected []string
+		err      string
+	}{
+		// list order is kept where after leaves it free
+		{`
+  - name: a
+    image: a
+  - name: b
+    image: b
+`, []string{"a", "b"}, ""},
+		{`
+  - name: mount
+    image: mount
+    after: [format]
+  - name: dhcpcd
+    image: dhcpcd
+  - name: format
+    image: format
+  - name: sysctl
+    image: sysctl
+`, []string{"dhcpcd", "format", "mount", "sysctl"}, ""},
+		{`
+  - name: c
+    image: c
+    after: [a, b]
+  - name: b
+    image: b
+    after: [a]
+  - name: a
+    image: a
+`, []string{"a", "b", "c"}, ""},
+		{`
+  - name: a
+    image: a
+    after: [missing]
+`, nil, "Onboot a is after missing, which is not an onboot container"},
+		{`
+  - name: a
+    image: a
+  - name: b
+    image: b
+    after: [c]
+  - name: c
+    image: c
+    after: [d]
+  - name: d
+    image: d
+    after: [b]
+`, nil, "Onboot containers depend on each other in a cycle: b after c after d after b"},
+		{`
+  - name: a
+    image: a
+    after: [a]
+`, nil, "Onboot containers depend on each other in a cycle: a after a"},
+	}
+	for _, testCase := range testCases {
+		m, err := NewConfig([]byte("onboot:" + testCase.onboot))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = orderOnboot(&m)
+		if testCase.err != "" {
+			if err == nil || err.Error() != testCase.err {
+				t.Errorf("Expected error %q, got %v", testCase.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error ordering %s: %v", testCase.onboot, err)
+			continue
+		}
+		names := []string{}
+		for _, image := range m.Onboot {
+			names = append(names, image.Name)
+		}
+		if !reflect.DeepEqual(names, testCase.expected) {
+			t.Errorf("Expected onboot order %v, got %v", testCase.expected, names)
+		}
+	}
+
+	m, err := NewConfig([]byte(`
+services:
+  - name: nginx
+    image: nginx
+    after: [dhcpcd]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := orderOnboot(&m); err == nil || !strings.Contains(err.Error(), "only onboot containers run in order") {
+		t.Errorf("Expected an error for a service with after, got %v", err)
+	}
+}
+
+func TestValidateSchema(t *testing.T) {
+	// a policy that only allows linuxkit service images and requires a name
+	policy := `{
+  "type": "object",
+  "required": ["name"],
+  "properties": {
+    "services": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "properties": {
+          "image": { "type": "string", "pattern": "^linuxkit/" }
+        }
+      }
+    }
+  }
+}`
+	good, err := NewConfig([]byte("name: good\nservices:\n  - name: dhcpcd\n    image: linuxkit/dhcpcd:latest\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateSchema(good, policy); err != nil {
+		t.Errorf("Expected config to match the schema: %v", err)
+	}
+
+	bad, err := NewConfig([]byte("services:\n  - name: dhcpcd\n    image: linuxkit/dhcpcd:latest\n  - name: nginx\n    image: nginx:alpine\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ValidateSchema(bad, policy)
+	if err == nil {
+		t.Fatal("Expected config not to match the schema")
+	}
+	for _, expected := range []string{"- name: name is required", "- services.1.image: Does not match pattern"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %q in the error, got:\n%v", expected, err)
+		}
+	}
+
+	if err := ValidateSchema(good, "{"); err == nil {
+		t.Error("Expected an invalid schema to be an error")
+	}
+}
+
+func TestHooks(t *testing.T) {
+	m, err := NewConfig([]byte(`
+services:
+  - name: network
+    image: "linuxkit/netns:latest"
+    hooks:
+      prestart:
+        - path: /usr/bin/netns-setup
+          args: [netns-setup, --bridge, br0]
+          timeout: 10
+      poststart:
+        - path: /usr/bin/notify
+      poststop:
+        - path: /usr/bin/netns-teardown
+          env: [BRIDGE=br0]
+  - name: nginx
+    image: "nginx:alpine"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inspect := types.ImageInspect{Config: &container.Config{}}
+	spec, err := ConfigInspectToOCI(m.Services[0], inspect, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var oci struct {
+		Hooks map[string][]map[string]interface{} `json:"hooks"`
+	}
+	if err := json.Unmarshal(config, &oci); err != nil {
+		t.Fatal(err)
+	}
+	for stage, path := range map[string]string{"prestart": "/usr/bin/netns-setup", "poststart": "/usr/bin/notify", "poststop": "/usr/bin/netns-teardown"} {
+		if len(oci.Hooks[stage]) != 1 || oci.Hooks[stage][0]["path"] != path {
+			t.Errorf("Expected a %s hook running %s in config.json, got %v", stage, path, oci.Hooks[stage])
+		}
+	}
+	if prestart := spec.Hooks.Prestart[0]; !reflect.DeepEqual(prestart.Args, []string{"netns-setup", "--bridge", "br0"}) || prestart.Timeout == nil || *prestart.Timeout != 10 {
+		t.Errorf("Expected the prestart hook args and timeout, got %+v", prestart)
+	}
+	if env := spec.Hooks.Poststop[0].Env; !reflect.DeepEqual(env, []string{"BRIDGE=br0"}) {
+		t.Errorf("Expected the poststop hook env, got %v", env)
+	}
+
+	spec, err = ConfigInspectToOCI(m.Services[1], inspect, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config, _ := json.Marshal(spec); strings.Contains(string(config), `"hooks"`) {
+		t.Errorf("Expected no hooks in config.json for a service without them, got %s", config)
+	}
+
+	_, err = NewConfig([]byte("services:\n  - name: bad\n    image: alpine\n    hooks:\n      poststop:\n        - path: bin/cleanup\n"))
+	if err == nil || !strings.Contains(err.Error(), "poststop hook bin/cleanup must be an absolute path") {
+		t.Errorf("Expected a relative hook path to be rejected, got %v", err)
+	}
+	label := `{"hooks": {"prestart": [{"path": "setup"}]}}`
+	inspect = types.ImageInspect{Config: &container.Config{Labels: map[string]string{"org.mobyproject.config": label}}}
+	if _, err := ConfigInspectToOCI(m.Services[1], inspect, ""); err == nil {
+		t.Error("Expected a relative hook path in an image label to be rejected")
+	}
+}
+
+func TestMountOptions(t *testing.T) {
+	m, err := NewConfig([]byte(`
+services:
+  - name: docker
+    image: "docker:dind"
+    mounts:
+      - destination: /var/lib/docker
+        type: bind
+        source: /var/lib/docker
+        options: ["rbind"]
+        propagation: rshared
+      - destination: /etc/config
+        type: bind
+        source: /etc/config
+        options: ["rbind"]
+        readonly: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inspect := types.ImageInspect{Config: &container.Config{}}
+	spec, err := ConfigInspectToOCI(m.Services[0], inspect, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var oci struct {
+		Mounts []specs.Mount `json:"mounts"`
+	}
+	if err := json.Unmarshal(config, &oci); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"/var/lib/docker": {"rbind", "rshared"},
+		"/etc/config":     {"rbind", "ro"},
+	}
+	for _, mount := range oci.Mounts {
+		if opts, ok := expected[mount.Destination]; ok {
+			if !reflect.DeepEqual(mount.Options, opts) {
+				t.Errorf("Expected options %v for mount %s in config.json, got %v", opts, mount.Destination, mount.Options)
+			}
+			delete(expected, mount.Destination)
+		}
+	}
+	if len(expected) != 0 {
+		t.Errorf("Expected mounts %v in config.json", expected)
+	}
+
+	for config, msg := range map[string]string{
+		"propagation: recursive":                          "invalid propagation recursive",
+		"propagation: shared\n        options: [private]": "sets propagation shared and option private",
+		"readonly: true\n        options: [rw]":           "is readonly and has option rw",
+	} {
+		_, err := NewConfig([]byte("services:\n  - name: bad\n    image: alpine\n    mounts:\n      - destination: /data\n        " + config + "\n"))
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("Expected %q for mount with %s, got %v", msg, config, err)
+		}
+	}
+	label := `{"mounts": [{"destination": "/data", "propagation": "bogus"}]}`
+	inspect = types.ImageInspect{Config: &container.Config{Labels: map[string]string{"org.mobyproject.config": label}}}
+	if _, err := ConfigInspectToOCI(m.Services[0], inspect, ""); err == nil {
+		t.Error("Expected an invalid propagation in an image label to be rejected")
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// layerPath is a path added to the image by a layer before the files section
+type layerPath struct {
+	layer string
+	dir   bool
+}
+
+// layerPaths records the paths added by each layer as they are appended
+type layerPaths map[string]layerPath
+
+func (p layerPaths) add(layer string, hdr *tar.Header) {
+	p[cleanPath(hdr.Name)] = layerPath{layer: layer, dir: hdr.Typeflag == tar.TypeDir}
+}
+
+// fileConflicts returns the files section entries that replace a path added
+// by an earlier layer and are not marked as an override. A directory entry
+// over an existing directory does not conflict.
+func fileConflicts(files []File, paths layerPaths) []string {
+	conflicts := []string{}
+	for _, f := range files {
+		if f.Override {
+			continue
+		}
+		p, ok := paths[cleanPath(f.Path)]
+		if !ok || (p.dir && f.Directory) {
+			continue
+		}
+		conflicts = append(conflicts, fmt.Sprintf("%s from %s", f.logPath(), p.layer))
+	}
+	return conflicts
+}
+
+// checkFileConflicts warns about files section entries that replace paths in
+// earlier layers, failing instead if strict is set
+func checkFileConflicts(files []File, paths layerPaths, strict bool) error {
+	conflicts := fileConflicts(files, paths)
+	if len(conflicts) == 0 {
+		return nil
+	}
+	if strict {
+		return fmt.Errorf("Files section replaces paths in images, set override on the file if this is intended: %s", strings.Join(conflicts, ", "))
+	}
+	for _, c := range conflicts {
+		log.Warnf("Files section replaces %s, set override on the file if this is intended", c)
+	}
+	return nil
+}
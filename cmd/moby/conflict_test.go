@@ -0,0 +1,67 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func TestFileConflicts(t *testing.T) {
+	paths := layerPaths{}
+	init := makeTar(t, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/hosts", typeflag: tar.TypeReg, contents: "127.0.0.1 localhost"},
+		{name: "etc/issue", typeflag: tar.TypeReg, contents: "init"},
+	})
+	iw := tar.NewWriter(ioutil.Discard)
+	if err := initrdAppend(iw, init, appendOpts{paths: paths, layer: "linuxkit/init"}); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		files     []File
+		conflicts []string
+	}{
+		{[]File{{Path: "etc/motd", Contents: "new"}}, []string{}},
+		{[]File{{Path: "etc", Directory: true}}, []string{}},
+		{[]File{{Path: "etc/hosts", Contents: "override", Override: true}}, []string{}},
+		{[]File{{Path: "etc/hosts", Contents: "conflict"}}, []string{"etc/hosts from linuxkit/init"}},
+		{[]File{{Path: "/etc/issue", Symlink: "motd"}}, []string{"/etc/issue from linuxkit/init"}},
+		{[]File{{Path: "etc/issue", Contents: "secret", Sensitive: true}}, []string{redacted + " from linuxkit/init"}},
+	}
+	for _, testCase := range testCases {
+		if conflicts := fileConflicts(testCase.files, paths); !reflect.DeepEqual(conflicts, testCase.conflicts) {
+			t.Errorf("Expected conflicts %v for %v, got %v", testCase.conflicts, testCase.files, conflicts)
+		}
+	}
+
+	logs := new(bytes.Buffer)
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	conflict := []File{{Path: "etc/hosts", Contents: "conflict"}}
+	if err := checkFileConflicts(conflict, paths, false); err != nil {
+		t.Errorf("Expected only a warning for a conflicting file, got %v", err)
+	}
+	if !strings.Contains(logs.String(), "etc/hosts from linuxkit/init") {
+		t.Errorf("Expected a warning for a conflicting file, got %q", logs.String())
+	}
+	if err := checkFileConflicts(conflict, paths, true); err == nil {
+		t.Error("Expected an error for a conflicting file when strict")
+	}
+
+	logs.Reset()
+	override := []File{{Path: "etc/hosts", Contents: "override", Override: true}}
+	if err := checkFileConflicts(override, paths, true); err != nil {
+		t.Errorf("Unexpected error for an intentional override: %v", err)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("Expected no warning for an intentional override, got %q", logs.String())
+	}
+}
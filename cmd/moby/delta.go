@@ -0,0 +1,251 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// A delta is a tarball of the entries of an image that are new or differ
+// from those of a previous image, so that an update only has to send what
+// changed. Its first entry is an index that lists every entry of the new
+// image in order, saying whether it is in the delta or is the same in the
+// previous image, which is enough to make the new image byte for byte, and
+// the paths of the previous image that are no longer present, for an update
+// that is applied to a filesystem rather than to the previous tarball.
+
+// deltaIndexName is the name of the index entry of a delta
+const deltaIndexName = "moby-delta.json"
+
+// deltaIndex describes how an image is made from the previous image and the
+// entries of a delta
+type deltaIndex struct {
+	// Base and Image are the sha256 of the previous and the new image tarballs
+	Base    string       `json:"base"`
+	Image   string       `json:"image"`
+	Entries []deltaEntry `json:"entries"`
+	Removed []string     `json:"removed,omitempty"`
+}
+
+// deltaEntry is an entry of the new image, which is the next entry of the
+// delta if Delta is set, otherwise the entry of the previous image with the
+// same name
+type deltaEntry struct {
+	Name  string `json:"name"`
+	Delta bool   `json:"delta,omitempty"`
+}
+
+// imageEntry is an entry of an image tarball
+type imageEntry struct {
+	hdr      *tar.Header
+	contents []byte
+}
+
+// imageEntries reads the entries of an image tarball in order
+func imageEntries(image []byte) ([]imageEntry, error) {
+	entries := []imageEntry{}
+	tr := tar.NewReader(bytes.NewReader(image))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, imageEntry{hdr: hdr, contents: contents})
+	}
+}
+
+// entriesByName returns the entries of an image by name, where a name in
+// the tarball more than once is the last entry with it
+func entriesByName(entries []imageEntry) map[string]imageEntry {
+	byName := map[string]imageEntry{}
+	for _, e := range entries {
+		byName[e.hdr.Name] = e
+	}
+	return byName
+}
+
+// writeEntry adds an entry to a tarball
+func writeEntry(tw *tar.Writer, e imageEntry) error {
+	if err := tw.WriteHeader(e.hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(e.contents)
+	return err
+}
+
+// computeDelta returns the delta that makes image from the previous image
+func computeDelta(prev, image []byte) ([]byte, *deltaIndex, error) {
+	prevEntries, err := imageEntries(prev)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot read previous image: %v", err)
+	}
+	entries, err := imageEntries(image)
+	if err != nil {
+		return nil, nil, err
+	}
+	index := &deltaIndex{
+		Base:    fmt.Sprintf("%x", sha256.Sum256(prev)),
+		Image:   fmt.Sprintf("%x", sha256.Sum256(image)),
+		Entries: []deltaEntry{},
+	}
+	before := entriesByName(prevEntries)
+	changed := []imageEntry{}
+	present := map[string]bool{}
+	for _, e := range entries {
+		present[cleanPath(e.hdr.Name)] = true
+		p, ok := before[e.hdr.Name]
+		same := ok && reflect.DeepEqual(p.hdr, e.hdr) && bytes.Equal(p.contents, e.contents)
+		index.Entries = append(index.Entries, deltaEntry{Name: e.hdr.Name, Delta: !same})
+		if !same {
+			changed = append(changed, e)
+		}
+	}
+	for _, p := range prevEntries {
+		name := cleanPath(p.hdr.Name)
+		if !present[name] {
+			index.Removed = append(index.Removed, name)
+			present[name] = true
+		}
+	}
+
+	b, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return nil, nil, err
+	}
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	err = writeEntry(tw, imageEntry{hdr: &tar.Header{Name: deltaIndexName, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(b))}, contents: b})
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, e := range changed {
+		if err := writeEntry(tw, e); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), index, nil
+}
+
+// applyDelta makes the new image from the previous image and a delta,
+// failing unless the delta is against that image and the result is the
+// image it was computed from
+func applyDelta(prev, delta []byte) ([]byte, error) {
+	entries, err := imageEntries(delta)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 || entries[0].hdr.Name != deltaIndexName {
+		return nil, fmt.Errorf("Not a delta, the first entry is not %s", deltaIndexName)
+	}
+	var index deltaIndex
+	if err := json.Unmarshal(entries[0].contents, &index); err != nil {
+		return nil, fmt.Errorf("Cannot read %s: %v", deltaIndexName, err)
+	}
+	if base := fmt.Sprintf("%x", sha256.Sum256(prev)); base != index.Base {
+		return nil, fmt.Errorf("The delta is against the image %s, not %s", index.Base, base)
+	}
+	prevEntries, err := imageEntries(prev)
+	if err != nil {
+		return nil, err
+	}
+	before := entriesByName(prevEntries)
+	changed := entries[1:]
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, de := range index.Entries {
+		var e imageEntry
+		if de.Delta {
+			if len(changed) == 0 || changed[0].hdr.Name != de.Name {
+				return nil, fmt.Errorf("The delta does not have %s", de.Name)
+			}
+			e, changed = changed[0], changed[1:]
+		} else {
+			var ok bool
+			e, ok = before[de.Name]
+			if !ok {
+				return nil, fmt.Errorf("The previous image does not have %s", de.Name)
+			}
+		}
+		if err := writeEntry(tw, e); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if image := fmt.Sprintf("%x", sha256.Sum256(buf.Bytes())); image != index.Image {
+		return nil, fmt.Errorf("Applying the delta made the image %s, not %s", image, index.Image)
+	}
+	return buf.Bytes(), nil
+}
+
+// readDeltaBase reads the previous image of a delta, the file of a tar or
+// tar-gz output
+func readDeltaBase(filename string) ([]byte, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 2 || b[0] != 0x1f || b[1] != 0x8b {
+		return b, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(zr)
+}
+
+// withDelta adds the delta output to the outputs when there is a previous
+// image to compute it against
+func withDelta(out outputList, against string) outputList {
+	if against == "" || hasOutput(out, "delta") {
+		return out
+	}
+	return append(out, "delta")
+}
+
+// outputDelta writes the delta of the image against the previous image,
+// checking that applying it reproduces the image
+func outputDelta(base string, image []byte, o *outputOpts) error {
+	filename := base + "-delta.tar"
+	log.Debugf("output delta: %s against %s", base, o.deltaAgainst)
+	prev, err := readDeltaBase(o.deltaAgainst)
+	if err != nil {
+		return fmt.Errorf("Cannot read previous image: %v", err)
+	}
+	delta, index, err := computeDelta(prev, image)
+	if err != nil {
+		return err
+	}
+	if _, err := applyDelta(prev, delta); err != nil {
+		return fmt.Errorf("The delta does not reproduce the image: %v", err)
+	}
+	changed := 0
+	for _, e := range index.Entries {
+		if e.Delta {
+			changed++
+		}
+	}
+	log.Infof("  %s: %d of %d entries changed, %d removed", filename, changed, len(index.Entries), len(index.Removed))
+	return o.writeFile(filename, delta)
+}
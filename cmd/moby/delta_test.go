@@ -0,0 +1,94 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDelta(t *testing.T) {
+	prev := makeTar(t, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/hostname", typeflag: tar.TypeReg, contents: "moby"},
+		{name: "etc/motd", typeflag: tar.TypeReg, contents: "v1"},
+		{name: "usr/bin/old", typeflag: tar.TypeReg, contents: "old"},
+		{name: "bin/init", typeflag: tar.TypeReg, contents: "init"},
+	}).Bytes()
+	image := makeTar(t, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/hostname", typeflag: tar.TypeReg, contents: "moby"},
+		{name: "etc/motd", typeflag: tar.TypeReg, contents: "v2"},
+		{name: "usr/bin/new", typeflag: tar.TypeReg, contents: "new"},
+		{name: "bin/init", typeflag: tar.TypeReg, contents: "init"},
+	}).Bytes()
+
+	delta, index, err := computeDelta(prev, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdrs, _ := readTar(t, bytes.NewBuffer(delta))
+	names := []string{}
+	for name := range hdrs {
+		names = append(names, name)
+	}
+	if len(names) != 3 || hdrs[deltaIndexName] == nil || hdrs["etc/motd"] == nil || hdrs["usr/bin/new"] == nil {
+		t.Errorf("Expected the delta to have the index and the changed entries, got %v", names)
+	}
+	if !reflect.DeepEqual(index.Removed, []string{"usr/bin/old"}) {
+		t.Errorf("Expected usr/bin/old to be removed, got %v", index.Removed)
+	}
+
+	applied, err := applyDelta(prev, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(applied, image) {
+		t.Errorf("Expected applying the delta to the previous image to reproduce the image")
+	}
+	if _, err := applyDelta(image, delta); err == nil || !strings.Contains(err.Error(), "The delta is against the image") {
+		t.Errorf("Expected applying the delta to another image to fail, got %v", err)
+	}
+
+	// the previous image may be the tar-gz output of the build
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f, err := os.Create(filepath.Join(dir, "prev.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := gzip.NewWriter(f)
+	if _, err := zw.Write(prev); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	o := &outputOpts{deltaAgainst: f.Name()}
+	if err := outFuns["delta"](filepath.Join(dir, "test"), image, o); err != nil {
+		t.Fatal(err)
+	}
+	written, err := ioutil.ReadFile(filepath.Join(dir, "test-delta.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written, delta) {
+		t.Errorf("Expected the delta output to be the delta against the previous image")
+	}
+
+	if err := outFuns["delta"](filepath.Join(dir, "test"), image, &outputOpts{}); err == nil || !strings.Contains(err.Error(), "use -delta-against") {
+		t.Errorf("Expected the delta output to need -delta-against, got %v", err)
+	}
+	if out := withDelta(outputList{"tar"}, "prev.tar"); !reflect.DeepEqual(out, outputList{"tar", "delta"}) {
+		t.Errorf("Expected -delta-against to add the delta output, got %v", out)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// dirMetadataSuffix names the sidecar of a dir output, which lists what
+// could not be restored in the directory, such as ownership and device nodes
+// when building without privileges
+const dirMetadataSuffix = ".metadata.json"
+
+// checkOutputDir checks that a directory can be written by the dir output,
+// which only replaces a directory that is not empty if force is set
+func checkOutputDir(dir string, force bool) error {
+	fi, err := os.Lstat(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s exists and is not a directory", dir)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	if !force {
+		return fmt.Errorf("Directory %s is not empty, use -force to replace it", dir)
+	}
+	return os.RemoveAll(dir)
+}
+
+// tarContentSize returns the size of the regular files in a tarball
+func tarContentSize(image []byte) (int64, error) {
+	size := int64(0)
+	tr := tar.NewReader(bytes.NewReader(image))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+			size += hdr.Size
+		}
+	}
+}
+
+// outputDir unpacks the image into a directory, restoring ownership and
+// device nodes only when running as root on Linux
+func outputDir(base string, image []byte, o *outputOpts) error {
+	log.Debugf("output dir: %s", base)
+	log.Infof("  %s/", base)
+	return writeDir(base, image, unprivileged(), o)
+}
+
+// unprivileged reports whether ownership and device nodes cannot be restored,
+// when not running as root on Linux
+func unprivileged() bool {
+	return runtime.GOOS != "linux" || os.Geteuid() != 0
+}
+
+// writeDir unpacks the image into a directory, when rootless the metadata
+// that needs privileges to restore is written to a sidecar instead
+func writeDir(base string, image []byte, rootless bool, o *outputOpts) error {
+	size, err := tarContentSize(image)
+	if err != nil {
+		return err
+	}
+	if o.maxSize > 0 && o.written+size > o.maxSize {
+		return o.errTooLarge(base)
+	}
+	if err := checkOutputDir(base, o.force); err != nil {
+		return err
+	}
+	summary, err := untarDir(bytes.NewReader(image), base, rootless)
+	if err != nil {
+		return err
+	}
+	if err := o.account(base, size); err != nil {
+		return err
+	}
+
+	sidecar := base + dirMetadataSuffix
+	if len(summary.metadata) == 0 {
+		// a sidecar from an earlier build no longer applies
+		if err := os.Remove(sidecar); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if summary.owners != 0 || len(summary.skipped) != 0 {
+		log.Warnf("Ownership of %d entries and %d entries that need privileges to create are recorded in %s", summary.owners, len(summary.skipped), sidecar)
+	}
+	b, err := json.MarshalIndent(summary.metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	log.Infof("  %s", sidecar)
+	return o.writeFile(sidecar, b)
+}
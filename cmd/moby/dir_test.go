@@ -0,0 +1,157 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOutputDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hdrs := []*tar.Header{
+		{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "bin/busybox", Typeflag: tar.TypeReg, Mode: 04755, Size: 7},
+		{Name: "bin/sh", Typeflag: tar.TypeSymlink, Linkname: "/bin/busybox", Mode: 0777},
+		{Name: "bin/ls", Typeflag: tar.TypeLink, Linkname: "bin/busybox"},
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/shadow", Typeflag: tar.TypeReg, Mode: 0640, Gid: 42, Size: 6},
+		{Name: "root/", Typeflag: tar.TypeDir, Mode: 0500},
+		{Name: "dev/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+	}
+	contents := map[string]string{"bin/busybox": "busybox", "etc/shadow": "root:*"}
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, hdr := range hdrs {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(contents[hdr.Name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	image := buf.Bytes()
+
+	base := filepath.Join(dir, "test")
+	o := &outputOpts{current: "dir"}
+	if err := writeDir(base, image, true, o); err != nil {
+		t.Fatal(err)
+	}
+
+	// the tree matches the tar, apart from what needs privileges
+	for _, hdr := range hdrs {
+		name := strings.TrimSuffix(hdr.Name, "/")
+		fi, err := os.Lstat(filepath.Join(base, name))
+		if hdr.Typeflag == tar.TypeChar {
+			if !os.IsNotExist(err) {
+				t.Errorf("Expected %s to be skipped, got %v", name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected %s in the directory: %v", name, err)
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			// directories are kept accessible without privileges
+			if !fi.IsDir() || fi.Mode().Perm() != os.FileMode(hdr.Mode).Perm()|0700 {
+				t.Errorf("Expected %s to be a directory with mode %o, got %v", name, hdr.Mode|0700, fi.Mode())
+			}
+		case tar.TypeReg:
+			if fi.Mode() != hdr.FileInfo().Mode() {
+				t.Errorf("Expected %s to have mode %v, got %v", name, hdr.FileInfo().Mode(), fi.Mode())
+			}
+			b, err := ioutil.ReadFile(filepath.Join(base, name))
+			if err != nil || string(b) != contents[name] {
+				t.Errorf("Expected %s to contain %q, got %q: %v", name, contents[name], b, err)
+			}
+		case tar.TypeSymlink:
+			if link, err := os.Readlink(filepath.Join(base, name)); err != nil || link != hdr.Linkname {
+				t.Errorf("Expected %s to be a symlink to %s, got %q: %v", name, hdr.Linkname, link, err)
+			}
+		case tar.TypeLink:
+			target, err := os.Stat(filepath.Join(base, hdr.Linkname))
+			if err != nil || !os.SameFile(fi, target) {
+				t.Errorf("Expected %s to be a hard link to %s: %v", name, hdr.Linkname, err)
+			}
+		}
+	}
+
+	// the sidecar has the metadata that was not restored
+	b, err := ioutil.ReadFile(base + dirMetadataSuffix)
+	if err != nil {
+		t.Fatalf("Expected a sidecar with the metadata not restored: %v", err)
+	}
+	var metadata []untarMetadata
+	if err := json.Unmarshal(b, &metadata); err != nil {
+		t.Fatal(err)
+	}
+	recorded := map[string]untarMetadata{}
+	for _, m := range metadata {
+		recorded[m.Path] = m
+	}
+	if m := recorded["dev/null"]; m.Type != "character device" || m.Devmajor != 1 || m.Devminor != 3 || m.Mode != "0666" {
+		t.Errorf("Expected the device node dev/null in the sidecar, got %+v", m)
+	}
+	if m := recorded["root"]; m.Mode != "0500" {
+		t.Errorf("Expected the mode of root in the sidecar, got %+v", m)
+	}
+	if os.Getuid() != 0 || os.Getgid() != 0 {
+		if m := recorded["etc/shadow"]; m.GID != 42 || m.Mode != "0640" {
+			t.Errorf("Expected the owner of etc/shadow in the sidecar, got %+v", m)
+		}
+	}
+	if files := []string{base + dirMetadataSuffix}; !reflect.DeepEqual(o.files["dir"], files) {
+		t.Errorf("Expected the sidecar to be the file written, got %v", o.files["dir"])
+	}
+
+	// a directory that is not empty is only replaced with force
+	if err := writeDir(base, image, true, &outputOpts{}); err == nil || !strings.Contains(err.Error(), "-force") {
+		t.Errorf("Expected an error naming -force for a directory that is not empty, got %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(base, "stale"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// everything in this tar can be restored, so there is no sidecar
+	buf = new(bytes.Buffer)
+	tw = tar.NewWriter(buf)
+	err = tw.WriteHeader(&tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0644, Uid: os.Getuid(), Gid: os.Getgid(), Size: 4})
+	if err == nil {
+		_, err = tw.Write([]byte("moby"))
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeDir(base, buf.Bytes(), true, &outputOpts{force: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(base, "stale")); !os.IsNotExist(err) {
+		t.Errorf("Expected the directory to be replaced, got %v", err)
+	}
+	if _, err := os.Lstat(base + dirMetadataSuffix); !os.IsNotExist(err) {
+		t.Errorf("Expected the sidecar of the earlier build to be removed, got %v", err)
+	}
+
+	// the output is limited by the maximum output size
+	if err := writeDir(filepath.Join(dir, "small"), image, true, &outputOpts{maxSize: 10}); err == nil || !strings.Contains(err.Error(), "maximum output size") {
+		t.Errorf("Expected an error exceeding the maximum output size, got %v", err)
+	}
+}
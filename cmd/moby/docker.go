@@ -14,6 +14,7 @@ import (
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
@@ -118,37 +119,36 @@ func dockerRm(container string) error {
 	return nil
 }
 
-func dockerPull(image string, trustedPull bool) error {
+func dockerPull(image string, trust imageTrust) error {
 	log.Debugf("docker pull: %s", image)
 	cli, err := dockerClient()
 	if err != nil {
 		return errors.New("could not initialize Docker API client")
 	}
 
-	if trustedPull {
+	if trust.verify {
 		log.Debugf("pulling %s with content trust", image)
-		trustedImg, err := TrustedReference(image)
+		trustedImg, verified, err := resolveTrusted(image, TrustSoftFail, func(image string) (reference.Reference, error) {
+			return TrustedReference(image, trust.server, trust.rootKeys)
+		})
 		if err != nil {
 			return fmt.Errorf("Trusted pull for %s failed: %v", image, err)
 		}
 
-		// tag the image on a best-effort basis after pulling with content trust,
-		// ensuring that docker picks up the tag and digest fom the canonical format
-		defer func(src, dst string) {
-			if err := cli.ImageTag(context.Background(), src, dst); err != nil {
-				log.Debugf("could not tag trusted image %s to %s", src, dst)
-			}
-		}(trustedImg.String(), image)
+		if verified {
+			// tag the image on a best-effort basis after pulling with content trust,
+			// ensuring that docker picks up the tag and digest fom the canonical format
+			defer func(src, dst string) {
+				if err := cli.ImageTag(context.Background(), src, dst); err != nil {
+					log.Debugf("could not tag trusted image %s to %s", src, dst)
+				}
+			}(trustedImg, image)
+		}
 
-		image = trustedImg.String()
+		image = trustedImg
 	}
 
-	r, err := cli.ImagePull(context.Background(), image, types.ImagePullOptions{})
-	if err != nil {
-		return err
-	}
-	defer r.Close()
-	_, err = io.Copy(ioutil.Discard, r)
+	err = retryPull(image, PullRetries, daemonPuller(cli))
 	if err != nil {
 		return err
 	}
@@ -171,7 +171,7 @@ func dockerInspectImage(cli *client.Client, image string) (types.ImageInspect, e
 	inspect, _, err := cli.ImageInspectWithRaw(context.Background(), image)
 	if err != nil {
 		if client.IsErrImageNotFound(err) {
-			pullErr := dockerPull(image, false)
+			pullErr := dockerPull(image, imageTrust{})
 			if pullErr != nil {
 				return types.ImageInspect{}, pullErr
 			}
@@ -188,3 +188,12 @@ func dockerInspectImage(cli *client.Client, image string) (types.ImageInspect, e
 
 	return inspect, nil
 }
+
+// dockerImageInspect inspects a local image, pulling it if it is missing
+func dockerImageInspect(image string) (types.ImageInspect, error) {
+	cli, err := dockerClient()
+	if err != nil {
+		return types.ImageInspect{}, errors.New("could not initialize Docker API client")
+	}
+	return dockerInspectImage(cli, image)
+}
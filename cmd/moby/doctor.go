@@ -0,0 +1,183 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// doctorMinFree is the free space in MB in the temporary directory below
+// which builds of typical images are likely to fail
+const doctorMinFree = 2048
+
+// doctorCheck is a check that the environment is ready for builds, critical
+// checks are needed by every build and the others by some outputs
+type doctorCheck struct {
+	name     string
+	critical bool
+	check    func() error
+	hint     string
+}
+
+// doctorDir is a directory that builds write to
+type doctorDir struct {
+	name string
+	path string
+	hint string
+}
+
+// doctorEnv is the environment the checks look at
+type doctorEnv struct {
+	ping     func() error
+	lookPath func(string) (string, error)
+	dirs     []doctorDir
+	diskFree func(string) (uint64, error)
+}
+
+// writableDir checks that files can be created in a directory
+func writableDir(dir string) error {
+	f, err := ioutil.TempFile(dir, ".moby-doctor")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// doctorChecks returns the checks of an environment, the temporary directory
+// is the last of the directories
+func doctorChecks(env doctorEnv) []doctorCheck {
+	checks := []doctorCheck{{
+		name:     "Docker daemon is reachable",
+		critical: true,
+		check:    env.ping,
+		hint:     "Start Docker, or set DOCKER_HOST to a running daemon",
+	}}
+	for _, d := range env.dirs {
+		path := d.path
+		checks = append(checks, doctorCheck{
+			name:     fmt.Sprintf("%s %s is writable", d.name, path),
+			critical: true,
+			check:    func() error { return writableDir(path) },
+			hint:     d.hint,
+		})
+	}
+	if len(env.dirs) != 0 {
+		tmp := env.dirs[len(env.dirs)-1].path
+		checks = append(checks, doctorCheck{
+			name:     fmt.Sprintf("%s has %d MB free", tmp, doctorMinFree),
+			critical: true,
+			check: func() error {
+				free, err := env.diskFree(tmp)
+				if err != nil {
+					return err
+				}
+				if free < doctorMinFree*1024*1024 {
+					return fmt.Errorf("only %d MB free", free/(1024*1024))
+				}
+				return nil
+			},
+			hint: "Free some space, or set TMPDIR to a directory with more space",
+		})
+	}
+
+	needs := map[string][]string{}
+	for out, ts := range tools {
+		for _, tool := range ts {
+			needs[tool] = append(needs[tool], out)
+		}
+	}
+	names := []string{}
+	for tool := range needs {
+		names = append(names, tool)
+	}
+	sort.Strings(names)
+	for _, tool := range names {
+		tool := tool
+		sort.Strings(needs[tool])
+		checks = append(checks, doctorCheck{
+			name: fmt.Sprintf("%s is on the PATH", tool),
+			check: func() error {
+				_, err := env.lookPath(tool)
+				return err
+			},
+			hint: fmt.Sprintf("Install %s to build the %s outputs", tool, strings.Join(needs[tool], ", ")),
+		})
+	}
+	smoke := newSmokeTest(defaultSmokeMarker, defaultSmokeTimeout)
+	checks = append(checks, doctorCheck{
+		name: fmt.Sprintf("%s is on the PATH", smoke.qemu),
+		check: func() error {
+			_, err := env.lookPath(smoke.qemu)
+			return err
+		},
+		hint: fmt.Sprintf("Install %s to boot builds with -smoke-test", smoke.qemu),
+	})
+	return checks
+}
+
+// runDoctor runs the checks and writes a report, returning false if any
+// critical check failed
+func runDoctor(checks []doctorCheck, w io.Writer) bool {
+	ok := true
+	for _, c := range checks {
+		err := c.check()
+		if err == nil {
+			fmt.Fprintf(w, "PASS  %s\n", c.name)
+			continue
+		}
+		status := "WARN"
+		if c.critical {
+			status = "FAIL"
+			ok = false
+		}
+		fmt.Fprintf(w, "%s  %s: %v\n      %s\n", status, c.name, err, c.hint)
+	}
+	return ok
+}
+
+// Process the doctor arguments and check the environment
+func doctor(args []string) {
+	doctorCmd := flag.NewFlagSet("doctor", flag.ExitOnError)
+	doctorCmd.Usage = func() {
+		fmt.Printf("USAGE: %s doctor\n\n", os.Args[0])
+		fmt.Printf("Check that Docker, the output tools and the directories builds use are ready\n\n")
+		fmt.Printf("Options:\n")
+		doctorCmd.PrintDefaults()
+	}
+	if err := doctorCmd.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if len(doctorCmd.Args()) != 0 {
+		doctorCmd.Usage()
+		os.Exit(1)
+	}
+
+	env := doctorEnv{
+		ping: func() error {
+			cli, err := dockerClient()
+			if err != nil {
+				return err
+			}
+			_, err = cli.Ping(context.Background())
+			return err
+		},
+		lookPath: exec.LookPath,
+		dirs: []doctorDir{
+			{"Cache directory", MobyDir, "Make it writable, or choose another directory with -config"},
+			{"Temporary directory", os.TempDir(), "Make it writable, or set TMPDIR to another directory"},
+		},
+		diskFree: diskFree,
+	}
+	if !runDoctor(doctorChecks(env), os.Stdout) {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDoctor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := filepath.Join(dir, "cache")
+	if err := os.Mkdir(cache, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	healthy := func() doctorEnv {
+		return doctorEnv{
+			ping:     func() error { return nil },
+			lookPath: func(tool string) (string, error) { return "/usr/bin/" + tool, nil },
+			dirs: []doctorDir{
+				{"Cache directory", cache, "fix the cache"},
+				{"Temporary directory", dir, "fix the temporary directory"},
+			},
+			diskFree: func(string) (uint64, error) { return 10 * 1024 * 1024 * 1024, nil },
+		}
+	}
+	report := new(bytes.Buffer)
+	if !runDoctor(doctorChecks(healthy()), report) {
+		t.Errorf("Expected a healthy environment to pass, got:\n%s", report)
+	}
+	for _, name := range []string{"Docker daemon is reachable", "Cache directory " + cache + " is writable", "docker is on the PATH", "linuxkit is on the PATH"} {
+		if !strings.Contains(report.String(), "PASS  "+name+"\n") {
+			t.Errorf("Expected %q to pass, got:\n%s", name, report)
+		}
+	}
+	if strings.Contains(report.String(), "FAIL") || strings.Contains(report.String(), "WARN") {
+		t.Errorf("Expected no failures, got:\n%s", report)
+	}
+	files, err := ioutil.ReadDir(cache)
+	if err != nil || len(files) != 0 {
+		t.Errorf("Expected the writable check to clean up, got %v %v", files, err)
+	}
+
+	testCases := []struct {
+		name     string
+		breakEnv func(*doctorEnv)
+		critical bool
+		expected string
+	}{
+		{"daemon", func(e *doctorEnv) { e.ping = func() error { return errors.New("connection refused") } }, true,
+			"FAIL  Docker daemon is reachable: connection refused\n      Start Docker"},
+		{"cache", func(e *doctorEnv) { e.dirs[0].path = filepath.Join(dir, "missing") }, true,
+			"FAIL  Cache directory " + filepath.Join(dir, "missing") + " is writable: "},
+		{"disk", func(e *doctorEnv) { e.diskFree = func(string) (uint64, error) { return 100 * 1024 * 1024, nil } }, true,
+			"FAIL  " + dir + " has 2048 MB free: only 100 MB free\n      Free some space"},
+		{"statfs", func(e *doctorEnv) {
+			e.diskFree = func(string) (uint64, error) { return 0, errors.New("not supported") }
+		}, true,
+			"has 2048 MB free: not supported"},
+		{"tool", func(e *doctorEnv) {
+			e.lookPath = func(tool string) (string, error) {
+				if tool == "linuxkit" {
+					return "", errors.New("executable file not found in $PATH")
+				}
+				return "/usr/bin/" + tool, nil
+			}
+		}, false, "WARN  linuxkit is on the PATH: executable file not found in $PATH\n      Install linuxkit to build the gcp-img, img, img-gz, qcow2 outputs\n"},
+		{"qemu", func(e *doctorEnv) {
+			qemu := newSmokeTest(defaultSmokeMarker, defaultSmokeTimeout).qemu
+			e.lookPath = func(tool string) (string, error) {
+				if tool == qemu {
+					return "", errors.New("executable file not found in $PATH")
+				}
+				return "/usr/bin/" + tool, nil
+			}
+		}, false, "is on the PATH: executable file not found in $PATH\n      Install qemu-system-"},
+	}
+	for _, tc := range testCases {
+		env := healthy()
+		env.dirs = append([]doctorDir{}, env.dirs...)
+		tc.breakEnv(&env)
+		report := new(bytes.Buffer)
+		ok := runDoctor(doctorChecks(env), report)
+		if ok == tc.critical {
+			t.Errorf("%s: expected the doctor to pass %v, got %v:\n%s", tc.name, !tc.critical, ok, report)
+		}
+		if !strings.Contains(report.String(), tc.expected) {
+			t.Errorf("%s: expected the report to contain %q, got:\n%s", tc.name, tc.expected, report)
+		}
+		if n := strings.Count(report.String(), "FAIL") + strings.Count(report.String(), "WARN"); n != 1 {
+			t.Errorf("%s: expected one failed check, got %d:\n%s", tc.name, n, report)
+		}
+	}
+}
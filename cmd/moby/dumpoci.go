@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// dumpOCIConfig writes the config.json of the container bundle at path in
+// the image to the same path under dir, for inspection
+func dumpOCIConfig(dir, path string, config []byte) error {
+	filename := filepath.Join(dir, filepath.FromSlash(path), "config.json")
+	log.Debugf("dump oci: %s", filename)
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return fmt.Errorf("Cannot dump config.json of %s: %v", path, err)
+	}
+	if err := ioutil.WriteFile(filename, config, 0644); err != nil {
+		return fmt.Errorf("Cannot dump config.json of %s: %v", path, err)
+	}
+	return nil
+}
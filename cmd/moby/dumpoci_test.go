@@ -0,0 +1,85 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+func TestDumpOCI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootfs := makeTar(t, []tarEntry{{name: "bin", typeflag: tar.TypeDir}, {name: "bin/sh", typeflag: tar.TypeReg, contents: "sh"}}).Bytes()
+	images := &fakeImages{
+		exports: map[string][]byte{
+			"linuxkit/sysctl:v1": rootfs,
+			"linuxkit/getty:v1":  rootfs,
+		},
+		inspects: map[string]types.ImageInspect{
+			"linuxkit/sysctl:v1": {Os: "linux", Config: &container.Config{Cmd: []string{"/bin/sysctl"}}},
+			"linuxkit/getty:v1":  {Os: "linux", Config: &container.Config{Cmd: []string{"/bin/getty"}}},
+		},
+	}
+	defer func(source imageSource) { Images = source }(Images)
+	Images = images
+
+	m, err := NewConfig([]byte(`
+onboot:
+  - name: sysctl
+    image: linuxkit/sysctl:v1
+services:
+  - name: getty
+    image: linuxkit/getty:v1
+    env:
+      - TERM=linux
+  - name: console
+    image: linuxkit/getty:v1
+    rootfsPath: opt/console
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump := filepath.Join(dir, "oci")
+	image, _, err := buildInternal(m, buildOpts{dumpOCI: dump})
+	if err != nil {
+		t.Fatal(err)
+	}
+	undumped, _, err := buildInternal(m, buildOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(image, undumped) {
+		t.Error("Expected -dump-oci not to change the image")
+	}
+
+	_, contents := readTar(t, bytes.NewBuffer(image))
+	for _, path := range []string{"containers/onboot/000-sysctl", "containers/services/getty", "opt/console"} {
+		b, err := ioutil.ReadFile(filepath.Join(dump, path, "config.json"))
+		if err != nil {
+			t.Errorf("Expected config.json dumped for %s: %v", path, err)
+			continue
+		}
+		var spec map[string]interface{}
+		if err := json.Unmarshal(b, &spec); err != nil {
+			t.Errorf("Expected valid JSON dumped for %s: %v", path, err)
+		}
+		if string(b) != contents[path+"/config.json"] {
+			t.Errorf("Expected the config.json dumped for %s to be the one in the image", path)
+		}
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dump, "containers/services/getty/config.json")); !strings.Contains(string(b), "TERM=linux") {
+		t.Errorf("Expected the getty config.json to have its env, got %s", b)
+	}
+}
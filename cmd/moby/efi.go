@@ -0,0 +1,173 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	peSectionHeaderSize = 40
+	// peSubsystemEFIApplication is the subsystem of an EFI executable
+	peSubsystemEFIApplication = 10
+	// peDataSection are the characteristics of an initialized read only section
+	peDataSection = 0x40000040
+	// peCertificateTable is the index of the data directory of the signatures
+	peCertificateTable = 4
+)
+
+// peSection is a section to add to a PE binary
+type peSection struct {
+	name string
+	data []byte
+}
+
+func peAlign(n, align uint32) uint32 {
+	return (n + align - 1) / align * align
+}
+
+// addPESections appends sections to a PE binary after its existing sections.
+// Any signature is dropped as it does not cover the new sections, so the
+// result is ready to be signed again.
+func addPESections(stub []byte, sections []peSection) ([]byte, error) {
+	le := binary.LittleEndian
+	notPE := errors.New("EFI stub is not a PE binary")
+	if len(stub) < 0x40 || string(stub[0:2]) != "MZ" {
+		return nil, notPE
+	}
+	coff := int(le.Uint32(stub[0x3c:])) + 4
+	if coff+20 > len(stub) || string(stub[coff-4:coff]) != "PE\x00\x00" {
+		return nil, notPE
+	}
+	count := int(le.Uint16(stub[coff+2:]))
+	opt := coff + 20
+	table := opt + int(le.Uint16(stub[coff+16:]))
+	if table+count*peSectionHeaderSize > len(stub) || opt+72 > len(stub) {
+		return nil, notPE
+	}
+	// the optional header differs after the first fields for 32 and 64 bit binaries
+	var dirs int
+	switch le.Uint16(stub[opt:]) {
+	case 0x10b:
+		dirs = opt + 96
+	case 0x20b:
+		dirs = opt + 112
+	default:
+		return nil, notPE
+	}
+	if le.Uint16(stub[opt+68:]) != peSubsystemEFIApplication {
+		return nil, errors.New("EFI stub is not an EFI application")
+	}
+	sectionAlign := le.Uint32(stub[opt+32:])
+	fileAlign := le.Uint32(stub[opt+36:])
+	headers := le.Uint32(stub[opt+60:])
+	if sectionAlign == 0 || fileAlign == 0 || int(headers) > len(stub) {
+		return nil, notPE
+	}
+
+	out := append([]byte{}, stub...)
+	if le.Uint32(stub[dirs-4:]) > peCertificateTable && dirs+8*peCertificateTable+8 <= table {
+		cert := out[dirs+8*peCertificateTable:]
+		// the signatures are the last thing in the file
+		if offset := le.Uint32(cert); offset != 0 && int(offset) <= len(out) {
+			out = out[:offset]
+		}
+		le.PutUint64(cert, 0)
+	}
+
+	// new sections go after the last one in memory, and at the end of the file
+	room := headers
+	va := peAlign(headers, sectionAlign)
+	for i := 0; i < count; i++ {
+		s := out[table+i*peSectionHeaderSize:]
+		if end := peAlign(le.Uint32(s[12:])+le.Uint32(s[8:]), sectionAlign); end > va {
+			va = end
+		}
+		if ptr := le.Uint32(s[20:]); ptr != 0 && ptr < room {
+			room = ptr
+		}
+	}
+	if table+(count+len(sections))*peSectionHeaderSize > int(room) {
+		return nil, fmt.Errorf("EFI stub has no room for %d more section headers", len(sections))
+	}
+	initialized := le.Uint32(out[opt+8:])
+	for i, s := range sections {
+		if len(s.name) > 8 {
+			return nil, fmt.Errorf("PE section name %s is longer than 8 characters", s.name)
+		}
+		out = append(out, make([]byte, int(peAlign(uint32(len(out)), fileAlign))-len(out))...)
+		size := uint32(len(s.data))
+		raw := peAlign(size, fileAlign)
+		h := out[table+(count+i)*peSectionHeaderSize:]
+		copy(h[0:8], s.name)
+		le.PutUint32(h[8:], size)
+		le.PutUint32(h[12:], va)
+		le.PutUint32(h[16:], raw)
+		le.PutUint32(h[20:], uint32(len(out)))
+		le.PutUint32(h[36:], peDataSection)
+		out = append(out, s.data...)
+		out = append(out, make([]byte, raw-size)...)
+		va = peAlign(va+size, sectionAlign)
+		initialized += raw
+	}
+	le.PutUint16(out[coff+2:], uint16(count+len(sections)))
+	le.PutUint32(out[opt+8:], initialized)
+	le.PutUint32(out[opt+56:], va)
+	// the checksum is not checked for EFI binaries and signing sets it
+	le.PutUint32(out[opt+64:], 0)
+	return out, nil
+}
+
+// osRelease returns /etc/os-release from the image, or a minimal one naming
+// the image if it has none, for boot loaders to list the image by
+func osRelease(image []byte, name string) ([]byte, error) {
+	var osrel []byte
+	tr := tar.NewReader(bytes.NewReader(image))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if cleanPath(hdr.Name) == osReleasePath && (hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA) {
+			osrel, err = ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if osrel == nil {
+		osrel = []byte(fmt.Sprintf("ID=linuxkit\nNAME=%q\n", name))
+	}
+	return osrel, nil
+}
+
+// outputEFI writes a unified kernel image, an EFI stub with the kernel,
+// initrd and cmdline added as sections, which the stub boots without a
+// separate boot loader
+func outputEFI(filename string, stub, kernel, initrd []byte, cmdline string, osrel []byte, o *outputOpts) error {
+	log.Debugf("output efi: %s", filename)
+	log.Infof("  %s", filename)
+	sections := []peSection{
+		{".osrel", osrel},
+		{".cmdline", []byte(cmdline)},
+	}
+	if o.kernelVersion != "" {
+		sections = append(sections, peSection{".uname", []byte(o.kernelVersion)})
+	}
+	// the kernel is last as it is the largest and is loaded from there
+	sections = append(sections, peSection{".initrd", initrd}, peSection{".linux", kernel})
+	uki, err := addPESections(stub, sections)
+	if err != nil {
+		return err
+	}
+	return o.writeFile(filename, uki)
+}
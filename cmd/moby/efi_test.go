@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// makeEFIStub makes a 64 bit EFI application with a .text section and
+// headers of the given size, which need room for the section table
+func makeEFIStub(headers uint32) []byte {
+	le := binary.LittleEndian
+	stub := make([]byte, headers+512)
+	copy(stub, "MZ")
+	le.PutUint32(stub[0x3c:], 0x40)
+	copy(stub[0x40:], "PE\x00\x00")
+	coff := stub[0x44:]
+	le.PutUint16(coff[0:], pe.IMAGE_FILE_MACHINE_AMD64)
+	le.PutUint16(coff[2:], 1)
+	le.PutUint16(coff[16:], 240)
+	le.PutUint16(coff[18:], pe.IMAGE_FILE_EXECUTABLE_IMAGE)
+	opt := stub[0x58:]
+	le.PutUint16(opt[0:], 0x20b)
+	le.PutUint32(opt[32:], 4096)
+	le.PutUint32(opt[36:], 512)
+	le.PutUint32(opt[56:], 0x2000)
+	le.PutUint32(opt[60:], headers)
+	le.PutUint16(opt[68:], peSubsystemEFIApplication)
+	le.PutUint32(opt[108:], 16)
+	text := stub[0x58+240:]
+	copy(text[0:8], ".text")
+	le.PutUint32(text[8:], 16)
+	le.PutUint32(text[12:], 0x1000)
+	le.PutUint32(text[16:], 512)
+	le.PutUint32(text[20:], headers)
+	le.PutUint32(text[36:], 0x60000020)
+	return stub
+}
+
+func TestOutputEFI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stub := filepath.Join(dir, "linuxx64.efi.stub")
+	if err := ioutil.WriteFile(stub, makeEFIStub(0x400), 0644); err != nil {
+		t.Fatal(err)
+	}
+	image := testImage(t)
+	base := filepath.Join(dir, "test")
+	o := &outputOpts{efiStub: stub, kernelVersion: "4.9.75-linuxkit"}
+	if err := outFuns["efi"](base, image, o); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := pe.Open(base + ".efi")
+	if err != nil {
+		t.Fatalf("Expected a PE binary: %v", err)
+	}
+	defer f.Close()
+	opt, ok := f.OptionalHeader.(*pe.OptionalHeader64)
+	if !ok || opt.Subsystem != peSubsystemEFIApplication {
+		t.Fatalf("Expected a 64 bit EFI application, got %#v", f.OptionalHeader)
+	}
+
+	kernel, initrd, cmdline, err := tarToInitrd(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		".osrel":   "ID=linuxkit\nNAME=\"test\"\n",
+		".cmdline": cmdline,
+		".uname":   "4.9.75-linuxkit",
+		".initrd":  string(initrd),
+		".linux":   string(kernel),
+	}
+	names := []string{}
+	end := uint32(0)
+	for _, s := range f.Sections {
+		names = append(names, s.Name)
+		if s.VirtualAddress < end {
+			t.Errorf("Expected section %s to start after the previous section", s.Name)
+		}
+		end = s.VirtualAddress + s.VirtualSize
+		if s.VirtualAddress%opt.SectionAlignment != 0 || s.Offset%opt.FileAlignment != 0 {
+			t.Errorf("Expected section %s to be aligned", s.Name)
+		}
+		contents, ok := expected[s.Name]
+		if !ok {
+			continue
+		}
+		data, err := s.Data()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data[:s.VirtualSize]) != contents {
+			t.Errorf("Expected section %s to contain %q, got %q", s.Name, contents, data[:s.VirtualSize])
+		}
+	}
+	if sections := []string{".text", ".osrel", ".cmdline", ".uname", ".initrd", ".linux"}; !reflect.DeepEqual(names, sections) {
+		t.Errorf("Expected sections %v, got %v", sections, names)
+	}
+	if opt.SizeOfImage < end || opt.SizeOfImage%opt.SectionAlignment != 0 {
+		t.Errorf("Expected the image size %d to cover the sections, which end at %d", opt.SizeOfImage, end)
+	}
+	if !strings.Contains(cmdline, "console=ttyS0") {
+		t.Errorf("Expected the cmdline from the kernel config, got %q", cmdline)
+	}
+}
+
+func TestAddPESections(t *testing.T) {
+	sections := []peSection{{".cmdline", []byte("console=ttyS0")}, {".linux", []byte("kernel")}}
+
+	// a signature is removed as it no longer covers the binary
+	signed := append(makeEFIStub(0x400), bytes.Repeat([]byte{0xff}, 64)...)
+	binary.LittleEndian.PutUint32(signed[0x58+112+8*peCertificateTable:], uint32(len(signed)-64))
+	binary.LittleEndian.PutUint32(signed[0x58+112+8*peCertificateTable+4:], 64)
+	uki, err := addPESections(signed, sections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := pe.NewFile(bytes.NewReader(uki))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert := f.OptionalHeader.(*pe.OptionalHeader64).DataDirectory[peCertificateTable]; cert.Size != 0 {
+		t.Errorf("Expected the signature to be removed, got %+v", cert)
+	}
+	if bytes.Contains(uki, bytes.Repeat([]byte{0xff}, 64)) {
+		t.Error("Expected the signature data to be removed")
+	}
+
+	// the headers have exactly enough room for .text and the new sections
+	if _, err := addPESections(makeEFIStub(0x148+3*peSectionHeaderSize), sections); err != nil {
+		t.Errorf("Expected sections to fit in the headers: %v", err)
+	}
+	for _, stub := range [][]byte{makeEFIStub(0x148 + peSectionHeaderSize), []byte("not a binary"), {}} {
+		if _, err := addPESections(stub, sections); err == nil {
+			t.Errorf("Expected an error adding sections to a %d byte stub", len(stub))
+		}
+	}
+	app := makeEFIStub(0x400)
+	binary.LittleEndian.PutUint16(app[0x58+68:], 3)
+	if _, err := addPESections(app, sections); err == nil || !strings.Contains(err.Error(), "not an EFI application") {
+		t.Errorf("Expected an error for a stub that is not an EFI application, got %v", err)
+	}
+
+	if err := outFuns["efi"]("test", testImage(t), &outputOpts{}); err == nil || !strings.Contains(err.Error(), "-efi-stub") {
+		t.Errorf("Expected an error naming -efi-stub without a stub, got %v", err)
+	}
+}
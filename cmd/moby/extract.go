@@ -0,0 +1,309 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Process the extract arguments and execute extract
+func extract(args []string) {
+	extractCmd := flag.NewFlagSet("extract", flag.ExitOnError)
+	extractCmd.Usage = func() {
+		fmt.Printf("USAGE: %s extract [options] <image> <dir>\n\n", os.Args[0])
+		fmt.Printf("Extract the root filesystem of an image as it would be added to a build\n\n")
+		fmt.Printf("Options:\n")
+		extractCmd.PrintDefaults()
+	}
+	extractTar := extractCmd.Bool("tar", false, "Write the root filesystem to a tar file rather than a directory")
+	extractPull := extractCmd.Bool("pull", false, "Always pull the image")
+	extractTrust := extractCmd.Bool("content-trust", false, "Verify the image with content trust, as a trust section in a config would")
+	extractRootless := extractCmd.Bool("rootless", false, "Extract without privileges, skipping device nodes and ownership and listing what is not restored, the default when not run as root on Linux")
+	extractPrivileged := extractCmd.Bool("privileged", false, "Fail if device nodes or ownership cannot be restored, rather than skipping them when not run as root")
+	extractStrict := extractCmd.Bool("strict-extract", false, "Fail on anomalies in the image, such as entries outside its root filesystem")
+	var extractRegistryCAs outputList
+	extractCmd.Var(&extractRegistryCAs, "registry-ca", "CA certificate file to trust for content trust servers, in addition to the system CAs")
+	var extractInsecureRegistries outputList
+	extractCmd.Var(&extractInsecureRegistries, "insecure-registry", "Registry host[:port] to connect to without verifying TLS certificates or over plain HTTP, for development only")
+	extractTrustSoftFail := extractCmd.Bool("trust-soft-fail", false, "Pull without verification if content trust data is unavailable, verification failures are still errors")
+	var extractTrustRootKeys outputList
+	extractCmd.Var(&extractTrustRootKeys, "trust-root-key", "Pin the content trust root key ID of an image repository, as image=keyid, a new root signed by it replaces the cached root")
+
+	if err := extractCmd.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	remArgs := extractCmd.Args()
+	if len(remArgs) != 2 {
+		fmt.Println("Please specify an image and a destination")
+		extractCmd.Usage()
+		os.Exit(1)
+	}
+
+	if *extractRootless && *extractPrivileged {
+		log.Fatal("-rootless and -privileged cannot both be set")
+	}
+	rootless := *extractRootless || (!*extractPrivileged && unprivileged())
+
+	trustRootKeys, err := parseTrustRootKeys(extractTrustRootKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
+	TrustSoftFail = *extractTrustSoftFail
+	TrustRootKeys = trustRootKeys
+	RegistryCAs = extractRegistryCAs
+	for _, host := range extractInsecureRegistries {
+		if err := validInsecureRegistry(host); err != nil {
+			log.Fatal(err)
+		}
+	}
+	InsecureRegistries = extractInsecureRegistries
+	warnInsecureRegistries()
+	StrictExtract = *extractStrict
+
+	image, dest := remArgs[0], remArgs[1]
+	rootfs, err := ImageExtract(image, "", imageTrust{verify: *extractTrust}, *extractPull, nil)
+	if err != nil {
+		log.Fatalf("Failed to extract %s: %v", image, err)
+	}
+	if *extractTar {
+		err = ioutil.WriteFile(dest, rootfs, os.FileMode(0644))
+		if err != nil {
+			log.Fatalf("Failed to write %s: %v", dest, err)
+		}
+	} else {
+		summary, err := untarDir(bytes.NewReader(rootfs), dest, rootless)
+		if err != nil {
+			log.Fatalf("Failed to write %s: %v", dest, err)
+		}
+		if len(summary.skipped) != 0 {
+			log.Warnf("Skipped entries that need privileges to create:")
+			for _, s := range summary.skipped {
+				log.Warnf("  %s", s)
+			}
+		}
+		if summary.owners != 0 {
+			log.Warnf("Ownership of %d entries not owned by the current user was not restored", summary.owners)
+		}
+	}
+	log.Infof("Extracted %s to %s", image, dest)
+}
+
+// untarSummary lists what an extraction without privileges did not restore
+type untarSummary struct {
+	// skipped are the device nodes and fifos not created, and links to them
+	skipped []string
+	// owners is the number of entries not owned by the current user whose
+	// ownership was not restored
+	owners int
+	// metadata is what was not restored of each entry it lists
+	metadata []untarMetadata
+}
+
+// untarMetadata is the metadata of a tar entry that could not be restored,
+// the type is set for an entry that was not created at all
+type untarMetadata struct {
+	Path     string `json:"path"`
+	Type     string `json:"type,omitempty"`
+	Linkname string `json:"linkname,omitempty"`
+	Mode     string `json:"mode"`
+	UID      int    `json:"uid"`
+	GID      int    `json:"gid"`
+	Devmajor int64  `json:"devmajor,omitempty"`
+	Devminor int64  `json:"devminor,omitempty"`
+}
+
+// entryMetadata returns the metadata of a tar entry
+func entryMetadata(hdr *tar.Header, kind string) untarMetadata {
+	m := untarMetadata{
+		Path: path.Clean(hdr.Name),
+		Type: kind,
+		Mode: fmt.Sprintf("%04o", hdr.Mode&07777),
+		UID:  hdr.Uid,
+		GID:  hdr.Gid,
+	}
+	if hdr.Typeflag == tar.TypeLink {
+		m.Linkname = hdr.Linkname
+	}
+	if kind != "" && hdr.Typeflag != tar.TypeLink {
+		m.Devmajor = hdr.Devmajor
+		m.Devminor = hdr.Devminor
+	}
+	return m
+}
+
+// entryMode returns the permissions of a tar entry with the setuid, setgid
+// and sticky bits
+func entryMode(hdr *tar.Header) os.FileMode {
+	return hdr.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+}
+
+// specialTypes names the entry types that need privileges to create
+var specialTypes = map[byte]string{
+	tar.TypeChar:  "character device",
+	tar.TypeBlock: "block device",
+	tar.TypeFifo:  "fifo",
+}
+
+// untarDir writes the contents of a tarball into a directory. Restoring
+// ownership and creating device nodes need privileges, so when rootless is set
+// they are skipped and listed in the summary instead. Directories are kept
+// accessible to the current user when rootless, so the extracted tree can be
+// removed without privileges.
+func untarDir(r io.Reader, dir string, rootless bool) (untarSummary, error) {
+	summary := untarSummary{}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return summary, err
+	}
+	skipped := map[string]bool{}
+	// directories are made writable until all their entries are extracted
+	dirs := []string{}
+	dirModes := map[string]os.FileMode{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return summary, err
+		}
+		path, err := untarPath(dir, hdr.Name)
+		if err != nil {
+			return summary, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return summary, err
+		}
+		if err := removeSymlink(path); err != nil {
+			return summary, err
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+		unrestored := false
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, mode|0700); err != nil {
+				return summary, err
+			}
+			if _, ok := dirModes[path]; !ok {
+				dirs = append(dirs, path)
+			}
+			dirModes[path] = entryMode(hdr)
+			if rootless && mode&0700 != 0700 {
+				unrestored = true
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+			if err != nil {
+				return summary, err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return summary, err
+			}
+			// the mode is not masked by the umask
+			if err := os.Chmod(path, entryMode(hdr)); err != nil {
+				return summary, err
+			}
+		case tar.TypeSymlink:
+			os.Remove(path)
+			if err := os.Symlink(hdr.Linkname, path); err != nil {
+				return summary, err
+			}
+		case tar.TypeLink:
+			target, err := untarPath(dir, hdr.Linkname)
+			if err != nil {
+				return summary, err
+			}
+			if skipped[target] {
+				skipped[path] = true
+				summary.skipped = append(summary.skipped, fmt.Sprintf("%s (link to %s)", hdr.Name, hdr.Linkname))
+				summary.metadata = append(summary.metadata, entryMetadata(hdr, "hard link"))
+				continue
+			}
+			os.Remove(path)
+			if err := os.Link(target, path); err != nil {
+				return summary, err
+			}
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			if rootless {
+				skipped[path] = true
+				summary.skipped = append(summary.skipped, fmt.Sprintf("%s (%s)", hdr.Name, specialTypes[hdr.Typeflag]))
+				summary.metadata = append(summary.metadata, entryMetadata(hdr, specialTypes[hdr.Typeflag]))
+				continue
+			}
+			os.Remove(path)
+			if err := mknod(path, hdr); err != nil {
+				return summary, fmt.Errorf("Cannot create %s %s, use -rootless to skip it: %v", specialTypes[hdr.Typeflag], hdr.Name, err)
+			}
+		default:
+			log.Debugf("untar: skipping %s of type %c", hdr.Name, hdr.Typeflag)
+			continue
+		}
+		if rootless {
+			if hdr.Uid != os.Getuid() || hdr.Gid != os.Getgid() {
+				summary.owners++
+				unrestored = true
+			}
+			if unrestored {
+				summary.metadata = append(summary.metadata, entryMetadata(hdr, ""))
+			}
+			continue
+		}
+		if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+			return summary, fmt.Errorf("Cannot set the owner of %s, use -rootless to skip it: %v", hdr.Name, err)
+		}
+	}
+	// the deepest directories first, as a parent may not be writable
+	for i := len(dirs) - 1; i >= 0; i-- {
+		mode := dirModes[dirs[i]]
+		if rootless {
+			mode |= 0700
+		}
+		if err := os.Chmod(dirs[i], mode); err != nil {
+			return summary, err
+		}
+	}
+	return summary, nil
+}
+
+// removeSymlink removes a symlink extracted earlier at path, so an entry of
+// the same name is not written, chmodded or chowned through it to where it
+// points
+func removeSymlink(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// untarPath returns where a tar entry is written under dir, refusing names
+// that leave it either directly or through a symlink extracted earlier
+func untarPath(dir, name string) (string, error) {
+	rel := filepath.Clean(name)
+	if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("Tar entry %s is outside %s", name, dir)
+	}
+	path := dir
+	parts := strings.Split(rel, string(filepath.Separator))
+	for i, part := range parts {
+		path = filepath.Join(path, part)
+		if i == len(parts)-1 {
+			break
+		}
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("Tar entry %s is beneath the symlink %s", name, filepath.Join(parts[:i+1]...))
+		}
+	}
+	return path, nil
+}
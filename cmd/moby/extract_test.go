@@ -0,0 +1,177 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type linkEntry struct {
+	name     string
+	typeflag byte
+	contents string
+	linkname string
+	uid      int
+	major    int64
+	minor    int64
+}
+
+func makeLinkTar(t *testing.T, entries []linkEntry) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Mode:     0644,
+			Size:     int64(len(e.contents)),
+			Linkname: e.linkname,
+			Uid:      e.uid,
+			Devmajor: e.major,
+			Devminor: e.minor,
+		}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestUntarDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the layout of an exported image, which has no leading prefix
+	rootfs := makeLinkTar(t, []linkEntry{
+		{name: "bin/", typeflag: tar.TypeDir},
+		{name: "bin/busybox", typeflag: tar.TypeReg, contents: "busybox"},
+		{name: "bin/sh", typeflag: tar.TypeSymlink, linkname: "/bin/busybox"},
+		{name: "bin/ls", typeflag: tar.TypeLink, linkname: "bin/busybox"},
+		{name: "etc/hostname", typeflag: tar.TypeReg, contents: "moby"},
+		{name: "etc/shadow", typeflag: tar.TypeReg, contents: "root:*", uid: 4242},
+		{name: "dev/null", typeflag: tar.TypeChar, major: 1, minor: 3},
+		{name: "dev/null2", typeflag: tar.TypeLink, linkname: "dev/null"},
+		{name: "dev/sda", typeflag: tar.TypeBlock, major: 8},
+		{name: "run/initctl", typeflag: tar.TypeFifo},
+	})
+	summary, err := untarDir(rootfs, dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skipped := []string{"dev/null (character device)", "dev/null2 (link to dev/null)", "dev/sda (block device)", "run/initctl (fifo)"}
+	if !reflect.DeepEqual(summary.skipped, skipped) {
+		t.Errorf("Expected skipped entries %v, got %v", skipped, summary.skipped)
+	}
+	// the six entries that are extracted are owned by root apart from etc/shadow
+	owners := 6
+	if os.Getuid() == 0 && os.Getgid() == 0 {
+		owners = 1
+	}
+	if summary.owners != owners {
+		t.Errorf("Expected %d entries with ownership not restored, got %d", owners, summary.owners)
+	}
+
+	for path, expected := range map[string]string{"bin/busybox": "busybox", "bin/ls": "busybox", "etc/hostname": "moby"} {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, path))
+		if err != nil {
+			t.Errorf("Expected %s to be extracted: %v", path, err)
+		} else if string(contents) != expected {
+			t.Errorf("Expected %s to contain %q, got %q", path, expected, contents)
+		}
+	}
+	if link, err := os.Readlink(filepath.Join(dir, "bin/sh")); err != nil || link != "/bin/busybox" {
+		t.Errorf("Expected bin/sh to be a symlink to /bin/busybox, got %q: %v", link, err)
+	}
+	for _, special := range []string{"dev/null", "dev/null2", "dev/sda", "run/initctl"} {
+		if _, err := os.Lstat(filepath.Join(dir, special)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be skipped, got %v", special, err)
+		}
+	}
+
+	for _, entries := range [][]linkEntry{
+		{{name: "../escape", typeflag: tar.TypeReg, contents: "x"}},
+		{{name: "/escape", typeflag: tar.TypeReg, contents: "x"}},
+		{{name: "link", typeflag: tar.TypeLink, linkname: "../escape"}},
+		{{name: "up", typeflag: tar.TypeSymlink, linkname: ".."}, {name: "up/escape", typeflag: tar.TypeReg, contents: "x"}},
+	} {
+		if _, err := untarDir(makeLinkTar(t, entries), filepath.Join(dir, "unsafe"), true); err == nil {
+			t.Errorf("Expected error extracting %s outside the directory", entries[len(entries)-1].name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escape")); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing written outside the directory, got %v", err)
+	}
+}
+
+func TestUntarOverSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outside := filepath.Join(dir, "outside")
+	if err := os.Mkdir(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(outside, "target")
+	if err := ioutil.WriteFile(target, []byte("keep"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// each name is a symlink out of the directory before it is replaced
+	image := makeLinkTar(t, []linkEntry{
+		{name: "etc/passwd", typeflag: tar.TypeSymlink, linkname: target},
+		{name: "etc/passwd", typeflag: tar.TypeReg, contents: "replaced"},
+		{name: "etc/hosts", typeflag: tar.TypeSymlink, linkname: target},
+		{name: "etc/hosts", typeflag: tar.TypeLink, linkname: "etc/passwd"},
+		{name: "var", typeflag: tar.TypeSymlink, linkname: outside},
+		{name: "var", typeflag: tar.TypeDir},
+	}).Bytes()
+
+	for _, extract := range []struct {
+		name string
+		f    func(dest string) error
+	}{
+		{"untarDir", func(dest string) error {
+			_, err := untarDir(bytes.NewReader(image), dest, true)
+			return err
+		}},
+		{"dir output", func(dest string) error {
+			return writeDir(dest, image, true, &outputOpts{})
+		}},
+	} {
+		dest := filepath.Join(dir, extract.name)
+		if err := extract.f(dest); err != nil {
+			t.Fatalf("%s: %v", extract.name, err)
+		}
+		b, err := ioutil.ReadFile(target)
+		fi, statErr := os.Stat(target)
+		if err != nil || string(b) != "keep" || statErr != nil || fi.Mode().Perm() != 0600 {
+			t.Errorf("%s: Expected the file outside the directory to be unchanged, got %q %v", extract.name, b, fi.Mode())
+		}
+		for _, name := range []string{"etc/passwd", "etc/hosts"} {
+			fi, err := os.Lstat(filepath.Join(dest, name))
+			if err != nil || !fi.Mode().IsRegular() {
+				t.Errorf("%s: Expected %s to replace the symlink with a file, got %v", extract.name, name, err)
+			}
+		}
+		if fi, err := os.Lstat(filepath.Join(dest, "var")); err != nil || !fi.IsDir() {
+			t.Errorf("%s: Expected var to replace the symlink with a directory, got %v", extract.name, err)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// fatMaxFile is the largest file FAT32 can store, 4GiB less a byte
+var fatMaxFile int64 = 1<<32 - 1
+
+// checkFATFile fails if a file that an output puts on the FAT EFI system
+// partition of the image is larger than FAT32 can store, rather than the
+// output being corrupt, as the file cannot be split across the partition
+func checkFATFile(output, what string, size int64) error {
+	if size <= fatMaxFile {
+		return nil
+	}
+	return fmt.Errorf("The %s is %d bytes, larger than the %d bytes of a file on FAT32, which the %s output puts it on. -fat-split only splits the files of the kernel+initrd and initrd outputs", what, size, fatMaxFile, output)
+}
+
+// writeFATFile writes a file of an output that may be copied to a FAT boot
+// partition, in numbered parts that FAT32 can store if it is too large and
+// fatSplit is set
+func (o *outputOpts) writeFATFile(filename string, data []byte) error {
+	if !o.fatSplit || int64(len(data)) <= fatMaxFile {
+		return o.writeFile(filename, data)
+	}
+	parts := 0
+	for start := int64(0); start < int64(len(data)); start += fatMaxFile {
+		end := start + fatMaxFile
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		err := o.writeFile(fmt.Sprintf("%s.%03d", filename, parts), data[start:end])
+		if err != nil {
+			return err
+		}
+		parts++
+	}
+	name := filepath.Base(filename)
+	log.Warnf("%s is larger than a file on FAT32 can be, it is written in %d parts. Join them with: cat %s.* > %s, or list them in order on the initrd line of a boot loader that loads several initrds, such as GRUB", filename, parts, name, name)
+	return nil
+}
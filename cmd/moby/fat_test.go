@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFATOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(max int64) { fatMaxFile = max }(fatMaxFile)
+
+	image := testImage(t)
+	_, initrd, _, err := tarToInitrd(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fatMaxFile = int64(len(initrd)/3 + 1)
+
+	// the FAT outputs fail before the image is built, even with -fat-split
+	stub := filepath.Join(dir, "linuxx64.efi.stub")
+	if err := ioutil.WriteFile(stub, []byte("stub"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ output, expected string }{
+		{"iso-efi", "The initrd is"},
+		{"efi", "The unified kernel image is"},
+	} {
+		o := &outputOpts{efiStub: stub, fatSplit: true}
+		err := outFuns[tc.output](filepath.Join(dir, "test"), image, o)
+		if err == nil || !strings.Contains(err.Error(), tc.expected) || !strings.Contains(err.Error(), "on FAT32, which the "+tc.output+" output puts it on") {
+			t.Errorf("Expected the %s output to fail with %q, got %v", tc.output, tc.expected, err)
+		}
+	}
+
+	// without -fat-split the initrd is written whole
+	base := filepath.Join(dir, "whole")
+	o := &outputOpts{}
+	if err := outputs(base, image, outputList{"kernel+initrd"}, o); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(base + "-initrd.img"); err != nil {
+		t.Errorf("Expected the initrd without -fat-split, got %v", err)
+	}
+
+	// with -fat-split it is written in parts no larger than FAT32 allows,
+	// which join to the initrd
+	base = filepath.Join(dir, "split")
+	o = &outputOpts{fatSplit: true}
+	if err := outputs(base, image, outputList{"kernel+initrd"}, o); err != nil {
+		t.Fatal(err)
+	}
+	parts := []string{base + "-initrd.img.000", base + "-initrd.img.001", base + "-initrd.img.002"}
+	if !reflect.DeepEqual(o.files["kernel+initrd"], append(parts, base+"-kernel", base+"-cmdline")) {
+		t.Errorf("Expected the initrd in parts %v, got %v", parts, o.files["kernel+initrd"])
+	}
+	joined := []byte{}
+	for _, part := range parts {
+		b, err := ioutil.ReadFile(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(b)) > fatMaxFile {
+			t.Errorf("Expected %s to fit on FAT32, it is %d bytes", part, len(b))
+		}
+		joined = append(joined, b...)
+	}
+	if string(joined) != string(initrd) {
+		t.Error("Expected the parts to join to the initrd")
+	}
+	if _, err := os.Stat(base + "-initrd.img"); !os.IsNotExist(err) {
+		t.Errorf("Expected no whole initrd with -fat-split, got %v", err)
+	}
+}
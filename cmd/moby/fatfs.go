@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	// fatRootEntries is the number of entries in the root directory, which
+	// take 32 sectors
+	fatRootEntries = 512
+	fatEntrySize   = 32
+	// fatMinClusters and fatMaxClusters are the cluster counts of FAT16
+	fatMinClusters = 4085
+	fatMaxClusters = 65524
+	fatAttrLabel   = 0x08
+	fatAttrDir     = 0x10
+	fatAttrFile    = 0x20
+	fatAttrLFN     = 0x0f
+	// fatDate is 1980-01-01, the earliest date FAT can store, so the same
+	// files always give the same filesystem
+	fatDate = 0x0021
+)
+
+// fatFile is a file to add to a FAT filesystem, at a path with / separators
+type fatFile struct {
+	path     string
+	contents []byte
+}
+
+// fatNode is a file or directory of a FAT filesystem being written
+type fatNode struct {
+	name     string
+	dir      bool
+	contents []byte
+	children []*fatNode
+	parent   *fatNode
+	cluster  uint16
+	short    [11]byte
+}
+
+// lfnEntries returns the number of long file name entries for a name
+func lfnEntries(name string) int {
+	return (len(utf16.Encode([]rune(name))) + 12) / 13
+}
+
+// dirBytes is the size of the entries of a directory, with the volume label
+// in the root and the . and .. entries in others
+func (n *fatNode) dirBytes() int {
+	entries := 2
+	if n.parent == nil {
+		entries = 1
+	}
+	for _, c := range n.children {
+		entries += lfnEntries(c.name) + 1
+	}
+	return entries * fatEntrySize
+}
+
+// fatShortName makes a unique 8.3 name for a name in a directory, which
+// always has a long name entry as well
+func fatShortName(name string, used map[[11]byte]bool) ([11]byte, error) {
+	clean := func(s string) string {
+		b := []byte{}
+		for _, c := range strings.ToUpper(s) {
+			if (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || strings.ContainsRune("!#$%&'()-@^_`{}~", c) {
+				b = append(b, byte(c))
+			}
+		}
+		return string(b)
+	}
+	base, ext := name, ""
+	if i := strings.LastIndex(name, "."); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	base, ext = clean(base), clean(ext)
+	if len(base) > 6 {
+		base = base[:6]
+	}
+	if len(ext) > 3 {
+		ext = ext[:3]
+	}
+	for i := 1; i < 10000; i++ {
+		tail := fmt.Sprintf("~%d", i)
+		b := base
+		if len(b)+len(tail) > 8 {
+			b = b[:8-len(tail)]
+		}
+		var short [11]byte
+		copy(short[:], fmt.Sprintf("%-8s%-3s", b+tail, ext))
+		if !used[short] {
+			used[short] = true
+			return short, nil
+		}
+	}
+	return [11]byte{}, fmt.Errorf("Too many files like %s in a directory", name)
+}
+
+// fatChecksum is the checksum of a short name kept in its long name entries
+func fatChecksum(short [11]byte) byte {
+	var sum byte
+	for _, c := range short {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+	return sum
+}
+
+// fatDirEntry encodes the short entry of a file, directory or volume label
+func fatDirEntry(short [11]byte, attr byte, cluster uint16, size uint32) []byte {
+	e := make([]byte, fatEntrySize)
+	copy(e[0:11], short[:])
+	e[11] = attr
+	binary.LittleEndian.PutUint16(e[16:], fatDate)
+	binary.LittleEndian.PutUint16(e[18:], fatDate)
+	binary.LittleEndian.PutUint16(e[24:], fatDate)
+	binary.LittleEndian.PutUint16(e[26:], cluster)
+	binary.LittleEndian.PutUint32(e[28:], size)
+	return e
+}
+
+// fatLFNEntries encodes the long name entries of a name, which come before
+// its short entry with the last part of the name first
+func fatLFNEntries(name string, short [11]byte) []byte {
+	chars := utf16.Encode([]rune(name))
+	n := lfnEntries(name)
+	if len(chars)%13 != 0 {
+		chars = append(chars, 0)
+	}
+	for len(chars) < n*13 {
+		chars = append(chars, 0xffff)
+	}
+	sum := fatChecksum(short)
+	out := []byte{}
+	for i := n; i >= 1; i-- {
+		e := make([]byte, fatEntrySize)
+		e[0] = byte(i)
+		if i == n {
+			e[0] |= 0x40
+		}
+		e[11] = fatAttrLFN
+		e[13] = sum
+		part := chars[(i-1)*13 : i*13]
+		for j, c := range part {
+			off := 1 + 2*j
+			if j >= 5 {
+				off = 14 + 2*(j-5)
+			}
+			if j >= 11 {
+				off = 28 + 2*(j-11)
+			}
+			binary.LittleEndian.PutUint16(e[off:], c)
+		}
+		out = append(out, e...)
+	}
+	return out
+}
+
+// fatTree arranges files into directories, in order of their names
+func fatTree(files []fatFile) (*fatNode, error) {
+	root := &fatNode{dir: true}
+	dirs := map[string]*fatNode{"": root}
+	var dir func(p string) (*fatNode, error)
+	dir = func(p string) (*fatNode, error) {
+		if d, ok := dirs[p]; ok {
+			if !d.dir {
+				return nil, fmt.Errorf("%s is a file and a directory", p)
+			}
+			return d, nil
+		}
+		parent, err := dir(path.Dir("/" + p)[1:])
+		if err != nil {
+			return nil, err
+		}
+		d := &fatNode{name: path.Base(p), dir: true, parent: parent}
+		parent.children = append(parent.children, d)
+		dirs[p] = d
+		return d, nil
+	}
+	for _, f := range files {
+		p := cleanPath(f.path)
+		if p == "" {
+			return nil, fmt.Errorf("Invalid file path %q", f.path)
+		}
+		if _, ok := dirs[p]; ok {
+			return nil, fmt.Errorf("%s is in the filesystem twice", p)
+		}
+		parent, err := dir(path.Dir("/" + p)[1:])
+		if err != nil {
+			return nil, err
+		}
+		n := &fatNode{name: path.Base(p), contents: f.contents, parent: parent}
+		parent.children = append(parent.children, n)
+		dirs[p] = n
+	}
+	var sortTree func(n *fatNode) error
+	sortTree = func(n *fatNode) error {
+		sort.Slice(n.children, func(i, j int) bool { return n.children[i].name < n.children[j].name })
+		used := map[[11]byte]bool{}
+		for _, c := range n.children {
+			short, err := fatShortName(c.name, used)
+			if err != nil {
+				return err
+			}
+			c.short = short
+			if err := sortTree(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return root, sortTree(root)
+}
+
+// fatFilesystem formats a FAT16 filesystem of size bytes with a volume label,
+// holding the files given
+func fatFilesystem(size int64, label string, files []fatFile) ([]byte, error) {
+	sectors := size / sectorSize
+	spc := int64(1)
+	for sectors/spc > fatMaxClusters {
+		spc *= 2
+	}
+	rootSectors := int64(fatRootEntries * fatEntrySize / sectorSize)
+	fatSectors := ((sectors/spc+2)*2 + sectorSize - 1) / sectorSize
+	dataStart := 1 + 2*fatSectors + rootSectors
+	clusters := (sectors - dataStart) / spc
+	if clusters < fatMinClusters {
+		return nil, fmt.Errorf("A FAT16 filesystem of %d bytes is too small", size)
+	}
+	clusterBytes := spc * sectorSize
+
+	root, err := fatTree(files)
+	if err != nil {
+		return nil, err
+	}
+	if root.dirBytes() > fatRootEntries*fatEntrySize {
+		return nil, fmt.Errorf("Too many files in the root directory of the filesystem")
+	}
+
+	fs := make([]byte, sectors*sectorSize)
+	fat := make([]uint16, clusters+2)
+	fat[0], fat[1] = 0xfff8, 0xffff
+	next := int64(2)
+	// allocate lays out each file and directory in contiguous clusters
+	var allocate func(n *fatNode) error
+	allocate = func(n *fatNode) error {
+		for _, c := range n.children {
+			length := int64(len(c.contents))
+			if c.dir {
+				length = int64(c.dirBytes())
+			}
+			count := (length + clusterBytes - 1) / clusterBytes
+			if count == 0 {
+				continue
+			}
+			if next+count > clusters+2 {
+				return fmt.Errorf("The files do not fit in a FAT16 filesystem of %d bytes", size)
+			}
+			c.cluster = uint16(next)
+			for i := int64(0); i < count; i++ {
+				fat[next+i] = uint16(next + i + 1)
+			}
+			fat[next+count-1] = 0xffff
+			next += count
+			if c.dir {
+				if err := allocate(c); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := allocate(root); err != nil {
+		return nil, err
+	}
+
+	var shortLabel [11]byte
+	copy(shortLabel[:], fmt.Sprintf("%-11s", strings.ToUpper(label)))
+	offset := func(cluster uint16) int64 {
+		return (dataStart + (int64(cluster)-2)*spc) * sectorSize
+	}
+	var write func(n *fatNode, at int64)
+	write = func(n *fatNode, at int64) {
+		entries := []byte{}
+		if n.parent == nil {
+			entries = append(entries, fatDirEntry(shortLabel, fatAttrLabel, 0, 0)...)
+		} else {
+			var dot, dotdot [11]byte
+			copy(dot[:], ".          ")
+			copy(dotdot[:], "..         ")
+			entries = append(entries, fatDirEntry(dot, fatAttrDir, n.cluster, 0)...)
+			entries = append(entries, fatDirEntry(dotdot, fatAttrDir, n.parent.cluster, 0)...)
+		}
+		for _, c := range n.children {
+			entries = append(entries, fatLFNEntries(c.name, c.short)...)
+			if c.dir {
+				entries = append(entries, fatDirEntry(c.short, fatAttrDir, c.cluster, 0)...)
+				write(c, offset(c.cluster))
+				continue
+			}
+			entries = append(entries, fatDirEntry(c.short, fatAttrFile, c.cluster, uint32(len(c.contents)))...)
+			if c.cluster != 0 {
+				copy(fs[offset(c.cluster):], c.contents)
+			}
+		}
+		copy(fs[at:], entries)
+	}
+	write(root, (1+2*fatSectors)*sectorSize)
+
+	for i := int64(0); i < 2; i++ {
+		at := (1 + i*fatSectors) * sectorSize
+		for j, e := range fat {
+			binary.LittleEndian.PutUint16(fs[at+int64(2*j):], e)
+		}
+	}
+
+	b := fs[:sectorSize]
+	copy(b[0:3], []byte{0xeb, 0x3c, 0x90})
+	copy(b[3:11], "MOBY    ")
+	binary.LittleEndian.PutUint16(b[11:], sectorSize)
+	b[13] = byte(spc)
+	binary.LittleEndian.PutUint16(b[14:], 1)
+	b[16] = 2
+	binary.LittleEndian.PutUint16(b[17:], fatRootEntries)
+	if sectors < 65536 {
+		binary.LittleEndian.PutUint16(b[19:], uint16(sectors))
+	} else {
+		binary.LittleEndian.PutUint32(b[32:], uint32(sectors))
+	}
+	b[21] = 0xf8
+	binary.LittleEndian.PutUint16(b[22:], uint16(fatSectors))
+	binary.LittleEndian.PutUint16(b[24:], 32)
+	binary.LittleEndian.PutUint16(b[26:], 64)
+	b[36] = 0x80
+	b[38] = 0x29
+	// the serial number is derived from the files, so it is stable
+	serial := sha256.Sum256(fs)
+	copy(b[39:43], serial[:4])
+	copy(b[43:54], shortLabel[:])
+	copy(b[54:62], "FAT16   ")
+	b[510], b[511] = 0x55, 0xaa
+	return fs, nil
+}
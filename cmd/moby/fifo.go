@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// isFIFO returns whether filename is an existing named pipe
+func isFIFO(filename string) bool {
+	fi, err := os.Stat(filename)
+	return err == nil && fi.Mode()&os.ModeNamedPipe != 0
+}
+
+// fifoOutput returns the output whose file is an existing named pipe, or ""
+// if there is none. Only a build of that one output can write to the pipe.
+func fifoOutput(base string, out outputList) (string, error) {
+	for _, o := range out {
+		suffix, ok := outputSuffixes[o]
+		if !ok || !isFIFO(base+suffix) {
+			continue
+		}
+		if len(out) != 1 {
+			return "", fmt.Errorf("%s is a named pipe, which can only be written by a build of the single output %s, not %s", base+suffix, o, out.String())
+		}
+		return o, nil
+	}
+	return "", nil
+}
+
+// streamFuns write the single file of an output to w as it is made, so it is
+// streamed to a named pipe without being written anywhere else first
+var streamFuns = map[string]func(w io.Writer, filename string, image []byte, o *outputOpts) error{
+	"tar": func(w io.Writer, filename string, image []byte, o *outputOpts) error {
+		_, err := o.limitWriter(filename, w).Write(image)
+		return err
+	},
+	"tar-gz": writeTarGz,
+}
+
+// outputFIFO streams an output to its named pipe, which blocks until a reader
+// opens the pipe. An output that cannot be written to the pipe as it is made
+// is written to a temporary directory first. The pipe is not recorded as a
+// file written, it cannot be read back.
+func outputFIFO(base string, image []byte, o string, opts *outputOpts) error {
+	fifo := base + outputSuffixes[o]
+	stream, ok := streamFuns[o]
+	if !ok {
+		tmp, err := ioutil.TempDir("", "moby-fifo")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		tmpBase := filepath.Join(tmp, filepath.Base(base))
+		if err := outFuns[o](tmpBase, image, opts); err != nil {
+			return err
+		}
+		delete(opts.files, o)
+		stream = func(w io.Writer, filename string, image []byte, opts *outputOpts) error {
+			in, err := os.Open(tmpBase + outputSuffixes[o])
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+			_, err = io.Copy(w, in)
+			return err
+		}
+	}
+
+	log.Infof("  Stream to the named pipe %s", fifo)
+	out, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err := stream(out, fifo, image, opts); err != nil {
+		out.Close()
+		return fmt.Errorf("Cannot stream %s to the named pipe %s: %v", o, fifo, err)
+	}
+	return out.Close()
+}
@@ -0,0 +1,97 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestOutputFIFO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	image := testImage(t)
+	base := filepath.Join(dir, "test")
+
+	// the consumer reads the pipe as the output is streamed to it
+	type read struct {
+		b   []byte
+		err error
+	}
+	consume := func(fifo string) chan read {
+		done := make(chan read)
+		go func() {
+			f, err := os.Open(fifo)
+			if err != nil {
+				done <- read{err: err}
+				return
+			}
+			defer f.Close()
+			b, err := ioutil.ReadAll(f)
+			done <- read{b, err}
+		}()
+		return done
+	}
+
+	// tar and tar-gz are written straight to the pipe, without a temporary
+	// file, and the others through one
+	defer func(tmp string) { os.Setenv("TMPDIR", tmp) }(os.Getenv("TMPDIR"))
+	for _, output := range []string{"tar", "tar-gz", "initrd"} {
+		fifo := base + outputSuffixes[output]
+		if err := syscall.Mkfifo(fifo, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := streamFuns[output]; ok {
+			os.Setenv("TMPDIR", filepath.Join(dir, "missing"))
+		} else {
+			os.Setenv("TMPDIR", dir)
+		}
+		done := consume(fifo)
+		o := &outputOpts{compressLevel: defaultCompressLevel}
+		if err := outputs(base, image, outputList{output}, o); err != nil {
+			t.Fatalf("Cannot stream %s: %v", output, err)
+		}
+		r := <-done
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		plain := filepath.Join(dir, "plain")
+		if err := outputs(plain, image, outputList{output}, &outputOpts{compressLevel: defaultCompressLevel}); err != nil {
+			t.Fatal(err)
+		}
+		want, err := ioutil.ReadFile(plain + outputSuffixes[output])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(r.b, want) {
+			t.Errorf("Expected the %d bytes of the %s output from the named pipe, got %d", len(want), output, len(r.b))
+		}
+		if !isFIFO(fifo) || len(o.files[output]) != 0 {
+			t.Errorf("Expected the named pipe to be kept and not recorded as an output file, got %v", o.files)
+		}
+		if err := os.Remove(fifo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Setenv("TMPDIR", dir)
+
+	fifo := base + ".tar"
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := outputs(base, image, outputList{"tar", "tar-gz"}, &outputOpts{}); err == nil || !strings.Contains(err.Error(), "can only be written by a build of the single output tar") {
+		t.Errorf("Expected a named pipe with more than one output to be an error, got %v", err)
+	}
+	if _, err := os.Stat(base + ".tar.gz"); !os.IsNotExist(err) {
+		t.Errorf("Expected no outputs to be written with the named pipe error, got %v", err)
+	}
+}
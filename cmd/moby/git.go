@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// gitConfig is a reference to a config file in a Git repository, written as
+// git://host/repo//path/config.yml@ref or git+<scheme>://host/repo//path/config.yml@ref
+type gitConfig struct {
+	url  string
+	path string
+	ref  string
+}
+
+func isGitConfig(s string) bool {
+	return strings.HasPrefix(s, "git://") || strings.HasPrefix(s, "git+")
+}
+
+func parseGitConfig(s string) (gitConfig, error) {
+	g := gitConfig{}
+	if !isGitConfig(s) {
+		return g, fmt.Errorf("not a git config reference: %s", s)
+	}
+	u := strings.TrimPrefix(s, "git+")
+	i := strings.Index(u, "://")
+	if i == -1 {
+		return g, fmt.Errorf("git config reference has no scheme: %s", s)
+	}
+	// the path in the repository follows the first // after the scheme
+	j := strings.Index(u[i+3:], "//")
+	if j == -1 {
+		return g, fmt.Errorf("git config reference is missing //path to the config file: %s", s)
+	}
+	g.url = u[:i+3+j]
+	g.path = u[i+3+j+2:]
+	if k := strings.LastIndex(g.path, "@"); k != -1 {
+		g.ref = g.path[k+1:]
+		g.path = g.path[:k]
+	}
+	if g.ref == "" {
+		g.ref = "HEAD"
+	}
+	if g.path == "" {
+		return g, fmt.Errorf("git config reference has an empty path: %s", s)
+	}
+	g.path = filepath.Clean(g.path)
+	if filepath.IsAbs(g.path) || strings.HasPrefix(g.path, "..") {
+		return g, fmt.Errorf("config path must be inside the repository: %s", s)
+	}
+	return g, nil
+}
+
+func git(dir string, args ...string) error {
+	_, err := gitOutput(dir, args...)
+	return err
+}
+
+// gitOutput runs git in dir, returning its output
+func gitOutput(dir string, args ...string) (string, error) {
+	log.Debugf("git: %s", strings.Join(args, " "))
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		return "", errors.New("git does not seem to be installed")
+	}
+	cmd := exec.Command(gitPath, args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s failed: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// gitCommit returns the commit checked out in the repository containing dir
+func gitCommit(dir string) (string, error) {
+	return gitOutput(dir, "rev-parse", "HEAD")
+}
+
+// fetch does a shallow fetch of the ref into a temporary directory, returning
+// the directory, which the caller must remove.
+func (g gitConfig) fetch() (string, error) {
+	dir, err := ioutil.TempDir("", "moby-git")
+	if err != nil {
+		return "", err
+	}
+	// init and fetch rather than clone so that the ref can also be a commit
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"fetch", "-q", "--depth", "1", g.url, g.ref},
+		{"checkout", "-q", "FETCH_HEAD"},
+	} {
+		if err := git(dir, args...); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// gitFetchConfig reads a config file from a Git repository, returning the config and the
+// checked out repository, which relative paths in the config are resolved against.
+func gitFetchConfig(g gitConfig) ([]byte, string, error) {
+	log.Infof("Fetch config %s from %s at %s", g.path, g.url, g.ref)
+	dir, err := g.fetch()
+	if err != nil {
+		return []byte{}, "", err
+	}
+	config, err := ioutil.ReadFile(filepath.Join(dir, g.path))
+	if err != nil {
+		os.RemoveAll(dir)
+		return []byte{}, "", err
+	}
+	return config, dir, nil
+}
+
+// resolveFiles makes the file sources in a config relative to root, refusing
+// absolute sources and those that would leave it, including through symlinks
+func resolveFiles(m *Moby, root string) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	for i, f := range m.Files {
+		if f.Source == "" {
+			continue
+		}
+		clean := path.Clean(filepath.ToSlash(f.Source))
+		if filepath.IsAbs(f.Source) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return fmt.Errorf("Invalid source %s of file %s: must be inside the repository", f.Source, f.Path)
+		}
+		source := filepath.Join(root, f.Source)
+		real, err := filepath.EvalSymlinks(source)
+		if err != nil {
+			return fmt.Errorf("Cannot resolve source %s of file %s: %v", f.Source, f.Path, err)
+		}
+		if rel, err := filepath.Rel(realRoot, real); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("Invalid source %s of file %s: must be inside the repository", f.Source, f.Path)
+		}
+		m.Files[i].Source = source
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseGitConfig(t *testing.T) {
+	testCases := []struct {
+		ref      string
+		expected gitConfig
+	}{
+		{"git://github.com/linuxkit/linuxkit//examples/docker.yml@v0.1", gitConfig{"git://github.com/linuxkit/linuxkit", "examples/docker.yml", "v0.1"}},
+		{"git://github.com/linuxkit/linuxkit//linuxkit.yml", gitConfig{"git://github.com/linuxkit/linuxkit", "linuxkit.yml", "HEAD"}},
+		{"git+https://example.com/repo.git//a/b.yml@abc123", gitConfig{"https://example.com/repo.git", "a/b.yml", "abc123"}},
+		{"git+file:///srv/repo.git//config.yml@master", gitConfig{"file:///srv/repo.git", "config.yml", "master"}},
+	}
+	for _, testCase := range testCases {
+		g, err := parseGitConfig(testCase.ref)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %s: %v", testCase.ref, err)
+			continue
+		}
+		if g != testCase.expected {
+			t.Errorf("Expected %v parsing %s, got %v", testCase.expected, testCase.ref, g)
+		}
+	}
+
+	for _, ref := range []string{"git://github.com/linuxkit/linuxkit", "git+https://example.com/repo.git//../config.yml", "git://example.com/repo//@v1"} {
+		if _, err := parseGitConfig(ref); err == nil {
+			t.Errorf("Expected error parsing %s", ref)
+		}
+	}
+}
+
+func TestGitFetchConfig(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bare := filepath.Join(dir, "repo.git")
+	work := filepath.Join(dir, "work")
+	run := func(dir string, args ...string) {
+		args = append([]string{"-c", "user.name=moby", "-c", "user.email=moby@example.com"}, args...)
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+	write := func(name, contents string) {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(work, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(work, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run(dir, "init", "-q", "--bare", bare)
+	run(dir, "init", "-q", work)
+	write("configs/test.yml", "files:\n  - path: etc/motd\n    source: files/motd\n")
+	write("files/motd", "v1")
+	run(work, "add", ".")
+	run(work, "commit", "-q", "-m", "v1")
+	run(work, "tag", "v1")
+	write("files/motd", "v2")
+	run(work, "commit", "-q", "-a", "-m", "v2")
+	run(work, "push", "-q", bare, "HEAD:refs/heads/master", "v1")
+
+	for ref, expected := range map[string]string{"v1": "v1", "master": "v2"} {
+		g, err := parseGitConfig("git+file://" + bare + "//configs/test.yml@" + ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, root, err := gitFetchConfig(g)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+		m, err := NewConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := resolveFiles(&m, root); err != nil {
+			t.Fatal(err)
+		}
+		if m.Files[0].Source != filepath.Join(root, "files/motd") {
+			t.Errorf("Expected source to be resolved against the repository, got %s", m.Files[0].Source)
+		}
+		_, contents := readTar(t, mustFilesystem(t, m))
+		if contents["etc/motd"] != expected {
+			t.Errorf("Expected contents %s at ref %s, got %s", expected, ref, contents["etc/motd"])
+		}
+	}
+
+	// the hash of a config does not depend on where it was checked out
+	hashes := []string{}
+	for i := 0; i < 2; i++ {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stdout := os.Stdout
+		os.Stdout = w
+		c := &buildCommand{printConfigHash: true}
+		err = c.run("git+file://"+bare+"//configs/test.yml@v1", "")
+		os.Stdout = stdout
+		w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, string(hash))
+	}
+	if hashes[0] == "" || hashes[0] != hashes[1] {
+		t.Errorf("Expected the hash of a git config to be stable, got %q", hashes)
+	}
+
+	g, err := parseGitConfig("git+file://" + bare + "//configs/test.yml@nonexistent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := gitFetchConfig(g); err == nil {
+		t.Error("Expected error fetching nonexistent ref")
+	}
+}
+
+func TestResolveFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "repo")
+	if err := os.MkdirAll(filepath.Join(root, "files"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{filepath.Join(root, "files/motd"), filepath.Join(root, "motd"), filepath.Join(dir, "motd")} {
+		if err := ioutil.WriteFile(file, []byte("motd"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{"files/link": "../motd", "files/escape": "../../motd", "files/host": "/etc/passwd"} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for source, expected := range map[string]string{
+		"files/motd":       filepath.Join(root, "files/motd"),
+		"files/../motd":    filepath.Join(root, "motd"),
+		"files/link":       filepath.Join(root, "files/link"),
+		"/etc/motd":        "",
+		"files/escape":     "",
+		"files/host":       "",
+		"../motd":          "",
+		"files/../../motd": "",
+		"..":               "",
+	} {
+		m := Moby{Files: []File{{Path: "etc/motd", Source: source}}}
+		err := resolveFiles(&m, root)
+		if expected == "" {
+			if err == nil || !strings.Contains(err.Error(), "must be inside the repository") {
+				t.Errorf("Expected source %s outside the repository to be an error, got %v", source, err)
+			}
+			continue
+		}
+		if err != nil || m.Files[0].Source != expected {
+			t.Errorf("Expected source %s to resolve to %s, got %s %v", source, expected, m.Files[0].Source, err)
+		}
+	}
+}
@@ -3,12 +3,16 @@ package main
 import (
 	"archive/tar"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"path"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
 )
 
 // This uses Docker to convert a Docker image into a tarball. It would be an improvement if we
@@ -39,24 +43,56 @@ nameserver 2001:4860:4860::8844
 	"etc/hostname": "moby",
 }
 
+// StrictExtract makes anomalies found while extracting an image, such as
+// entries outside its root filesystem, errors rather than warnings
+var StrictExtract bool
+
+// extractWarning reports an anomaly in an image, returning it as an error if
+// StrictExtract is set
+func extractWarning(image, format string, args ...interface{}) error {
+	msg := fmt.Sprintf("Image %s %s", image, fmt.Sprintf(format, args...))
+	if StrictExtract {
+		return errors.New(msg)
+	}
+	log.Warn(msg)
+	return nil
+}
+
+// exportTypes are the entry types expected in an exported container
+var exportTypes = map[byte]bool{
+	tar.TypeReg:     true,
+	tar.TypeRegA:    true,
+	tar.TypeDir:     true,
+	tar.TypeSymlink: true,
+	tar.TypeLink:    true,
+	tar.TypeChar:    true,
+	tar.TypeBlock:   true,
+	tar.TypeFifo:    true,
+}
+
 // ImageExtract extracts the filesystem from an image and returns a tarball with the files prefixed by the given path
-func ImageExtract(image, prefix string, trust bool, pull bool) ([]byte, error) {
-	log.Debugf("image extract: %s %s", image, prefix)
+func ImageExtract(image, prefix string, trust imageTrust, pull bool, timings *buildTimings) ([]byte, error) {
 	out := new(bytes.Buffer)
-	tw := tar.NewWriter(out)
-	err := tarPrefix(prefix, tw)
-	if err != nil {
+	if err := ImageExtractTo(out, image, prefix, trust, pull, timings); err != nil {
 		return []byte{}, err
 	}
-	err = imageTar(image, prefix, tw, trust, pull)
+	return out.Bytes(), nil
+}
+
+// ImageExtractTo extracts the filesystem from an image and writes it to w as a
+// tarball with the files prefixed by the given path
+func ImageExtractTo(w io.Writer, image, prefix string, trust imageTrust, pull bool, timings *buildTimings) error {
+	log.Debugf("image extract: %s %s", image, prefix)
+	tw := tar.NewWriter(w)
+	err := tarPrefix(prefix, tw)
 	if err != nil {
-		return []byte{}, err
+		return err
 	}
-	err = tw.Close()
+	_, err = imageTar(image, prefix, tw, trust, pull, timings)
 	if err != nil {
-		return []byte{}, err
+		return err
 	}
-	return out.Bytes(), nil
+	return tw.Close()
 }
 
 // tarPrefix creates the leading directories for a path
@@ -87,49 +123,149 @@ func tarPrefix(path string, tw *tar.Writer) error {
 	return nil
 }
 
-func imageTar(image, prefix string, tw *tar.Writer, trust bool, pull bool) error {
-	log.Debugf("image tar: %s %s", image, prefix)
-	if prefix != "" && prefix[len(prefix)-1] != byte('/') {
-		return fmt.Errorf("prefix does not end with /: %s", prefix)
+// imagePull pulls an image, with content trust if trust is set, returning
+// how long the pull took
+func imagePull(image string, trust imageTrust) (time.Duration, error) {
+	var d time.Duration
+	err := registrySlots.run(image, func() error {
+		log.Infof("Pull image: %s", image)
+		start := time.Now()
+		err := registryRateLimits.retry(registryHost(image), image, func() error {
+			return dockerPull(image, trust)
+		})
+		d = time.Since(start)
+		return err
+	})
+	if err != nil {
+		return d, fmt.Errorf("Could not pull image %s: %v", image, err)
 	}
+	return d, nil
+}
 
-	if pull || trust {
-		log.Infof("Pull image: %s", image)
-		err := dockerPull(image, trust)
+// imageSource provides the filesystems and configs of the images in a build
+type imageSource interface {
+	// export returns the filesystem of an image as an exported container,
+	// and the time spent pulling the image
+	export(image string, trust imageTrust, pull bool) ([]byte, time.Duration, error)
+	inspect(image string) (types.ImageInspect, error)
+	// pull updates an image from its registry, returning the time spent
+	pull(image string, trust imageTrust) (time.Duration, error)
+}
+
+// Images is where builds get images from, the Docker daemon unless a build
+// is being replayed
+var Images imageSource = dockerImages{}
+
+// dockerImages gets images from the Docker daemon, pulling them if they are
+// not available locally
+type dockerImages struct{}
+
+func (dockerImages) export(image string, trust imageTrust, pull bool) ([]byte, time.Duration, error) {
+	var pulled time.Duration
+	if pull || trust.verify {
+		d, err := imagePull(image, trust)
+		pulled += d
 		if err != nil {
-			return fmt.Errorf("Could not pull image %s: %v", image, err)
+			return nil, pulled, err
 		}
 	}
 	container, err := dockerCreate(image)
 	if err != nil {
 		// if the image wasn't found, pull it down.  Bail on other errors.
 		if strings.Contains(err.Error(), "No such image") {
-			log.Infof("Pull image: %s", image)
-			err := dockerPull(image, trust)
+			d, err := imagePull(image, trust)
+			pulled += d
 			if err != nil {
-				return fmt.Errorf("Could not pull image %s: %v", image, err)
+				return nil, pulled, err
 			}
 			container, err = dockerCreate(image)
 			if err != nil {
-				return fmt.Errorf("Failed to docker create image %s: %v", image, err)
+				return nil, pulled, fmt.Errorf("Failed to docker create image %s: %v", image, err)
 			}
 		} else {
-			return fmt.Errorf("Failed to create docker image %s: %v", image, err)
+			return nil, pulled, fmt.Errorf("Failed to create docker image %s: %v", image, err)
 		}
 	}
 	contents, err := dockerExport(container)
 	if err != nil {
-		return fmt.Errorf("Failed to docker export container from container %s: %v", container, err)
+		return nil, pulled, fmt.Errorf("Failed to docker export container from container %s: %v", container, err)
 	}
 	err = dockerRm(container)
 	if err != nil {
-		return fmt.Errorf("Failed to docker rm container %s: %v", container, err)
+		return nil, pulled, fmt.Errorf("Failed to docker rm container %s: %v", container, err)
+	}
+	return contents, pulled, nil
+}
+
+func (dockerImages) inspect(image string) (types.ImageInspect, error) {
+	return dockerImageInspect(image)
+}
+
+func (dockerImages) pull(image string, trust imageTrust) (time.Duration, error) {
+	return imagePull(image, trust)
+}
+
+// imageRepoDigest returns the digest of an image, the repository digest if the
+// image was pulled from a registry, otherwise the image ID
+func imageRepoDigest(image string) (string, error) {
+	inspect, err := Images.inspect(image)
+	if err != nil {
+		return "", err
+	}
+	for _, rd := range inspect.RepoDigests {
+		parts := strings.SplitN(rd, "@", 2)
+		if len(parts) == 2 {
+			return parts[1], nil
+		}
+	}
+	return inspect.ID, nil
+}
+
+// imageTar writes the filesystem of an image to tw with the prefix,
+// returning the number of regular files written, and adds the time spent
+// pulling and extracting it to timings
+func imageTar(image, prefix string, tw *tar.Writer, trust imageTrust, pull bool, timings *buildTimings) (int, error) {
+	log.Debugf("image tar: %s %s", image, prefix)
+	if prefix != "" && prefix[len(prefix)-1] != byte('/') {
+		return 0, fmt.Errorf("prefix does not end with /: %s", prefix)
+	}
+	// the pull is timed on its own, the rest is extraction
+	start := time.Now()
+	var pulled time.Duration
+	defer func() {
+		if pulled != 0 {
+			timings.add(phasePull, image, pulled)
+		}
+		timings.add(phaseExtract, image, time.Since(start)-pulled)
+	}()
+
+	contents, pulled, err := Images.export(image, trust, pull)
+	if err != nil {
+		return 0, err
 	}
 
-	// now we need to filter out some files from the resulting tar archive
+	files, err := copyExportFiles(image, prefix, contents, tw)
+	if err != nil {
+		return 0, err
+	}
+	err = tw.Close()
+	if err != nil {
+		return 0, err
+	}
+	return files, nil
+}
+
+// copyExport copies an exported container to tw with the prefix, filtering
+// out the files added by docker
+func copyExport(image, prefix string, contents []byte, tw *tar.Writer) error {
+	_, err := copyExportFiles(image, prefix, contents, tw)
+	return err
+}
 
-	r := bytes.NewReader(contents)
-	tr := tar.NewReader(r)
+// copyExportFiles is copyExport, returning the number of regular files copied
+func copyExportFiles(image, prefix string, contents []byte, tw *tar.Writer) (int, error) {
+	tr := tar.NewReader(bytes.NewReader(contents))
+	files := 0
 
 	for {
 		hdr, err := tr.Next()
@@ -137,58 +273,93 @@ func imageTar(image, prefix string, tw *tar.Writer, trust bool, pull bool) error
 			break
 		}
 		if err != nil {
-			return err
+			return 0, err
+		}
+		clean := path.Clean(hdr.Name)
+		if path.IsAbs(hdr.Name) || clean == ".." || strings.HasPrefix(clean, "../") {
+			if err := extractWarning(image, "has an entry %s outside its root filesystem", hdr.Name); err != nil {
+				return 0, err
+			}
+			// the entry is never added, it would be written outside the prefix
+			continue
+		}
+		if !exportTypes[hdr.Typeflag] {
+			if err := extractWarning(image, "has an entry %s of unsupported type %c", hdr.Name, hdr.Typeflag); err != nil {
+				return 0, err
+			}
 		}
 		if exclude[hdr.Name] {
 			log.Debugf("image tar: %s %s exclude %s", image, prefix, hdr.Name)
 			_, err = io.Copy(ioutil.Discard, tr)
 			if err != nil {
-				return err
+				return 0, err
 			}
-		} else if replace[hdr.Name] != "" {
+			continue
+		}
+		if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+			files++
+		}
+		if replace[hdr.Name] != "" {
 			contents := replace[hdr.Name]
 			hdr.Size = int64(len(contents))
 			hdr.Name = prefix + hdr.Name
 			log.Debugf("image tar: %s %s add %s", image, prefix, hdr.Name)
 			if err := tw.WriteHeader(hdr); err != nil {
-				return err
+				return 0, err
 			}
 			buf := bytes.NewBufferString(contents)
 			_, err = io.Copy(tw, buf)
 			if err != nil {
-				return err
+				return 0, err
 			}
 			_, err = io.Copy(ioutil.Discard, tr)
 			if err != nil {
-				return err
+				return 0, err
 			}
 		} else {
 			log.Debugf("image tar: %s %s add %s", image, prefix, hdr.Name)
 			hdr.Name = prefix + hdr.Name
 			if err := tw.WriteHeader(hdr); err != nil {
-				return err
+				return 0, err
 			}
 			_, err = io.Copy(tw, tr)
 			if err != nil {
-				return err
+				return 0, err
 			}
 		}
 	}
-	err = tw.Close()
-	if err != nil {
-		return err
+	return files, nil
+}
+
+// emptyRootfs warns that the root filesystem of a bundle has no regular
+// files, which usually means the image is misconfigured or for another
+// platform, and fails instead if strict or StrictExtract is set
+func emptyRootfs(name string, strict bool) error {
+	if strict || StrictExtract {
+		return fmt.Errorf("The root filesystem of %s has no files", name)
 	}
+	log.Warnf("The root filesystem of %s has no files, it will not be able to run", name)
 	return nil
 }
 
 // ImageBundle produces an OCI bundle at the given path in a tarball, given an image and a config.json
-func ImageBundle(path string, image string, config []byte, trust bool, pull bool) ([]byte, error) {
-	log.Debugf("image bundle: %s %s cfg: %s", path, image, string(config))
+func ImageBundle(path string, image string, config []byte, trust imageTrust, pull bool, timings *buildTimings) ([]byte, error) {
 	out := new(bytes.Buffer)
-	tw := tar.NewWriter(out)
+	if _, err := ImageBundleTo(out, path, image, config, trust, pull, timings); err != nil {
+		return []byte{}, err
+	}
+	return out.Bytes(), nil
+}
+
+// ImageBundleTo writes an OCI bundle at the given path to w as a tarball,
+// given an image and a config.json, returning the number of regular files in
+// its root filesystem
+func ImageBundleTo(w io.Writer, path string, image string, config []byte, trust imageTrust, pull bool, timings *buildTimings) (int, error) {
+	log.Debugf("image bundle: %s %s cfg: %s", path, image, string(config))
+	tw := tar.NewWriter(w)
 	err := tarPrefix(path+"/rootfs/", tw)
 	if err != nil {
-		return []byte{}, err
+		return 0, err
 	}
 	hdr := &tar.Header{
 		Name: path + "/" + "config.json",
@@ -197,20 +368,20 @@ func ImageBundle(path string, image string, config []byte, trust bool, pull bool
 	}
 	err = tw.WriteHeader(hdr)
 	if err != nil {
-		return []byte{}, err
+		return 0, err
 	}
 	buf := bytes.NewBuffer(config)
 	_, err = io.Copy(tw, buf)
 	if err != nil {
-		return []byte{}, err
+		return 0, err
 	}
-	err = imageTar(image, path+"/rootfs/", tw, trust, pull)
+	files, err := imageTar(image, path+"/rootfs/", tw, trust, pull, timings)
 	if err != nil {
-		return []byte{}, err
+		return 0, err
 	}
 	err = tw.Close()
 	if err != nil {
-		return []byte{}, err
+		return 0, err
 	}
-	return out.Bytes(), nil
+	return files, nil
 }
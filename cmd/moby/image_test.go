@@ -0,0 +1,117 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+func TestEmptyRootfs(t *testing.T) {
+	logs := new(bytes.Buffer)
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+	defer func(source imageSource) { Images = source }(Images)
+	Images = &fakeImages{
+		exports: map[string][]byte{
+			"example/empty:v1": makeTar(t, []tarEntry{
+				{name: "etc", typeflag: tar.TypeDir},
+				{name: "bin/sh", typeflag: tar.TypeSymlink},
+			}).Bytes(),
+			"example/full:v1": makeTar(t, []tarEntry{{name: "bin/nginx", typeflag: tar.TypeReg, contents: "binary"}}).Bytes(),
+		},
+		inspects: map[string]types.ImageInspect{},
+	}
+
+	// the config.json does not count as a file in the root filesystem
+	path := "containers/services/nginx"
+	files, err := ImageBundleTo(new(bytes.Buffer), path, "example/empty:v1", []byte("{}"), imageTrust{}, false, nil)
+	if err != nil || files != 0 {
+		t.Fatalf("Expected no files in the empty root filesystem, got %d %v", files, err)
+	}
+	if err := emptyRootfs("nginx", false); err != nil {
+		t.Errorf("Expected only a warning for an empty root filesystem, got %v", err)
+	}
+	if !strings.Contains(logs.String(), "nginx has no files") {
+		t.Errorf("Expected a warning for an empty root filesystem, got %q", logs.String())
+	}
+	if err := emptyRootfs("nginx", true); err == nil {
+		t.Error("Expected an error for an empty root filesystem when strict")
+	}
+
+	files, err = ImageBundleTo(new(bytes.Buffer), path, "example/full:v1", []byte("{}"), imageTrust{}, false, nil)
+	if err != nil || files != 1 {
+		t.Errorf("Expected a file in the root filesystem, got %d %v", files, err)
+	}
+}
+
+func TestStrictExtract(t *testing.T) {
+	logs := new(bytes.Buffer)
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+	defer func(strict bool) { StrictExtract = strict }(StrictExtract)
+
+	anomalous := makeLinkTar(t, []linkEntry{
+		{name: "bin/sh", typeflag: tar.TypeReg, contents: "sh"},
+		{name: "Dockerfile", typeflag: tar.TypeReg, contents: "FROM scratch"},
+		{name: "../etc/passwd", typeflag: tar.TypeReg, contents: "root"},
+		{name: "data", typeflag: tar.TypeCont, contents: "x"},
+	}).Bytes()
+	inspect := types.ImageInspect{Os: "windows"}
+	yaml := MobyImage{Name: "test", Image: "example/odd:latest"}
+
+	StrictExtract = false
+	buf := new(bytes.Buffer)
+	if err := copyExport("example/odd:latest", "rootfs/", anomalous, tar.NewWriter(buf)); err != nil {
+		t.Fatalf("Expected only warnings for an anomalous image, got %v", err)
+	}
+	if _, err := ConfigInspectToOCI(yaml, inspect, ""); err != nil {
+		t.Fatalf("Expected only warnings for an image without a config, got %v", err)
+	}
+	for _, warning := range []string{"has an entry ../etc/passwd outside its root filesystem", "has an entry data of unsupported type 7", "has no image config", "is for windows"} {
+		if !strings.Contains(logs.String(), "example/odd:latest "+warning) {
+			t.Errorf("Expected a warning that the image %s, got %q", warning, logs.String())
+		}
+	}
+	_, contents := readTar(t, buf)
+	if contents["rootfs/bin/sh"] != "sh" {
+		t.Error("Expected the files of the image to be copied with the prefix")
+	}
+	if _, ok := contents["rootfs/Dockerfile"]; ok {
+		t.Error("Expected the Dockerfile to be excluded")
+	}
+	for name := range contents {
+		if strings.Contains(name, "etc/passwd") {
+			t.Errorf("Expected the entry outside the root filesystem to be skipped, got %s", name)
+		}
+	}
+
+	StrictExtract = true
+	logs.Reset()
+	for _, entries := range [][]linkEntry{
+		{{name: "../etc/passwd", typeflag: tar.TypeReg, contents: "root"}},
+		{{name: "data", typeflag: tar.TypeCont, contents: "x"}},
+	} {
+		err := copyExport("example/odd:latest", "rootfs/", makeLinkTar(t, entries).Bytes(), tar.NewWriter(new(bytes.Buffer)))
+		if err == nil || !strings.Contains(err.Error(), "Image example/odd:latest has an entry "+entries[0].name) {
+			t.Errorf("Expected an error naming the image for %s, got %v", entries[0].name, err)
+		}
+	}
+	if _, err := ConfigInspectToOCI(yaml, types.ImageInspect{Os: "linux"}, ""); err == nil || !strings.Contains(err.Error(), "example/odd:latest has no image config") {
+		t.Errorf("Expected an error for an image without a config, got %v", err)
+	}
+	if _, err := ConfigInspectToOCI(yaml, types.ImageInspect{Os: "windows", Config: &container.Config{}}, ""); err == nil {
+		t.Error("Expected an error for an image that is not for linux")
+	}
+	if err := copyExport("example/ok:latest", "rootfs/", makeLinkTar(t, []linkEntry{{name: "bin/sh", typeflag: tar.TypeReg}}).Bytes(), tar.NewWriter(new(bytes.Buffer))); err != nil {
+		t.Errorf("Unexpected error for an ordinary image: %v", err)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("Expected errors rather than warnings when strict, got %q", logs.String())
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+)
+
+// ageUnits are the units of an image age beyond those of time.ParseDuration
+var ageUnits = map[string]time.Duration{
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+}
+
+// parseAge parses the maximum age of an image or a cache entry, in days such
+// as 30d, weeks such as 2w, or a duration such as 12h
+func parseAge(s string) (time.Duration, error) {
+	for suffix, unit := range ageUnits {
+		if !strings.HasSuffix(s, suffix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(s, suffix))
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("Invalid age %s, expected a number of days or weeks such as 30d or 2w", s)
+		}
+		return time.Duration(n) * unit, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("Invalid age %s, expected a number of days or weeks such as 30d or 2w", s)
+	}
+	return d, nil
+}
+
+// formatImageAge gives an age in days, or hours if it is less than a day
+func formatImageAge(d time.Duration) string {
+	if d < 24*time.Hour {
+		return fmt.Sprintf("%d hours", int(d.Hours()))
+	}
+	return fmt.Sprintf("%d days", int(d.Hours()/24))
+}
+
+// checkImageAges warns about each image of a config that was created more
+// than maxAge before now, failing instead if strict is set
+func checkImageAges(m Moby, maxAge time.Duration, now time.Time, strict bool, inspect func(string) (types.ImageInspect, error)) error {
+	if maxAge == 0 {
+		return nil
+	}
+	seen := map[string]bool{}
+	for _, ci := range configImages(m) {
+		if seen[ci.image] {
+			continue
+		}
+		seen[ci.image] = true
+		info, err := inspect(ci.image)
+		if err != nil {
+			return err
+		}
+		created, err := time.Parse(time.RFC3339Nano, info.Created)
+		msg := ""
+		if err != nil {
+			msg = fmt.Sprintf("Image %s has no valid created time %q, so its age cannot be checked against the maximum of %s", ci.image, info.Created, formatImageAge(maxAge))
+		} else if age := now.Sub(created); age > maxAge {
+			msg = fmt.Sprintf("Image %s was created %s ago on %s, older than the maximum image age of %s", ci.image, formatImageAge(age), created.UTC().Format("2006-01-02"), formatImageAge(maxAge))
+		}
+		if msg == "" {
+			continue
+		}
+		if strict {
+			return errors.New(msg)
+		}
+		log.Warn(msg)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"archive/tar"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+func TestParseAge(t *testing.T) {
+	for s, expected := range map[string]time.Duration{
+		"30d": 30 * 24 * time.Hour,
+		"2w":  14 * 24 * time.Hour,
+		"12h": 12 * time.Hour,
+	} {
+		d, err := parseAge(s)
+		if err != nil || d != expected {
+			t.Errorf("Expected %s to be %s, got %s %v", s, expected, d, err)
+		}
+	}
+	for _, s := range []string{"", "d", "0d", "-1w", "1.5d", "30", "thirty days"} {
+		if _, err := parseAge(s); err == nil {
+			t.Errorf("Expected an error parsing %q", s)
+		}
+	}
+}
+
+func TestMaxImageAge(t *testing.T) {
+	now := time.Now()
+	images := &fakeImages{
+		exports: map[string][]byte{
+			"linuxkit/fresh:v1": makeTar(t, []tarEntry{{name: "bin/fresh", typeflag: tar.TypeReg, contents: "fresh"}}).Bytes(),
+			"linuxkit/stale:v1": makeTar(t, []tarEntry{{name: "bin/stale", typeflag: tar.TypeReg, contents: "stale"}}).Bytes(),
+		},
+		inspects: map[string]types.ImageInspect{
+			"linuxkit/fresh:v1": {ID: "sha256:1111", Os: "linux", Created: now.Add(-2 * 24 * time.Hour).Format(time.RFC3339Nano)},
+			"linuxkit/stale:v1": {ID: "sha256:2222", Os: "linux", Created: "2017-01-02T03:04:05.123456789Z"},
+		},
+	}
+	defer func(source imageSource) { Images = source }(Images)
+	Images = images
+
+	testCases := []struct {
+		init     string
+		strict   bool
+		expected string
+	}{
+		{"linuxkit/fresh:v1", true, ""},
+		// without strict the stale image is only a warning
+		{"linuxkit/stale:v1", false, ""},
+		{"linuxkit/stale:v1", true, "Image linuxkit/stale:v1 was created"},
+		{"linuxkit/stale:v1", true, "ago on 2017-01-02, older than the maximum image age of 30 days"},
+	}
+	for _, tc := range testCases {
+		m, err := NewConfig([]byte("init:\n  - linuxkit/fresh:v1\n  - " + tc.init + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = buildInternal(m, buildOpts{maxImageAge: 30 * 24 * time.Hour, strict: tc.strict})
+		if tc.expected == "" {
+			if err != nil {
+				t.Errorf("Expected %s to be built with strict %v, got %v", tc.init, tc.strict, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("Expected %q, got %v", tc.expected, err)
+		}
+	}
+
+	m, err := NewConfig([]byte("init:\n  - linuxkit/stale:v1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, _ := time.Parse(time.RFC3339, "2017-01-20T00:00:00Z")
+	if err := checkImageAges(m, 30*24*time.Hour, created, true, Images.inspect); err != nil {
+		t.Errorf("Expected the image to be within the age limit at the time given, got %v", err)
+	}
+}
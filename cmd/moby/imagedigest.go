@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/opencontainers/go-digest"
+)
+
+// declaredDigests returns the digest declared for each image of a config
+// that has one
+func declaredDigests(m Moby) map[string]string {
+	digests := map[string]string{}
+	if m.Kernel.Digest != "" {
+		digests[m.Kernel.Image] = m.Kernel.Digest
+	}
+	for _, image := range append(append([]MobyImage{}, m.Onboot...), m.Services...) {
+		if image.Digest != "" {
+			digests[image.Image] = image.Digest
+		}
+	}
+	return digests
+}
+
+// validImageDigests checks the declared digests are sha256 digests that agree
+// with any digest in the image reference and with each other
+func validImageDigests(m Moby) error {
+	declared := map[string]string{}
+	check := func(image, d string) error {
+		if d == "" {
+			return nil
+		}
+		parsed, err := digest.Parse(d)
+		if err != nil || parsed.Algorithm() != digest.SHA256 {
+			return fmt.Errorf("Invalid digest %s of image %s, expected sha256:<64 hex characters>", d, image)
+		}
+		if ref, err := reference.ParseAnyReference(image); err == nil {
+			if digested, ok := ref.(reference.Digested); ok && digested.Digest() != parsed {
+				return fmt.Errorf("Image %s has the digest %s in its reference, not the declared digest %s", image, digested.Digest(), d)
+			}
+		}
+		if other, ok := declared[image]; ok && other != d {
+			return fmt.Errorf("Image %s is declared with the digests %s and %s", image, other, d)
+		}
+		declared[image] = d
+		return nil
+	}
+	if err := check(m.Kernel.Image, m.Kernel.Digest); err != nil {
+		return err
+	}
+	for _, image := range append(append([]MobyImage{}, m.Onboot...), m.Services...) {
+		if err := check(image.Image, image.Digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkImageDigest checks a pulled image has the digest expected, as the
+// digest of a repository it was pulled from or its ID
+func checkImageDigest(image, expected string, inspect func(string) (types.ImageInspect, error)) error {
+	info, err := inspect(image)
+	if err != nil {
+		return err
+	}
+	found := []string{}
+	for _, rd := range info.RepoDigests {
+		parts := strings.SplitN(rd, "@", 2)
+		if len(parts) == 2 {
+			found = append(found, parts[1])
+		}
+	}
+	found = append(found, info.ID)
+	for _, d := range found {
+		if d == expected {
+			return nil
+		}
+	}
+	return fmt.Errorf("Image %s does not have the declared digest %s, it has %s", image, expected, strings.Join(found, ", "))
+}
+
+// checkImageDigests checks each image of a config with a declared digest,
+// once it has been pulled
+func checkImageDigests(m Moby, inspect func(string) (types.ImageInspect, error)) error {
+	declared := declaredDigests(m)
+	for _, ci := range configImages(m) {
+		expected, ok := declared[ci.image]
+		if !ok {
+			continue
+		}
+		delete(declared, ci.image)
+		if err := checkImageDigest(ci.image, expected, inspect); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"archive/tar"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+func TestImageDigests(t *testing.T) {
+	pinned := "sha256:" + strings.Repeat("a", 64)
+	other := "sha256:" + strings.Repeat("b", 64)
+	images := &fakeImages{
+		exports: map[string][]byte{
+			"linuxkit/getty:v1": makeTar(t, []tarEntry{{name: "bin/getty", typeflag: tar.TypeReg, contents: "getty"}}).Bytes(),
+		},
+		inspects: map[string]types.ImageInspect{
+			"linuxkit/getty:v1": {
+				ID:          "sha256:" + strings.Repeat("c", 64),
+				Os:          "linux",
+				RepoDigests: []string{"mirror.example.com/linuxkit/getty@" + other, "linuxkit/getty@" + pinned},
+				Config:      &container.Config{Cmd: []string{"/bin/getty"}},
+			},
+		},
+	}
+	defer func(source imageSource) { Images = source }(Images)
+	Images = images
+
+	testCases := []struct {
+		digest   string
+		expected string
+	}{
+		{pinned, ""},
+		// any repository digest of the image matches
+		{other, ""},
+		{"sha256:" + strings.Repeat("d", 64), "does not have the declared digest"},
+	}
+	for _, tc := range testCases {
+		m, err := NewConfig([]byte("services:\n  - name: getty\n    image: linuxkit/getty:v1\n    digest: " + tc.digest + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = buildInternal(m, buildOpts{})
+		if tc.expected == "" {
+			if err != nil {
+				t.Errorf("Expected the image to match the declared digest %s, got %v", tc.digest, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.expected) || !strings.Contains(err.Error(), pinned) {
+			t.Errorf("Expected %q with the digests the image has, got %v", tc.expected, err)
+		}
+	}
+
+	for config, expected := range map[string]string{
+		"kernel:\n  image: k\n  digest: sha256:abc\n":                                                                                       "Invalid digest sha256:abc of image k",
+		"services:\n  - name: a\n    image: a\n    digest: md5:" + strings.Repeat("a", 32) + "\n":                                           "Invalid digest",
+		"services:\n  - name: a\n    image: a@" + pinned + "\n    digest: " + other + "\n":                                                  "has the digest " + pinned + " in its reference",
+		"onboot:\n  - name: a\n    image: a\n    digest: " + pinned + "\nservices:\n  - name: b\n    image: a\n    digest: " + other + "\n": "declared with the digests",
+	} {
+		if _, err := NewConfig([]byte(config)); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %q for %q, got %v", expected, config, err)
+		}
+	}
+}
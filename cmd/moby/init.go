@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/term"
+)
+
+// initAnswers are the choices a scaffolded config is made from
+type initAnswers struct {
+	kernel  string
+	service string
+	output  string
+}
+
+// defaultInitAnswers are used for the choices that are not given
+var defaultInitAnswers = initAnswers{
+	kernel:  "linuxkit/kernel:4.9.x",
+	service: "nginx:alpine",
+	output:  "kernel+initrd",
+}
+
+// initTemplate is a minimal config, commented for new users, which has the
+// kernel image, service image, service name and output filled in
+const initTemplate = `# A Moby config, built with: moby build %[5]s
+#
+# Images are unpacked into the root filesystem in the order of the sections
+# below. Pin images by tag or digest so that builds are repeatable.
+
+# The kernel image, and the cmdline it boots with.
+kernel:
+  image: %[1]q
+  cmdline: "console=tty0 console=ttyS0"
+
+# The init system and the container runtime that starts the containers.
+init:
+  - linuxkit/init:4fc8aa82ab34d62d510575c8fbe0c58b7ba9c480
+  - linuxkit/runc:3a4e6cbf15470f62501b019b55e1caac5ee7689f
+  - linuxkit/containerd:b1766e4c4c09f63ac4925a6e4612852a93f7e73b
+
+# Containers that run once at boot, one after another, before the services.
+# onboot:
+#   - name: dhcpcd
+#     image: "linuxkit/dhcpcd:7d2f17a0e5d1ef9a75a527821a9ab0d753b22e7e"
+#     command: ["/sbin/dhcpcd", "--nobackground", "-f", "/dhcpcd.conf", "-1"]
+
+# Containers that are started at boot and keep running.
+services:
+  - name: %[3]q
+    image: %[2]q
+
+# Files added to the root filesystem.
+# files:
+#   - path: etc/motd
+#     contents: "Hello from Moby"
+
+# The outputs built when -output is not given.
+outputs:
+  - %[4]s
+`
+
+// initServiceName returns a container name for a service image, from the
+// last part of its name without the tag or digest
+func initServiceName(image string) string {
+	name := image
+	if i := strings.Index(name, "@"); i != -1 {
+		name = name[:i]
+	}
+	name = path.Base(name)
+	if i := strings.Index(name, ":"); i != -1 {
+		name = name[:i]
+	}
+	return name
+}
+
+// scaffoldConfig returns the config for the answers, which is checked to
+// be valid
+func scaffoldConfig(a initAnswers, filename string) ([]byte, error) {
+	name := initServiceName(a.service)
+	if name == "" || name == "." || name == "/" {
+		return nil, fmt.Errorf("Cannot name a service for image %s", a.service)
+	}
+	config := []byte(fmt.Sprintf(initTemplate, a.kernel, a.service, name, a.output, filename))
+	if _, err := NewConfig(config); err != nil {
+		return nil, fmt.Errorf("Invalid config: %v", err)
+	}
+	return config, nil
+}
+
+// outputTypes returns the output types in order
+func outputTypes() []string {
+	types := []string{}
+	for o := range outFuns {
+		types = append(types, o)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// promptAnswers asks for each answer on w, reading them from r, an empty
+// answer or the end of r keeps the default
+func promptAnswers(r io.Reader, w io.Writer, defaults initAnswers) (initAnswers, error) {
+	a := defaults
+	br := bufio.NewReader(r)
+	ask := func(question, def string) (string, error) {
+		fmt.Fprintf(w, "%s [%s]: ", question, def)
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if err == io.EOF {
+			fmt.Fprintln(w)
+		}
+		if answer := strings.TrimSpace(line); answer != "" {
+			return answer, nil
+		}
+		return def, nil
+	}
+	var err error
+	if a.kernel, err = ask("Kernel image", a.kernel); err != nil {
+		return a, err
+	}
+	if a.service, err = ask("Service image", a.service); err != nil {
+		return a, err
+	}
+	for {
+		if a.output, err = ask("Output type", a.output); err != nil {
+			return a, err
+		}
+		if outFuns[a.output] != nil {
+			return a, nil
+		}
+		fmt.Fprintf(w, "Unknown output type %s, must be one of: %s\n", a.output, strings.Join(outputTypes(), ", "))
+		a.output = defaults.output
+	}
+}
+
+// Process the init arguments and write a new config
+func initConfig(args []string) {
+	initCmd := flag.NewFlagSet("init", flag.ExitOnError)
+	initCmd.Usage = func() {
+		fmt.Printf("USAGE: %s init [options] [file]\n\n", os.Args[0])
+		fmt.Printf("Write a minimal commented config to start from, config.yml by default\n")
+		fmt.Printf("Asks for the images and output when run on a terminal, unless -y is given\n\n")
+		fmt.Printf("Options:\n")
+		initCmd.PrintDefaults()
+	}
+	initKernel := initCmd.String("kernel", defaultInitAnswers.kernel, "Kernel image")
+	initService := initCmd.String("service", defaultInitAnswers.service, "Image of the service to run")
+	initOutput := initCmd.String("output", defaultInitAnswers.output, "Output type to build [ "+strings.Join(outputTypes(), " ")+" ]")
+	initYes := initCmd.Bool("y", false, "Use the options without asking")
+	initForce := initCmd.Bool("force", false, "Replace the file if it exists")
+
+	if err := initCmd.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	remArgs := initCmd.Args()
+	if len(remArgs) > 1 {
+		initCmd.Usage()
+		os.Exit(1)
+	}
+	filename := "config.yml"
+	if len(remArgs) == 1 {
+		filename = remArgs[0]
+	}
+	if _, err := os.Stat(filename); err == nil && !*initForce {
+		log.Fatalf("%s already exists, use -force to replace it", filename)
+	}
+
+	a := initAnswers{kernel: *initKernel, service: *initService, output: *initOutput}
+	if _, interactive := term.GetFdInfo(os.Stdin); interactive && !*initYes {
+		var err error
+		a, err = promptAnswers(os.Stdin, os.Stdout, a)
+		if err != nil {
+			log.Fatalf("Cannot read answers: %v", err)
+		}
+	}
+	if outFuns[a.output] == nil {
+		log.Fatalf("Unknown output type %s, must be one of: %s", a.output, strings.Join(outputTypes(), ", "))
+	}
+	config, err := scaffoldConfig(a, filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, config, 0644); err != nil {
+		log.Fatalf("Cannot write config: %v", err)
+	}
+	log.Infof("Wrote %s", filename)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestScaffoldConfig(t *testing.T) {
+	for _, a := range []initAnswers{
+		defaultInitAnswers,
+		{kernel: "linuxkit/kernel:4.14.x", service: "docker.io/library/redis:4@sha256:0123", output: "qcow2"},
+	} {
+		config, err := scaffoldConfig(a, "config.yml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := NewConfig(config)
+		if err != nil {
+			t.Fatalf("Expected the scaffolded config to parse: %v\n%s", err, config)
+		}
+		if m.Kernel.Image != a.kernel || len(m.Init) == 0 || len(m.Onboot) != 0 {
+			t.Errorf("Expected kernel %s and init images, got %+v %v %v", a.kernel, m.Kernel, m.Init, m.Onboot)
+		}
+		if len(m.Services) != 1 || m.Services[0].Image != a.service || m.Services[0].Name != initServiceName(a.service) {
+			t.Errorf("Expected the service %s, got %+v", a.service, m.Services)
+		}
+		if !reflect.DeepEqual(m.Outputs, []string{a.output}) {
+			t.Errorf("Expected outputs [%s], got %v", a.output, m.Outputs)
+		}
+		if !bytes.Contains(config, []byte("# ")) {
+			t.Error("Expected the scaffolded config to be commented")
+		}
+	}
+
+	if _, err := scaffoldConfig(initAnswers{kernel: "k", service: "s", output: "floppy"}, "config.yml"); err == nil {
+		t.Error("Expected an error for an unknown output type")
+	}
+}
+
+func TestInitServiceName(t *testing.T) {
+	for image, name := range map[string]string{
+		"nginx:alpine":                  "nginx",
+		"linuxkit/getty:v1":             "getty",
+		"localhost:5000/app":            "app",
+		"quay.io/coreos/etcd@sha256:01": "etcd",
+	} {
+		if n := initServiceName(image); n != name {
+			t.Errorf("Expected service name %s for %s, got %s", name, image, n)
+		}
+	}
+}
+
+func TestPromptAnswers(t *testing.T) {
+	// the kernel keeps its default, and the unknown output is asked again
+	out := new(bytes.Buffer)
+	a, err := promptAnswers(strings.NewReader("\nredis:4\nfloppy\nqcow2\n"), out, defaultInitAnswers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := initAnswers{kernel: defaultInitAnswers.kernel, service: "redis:4", output: "qcow2"}
+	if a != expected {
+		t.Errorf("Expected answers %+v, got %+v", expected, a)
+	}
+	if !strings.Contains(out.String(), "Kernel image [linuxkit/kernel:4.9.x]: ") || !strings.Contains(out.String(), "Unknown output type floppy") {
+		t.Errorf("Expected prompts with defaults and an unknown output error, got %q", out.String())
+	}
+
+	// the defaults are kept for the answers after the end of the input
+	a, err = promptAnswers(strings.NewReader("linuxkit/kernel:4.14.x"), new(bytes.Buffer), defaultInitAnswers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = defaultInitAnswers
+	expected.kernel = "linuxkit/kernel:4.14.x"
+	if a != expected {
+		t.Errorf("Expected answers %+v, got %+v", expected, a)
+	}
+}
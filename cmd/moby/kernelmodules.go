@@ -0,0 +1,118 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// modulesLoadPath is where the kernel modules to load at boot are listed,
+// see modules-load.d(5)
+const modulesLoadPath = "etc/modules-load.d/moby.conf"
+
+// moduleSuffixes are the suffixes of the module files in lib/modules
+var moduleSuffixes = []string{".ko", ".ko.gz", ".ko.xz", ".ko.zst"}
+
+// moduleName returns the name of a module as it is loaded, where dashes and
+// underscores are the same
+func moduleName(name string) string {
+	return strings.Replace(name, "-", "_", -1)
+}
+
+// validKernelModules checks the names of the modules to load at boot, which
+// are each a line of modulesLoadPath
+func validKernelModules(modules []string) error {
+	seen := map[string]bool{}
+	for _, m := range modules {
+		if m == "" || strings.ContainsAny(m, "/# \t\n") {
+			return fmt.Errorf("Invalid kernel module %q, expected the name of a module such as br_netfilter", m)
+		}
+		if seen[moduleName(m)] {
+			return fmt.Errorf("Invalid kernel modules: %s is listed more than once", m)
+		}
+		seen[moduleName(m)] = true
+	}
+	return nil
+}
+
+// kernelModules returns the names of the modules in a kernel filesystem
+// tarball, those in module files and those built in to the kernel
+func kernelModules(fs []byte) (map[string]bool, error) {
+	modules := map[string]bool{}
+	tr := tar.NewReader(bytes.NewReader(fs))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return modules, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := cleanPath(hdr.Name)
+		if !strings.HasPrefix(name, "lib/modules/") {
+			continue
+		}
+		if path.Base(name) == "modules.builtin" {
+			s := bufio.NewScanner(tr)
+			for s.Scan() {
+				if m := moduleFile(s.Text()); m != "" {
+					modules[m] = true
+				}
+			}
+			if err := s.Err(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+			if m := moduleFile(name); m != "" {
+				modules[m] = true
+			}
+		}
+	}
+}
+
+// moduleFile returns the name of the module of a module file, or "" if it is
+// not one
+func moduleFile(file string) string {
+	base := path.Base(strings.TrimSpace(file))
+	for _, suffix := range moduleSuffixes {
+		if strings.HasSuffix(base, suffix) && base != suffix {
+			return moduleName(strings.TrimSuffix(base, suffix))
+		}
+	}
+	return ""
+}
+
+// addKernelModules adds modulesLoadPath listing the modules of the kernel
+// config to the files of a config, warning about those not in the kernel
+// filesystem tarball fs, which would fail to load at boot
+func addKernelModules(m *Moby, fs []byte) error {
+	if len(m.Kernel.Modules) == 0 {
+		return nil
+	}
+	for _, f := range m.Files {
+		if cleanPath(f.Path) == modulesLoadPath {
+			return fmt.Errorf("The files section has /%s, it cannot also be generated from the kernel modules", modulesLoadPath)
+		}
+	}
+	available, err := kernelModules(fs)
+	if err != nil {
+		return fmt.Errorf("Cannot read the modules of %s: %v", m.Kernel.Image, err)
+	}
+	for _, name := range m.Kernel.Modules {
+		if !available[moduleName(name)] {
+			log.Warnf("Kernel module %s is not in %s, it will fail to load at boot", name, m.Kernel.Image)
+		}
+	}
+	log.Infof("Add /%s", modulesLoadPath)
+	contents := "# The kernel modules of the config, loaded at boot\n" + strings.Join(m.Kernel.Modules, "\n") + "\n"
+	m.Files = append(m.Files, File{Path: modulesLoadPath, Contents: contents})
+	return nil
+}
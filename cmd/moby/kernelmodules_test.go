@@ -0,0 +1,88 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+)
+
+func TestKernelModules(t *testing.T) {
+	ktar := makeTar(t, []tarEntry{
+		{name: "lib/modules/4.9.0/", typeflag: tar.TypeDir},
+		{name: "lib/modules/4.9.0/kernel/fs/overlayfs/overlay.ko", typeflag: tar.TypeReg, contents: "ko"},
+		{name: "lib/modules/4.9.0/kernel/net/bridge/br_netfilter.ko.xz", typeflag: tar.TypeReg, contents: "ko"},
+		{name: "lib/modules/4.9.0/modules.builtin", typeflag: tar.TypeReg, contents: "kernel/net/ipv4/tcp_bbr.ko\nkernel/fs/ext4/ext4.ko\n"},
+	})
+	kernel := makeTar(t, []tarEntry{
+		{name: "kernel", typeflag: tar.TypeReg, contents: "kernel image"},
+		{name: "kernel.tar", typeflag: tar.TypeReg, contents: ktar.String()},
+	})
+	defer func(source imageSource) { Images = source }(Images)
+	Images = &fakeImages{
+		exports:  map[string][]byte{"linuxkit/kernel:4.9.x": kernel.Bytes()},
+		inspects: map[string]types.ImageInspect{},
+	}
+	logger := log.StandardLogger()
+	defer func(out io.Writer) { logger.Out = out }(logger.Out)
+	logs := new(bytes.Buffer)
+	logger.Out = logs
+
+	m, err := NewConfig([]byte("kernel:\n  image: linuxkit/kernel:4.9.x\n  modules: [overlay, br-netfilter, tcp_bbr, wireguard]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, _, err := buildInternal(m, buildOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, contents := readTar(t, bytes.NewBuffer(image))
+	expected := "# The kernel modules of the config, loaded at boot\noverlay\nbr-netfilter\ntcp_bbr\nwireguard\n"
+	if contents[modulesLoadPath] != expected {
+		t.Errorf("Expected %s to list the modules, got %q", modulesLoadPath, contents[modulesLoadPath])
+	}
+	for _, name := range []string{"overlay", "br-netfilter", "tcp_bbr"} {
+		if strings.Contains(logs.String(), "Kernel module "+name+" ") {
+			t.Errorf("Expected no warning for %s, which is in the kernel, got %q", name, logs.String())
+		}
+	}
+	if !strings.Contains(logs.String(), "Kernel module wireguard is not in linuxkit/kernel:4.9.x") {
+		t.Errorf("Expected a warning for the missing module, got %q", logs.String())
+	}
+
+	// without modules no file is added
+	m, err = NewConfig([]byte("kernel:\n  image: linuxkit/kernel:4.9.x\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, _, err = buildInternal(m, buildOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, contents := readTar(t, bytes.NewBuffer(image)); contents[modulesLoadPath] != "" {
+		t.Errorf("Expected no %s without modules", modulesLoadPath)
+	}
+
+	m, err = NewConfig([]byte("kernel:\n  image: linuxkit/kernel:4.9.x\n  modules: [overlay]\nfiles:\n  - path: /etc/modules-load.d/moby.conf\n    contents: loop\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := buildInternal(m, buildOpts{}); err == nil || !strings.Contains(err.Error(), "cannot also be generated") {
+		t.Errorf("Expected a files section with the modules file to be an error, got %v", err)
+	}
+
+	for config, expected := range map[string]string{
+		"kernel:\n  modules: [overlay]\n":                                "modules set without a kernel image",
+		"kernel:\n  image: k\n  modules: [br_netfilter, br-netfilter]\n": "br-netfilter is listed more than once",
+		"kernel:\n  image: k\n  modules: [kernel/fs/overlay]\n":          "Invalid kernel module",
+		"kernel:\n  image: k\n  modules: [\"\"]\n":                       "Invalid kernel module",
+	} {
+		if _, err := NewConfig([]byte(config)); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %q for %q, got %v", expected, config, err)
+		}
+	}
+}
@@ -38,17 +38,21 @@ func imageFilename(name string) string {
 
 func ensureLinuxkitImage(name string) error {
 	filename := imageFilename(name)
+	err := os.MkdirAll(cacheDir(), 0755)
+	if err != nil {
+		return err
+	}
+	// the outputs use the images after this returns, so a clean of the
+	// cache waits for the build to finish
+	if err := holdCache(cacheDir()); err != nil {
+		return err
+	}
 	_, err1 := os.Stat(filename + "-kernel")
 	_, err2 := os.Stat(filename + "-initrd.img")
 	_, err3 := os.Stat(filename + "-cmdline")
 	if err1 == nil && err2 == nil && err3 == nil {
-		return nil
+		return touchCache(filename+"-kernel", filename+"-initrd.img", filename+"-cmdline")
 	}
-	err := os.MkdirAll(filepath.Join(MobyDir, "linuxkit"), 0755)
-	if err != nil {
-		return err
-	}
-	// TODO clean up old files
 	log.Infof("Building LinuxKit image %s to generate output formats", name)
 
 	yaml := linuxkitYaml[name]
@@ -58,7 +62,10 @@ func ensureLinuxkitImage(name string) error {
 		return err
 	}
 	// TODO pass through --pull to here
-	image := buildInternal(m, false)
+	image, _, err := buildInternal(m, buildOpts{})
+	if err != nil {
+		return err
+	}
 	kernel, initrd, cmdline, err := tarToInitrd(image)
 	if err != nil {
 		return fmt.Errorf("Error converting to initrd: %v", err)
@@ -72,21 +79,40 @@ func ensureLinuxkitImage(name string) error {
 }
 
 func writeKernelInitrd(filename string, kernel []byte, initrd []byte, cmdline string) error {
-	err := ioutil.WriteFile(filename+"-kernel", kernel, 0600)
+	err := writeCacheFile(filename+"-kernel", kernel)
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(filename+"-initrd.img", initrd, 0600)
+	err = writeCacheFile(filename+"-initrd.img", initrd)
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(filename+"-cmdline", []byte(cmdline), 0600)
+	err = writeCacheFile(filename+"-cmdline", []byte(cmdline))
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// writeCacheFile writes a file of the cache by renaming a temporary file, so
+// a build never sees a partly written image, even when another build is
+// writing the same image
+func writeCacheFile(filename string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
 func outputLinuxKit(format string, filename string, kernel []byte, initrd []byte, cmdline string, size int, hyperkit bool) error {
 	log.Debugf("output linuxkit generated img: %s %s size %d", format, filename, size)
 
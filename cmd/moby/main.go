@@ -52,6 +52,12 @@ func main() {
 		fmt.Printf("USAGE: %s [options] COMMAND\n\n", filepath.Base(os.Args[0]))
 		fmt.Printf("Commands:\n")
 		fmt.Printf("  build       Build a Moby image from a YAML file\n")
+		fmt.Printf("  cache       List and clean the cache of LinuxKit images used by some outputs\n")
+		fmt.Printf("  doctor      Check that the environment is ready for builds\n")
+		fmt.Printf("  extract     Extract the root filesystem of an image to a directory or tar\n")
+		fmt.Printf("  init        Write a new config to start from\n")
+		fmt.Printf("  pull        Pull the images of a YAML file without building it\n")
+		fmt.Printf("  verify      Verify an image matches a reproducible build of a YAML file\n")
 		fmt.Printf("  version     Print version information\n")
 		fmt.Printf("  help        Print this message\n")
 		fmt.Printf("\n")
@@ -100,6 +106,18 @@ func main() {
 	switch args[0] {
 	case "build":
 		build(args[1:])
+	case "cache":
+		cache(args[1:])
+	case "doctor":
+		doctor(args[1:])
+	case "extract":
+		extract(args[1:])
+	case "init":
+		initConfig(args[1:])
+	case "pull":
+		pull(args[1:])
+	case "verify":
+		verify(args[1:])
 	case "version":
 		version()
 	case "help":
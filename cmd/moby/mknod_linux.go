@@ -0,0 +1,29 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"archive/tar"
+	"syscall"
+)
+
+// mknod creates a device node or fifo from a tar entry
+func mknod(path string, hdr *tar.Header) error {
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeChar:
+		mode |= syscall.S_IFCHR
+	case tar.TypeBlock:
+		mode |= syscall.S_IFBLK
+	case tar.TypeFifo:
+		mode |= syscall.S_IFIFO
+	}
+	return syscall.Mknod(path, mode, int(mkdev(hdr.Devmajor, hdr.Devminor)))
+}
+
+// mkdev encodes a device number as glibc does
+func mkdev(major, minor int64) uint64 {
+	maj, min := uint64(major), uint64(minor)
+	return (min & 0xff) | ((maj & 0xfff) << 8) | ((min &^ 0xff) << 12) | ((maj &^ 0xfff) << 32)
+}
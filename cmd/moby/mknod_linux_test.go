@@ -0,0 +1,50 @@
+package main
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestUntarDirPrivileged(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("creating device nodes needs root")
+	}
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootfs := makeLinkTar(t, []linkEntry{
+		{name: "etc/shadow", typeflag: tar.TypeReg, contents: "root:*", uid: 4242},
+		{name: "dev/null", typeflag: tar.TypeChar, major: 1, minor: 3},
+	})
+	summary, err := untarDir(rootfs, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.skipped) != 0 || summary.owners != 0 {
+		t.Errorf("Expected nothing skipped with privileges, got %+v", summary)
+	}
+	fi, err := os.Lstat(filepath.Join(dir, "dev/null"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		t.Errorf("Expected dev/null to be a character device, got %v", fi.Mode())
+	}
+	if st := fi.Sys().(*syscall.Stat_t); st.Rdev != mkdev(1, 3) {
+		t.Errorf("Expected dev/null to be device 1:3, got %x", st.Rdev)
+	}
+	fi, err = os.Lstat(filepath.Join(dir, "etc/shadow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := fi.Sys().(*syscall.Stat_t); st.Uid != 4242 {
+		t.Errorf("Expected etc/shadow to be owned by 4242, got %d", st.Uid)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"archive/tar"
+	"errors"
+)
+
+// mknod creates a device node or fifo from a tar entry
+func mknod(path string, hdr *tar.Header) error {
+	return errors.New("device nodes and fifos can only be created on Linux")
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// normalizeDirs drops the headers of directories that repeat an earlier
+	// header of the same directory
+	normalizeDirs = "dirs"
+	// normalizeAll also drops empty entries without a path, which some
+	// images have as padding
+	normalizeAll = "all"
+)
+
+var normalizeModes = []string{normalizeDirs, normalizeAll}
+
+func validNormalizeMode(mode string) error {
+	if mode == "" {
+		return nil
+	}
+	for _, m := range normalizeModes {
+		if mode == m {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown tar normalization %s, must be one of: %s", mode, strings.Join(normalizeModes, ", "))
+}
+
+// sameDirectory reports whether a directory header only repeats the last
+// header of the path, with the same permissions, owner and extended
+// attributes, ignoring the timestamps
+func sameDirectory(last, hdr *tar.Header) bool {
+	if last == nil || last.Typeflag != tar.TypeDir || hdr.Typeflag != tar.TypeDir {
+		return false
+	}
+	if last.Mode != hdr.Mode || last.Uid != hdr.Uid || last.Gid != hdr.Gid || last.Uname != hdr.Uname || last.Gname != hdr.Gname {
+		return false
+	}
+	return reflect.DeepEqual(paxAttributes(last), paxAttributes(hdr))
+}
+
+// paxAttributes returns the PAX records of a header apart from the timestamps
+func paxAttributes(hdr *tar.Header) map[string]string {
+	attrs := map[string]string{}
+	for k, v := range hdr.PAXRecords {
+		if k != "mtime" && k != "atime" && k != "ctime" {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
+
+// emptyEntry reports whether an entry is padding, empty and without a path
+func emptyEntry(hdr *tar.Header) bool {
+	return hdr.Typeflag != tar.TypeDir && hdr.Size == 0 && cleanPath(hdr.Name) == ""
+}
+
+// normalizeTar drops the redundant directory headers of an image, and the
+// empty entries too with normalizeAll, logging what was dropped. The first
+// header of a directory is kept, so its timestamps are those of the image
+// that added it.
+func normalizeTar(image []byte, mode string) ([]byte, error) {
+	if mode == "" {
+		return image, nil
+	}
+	out := new(bytes.Buffer)
+	tw := tar.NewWriter(out)
+	tr := tar.NewReader(bytes.NewReader(image))
+	last := map[string]*tar.Header{}
+	dirs, empty := 0, 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if mode == normalizeAll && emptyEntry(hdr) {
+			log.Debugf("normalize tar: drop empty entry %q", hdr.Name)
+			empty++
+			continue
+		}
+		name := cleanPath(hdr.Name)
+		if sameDirectory(last[name], hdr) {
+			log.Debugf("normalize tar: drop repeated directory %s", hdr.Name)
+			dirs++
+			continue
+		}
+		last[name] = hdr
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if dirs != 0 || empty != 0 {
+		log.Infof("Normalized the image tarball, dropped %d repeated directory headers and %d empty entries", dirs, empty)
+	}
+	return out.Bytes(), nil
+}
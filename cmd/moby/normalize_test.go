@@ -0,0 +1,87 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+// headerTar creates a tarball of empty entries with the given headers
+func headerTar(t *testing.T, hdrs []tar.Header) []byte {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for i := range hdrs {
+		if err := tw.WriteHeader(&hdrs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestNormalizeTar(t *testing.T) {
+	images := &fakeImages{
+		exports: map[string][]byte{
+			"linuxkit/init:v1": headerTar(t, []tar.Header{
+				{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: "etc/a", Typeflag: tar.TypeReg, Mode: 0644},
+				// padding
+				{Name: "", Typeflag: tar.TypeReg},
+			}),
+			"linuxkit/runc:v1": headerTar(t, []tar.Header{
+				{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: "./etc", Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: "etc/b", Typeflag: tar.TypeReg, Mode: 0644},
+				// a directory whose permissions change is not redundant
+				{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0700},
+				{Name: ".", Typeflag: tar.TypeReg},
+			}),
+		},
+		inspects: map[string]types.ImageInspect{
+			"linuxkit/init:v1": {ID: "sha256:1111", Os: "linux"},
+			"linuxkit/runc:v1": {ID: "sha256:2222", Os: "linux"},
+		},
+	}
+	defer func(source imageSource) { Images = source }(Images)
+	Images = images
+
+	m, err := NewConfig([]byte("init:\n  - linuxkit/init:v1\n  - linuxkit/runc:v1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		mode     string
+		expected []string
+	}{
+		{"", []string{"etc/", "etc/a", "", "etc/", "./etc", "etc/b", "etc/", "."}},
+		{normalizeDirs, []string{"etc/", "etc/a", "", "etc/b", "etc/", "."}},
+		{normalizeAll, []string{"etc/", "etc/a", "etc/b", "etc/"}},
+	}
+	for _, tc := range testCases {
+		image, _, err := buildInternal(m, buildOpts{normalizeTar: tc.mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		tr := tar.NewReader(bytes.NewReader(image))
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				break
+			}
+			names = append(names, hdr.Name)
+		}
+		if !reflect.DeepEqual(names, tc.expected) {
+			t.Errorf("Expected the entries %q normalizing %q, got %q", tc.expected, tc.mode, names)
+		}
+	}
+
+	if err := validNormalizeMode("junk"); err == nil {
+		t.Errorf("Expected an unknown normalization to be rejected")
+	}
+}
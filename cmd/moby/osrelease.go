@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// osReleasePath is where the os-release file is added, see os-release(5)
+const osReleasePath = "etc/os-release"
+
+// osReleaseQuote quotes a value of an os-release file, which is read as
+// shell variable assignments
+func osReleaseQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`", "\n", " ")
+	return `"` + r.Replace(s) + `"`
+}
+
+// osReleaseID returns the name as an os-release ID, which only has lower
+// case letters, digits, dots, underscores and dashes
+func osReleaseID(name string) string {
+	id := strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', '0' <= r && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		case 'A' <= r && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, name)
+	if id == "" {
+		return "linuxkit"
+	}
+	return id
+}
+
+// generateOSRelease returns an os-release file for the build of a config,
+// named after the build, with the hash of the config as the build ID
+func generateOSRelease(name string, m Moby) (string, error) {
+	hash, err := ConfigHash(m)
+	if err != nil {
+		return "", err
+	}
+	lines := []string{
+		"NAME=" + osReleaseQuote(name),
+		"ID=" + osReleaseID(name),
+		"PRETTY_NAME=" + osReleaseQuote(name),
+		"BUILD_ID=" + hash[:12],
+		"MOBY_VERSION=" + osReleaseQuote(Version),
+	}
+	if m.Kernel.Image != "" {
+		lines = append(lines, "MOBY_KERNEL="+osReleaseQuote(m.Kernel.Image))
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// addOSRelease adds the os-release file to the files of a config, unless an
+// image already provides one and force is not set, or the files section has one
+func addOSRelease(m *Moby, contents string, paths layerPaths, force bool) error {
+	for _, f := range m.Files {
+		if cleanPath(f.Path) == osReleasePath {
+			return fmt.Errorf("The files section has /%s, it cannot also be generated", osReleasePath)
+		}
+	}
+	if p, ok := paths[osReleasePath]; ok && !force {
+		log.Infof("Keep /%s from %s, use -force-os-release to replace it", osReleasePath, p.layer)
+		return nil
+	}
+	log.Infof("Add /%s", osReleasePath)
+	m.Files = append(m.Files, File{Path: osReleasePath, Contents: contents, Override: true})
+	return nil
+}
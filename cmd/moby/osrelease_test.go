@@ -0,0 +1,93 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+func TestGenerateOSRelease(t *testing.T) {
+	m, err := NewConfig([]byte("kernel:\n  image: linuxkit/kernel:4.9.x\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := ConfigHash(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	osrel, err := generateOSRelease(`My "Edge" $HOST`, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`NAME="My \"Edge\" \$HOST"`,
+		"ID=my--edge---host",
+		"BUILD_ID=" + hash[:12],
+		`MOBY_KERNEL="linuxkit/kernel:4.9.x"`,
+	} {
+		if !strings.Contains(osrel, line+"\n") {
+			t.Errorf("Expected %s in os-release, got:\n%s", line, osrel)
+		}
+	}
+	if id := osReleaseID(""); id != "linuxkit" {
+		t.Errorf("Expected a default ID of linuxkit, got %s", id)
+	}
+}
+
+func TestAddOSRelease(t *testing.T) {
+	images := &fakeImages{
+		exports: map[string][]byte{
+			"linuxkit/init:v1": makeTar(t, []tarEntry{
+				{name: "bin/", typeflag: tar.TypeDir},
+				{name: "bin/init", typeflag: tar.TypeReg, contents: "init"},
+			}).Bytes(),
+			"linuxkit/alpine:v1": makeTar(t, []tarEntry{
+				{name: "etc/", typeflag: tar.TypeDir},
+				{name: "etc/os-release", typeflag: tar.TypeReg, contents: "ID=alpine\n"},
+			}).Bytes(),
+		},
+		inspects: map[string]types.ImageInspect{
+			"linuxkit/init:v1":   {ID: "sha256:1111", Os: "linux"},
+			"linuxkit/alpine:v1": {ID: "sha256:2222", Os: "linux"},
+		},
+	}
+	defer func(source imageSource) { Images = source }(Images)
+	Images = images
+
+	testCases := []struct {
+		init     string
+		force    bool
+		expected string
+	}{
+		{"linuxkit/init:v1", false, "ID=test\n"},
+		{"linuxkit/alpine:v1", false, "ID=alpine\n"},
+		{"linuxkit/alpine:v1", true, "ID=test\n"},
+	}
+	for _, testCase := range testCases {
+		m, err := NewConfig([]byte("init:\n  - " + testCase.init + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// replacing the file from the image is not a conflict, even when strict
+		image, _, err := buildInternal(m, buildOpts{osRelease: "ID=test\n", forceOSRelease: testCase.force, strict: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, contents := readTar(t, bytes.NewBuffer(image))
+		if contents[osReleasePath] != testCase.expected {
+			t.Errorf("Expected os-release %q with %s and force %v, got %q", testCase.expected, testCase.init, testCase.force, contents[osReleasePath])
+		}
+	}
+
+	m, err := NewConfig([]byte("init:\n  - linuxkit/init:v1\nfiles:\n  - path: /etc/os-release\n    contents: ID=files\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = buildInternal(m, buildOpts{osRelease: "ID=test\n"})
+	if err == nil || !strings.Contains(err.Error(), "files section has /etc/os-release") {
+		t.Errorf("Expected an os-release in the files section to be an error, got %v", err)
+	}
+}
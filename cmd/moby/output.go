@@ -4,14 +4,26 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/linuxkit/linuxkit/src/initrd"
+	"github.com/surma/gocpio"
 )
 
 const (
@@ -21,107 +33,160 @@ const (
 	vmdk = "linuxkit/mkimage-vmdk:182b541474ca7965c8e8f987389b651859f760da@sha256:99638c5ddb17614f54c6b8e11bd9d49d1dea9d837f38e0f6c1a5f451085d449b"
 )
 
-var outFuns = map[string]func(string, []byte, int, bool) error{
-	"tar": func(base string, image []byte, size int, hyperkit bool) error {
-		err := outputTar(base, image)
+// digestOutput is where the stdout-sha output prints the digest of the image
+var digestOutput io.Writer = os.Stdout
+
+var outFuns = map[string]func(string, []byte, *outputOpts) error{
+	"tar": func(base string, image []byte, o *outputOpts) error {
+		err := outputTar(base, image, o)
 		if err != nil {
 			return fmt.Errorf("Error writing tar output: %v", err)
 		}
 		return nil
 	},
-	"kernel+initrd": func(base string, image []byte, size int, hyperkit bool) error {
-		kernel, initrd, cmdline, err := tarToInitrd(image)
+	"tar-gz": func(base string, image []byte, o *outputOpts) error {
+		err := outputTarGz(base, image, o)
+		if err != nil {
+			return fmt.Errorf("Error writing tar-gz output: %v", err)
+		}
+		return nil
+	},
+	"stdout-sha": func(base string, image []byte, o *outputOpts) error {
+		log.Debugf("output stdout-sha: %s", base)
+		_, err := fmt.Fprintf(digestOutput, "%x\n", sha256.Sum256(image))
+		return err
+	},
+	"kernel+initrd": func(base string, image []byte, o *outputOpts) error {
+		kernel, initrd, cmdline, err := o.splitImage(image)
 		if err != nil {
 			return fmt.Errorf("Error converting to initrd: %v", err)
 		}
-		err = outputKernelInitrd(base, kernel, initrd, cmdline)
+		err = outputKernelInitrd(base, kernel, initrd, cmdline, o)
 		if err != nil {
 			return fmt.Errorf("Error writing kernel+initrd output: %v", err)
 		}
 		return nil
 	},
-	"iso-bios": func(base string, image []byte, size int, hyperkit bool) error {
-		kernel, initrd, cmdline, err := tarToInitrd(image)
+	"docker-archive": func(base string, image []byte, o *outputOpts) error {
+		err := outputDockerArchive(base, image, o)
+		if err != nil {
+			return fmt.Errorf("Error writing docker-archive output: %v", err)
+		}
+		return nil
+	},
+	"initrd": func(base string, image []byte, o *outputOpts) error {
+		_, initrd, _, err := tarToInitrd(image)
 		if err != nil {
 			return fmt.Errorf("Error converting to initrd: %v", err)
 		}
-		err = outputImg(bios, base+".iso", kernel, initrd, cmdline)
+		err = outputInitrd(base, initrd, o)
 		if err != nil {
-			return fmt.Errorf("Error writing iso-bios output: %v", err)
+			return fmt.Errorf("Error writing initrd output: %v", err)
 		}
 		return nil
 	},
-	"iso-efi": func(base string, image []byte, size int, hyperkit bool) error {
-		kernel, initrd, cmdline, err := tarToInitrd(image)
+	"manifest": func(base string, image []byte, o *outputOpts) error {
+		_, initrd, _, err := tarToInitrd(image)
 		if err != nil {
 			return fmt.Errorf("Error converting to initrd: %v", err)
 		}
-		err = outputImg(efi, base+"-efi.iso", kernel, initrd, cmdline)
+		err = outputManifest(base, initrd, o)
 		if err != nil {
-			return fmt.Errorf("Error writing iso-efi output: %v", err)
+			return fmt.Errorf("Error writing manifest output: %v", err)
 		}
 		return nil
 	},
-	"img": func(base string, image []byte, size int, hyperkit bool) error {
-		filename := base + ".img"
-		log.Infof("  %s", filename)
-		kernel, initrd, cmdline, err := tarToInitrd(image)
+	"modules": func(base string, image []byte, o *outputOpts) error {
+		err := outputModules(base, o)
 		if err != nil {
-			return fmt.Errorf("Error converting to initrd: %v", err)
+			return fmt.Errorf("Error writing modules output: %v", err)
 		}
-		err = outputLinuxKit("raw", filename, kernel, initrd, cmdline, size, hyperkit)
+		return nil
+	},
+	"dir": func(base string, image []byte, o *outputOpts) error {
+		err := outputDir(base, image, o)
 		if err != nil {
-			return fmt.Errorf("Error writing qcow2 output: %v", err)
+			return fmt.Errorf("Error writing dir output: %v", err)
 		}
 		return nil
 	},
-	"img-gz": func(base string, image []byte, size int, hyperkit bool) error {
-		filename := base + ".img.gz"
-		log.Infof("  %s", filename)
-		kernel, initrd, cmdline, err := tarToInitrd(image)
+	"seed": func(base string, image []byte, o *outputOpts) error {
+		err := outputSeed(base, o)
+		if err != nil {
+			return fmt.Errorf("Error writing seed output: %v", err)
+		}
+		return nil
+	},
+	"tar-split": func(base string, image []byte, o *outputOpts) error {
+		err := outputTarSplit(base, image, o)
+		if err != nil {
+			return fmt.Errorf("Error writing tar-split output: %v", err)
+		}
+		return nil
+	},
+	"iso-bios": func(base string, image []byte, o *outputOpts) error {
+		kernel, initrd, cmdline, err := o.splitImage(image)
 		if err != nil {
 			return fmt.Errorf("Error converting to initrd: %v", err)
 		}
-		tmp, err := ioutil.TempDir("", "img-gz")
+		err = outputImg(bios, base+".iso", kernel, initrd, cmdline, o)
 		if err != nil {
-			return err
+			return fmt.Errorf("Error writing iso-bios output: %v", err)
 		}
-		err = outputLinuxKit("raw", filepath.Join(tmp, "uncompressed.img"), kernel, initrd, cmdline, size, hyperkit)
+		return nil
+	},
+	"iso-efi": func(base string, image []byte, o *outputOpts) error {
+		kernel, initrd, cmdline, err := o.splitImage(image)
 		if err != nil {
-			return fmt.Errorf("Error writing img-gz output: %v", err)
+			return fmt.Errorf("Error converting to initrd: %v", err)
 		}
-		out, err := os.Create(filename)
+		for what, b := range map[string][]byte{"kernel": kernel, "initrd": initrd} {
+			if err := checkFATFile("iso-efi", what, int64(len(b))); err != nil {
+				return err
+			}
+		}
+		err = outputImg(efi, base+"-efi.iso", kernel, initrd, cmdline, o)
 		if err != nil {
-			return err
+			return fmt.Errorf("Error writing iso-efi output: %v", err)
 		}
-		in, err := os.Open(filepath.Join(tmp, "uncompressed.img"))
+		return nil
+	},
+	"img": func(base string, image []byte, o *outputOpts) error {
+		filename := base + ".img"
+		log.Infof("  %s", filename)
+		kernel, initrd, cmdline, err := o.splitImage(image)
 		if err != nil {
-			return err
+			return fmt.Errorf("Error converting to initrd: %v", err)
 		}
-		zw := gzip.NewWriter(out)
-		io.Copy(zw, in)
-		err = zw.Close()
+		err = outputLinuxKit("raw", filename, kernel, initrd, cmdline, o.size, o.hyperkit)
 		if err != nil {
-			return err
+			return fmt.Errorf("Error writing qcow2 output: %v", err)
 		}
-		err = in.Close()
+		return o.accountFile(filename)
+	},
+	"img-gz": func(base string, image []byte, o *outputOpts) error {
+		filename := base + ".img.gz"
+		log.Infof("  %s", filename)
+		kernel, initrd, cmdline, err := o.splitImage(image)
 		if err != nil {
-			return err
+			return fmt.Errorf("Error converting to initrd: %v", err)
 		}
-		err = out.Close()
+		tmp, err := ioutil.TempDir("", "img-gz")
 		if err != nil {
 			return err
 		}
-		err = os.RemoveAll(tmp)
+		defer os.RemoveAll(tmp)
+		raw := filepath.Join(tmp, "uncompressed.img")
+		err = outputLinuxKit("raw", raw, kernel, initrd, cmdline, o.size, o.hyperkit)
 		if err != nil {
-			return err
+			return fmt.Errorf("Error writing img-gz output: %v", err)
 		}
-		return nil
+		return outputImgGz(filename, raw, o)
 	},
-	"gcp-img": func(base string, image []byte, size int, hyperkit bool) error {
+	"gcp-img": func(base string, image []byte, o *outputOpts) error {
 		filename := base + ".img.tar.gz"
 		log.Infof("  %s", filename)
-		kernel, initrd, cmdline, err := tarToInitrd(image)
+		kernel, initrd, cmdline, err := o.splitImage(image)
 		if err != nil {
 			return fmt.Errorf("Error converting to initrd: %v", err)
 		}
@@ -129,86 +194,98 @@ var outFuns = map[string]func(string, []byte, int, bool) error{
 		if err != nil {
 			return err
 		}
-		err = outputLinuxKit("raw", filepath.Join(tmp, "disk.raw"), kernel, initrd, cmdline, size, hyperkit)
+		defer os.RemoveAll(tmp)
+		raw := filepath.Join(tmp, "disk.raw")
+		err = outputLinuxKit("raw", raw, kernel, initrd, cmdline, o.size, o.hyperkit)
 		if err != nil {
 			return fmt.Errorf("Error writing gcp-img output: %v", err)
 		}
-		out, err := os.Create(filename)
-		if err != nil {
-			return err
-		}
-		in, err := os.Open(filepath.Join(tmp, "disk.raw"))
+		return outputGCPImage(filename, raw, o)
+	},
+	"qcow2": func(base string, image []byte, o *outputOpts) error {
+		filename := base + ".qcow2"
+		log.Infof("  %s", filename)
+		kernel, initrd, cmdline, err := o.splitImage(image)
 		if err != nil {
-			return err
+			return fmt.Errorf("Error converting to initrd: %v", err)
 		}
-		fi, err := in.Stat()
+		err = outputLinuxKit("qcow2", filename, kernel, initrd, cmdline, o.size, o.hyperkit)
 		if err != nil {
-			return err
+			return fmt.Errorf("Error writing qcow2 output: %v", err)
 		}
-		zw := gzip.NewWriter(out)
-		tw := tar.NewWriter(zw)
-		hdr := &tar.Header{
-			Name: "disk.raw",
-			Mode: 0600,
-			Size: fi.Size(),
+		return o.accountFile(filename)
+	},
+	"delta": func(base string, image []byte, o *outputOpts) error {
+		if o.deltaAgainst == "" {
+			return fmt.Errorf("The delta output needs the tarball of a previous build of the image to compare with, use -delta-against")
 		}
-		err = tw.WriteHeader(hdr)
+		err := outputDelta(base, image, o)
 		if err != nil {
-			return err
+			return fmt.Errorf("Error writing delta output: %v", err)
+		}
+		return nil
+	},
+	"efi": func(base string, image []byte, o *outputOpts) error {
+		if o.efiStub == "" {
+			return fmt.Errorf("The efi output needs an EFI stub to add the kernel to, such as linuxx64.efi.stub from systemd-boot, use -efi-stub")
 		}
-		io.Copy(tw, in)
-		err = tw.Close()
+		stub, err := ioutil.ReadFile(o.efiStub)
 		if err != nil {
-			return err
+			return fmt.Errorf("Cannot read EFI stub: %v", err)
 		}
-		err = zw.Close()
+		kernel, initrd, cmdline, err := o.splitImage(image)
 		if err != nil {
-			return err
+			return fmt.Errorf("Error converting to initrd: %v", err)
 		}
-		err = in.Close()
+		// the unified kernel image is a single file on the EFI system partition
+		err = checkFATFile("efi", "unified kernel image", int64(len(stub)+len(kernel)+len(initrd)+len(cmdline)))
 		if err != nil {
 			return err
 		}
-		err = out.Close()
+		osrel, err := osRelease(image, filepath.Base(base))
 		if err != nil {
-			return err
+			return fmt.Errorf("Error reading os-release: %v", err)
 		}
-		err = os.RemoveAll(tmp)
+		err = outputEFI(base+".efi", stub, kernel, initrd, cmdline, osrel, o)
 		if err != nil {
-			return err
+			return fmt.Errorf("Error writing efi output: %v", err)
 		}
 		return nil
 	},
-	"qcow2": func(base string, image []byte, size int, hyperkit bool) error {
-		filename := base + ".qcow2"
+	"ab-raw": func(base string, image []byte, o *outputOpts) error {
+		filename := base + "-ab-raw.img"
 		log.Infof("  %s", filename)
-		kernel, initrd, cmdline, err := tarToInitrd(image)
+		kernel, initrd, cmdline, err := o.splitImage(image)
 		if err != nil {
 			return fmt.Errorf("Error converting to initrd: %v", err)
 		}
-		err = outputLinuxKit("qcow2", filename, kernel, initrd, cmdline, size, hyperkit)
+		rootfs, err := abRootfs(kernel, initrd, cmdline)
 		if err != nil {
-			return fmt.Errorf("Error writing qcow2 output: %v", err)
+			return fmt.Errorf("Error writing ab-raw output: %v", err)
+		}
+		err = outputABDisk(filename, rootfs, o)
+		if err != nil {
+			return fmt.Errorf("Error writing ab-raw output: %v", err)
 		}
 		return nil
 	},
-	"vhd": func(base string, image []byte, size int, hyperkit bool) error {
-		kernel, initrd, cmdline, err := tarToInitrd(image)
+	"vhd": func(base string, image []byte, o *outputOpts) error {
+		kernel, initrd, cmdline, err := o.splitImage(image)
 		if err != nil {
 			return fmt.Errorf("Error converting to initrd: %v", err)
 		}
-		err = outputImg(vhd, base+".vhd", kernel, initrd, cmdline)
+		err = outputImg(vhd, base+".vhd", kernel, initrd, cmdline, o)
 		if err != nil {
 			return fmt.Errorf("Error writingvhd output: %v", err)
 		}
 		return nil
 	},
-	"vmdk": func(base string, image []byte, size int, hyperkit bool) error {
-		kernel, initrd, cmdline, err := tarToInitrd(image)
+	"vmdk": func(base string, image []byte, o *outputOpts) error {
+		kernel, initrd, cmdline, err := o.splitImage(image)
 		if err != nil {
 			return fmt.Errorf("Error converting to initrd: %v", err)
 		}
-		err = outputImg(vmdk, base+".vmdk", kernel, initrd, cmdline)
+		err = outputImg(vmdk, base+".vmdk", kernel, initrd, cmdline, o)
 		if err != nil {
 			return fmt.Errorf("Error writing vmdk output: %v", err)
 		}
@@ -216,6 +293,196 @@ var outFuns = map[string]func(string, []byte, int, bool) error{
 	},
 }
 
+// outputOpts are the options shared by all output types
+type outputOpts struct {
+	size     int
+	hyperkit bool
+	// maxSize is the limit in bytes on the combined size of all outputs, 0 for no limit
+	maxSize int64
+	written int64
+	// files records the files written by each output type
+	files   map[string][]string
+	current string
+	// keepGoing continues with the remaining outputs after one fails
+	keepGoing bool
+	// sensitive are the paths to redact in manifests
+	sensitive map[string]bool
+	// modules is the kernel filesystem tarball, if there is a kernel
+	modules []byte
+	// kernelVersion is the version of the kernel modules, if known
+	kernelVersion string
+	// compressLevel is the gzip level of compressed outputs
+	compressLevel int
+	// efiStub is the path of the EFI stub for the efi output
+	efiStub string
+	// manifestFormat is the format of the manifest output, json if empty
+	manifestFormat string
+	// mode is the permissions of the files written, 0 to leave them as written
+	mode os.FileMode
+	// force replaces the directory of the dir output if it is not empty
+	force bool
+	// cmdline is the kernel cmdline of an image without a boot/cmdline
+	cmdline string
+	// fatSplit writes an initrd too large for FAT32 in parts
+	fatSplit bool
+	// deltaAgainst is the tarball of the previous image for the delta output
+	deltaAgainst string
+	// seed is the cloud-init or Ignition seed of the config, nil if it has none
+	seed *configSeed
+	// timings are the timings of the build, nil to only add to Timings
+	timings *buildTimings
+}
+
+// addFile records a file written by the current output type
+func (o *outputOpts) addFile(filename string) {
+	if o.files == nil {
+		o.files = map[string][]string{}
+	}
+	o.files[o.current] = append(o.files[o.current], filename)
+}
+
+func (o *outputOpts) errTooLarge(filename string) error {
+	return fmt.Errorf("Writing %s exceeds the maximum output size of %d bytes", filename, o.maxSize)
+}
+
+// account adds n bytes written to filename to the total output size
+func (o *outputOpts) account(filename string, n int64) error {
+	o.written += n
+	if o.maxSize > 0 && o.written > o.maxSize {
+		return o.errTooLarge(filename)
+	}
+	return nil
+}
+
+// accountFile adds the size of a file written by an external tool to the
+// total output size, removing the file if the limit is exceeded
+func (o *outputOpts) accountFile(filename string) error {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	err = o.account(filename, fi.Size())
+	if err != nil {
+		os.Remove(filename)
+		return err
+	}
+	o.addFile(filename)
+	return nil
+}
+
+// writeFile writes an output file, checking the size limit before any data is written
+func (o *outputOpts) writeFile(filename string, data []byte) error {
+	if o.maxSize > 0 && o.written+int64(len(data)) > o.maxSize {
+		return o.errTooLarge(filename)
+	}
+	err := ioutil.WriteFile(filename, data, os.FileMode(0644))
+	if err != nil {
+		return err
+	}
+	o.addFile(filename)
+	return o.account(filename, int64(len(data)))
+}
+
+// limitedWriter counts the bytes of a streamed output and fails as soon as the limit is exceeded
+type limitedWriter struct {
+	w        io.Writer
+	o        *outputOpts
+	filename string
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if l.o.maxSize > 0 && l.o.written+int64(len(p)) > l.o.maxSize {
+		return 0, l.o.errTooLarge(l.filename)
+	}
+	n, err := l.w.Write(p)
+	l.o.written += int64(n)
+	return n, err
+}
+
+func (o *outputOpts) limitWriter(filename string, w io.Writer) io.Writer {
+	return &limitedWriter{w: w, o: o, filename: filename}
+}
+
+// defaultCompressLevel balances the size of compressed outputs against the time taken
+const defaultCompressLevel = 6
+
+func validCompressLevel(level int) error {
+	if level < gzip.NoCompression || level > gzip.BestCompression {
+		return fmt.Errorf("Compression level must be between %d and %d, got %d", gzip.NoCompression, gzip.BestCompression, level)
+	}
+	return nil
+}
+
+// parseOutputMode parses the octal permissions of the output files, which
+// must let the owner read them, "" leaves them as they are written
+func parseOutputMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("Output mode must be octal permissions such as 0644, got %s", s)
+	}
+	if mode&0400 == 0 {
+		return 0, fmt.Errorf("Output mode %s must let the owner read the outputs", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// setMode sets the permissions of output files to the output mode, if set
+func (o *outputOpts) setMode(files ...string) error {
+	if o.mode == 0 {
+		return nil
+	}
+	for _, file := range files {
+		if err := os.Chmod(file, o.mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gzipWriter compresses an output at the configured level, within the size limit
+func (o *outputOpts) gzipWriter(filename string, w io.Writer) (*gzip.Writer, error) {
+	return gzip.NewWriterLevel(o.limitWriter(filename, w), o.compressLevel)
+}
+
+// bootOutputs are the output types that boot the kernel with the initrd
+var bootOutputs = map[string]bool{
+	"kernel+initrd": true,
+	"initrd":        true,
+	"iso-bios":      true,
+	"iso-efi":       true,
+	"img":           true,
+	"img-gz":        true,
+	"gcp-img":       true,
+	"qcow2":         true,
+	"ab-raw":        true,
+	"efi":           true,
+	"vhd":           true,
+	"vmdk":          true,
+}
+
+// hasOutput reports whether an output type is one of the outputs
+func hasOutput(out outputList, output string) bool {
+	for _, o := range out {
+		if o == output {
+			return true
+		}
+	}
+	return false
+}
+
+// bootsInitrd reports whether any of the outputs boot the initrd
+func bootsInitrd(out outputList) bool {
+	for _, o := range out {
+		if bootOutputs[o] {
+			return true
+		}
+	}
+	return false
+}
+
 var prereq = map[string]string{
 	"img":     "mkimage",
 	"img-gz":  "mkimage",
@@ -232,6 +499,38 @@ func ensurePrereq(out string) error {
 	return err
 }
 
+// tools are the executables that output types run, which must be on the PATH
+var tools = map[string][]string{
+	"iso-bios": {"docker"},
+	"iso-efi":  {"docker"},
+	"vhd":      {"docker"},
+	"vmdk":     {"docker"},
+	"img":      {"docker", "linuxkit"},
+	"img-gz":   {"docker", "linuxkit"},
+	"gcp-img":  {"docker", "linuxkit"},
+	"qcow2":    {"docker", "linuxkit"},
+}
+
+// checkTools fails early if an executable needed by an output type is missing
+func checkTools(out outputList) error {
+	for _, o := range out {
+		for _, tool := range tools[o] {
+			if err := requireTool("output '"+o+"'", tool); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// requireTool fails if an executable needed by what is not on the PATH
+func requireTool(what, tool string) error {
+	if _, err := exec.LookPath(tool); err != nil {
+		return fmt.Errorf("%s requires %s, not found on PATH", what, tool)
+	}
+	return nil
+}
+
 func validateOutputs(out outputList) error {
 	log.Debugf("validating output: %v", out)
 
@@ -240,6 +539,13 @@ func validateOutputs(out outputList) error {
 		if f == nil {
 			return fmt.Errorf("Unknown output type %s", o)
 		}
+	}
+	// check all the tools are present before setting up any prerequisites
+	err := checkTools(out)
+	if err != nil {
+		return err
+	}
+	for _, o := range out {
 		err := ensurePrereq(o)
 		if err != nil {
 			return fmt.Errorf("Failed to set up output type %s: %v", o, err)
@@ -249,20 +555,43 @@ func validateOutputs(out outputList) error {
 	return nil
 }
 
-func outputs(base string, image []byte, out outputList, size int, hyperkit bool) error {
+func outputs(base string, image []byte, out outputList, opts *outputOpts) error {
 	log.Debugf("output: %v %s", out, base)
 
 	err := validateOutputs(out)
 	if err != nil {
 		return err
 	}
-	for _, o := range out {
+	fifo, err := fifoOutput(base, out)
+	if err != nil {
+		return err
+	}
+	failed := []string{}
+	for i, o := range out {
 		f := outFuns[o]
-		err := f(base, image, size, hyperkit)
+		progressf("Output %d/%d: %s", i+1, len(out), o)
+		opts.current = o
+		start := time.Now()
+		if o == fifo {
+			err = outputFIFO(base, image, o, opts)
+		} else {
+			err = f(base, image, opts)
+		}
+		opts.timings.since(phaseOutput, o, start)
+		if err == nil {
+			err = opts.setMode(opts.files[o]...)
+		}
 		if err != nil {
-			return err
+			if !opts.keepGoing {
+				return err
+			}
+			log.Errorf("Output %s failed: %v", o, err)
+			failed = append(failed, fmt.Sprintf("%s: %v", o, err))
 		}
 	}
+	if len(failed) != 0 {
+		return fmt.Errorf("%d of %d outputs failed: %s", len(failed), len(out), strings.Join(failed, "; "))
+	}
 
 	return nil
 }
@@ -280,6 +609,16 @@ func tarToInitrd(image []byte) ([]byte, []byte, string, error) {
 	return kernel, w.Bytes(), cmdline, nil
 }
 
+// splitImage is tarToInitrd for the outputs, the cmdline is the configured
+// one if the image has no boot/cmdline
+func (o *outputOpts) splitImage(image []byte) ([]byte, []byte, string, error) {
+	kernel, initrd, cmdline, err := tarToInitrd(image)
+	if err == nil && cmdline == "" {
+		cmdline = o.cmdline
+	}
+	return kernel, initrd, cmdline, err
+}
+
 func tarInitrdKernel(kernel, initrd []byte, cmdline string) (*bytes.Buffer, error) {
 	buf := new(bytes.Buffer)
 	tw := tar.NewWriter(buf)
@@ -329,7 +668,7 @@ func tarInitrdKernel(kernel, initrd []byte, cmdline string) (*bytes.Buffer, erro
 	return buf, nil
 }
 
-func outputImg(image, filename string, kernel []byte, initrd []byte, cmdline string) error {
+func outputImg(image, filename string, kernel []byte, initrd []byte, cmdline string, o *outputOpts) error {
 	log.Debugf("output img: %s %s", image, filename)
 	log.Infof("  %s", filename)
 	buf, err := tarInitrdKernel(kernel, initrd, cmdline)
@@ -340,7 +679,7 @@ func outputImg(image, filename string, kernel []byte, initrd []byte, cmdline str
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(filename, img, os.FileMode(0644))
+	err = o.writeFile(filename, img)
 	if err != nil {
 		return err
 	}
@@ -348,7 +687,7 @@ func outputImg(image, filename string, kernel []byte, initrd []byte, cmdline str
 }
 
 // this should replace the other version for types that can specify a size
-func outputImgSize(image, filename string, kernel []byte, initrd []byte, cmdline string, size int) error {
+func outputImgSize(image, filename string, kernel []byte, initrd []byte, cmdline string, size int, o *outputOpts) error {
 	log.Debugf("output img: %s %s size %d", image, filename, size)
 	log.Infof("  %s", filename)
 	buf, err := tarInitrdKernel(kernel, initrd, cmdline)
@@ -364,33 +703,407 @@ func outputImgSize(image, filename string, kernel []byte, initrd []byte, cmdline
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(filename, img, os.FileMode(0644))
+	err = o.writeFile(filename, img)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func outputKernelInitrd(base string, kernel []byte, initrd []byte, cmdline string) error {
+func outputKernelInitrd(base string, kernel []byte, initrd []byte, cmdline string, o *outputOpts) error {
 	log.Debugf("output kernel/initrd: %s %s", base, cmdline)
 	log.Infof("  %s %s %s", base+"-kernel", base+"-initrd.img", base+"-cmdline")
-	err := ioutil.WriteFile(base+"-initrd.img", initrd, os.FileMode(0644))
+	err := o.writeFATFile(base+"-initrd.img", initrd)
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(base+"-kernel", kernel, os.FileMode(0644))
+	err = o.writeFile(base+"-kernel", kernel)
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(base+"-cmdline", []byte(cmdline), os.FileMode(0644))
+	err = o.writeFile(base+"-cmdline", []byte(cmdline))
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func outputTar(base string, initrd []byte) error {
+// outputInitrd writes only the initrd, for bootloaders that supply the kernel separately
+func outputInitrd(base string, initrd []byte, o *outputOpts) error {
+	log.Debugf("output initrd: %s", base)
+	log.Infof("  %s", base+"-initrd.img")
+	return o.writeFATFile(base+"-initrd.img", initrd)
+}
+
+// dockerArchiveManifest is an entry in the manifest.json of a docker save tarball
+type dockerArchiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// dockerArchive creates a tarball in the docker save format, that can be
+// loaded with docker load, with the image as its single layer
+func dockerArchive(name string, image []byte) ([]byte, error) {
+	layerID := fmt.Sprintf("%x", sha256.Sum256(image))
+	config := map[string]interface{}{
+		"architecture": runtime.GOARCH,
+		"os":           "linux",
+		"created":      time.Unix(0, 0).UTC().Format(time.RFC3339),
+		"config":       map[string]interface{}{},
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": []string{"sha256:" + layerID},
+		},
+	}
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return []byte{}, err
+	}
+	configName := fmt.Sprintf("%x.json", sha256.Sum256(configJSON))
+	manifest := []dockerArchiveManifest{{
+		Config:   configName,
+		RepoTags: []string{strings.ToLower(name) + ":latest"},
+		Layers:   []string{layerID + "/layer.tar"},
+	}}
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	hdr := &tar.Header{
+		Name:     layerID,
+		Mode:     0755,
+		Typeflag: tar.TypeDir,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return []byte{}, err
+	}
+	files := []struct {
+		name     string
+		contents []byte
+	}{
+		{layerID + "/VERSION", []byte("1.0")},
+		{layerID + "/layer.tar", image},
+		{configName, configJSON},
+		{"manifest.json", manifestJSON},
+	}
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name: f.name,
+			Mode: 0644,
+			Size: int64(len(f.contents)),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return []byte{}, err
+		}
+		if _, err := tw.Write(f.contents); err != nil {
+			return []byte{}, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return []byte{}, err
+	}
+	return buf.Bytes(), nil
+}
+
+func outputDockerArchive(base string, image []byte, o *outputOpts) error {
+	log.Debugf("output docker archive: %s", base)
+	log.Infof("  %s", base+".docker.tar")
+	archive, err := dockerArchive(filepath.Base(base), image)
+	if err != nil {
+		return err
+	}
+	return o.writeFile(base+".docker.tar", archive)
+}
+
+// manifestEntry is the type of an entry in the path manifest of an image
+type manifestEntry struct {
+	Path string `json:"path"`
+	Type string `json:"type"`
+	Mode string `json:"mode"`
+	Size int64  `json:"size"`
+	UID  int    `json:"uid"`
+	GID  int    `json:"gid"`
+}
+
+type manifestEntries []manifestEntry
+
+func (m manifestEntries) Len() int {
+	return len(m)
+}
+func (m manifestEntries) Less(i, j int) bool {
+	return m[i].Path < m[j].Path
+}
+func (m manifestEntries) Swap(i, j int) {
+	m[i], m[j] = m[j], m[i]
+}
+
+var cpioTypes = map[int64]string{
+	cpio.TYPE_REG:     "file",
+	cpio.TYPE_DIR:     "dir",
+	cpio.TYPE_SYMLINK: "symlink",
+	cpio.TYPE_CHAR:    "char",
+	cpio.TYPE_BLK:     "block",
+	cpio.TYPE_FIFO:    "fifo",
+	cpio.TYPE_SOCK:    "socket",
+}
+
+// pathManifest lists every entry in an initrd, sorted by path, with the
+// sensitive paths redacted
+func pathManifest(initrd []byte, sensitive map[string]bool) (manifestEntries, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(initrd))
+	if err != nil {
+		return nil, err
+	}
+	// the initrd is zero padded after the gzip stream
+	zr.Multistream(false)
+	cr := cpio.NewReader(zr)
+	entries := manifestEntries{}
+	for {
+		hdr, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.IsTrailer() {
+			break
+		}
+		name := hdr.Name
+		if sensitive[name] {
+			name = redacted
+		}
+		entries = append(entries, manifestEntry{
+			Path: name,
+			Type: cpioTypes[hdr.Type],
+			Mode: fmt.Sprintf("%04o", hdr.Mode&07777),
+			Size: hdr.Size,
+			UID:  hdr.Uid,
+			GID:  hdr.Gid,
+		})
+	}
+	sort.Sort(entries)
+	return entries, nil
+}
+
+const (
+	manifestJSON = "json"
+	manifestText = "text"
+	manifestCSV  = "csv"
+)
+
+var manifestFormats = []string{manifestJSON, manifestText, manifestCSV}
+
+// manifestSuffixes are the file name suffixes of the manifest in each format
+var manifestSuffixes = map[string]string{
+	manifestJSON: "-manifest.json",
+	manifestText: "-manifest.txt",
+	manifestCSV:  "-manifest.csv",
+}
+
+// manifestColumns are the columns of the text and csv manifests, in the
+// order of the fields of each entry in the json manifest
+var manifestColumns = []string{"path", "type", "mode", "size", "uid", "gid"}
+
+func validManifestFormat(format string) error {
+	if manifestSuffixes[format] == "" {
+		return fmt.Errorf("Unknown manifest format %s, must be one of: %s", format, strings.Join(manifestFormats, ", "))
+	}
+	return nil
+}
+
+// writeManifest writes the path manifest as a json array of entries, as text
+// columns for people to read or as csv with a header row of manifestColumns
+func writeManifest(w io.Writer, entries manifestEntries, format string) error {
+	row := func(e manifestEntry) []string {
+		return []string{e.Path, e.Type, e.Mode, strconv.FormatInt(e.Size, 10), strconv.Itoa(e.UID), strconv.Itoa(e.GID)}
+	}
+	switch format {
+	case manifestText:
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.ToUpper(strings.Join(manifestColumns, "\t")))
+		for _, e := range entries {
+			fmt.Fprintln(tw, strings.Join(row(e), "\t"))
+		}
+		return tw.Flush()
+	case manifestCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(manifestColumns); err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := cw.Write(row(e)); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	manifest, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(manifest, '\n'))
+	return err
+}
+
+func outputManifest(base string, initrd []byte, o *outputOpts) error {
+	format := o.manifestFormat
+	if format == "" {
+		format = manifestJSON
+	}
+	filename := base + manifestSuffixes[format]
+	log.Debugf("output manifest: %s %s", base, format)
+	log.Infof("  %s", filename)
+	entries, err := pathManifest(initrd, o.sensitive)
+	if err != nil {
+		return err
+	}
+	buf := new(bytes.Buffer)
+	err = writeManifest(buf, entries, format)
+	if err != nil {
+		return err
+	}
+	return o.writeFile(filename, buf.Bytes())
+}
+
+func outputModules(base string, o *outputOpts) error {
+	log.Debugf("output modules: %s", base)
+	if o.modules == nil {
+		return errors.New("there are no kernel modules without a kernel image")
+	}
+	log.Infof("  %s", base+"-modules.tar")
+	return o.writeFile(base+"-modules.tar", o.modules)
+}
+
+func outputTar(base string, initrd []byte, o *outputOpts) error {
 	log.Debugf("output tar: %s", base)
 	log.Infof("  %s", base+".tar")
-	return ioutil.WriteFile(base+".tar", initrd, os.FileMode(0644))
+	return o.writeFile(base+".tar", initrd)
+}
+
+// outputTarGz writes the same tarball as the tar output, compressed
+func outputTarGz(base string, image []byte, o *outputOpts) error {
+	filename := base + ".tar.gz"
+	log.Debugf("output tar-gz: %s", base)
+	log.Infof("  %s", filename)
+	out, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := writeTarGz(out, filename, image, o); err != nil {
+		out.Close()
+		os.Remove(filename)
+		return err
+	}
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+	o.addFile(filename)
+	return nil
+}
+
+// outputGCPImage writes a raw disk image as the gzipped tarball that GCP
+// imports, removing the partial file if it cannot be written
+func outputGCPImage(filename, raw string, o *outputOpts) error {
+	out, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = writeGCPImage(out, filename, raw, o)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(filename)
+		return err
+	}
+	o.addFile(filename)
+	return nil
+}
+
+// writeGCPImage writes the tarball of the gcp-img output to w
+func writeGCPImage(w io.Writer, filename, raw string, o *outputOpts) error {
+	in, err := os.Open(raw)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	zw, err := o.gzipWriter(filename, w)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(zw)
+	hdr := &tar.Header{
+		Name: "disk.raw",
+		Mode: 0600,
+		Size: fi.Size(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, in); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// outputImgGz writes a raw disk image gzipped, removing the partial file if it
+// cannot be written
+func outputImgGz(filename, raw string, o *outputOpts) error {
+	out, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = writeImgGz(out, filename, raw, o)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(filename)
+		return err
+	}
+	o.addFile(filename)
+	return nil
+}
+
+// writeImgGz writes the compressed disk image of the img-gz output to w
+func writeImgGz(w io.Writer, filename, raw string, o *outputOpts) error {
+	in, err := os.Open(raw)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	zw, err := o.gzipWriter(filename, w)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(zw, in); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// writeTarGz writes the tarball of the tar-gz output to w
+func writeTarGz(w io.Writer, filename string, image []byte, o *outputOpts) error {
+	zw, err := o.gzipWriter(filename, w)
+	if err != nil {
+		return err
+	}
+	if _, err := zw.Write(image); err != nil {
+		return err
+	}
+	return zw.Close()
 }
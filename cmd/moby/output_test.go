@@ -0,0 +1,778 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/surma/gocpio"
+)
+
+// testImage assembles an image tarball with a kernel and some files
+func testImage(t *testing.T) []byte {
+	kernel, ktar, err := untarKernel(kernelImageTar(t), "kernel", "bzImage", "kernel.tar", KernelConfig{Cmdline: "console=ttyS0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := makeTar(t, []tarEntry{
+		{name: "etc", typeflag: tar.TypeDir},
+		{name: "etc/hostname", typeflag: tar.TypeReg, contents: "moby"},
+	})
+	buf := new(bytes.Buffer)
+	iw := tar.NewWriter(buf)
+	for _, r := range []io.Reader{kernel, ktar, files} {
+		if err := initrdAppend(iw, r, appendOpts{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := iw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// readInitrd lists the entries in a compressed cpio initrd
+func readInitrd(t *testing.T, filename string) []string {
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the initrd is zero padded after the gzip stream
+	zr.Multistream(false)
+	cr := cpio.NewReader(zr)
+	names := []string{}
+	for {
+		hdr, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.IsTrailer() {
+			break
+		}
+		names = append(names, hdr.Name)
+	}
+	return names
+}
+
+func TestMaxOutputSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := bytes.Repeat([]byte("x"), 4096)
+
+	// within the limit
+	base := filepath.Join(dir, "within")
+	o := &outputOpts{maxSize: 8192}
+	if err := outputs(base, image, outputList{"tar"}, o); err != nil {
+		t.Fatalf("unexpected error for output within limit: %v", err)
+	}
+	if _, err := os.Stat(base + ".tar"); err != nil {
+		t.Errorf("expected output to be written: %v", err)
+	}
+
+	// the second output pushes the total over the limit
+	o = &outputOpts{maxSize: 6000}
+	if err := outputs(base, image, outputList{"tar"}, o); err != nil {
+		t.Fatalf("unexpected error for first output: %v", err)
+	}
+	base = filepath.Join(dir, "exceeds")
+	if err := outputs(base, image, outputList{"tar"}, o); err == nil {
+		t.Error("expected error for output exceeding limit")
+	}
+	if _, err := os.Stat(base + ".tar"); !os.IsNotExist(err) {
+		t.Error("expected output exceeding limit not to be written")
+	}
+}
+
+func TestMaxOutputSizeStreamed(t *testing.T) {
+	data := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	o := &outputOpts{maxSize: 100}
+	out := new(bytes.Buffer)
+	zw := gzip.NewWriter(o.limitWriter("test.gz", out))
+	_, err := zw.Write(data)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		t.Error("expected streamed output exceeding limit to fail")
+	}
+	if int64(out.Len()) > o.maxSize {
+		t.Errorf("streamed output wrote %d bytes past limit of %d", out.Len(), o.maxSize)
+	}
+
+	o = &outputOpts{maxSize: 1024 * 1024}
+	out = new(bytes.Buffer)
+	zw = gzip.NewWriter(o.limitWriter("test.gz", out))
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if o.written != int64(out.Len()) {
+		t.Errorf("expected %d bytes accounted, got %d", out.Len(), o.written)
+	}
+}
+
+func TestCompressLevel(t *testing.T) {
+	data := []byte(strings.Repeat("moby compresses well ", 1000))
+
+	sizes := map[int]int{}
+	for _, level := range []int{gzip.NoCompression, gzip.BestCompression} {
+		o := &outputOpts{compressLevel: level}
+		out := new(bytes.Buffer)
+		zw, err := o.gzipWriter("test.gz", out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := zw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		sizes[level] = out.Len()
+
+		zr, err := gzip.NewReader(out)
+		if err != nil {
+			t.Fatalf("Level %d output is not valid gzip: %v", level, err)
+		}
+		got, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("Level %d output is not valid gzip: %v", level, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("Level %d output does not decompress to the input", level)
+		}
+	}
+	if sizes[gzip.NoCompression] <= len(data) {
+		t.Errorf("Expected level 0 to store the data uncompressed, got %d bytes from %d", sizes[gzip.NoCompression], len(data))
+	}
+	if sizes[gzip.BestCompression] >= sizes[gzip.NoCompression] {
+		t.Errorf("Expected level 9 to be smaller than level 0, got %d and %d bytes", sizes[gzip.BestCompression], sizes[gzip.NoCompression])
+	}
+
+	for _, level := range []int{-1, 10} {
+		if err := validCompressLevel(level); err == nil {
+			t.Errorf("Expected compression level %d to be rejected", level)
+		}
+	}
+	if err := validCompressLevel(defaultCompressLevel); err != nil {
+		t.Errorf("Expected the default compression level to be valid: %v", err)
+	}
+}
+
+func TestOutputTarGz(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := testImage(t)
+	base := filepath.Join(dir, "test")
+	if err := outputs(base, image, outputList{"tar"}, &outputOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ioutil.ReadFile(base + ".tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sizes := map[int]int64{}
+	for _, level := range []int{gzip.NoCompression, gzip.BestCompression} {
+		o := &outputOpts{compressLevel: level}
+		if err := outputs(base, image, outputList{"tar-gz"}, o); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(o.files["tar-gz"], []string{base + ".tar.gz"}) {
+			t.Errorf("Expected the tar-gz output to write %s.tar.gz, got %v", base, o.files)
+		}
+		f, err := os.Open(base + ".tar.gz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("Level %d output is not valid gzip: %v", level, err)
+		}
+		got, err := ioutil.ReadAll(zr)
+		f.Close()
+		if err != nil {
+			t.Fatalf("Level %d output is not valid gzip: %v", level, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("Level %d output does not decompress to the tar output", level)
+		}
+		sizes[level] = o.written
+	}
+	if sizes[gzip.BestCompression] >= sizes[gzip.NoCompression] || sizes[gzip.NoCompression] <= int64(len(plain)) {
+		t.Errorf("Expected the compression level to be used, got %d and %d bytes from %d", sizes[gzip.NoCompression], sizes[gzip.BestCompression], len(plain))
+	}
+}
+
+func TestOutputInitrd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := testImage(t)
+
+	base := filepath.Join(dir, "bare")
+	if err := outputs(base, image, outputList{"initrd"}, &outputOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range readInitrd(t, base+"-initrd.img") {
+		if name == "boot/kernel" || name == "boot/cmdline" {
+			t.Errorf("initrd output should not contain %s", name)
+		}
+	}
+	if _, err := os.Stat(base + "-kernel"); !os.IsNotExist(err) {
+		t.Error("initrd output should not write a kernel")
+	}
+
+	base = filepath.Join(dir, "full")
+	if err := outputs(base, image, outputList{"kernel+initrd"}, &outputOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	kernel, err := ioutil.ReadFile(base + "-kernel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(kernel) != "kernel image" {
+		t.Errorf("expected kernel+initrd output to contain the kernel, got %q", kernel)
+	}
+	found := false
+	for _, name := range readInitrd(t, base+"-initrd.img") {
+		if name == "etc/hostname" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("expected initrd to contain etc/hostname")
+	}
+}
+
+func TestOutputDockerArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := testImage(t)
+	base := filepath.Join(dir, "Test")
+	if err := outputs(base, image, outputList{"docker-archive"}, &outputOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := ioutil.ReadFile(base + ".docker.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, contents := readTar(t, bytes.NewBuffer(archive))
+
+	var manifest []dockerArchiveManifest
+	if err := json.Unmarshal([]byte(contents["manifest.json"]), &manifest); err != nil {
+		t.Fatalf("Invalid manifest.json: %v", err)
+	}
+	if len(manifest) != 1 {
+		t.Fatalf("Expected one image in manifest.json, got %d", len(manifest))
+	}
+	if len(manifest[0].RepoTags) != 1 || manifest[0].RepoTags[0] != "test:latest" {
+		t.Errorf("Expected repo tag test:latest, got %v", manifest[0].RepoTags)
+	}
+	var config struct {
+		Rootfs struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	if err := json.Unmarshal([]byte(contents[manifest[0].Config]), &config); err != nil {
+		t.Fatalf("Invalid image config %s: %v", manifest[0].Config, err)
+	}
+	if len(manifest[0].Layers) != 1 || len(config.Rootfs.DiffIDs) != 1 {
+		t.Fatalf("Expected a single layer, got %v and diff ids %v", manifest[0].Layers, config.Rootfs.DiffIDs)
+	}
+	layer := contents[manifest[0].Layers[0]]
+	if layer != string(image) {
+		t.Error("Expected the layer to contain the image")
+	}
+	if config.Rootfs.DiffIDs[0] != fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(layer))) {
+		t.Errorf("Diff id %s does not match the layer", config.Rootfs.DiffIDs[0])
+	}
+}
+
+func TestCheckTools(t *testing.T) {
+	defer func(funs map[string]func(string, []byte, *outputOpts) error, needs map[string][]string) {
+		outFuns, tools = funs, needs
+	}(outFuns, tools)
+	funs := map[string]func(string, []byte, *outputOpts) error{}
+	for o, f := range outFuns {
+		funs[o] = f
+	}
+	needs := map[string][]string{}
+	for o, t := range tools {
+		needs[o] = t
+	}
+	outFuns, tools = funs, needs
+	outFuns["fake"] = func(base string, image []byte, o *outputOpts) error {
+		return nil
+	}
+	tools["fake"] = []string{"moby-test-nonexistent-tool"}
+
+	err := validateOutputs(outputList{"tar", "fake"})
+	if err == nil {
+		t.Fatal("Expected error for output requiring a missing tool")
+	}
+	expected := "output 'fake' requires moby-test-nonexistent-tool, not found on PATH"
+	if err.Error() != expected {
+		t.Errorf("Expected error %q, got %q", expected, err.Error())
+	}
+
+	// outputs not using any tools are always valid
+	if err := validateOutputs(outputList{"tar", "initrd"}); err != nil {
+		t.Errorf("Unexpected error for outputs without tools: %v", err)
+	}
+}
+
+func TestOutputsKeepGoing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// not a tarball, so the initrd output fails but the tar output does not
+	image := bytes.Repeat([]byte("x"), 4096)
+	out := outputList{"initrd", "tar"}
+
+	base := filepath.Join(dir, "failfast")
+	if err := outputs(base, image, out, &outputOpts{}); err == nil {
+		t.Error("expected error from failing output")
+	}
+	if _, err := os.Stat(base + ".tar"); !os.IsNotExist(err) {
+		t.Error("expected outputs after a failure not to be written without keep going")
+	}
+
+	base = filepath.Join(dir, "keepgoing")
+	o := &outputOpts{keepGoing: true}
+	err = outputs(base, image, out, o)
+	if err == nil {
+		t.Error("expected error from failing output with keep going")
+	} else if !strings.Contains(err.Error(), "1 of 2 outputs failed") {
+		t.Errorf("expected aggregate error, got %v", err)
+	}
+	if _, err := os.Stat(base + ".tar"); err != nil {
+		t.Errorf("expected outputs after a failure to be written with keep going: %v", err)
+	}
+	if len(o.files["tar"]) != 1 {
+		t.Errorf("expected tar output to be recorded, got %v", o.files)
+	}
+}
+
+func TestOutputManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := testImage(t)
+	base := filepath.Join(dir, "test")
+	if err := outputs(base, image, outputList{"initrd", "manifest"}, &outputOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(base + "-manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest []manifestEntry
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		t.Fatalf("Invalid manifest: %v", err)
+	}
+
+	// the manifest lists exactly the assembled initrd contents, sorted
+	names := readInitrd(t, base+"-initrd.img")
+	sort.Strings(names)
+	paths := []string{}
+	for _, e := range manifest {
+		paths = append(paths, e.Path)
+	}
+	if !reflect.DeepEqual(paths, names) {
+		t.Errorf("Expected manifest paths %v, got %v", names, paths)
+	}
+
+	expected := map[string]manifestEntry{
+		"etc":          {Path: "etc", Type: "dir", Mode: "0755"},
+		"etc/hostname": {Path: "etc/hostname", Type: "file", Mode: "0644", Size: 4},
+	}
+	for _, e := range manifest {
+		if want, ok := expected[e.Path]; ok && e != want {
+			t.Errorf("Expected manifest entry %+v, got %+v", want, e)
+		}
+	}
+}
+
+func TestOutputModules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	buf := new(bytes.Buffer)
+	iw := tar.NewWriter(buf)
+	modules, err := addKernel(iw, kernelImageTar(t).Bytes(), KernelConfig{}, appendOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := iw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	base := filepath.Join(dir, "test")
+	if err := outputs(base, buf.Bytes(), outputList{"modules"}, &outputOpts{modules: modules}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(base + "-modules.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdrs, _ := readTar(t, bytes.NewBuffer(b))
+	if _, ok := hdrs["lib/modules/4.9.0/"]; !ok {
+		t.Errorf("Expected modules output to contain the kernel filesystem, got %v", hdrs)
+	}
+	for _, name := range []string{"boot/kernel", "boot/cmdline", "kernel"} {
+		if _, ok := hdrs[name]; ok {
+			t.Errorf("Expected modules output not to contain %s", name)
+		}
+	}
+
+	if err := outputs(base, buf.Bytes(), outputList{"modules"}, &outputOpts{}); err == nil {
+		t.Error("Expected modules output to fail without a kernel")
+	}
+}
+
+func TestManifestFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := testImage(t)
+	base := filepath.Join(dir, "test")
+	rendered := map[string]string{}
+	for _, format := range manifestFormats {
+		if err := outFuns["manifest"](base, image, &outputOpts{manifestFormat: format}); err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(base + manifestSuffixes[format])
+		if err != nil {
+			t.Fatalf("Expected a %s manifest: %v", format, err)
+		}
+		rendered[format] = string(b)
+	}
+
+	var entries manifestEntries
+	if err := json.Unmarshal([]byte(rendered[manifestJSON]), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 {
+		t.Fatal("Expected entries in the manifest")
+	}
+	rows := [][]string{manifestColumns}
+	for _, e := range entries {
+		rows = append(rows, []string{e.Path, e.Type, e.Mode, fmt.Sprint(e.Size), fmt.Sprint(e.UID), fmt.Sprint(e.GID)})
+	}
+
+	records, err := csv.NewReader(strings.NewReader(rendered[manifestCSV])).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(records, rows) {
+		t.Errorf("Expected the csv manifest to have the same entries as the json manifest, got %v and %v", records, rows)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(rendered[manifestText], "\n"), "\n")
+	if len(lines) != len(rows) {
+		t.Fatalf("Expected %d lines in the text manifest, got %d", len(rows), len(lines))
+	}
+	for i, line := range lines {
+		expected := rows[i]
+		if i == 0 {
+			expected = strings.Fields(strings.ToUpper(strings.Join(manifestColumns, " ")))
+		}
+		if fields := strings.Fields(line); !reflect.DeepEqual(fields, expected) {
+			t.Errorf("Expected text manifest line %v, got %v", expected, fields)
+		}
+	}
+
+	// json is the default
+	if err := outFuns["manifest"](filepath.Join(dir, "default"), image, &outputOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "default-manifest.json")); err != nil || string(b) != rendered[manifestJSON] {
+		t.Errorf("Expected the json manifest by default: %v", err)
+	}
+	if err := validManifestFormat("yaml"); err == nil {
+		t.Error("Expected an unknown manifest format to be rejected")
+	}
+}
+
+func TestOutputMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, mode := range []os.FileMode{0600, 0640, 0755} {
+		o := &outputOpts{mode: mode}
+		base := filepath.Join(dir, fmt.Sprintf("test%o", mode))
+		if err := outputs(base, testImage(t), outputList{"tar", "kernel+initrd", "manifest"}, o); err != nil {
+			t.Fatal(err)
+		}
+		written := 0
+		for out, files := range o.files {
+			for _, file := range files {
+				written++
+				fi, err := os.Stat(file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fi.Mode().Perm() != mode {
+					t.Errorf("Expected %s output %s to have mode %o, got %o", out, file, mode, fi.Mode().Perm())
+				}
+			}
+		}
+		if written < 5 {
+			t.Errorf("Expected at least 5 output files, got %d", written)
+		}
+	}
+
+	// the build also sets the mode of the Packer manifest and archive
+	conf := filepath.Join(dir, "files.yml")
+	if err := ioutil.WriteFile(conf, []byte("files:\n  - path: etc/motd\n    contents: hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &buildCommand{
+		out:            outputList{"tar"},
+		outputMode:     0600,
+		packerManifest: filepath.Join(dir, "packer.json"),
+		archive:        filepath.Join(dir, "files.tar.gz"),
+		compressLevel:  defaultCompressLevel,
+	}
+	if err := c.run(conf, dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{filepath.Join(dir, "files.tar"), c.packerManifest, c.archive} {
+		fi, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0600 {
+			t.Errorf("Expected %s to have mode 600, got %o", file, fi.Mode().Perm())
+		}
+	}
+
+	for s, expected := range map[string]os.FileMode{"": 0, "0644": 0644, "600": 0600, "0640": 0640, "0755": 0755} {
+		mode, err := parseOutputMode(s)
+		if err != nil || mode != expected {
+			t.Errorf("Expected output mode %q to be %o, got %o %v", s, expected, mode, err)
+		}
+	}
+	for _, s := range []string{"0", "644x", "0888", "01644", "-644", "rw-r--r--", "0044"} {
+		if _, err := parseOutputMode(s); err == nil {
+			t.Errorf("Expected output mode %q to be rejected", s)
+		}
+	}
+}
+
+func TestOutputStdoutSHA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := filepath.Join(dir, "test.yml")
+	if err := ioutil.WriteFile(conf, []byte("init:\n  - linuxkit/init:v1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	images := &fakeImages{
+		exports: map[string][]byte{
+			"linuxkit/init:v1": makeTar(t, []tarEntry{
+				{name: "bin", typeflag: tar.TypeDir},
+				{name: "bin/init", typeflag: tar.TypeReg, contents: "init"},
+			}).Bytes(),
+		},
+		inspects: map[string]types.ImageInspect{
+			"linuxkit/init:v1": {ID: "sha256:1111", Os: "linux"},
+		},
+	}
+	defer func(source imageSource, w io.Writer) {
+		Images = source
+		digestOutput = w
+	}(Images, digestOutput)
+	Images = images
+	printed := new(bytes.Buffer)
+	digestOutput = printed
+
+	// the digest is of the image built reproducibly, with nothing written
+	shaDir := filepath.Join(dir, "sha")
+	tarDir := filepath.Join(dir, "tar")
+	for _, d := range []string{shaDir, tarDir} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := &buildCommand{out: outputList{"stdout-sha"}, compressLevel: defaultCompressLevel}
+	if err := c.run(conf, shaDir); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := ioutil.ReadDir(shaDir); len(files) != 0 {
+		t.Errorf("Expected stdout-sha to write no files, got %d", len(files))
+	}
+
+	c = &buildCommand{out: outputList{"tar"}, compressLevel: defaultCompressLevel, opts: buildOpts{reproducible: true}}
+	if err := c.run(conf, tarDir); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := sha256File(filepath.Join(tarDir, "test.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if printed.String() != hash+"\n" {
+		t.Errorf("Expected stdout-sha to print the sha256 of the tar output %s, got %q", hash, printed.String())
+	}
+}
+
+func TestOutputGCPImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	disk := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(disk)
+	raw := filepath.Join(dir, "disk.raw")
+	if err := ioutil.WriteFile(raw, disk, 0644); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "test.img.tar.gz")
+
+	o := &outputOpts{compressLevel: defaultCompressLevel, current: "gcp-img"}
+	if err := outputGCPImage(filename, raw, o); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := io.Copy(buf, zr); err != nil {
+		t.Fatal(err)
+	}
+	hdrs, contents := readTar(t, buf)
+	if hdrs["disk.raw"] == nil || contents["disk.raw"] != string(disk) || !reflect.DeepEqual(o.files["gcp-img"], []string{filename}) {
+		t.Errorf("Expected the disk image in the tarball and the file recorded, got %v %v", hdrs, o.files)
+	}
+
+	// the partial file is removed whichever write fails
+	for _, limit := range []int64{10, 1024, int64(len(disk))} {
+		o := &outputOpts{compressLevel: defaultCompressLevel, maxSize: limit}
+		if err := outputGCPImage(filename, raw, o); err == nil || !strings.Contains(err.Error(), "maximum output size") {
+			t.Errorf("Expected the %d byte limit to fail the output, got %v", limit, err)
+		}
+		if _, err := os.Stat(filename); !os.IsNotExist(err) || len(o.files) != 0 {
+			t.Errorf("Expected the partial output to be removed with the %d byte limit, got %v %v", limit, err, o.files)
+		}
+	}
+}
+
+func TestOutputImgGz(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	disk := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(disk)
+	raw := filepath.Join(dir, "uncompressed.img")
+	if err := ioutil.WriteFile(raw, disk, 0644); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "test.img.gz")
+
+	o := &outputOpts{compressLevel: defaultCompressLevel, current: "img-gz"}
+	if err := outputImgGz(filename, raw, o); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, disk) || !reflect.DeepEqual(o.files["img-gz"], []string{filename}) {
+		t.Errorf("Expected the compressed disk image and the file recorded, got %d bytes and %v", len(b), o.files)
+	}
+
+	// the partial file is removed whichever write fails, or if there is no disk image
+	for _, limit := range []int64{10, 1024, int64(len(disk))} {
+		o := &outputOpts{compressLevel: defaultCompressLevel, maxSize: limit}
+		if err := outputImgGz(filename, raw, o); err == nil || !strings.Contains(err.Error(), "maximum output size") {
+			t.Errorf("Expected the %d byte limit to fail the output, got %v", limit, err)
+		}
+		if _, err := os.Stat(filename); !os.IsNotExist(err) || len(o.files) != 0 {
+			t.Errorf("Expected the partial output to be removed with the %d byte limit, got %v %v", limit, err, o.files)
+		}
+	}
+	o = &outputOpts{compressLevel: defaultCompressLevel}
+	if err := outputImgGz(filename, filepath.Join(dir, "missing.img"), o); err == nil {
+		t.Error("Expected an error without the disk image")
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) || len(o.files) != 0 {
+		t.Errorf("Expected no output without the disk image, got %v %v", err, o.files)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The structure written by the Packer manifest post-processor, see
+// https://www.packer.io/docs/post-processors/manifest.html
+
+type packerManifest struct {
+	Builds      []packerBuild `json:"builds"`
+	LastRunUUID string        `json:"last_run_uuid"`
+}
+
+type packerBuild struct {
+	Name          string            `json:"name"`
+	BuilderType   string            `json:"builder_type"`
+	BuildTime     int64             `json:"build_time"`
+	Files         []packerFile      `json:"files"`
+	ArtifactID    string            `json:"artifact_id"`
+	PackerRunUUID string            `json:"packer_run_uuid"`
+	CustomData    map[string]string `json:"custom_data"`
+}
+
+type packerFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+func uuid() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	// version 4, variant 10
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+func sha256File(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// writePackerManifest writes a Packer compatible manifest with a build for each output type,
+// the sha256 checksum of each file is recorded in the custom data keyed by file name, along
+// with the kernel version if it is known
+func writePackerManifest(filename string, out outputList, o *outputOpts) error {
+	log.Debugf("packer manifest: %s", filename)
+	runUUID, err := uuid()
+	if err != nil {
+		return err
+	}
+	manifest := packerManifest{
+		Builds:      []packerBuild{},
+		LastRunUUID: runUUID,
+	}
+	now := time.Now().Unix()
+	for _, output := range out {
+		build := packerBuild{
+			Name:          output,
+			BuilderType:   "moby",
+			BuildTime:     now,
+			Files:         []packerFile{},
+			PackerRunUUID: runUUID,
+			CustomData:    map[string]string{},
+		}
+		if o.kernelVersion != "" {
+			build.CustomData["kernel_version"] = o.kernelVersion
+		}
+		for _, file := range o.files[output] {
+			fi, err := os.Stat(file)
+			if err != nil {
+				return err
+			}
+			sum, err := sha256File(file)
+			if err != nil {
+				return err
+			}
+			build.Files = append(build.Files, packerFile{Name: file, Size: fi.Size()})
+			build.CustomData[file] = "sha256:" + sum
+			if build.ArtifactID == "" {
+				build.ArtifactID = file
+			}
+		}
+		manifest.Builds = append(manifest.Builds, build)
+	}
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	log.Infof("  %s", filename)
+	return ioutil.WriteFile(filename, b, 0644)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPackerManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := outputList{"tar", "kernel+initrd"}
+	o := &outputOpts{kernelVersion: "4.9.0"}
+	if err := outputs(filepath.Join(dir, "test"), testImage(t), out, o); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "packer-manifest.json")
+	if err := writePackerManifest(filename, out, o); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest packerManifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(manifest.Builds) != len(out) {
+		t.Fatalf("Expected %d builds in manifest, got %d", len(out), len(manifest.Builds))
+	}
+	expected := map[string]int{"tar": 1, "kernel+initrd": 3}
+	for _, build := range manifest.Builds {
+		if build.PackerRunUUID != manifest.LastRunUUID {
+			t.Errorf("Expected build run uuid %s to match last run uuid %s", build.PackerRunUUID, manifest.LastRunUUID)
+		}
+		if build.CustomData["kernel_version"] != "4.9.0" {
+			t.Errorf("Expected kernel version in custom data for %s, got %v", build.Name, build.CustomData)
+		}
+		if len(build.Files) != expected[build.Name] {
+			t.Errorf("Expected %d files for output %s, got %d", expected[build.Name], build.Name, len(build.Files))
+		}
+		for _, f := range build.Files {
+			fi, err := os.Stat(f.Name)
+			if err != nil {
+				t.Errorf("Manifest lists file %s which was not written: %v", f.Name, err)
+				continue
+			}
+			if fi.Size() != f.Size {
+				t.Errorf("Expected size %d for %s, got %d", fi.Size(), f.Name, f.Size)
+			}
+			sum, err := sha256File(f.Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if build.CustomData[f.Name] != "sha256:"+sum {
+				t.Errorf("Expected checksum sha256:%s for %s, got %s", sum, f.Name, build.CustomData[f.Name])
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/term"
+)
+
+const (
+	// progressAuto redraws progress in place on a terminal, otherwise it is plain
+	progressAuto = "auto"
+	// progressPlain writes progress a line at a time
+	progressPlain = "plain"
+	// progressNone does not write any progress
+	progressNone = "none"
+)
+
+var progressModes = []string{progressAuto, progressPlain, progressNone}
+
+// ProgressMode controls how all progress is shown, it does not affect logging
+var ProgressMode = progressAuto
+
+// progressOut is where progress is written
+var progressOut io.Writer = os.Stderr
+
+func validProgressMode(mode string) error {
+	for _, m := range progressModes {
+		if mode == m {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown progress mode %s, must be one of: %s", mode, strings.Join(progressModes, ", "))
+}
+
+// progressTerminal returns the terminal to redraw progress on, if there is one
+func progressTerminal() (uintptr, bool) {
+	if ProgressMode != progressAuto {
+		return 0, false
+	}
+	return term.GetFdInfo(progressOut)
+}
+
+// progressf writes a line of progress
+func progressf(format string, args ...interface{}) {
+	if ProgressMode == progressNone {
+		return
+	}
+	fmt.Fprintf(progressOut, format+"\n", args...)
+}
+
+// progressStream displays a stream of progress messages from the Docker API,
+// returning any error in the stream
+func progressStream(r io.Reader) error {
+	if ProgressMode == progressNone {
+		_, err := io.Copy(ioutil.Discard, r)
+		return err
+	}
+	fd, isTerminal := progressTerminal()
+	return jsonmessage.DisplayJSONMessagesStream(r, progressOut, fd, isTerminal, nil)
+}
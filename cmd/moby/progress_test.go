@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func TestProgressMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logs := new(bytes.Buffer)
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+	defer func(mode string) { ProgressMode = mode }(ProgressMode)
+	defer func() { progressOut = os.Stderr }()
+
+	pull := `{"status":"Pulling from linuxkit/init","id":"latest"}
+{"status":"Downloading","progressDetail":{"current":10,"total":100},"progress":"[=>   ]","id":"abc123"}
+{"status":"Pull complete","id":"abc123"}
+`
+	testCases := []struct {
+		mode     string
+		progress bool
+	}{
+		{progressNone, false},
+		{progressPlain, true},
+		// not a terminal so the same as plain
+		{progressAuto, true},
+	}
+	for _, testCase := range testCases {
+		ProgressMode = testCase.mode
+		progress := new(bytes.Buffer)
+		progressOut = progress
+		logs.Reset()
+
+		base := filepath.Join(dir, testCase.mode)
+		if err := outputs(base, []byte("image"), outputList{"tar"}, &outputOpts{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := progressStream(strings.NewReader(pull)); err != nil {
+			t.Fatal(err)
+		}
+
+		if testCase.progress {
+			for _, line := range []string{"Output 1/1: tar", "Pulling from linuxkit/init", "abc123: Pull complete"} {
+				if !strings.Contains(progress.String(), line) {
+					t.Errorf("Expected progress %q with mode %s, got %q", line, testCase.mode, progress.String())
+				}
+			}
+		} else if progress.Len() != 0 {
+			t.Errorf("Expected no progress with mode %s, got %q", testCase.mode, progress.String())
+		}
+		if !strings.Contains(logs.String(), base+".tar") {
+			t.Errorf("Expected info logs with mode %s, got %q", testCase.mode, logs.String())
+		}
+	}
+
+	if err := progressStream(strings.NewReader(`{"errorDetail":{"message":"not found"},"error":"not found"}`)); err == nil {
+		t.Error("Expected error in progress stream to be returned")
+	}
+	if err := validProgressMode("fancy"); err == nil {
+		t.Error("Expected unknown progress mode to be rejected")
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A SLSA provenance attestation in an in-toto statement, see
+// https://slsa.dev/provenance/v0.2 and https://in-toto.io/Statement/v0.1
+
+const (
+	intotoStatementType = "https://in-toto.io/Statement/v0.1"
+	slsaPredicateType   = "https://slsa.dev/provenance/v0.2"
+	provenanceBuilder   = "https://github.com/moby/tool"
+	provenanceBuildType = "https://github.com/moby/tool/build@v1"
+)
+
+type intotoStatement struct {
+	Type          string          `json:"_type"`
+	PredicateType string          `json:"predicateType"`
+	Subject       []intotoSubject `json:"subject"`
+	Predicate     slsaProvenance  `json:"predicate"`
+}
+
+type intotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type slsaProvenance struct {
+	Builder    slsaBuilder    `json:"builder"`
+	BuildType  string         `json:"buildType"`
+	Invocation slsaInvocation `json:"invocation"`
+	Metadata   slsaMetadata   `json:"metadata"`
+	Materials  []slsaMaterial `json:"materials"`
+}
+
+type slsaBuilder struct {
+	ID string `json:"id"`
+}
+
+type slsaInvocation struct {
+	ConfigSource slsaMaterial      `json:"configSource"`
+	Parameters   map[string]string `json:"parameters,omitempty"`
+	Environment  map[string]string `json:"environment,omitempty"`
+}
+
+type slsaMetadata struct {
+	BuildStartedOn  string           `json:"buildStartedOn"`
+	BuildFinishedOn string           `json:"buildFinishedOn"`
+	Completeness    slsaCompleteness `json:"completeness"`
+	Reproducible    bool             `json:"reproducible"`
+}
+
+type slsaCompleteness struct {
+	Parameters  bool `json:"parameters"`
+	Environment bool `json:"environment"`
+	Materials   bool `json:"materials"`
+}
+
+type slsaMaterial struct {
+	URI        string            `json:"uri,omitempty"`
+	Digest     map[string]string `json:"digest"`
+	EntryPoint string            `json:"entryPoint,omitempty"`
+}
+
+// splitDigest returns a digest of the form alg:hex as a digest set
+func splitDigest(dgst string) (map[string]string, error) {
+	parts := strings.SplitN(dgst, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("Invalid digest %s", dgst)
+	}
+	return map[string]string{parts[0]: parts[1]}, nil
+}
+
+// configMaterial returns the config a build was read from, with the commit
+// it was checked out at if it was fetched from git
+func configMaterial(src configSource) (slsaMaterial, error) {
+	material := slsaMaterial{
+		URI:    src.uri,
+		Digest: map[string]string{"sha256": fmt.Sprintf("%x", sha256.Sum256(src.config))},
+	}
+	if src.root != "" {
+		commit, err := gitCommit(src.root)
+		if err != nil {
+			return slsaMaterial{}, err
+		}
+		material.Digest["sha1"] = commit
+	}
+	return material, nil
+}
+
+// fileMaterial returns a file read by a build, named relative to the
+// repository the config was checked out from if it is inside it
+func fileMaterial(src configSource, path string) (slsaMaterial, error) {
+	sum, err := sha256File(path)
+	if err != nil {
+		return slsaMaterial{}, err
+	}
+	uri := path
+	if src.root != "" {
+		if rel, err := filepath.Rel(src.root, path); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			uri = filepath.ToSlash(rel)
+		}
+	}
+	return slsaMaterial{URI: uri, Digest: map[string]string{"sha256": sum}}, nil
+}
+
+// provenance creates a provenance attestation for the build of a config
+// from src, which started at start, listing the included configs, file
+// sources and images of the config as materials, the images with the
+// digests returned by resolve, and the written files as subjects. Secrets
+// are not listed, so the materials of a build that uses them are incomplete.
+func provenance(name string, src configSource, m Moby, files []string, resolve func(string) (string, error), start time.Time, reproducible bool) ([]byte, error) {
+	config, err := configMaterial(src)
+	if err != nil {
+		return []byte{}, fmt.Errorf("Cannot resolve config source: %v", err)
+	}
+	statement := intotoStatement{
+		Type:          intotoStatementType,
+		PredicateType: slsaPredicateType,
+		Subject:       []intotoSubject{},
+		Predicate: slsaProvenance{
+			Builder:   slsaBuilder{ID: provenanceBuilder},
+			BuildType: provenanceBuildType,
+			Invocation: slsaInvocation{
+				ConfigSource: config,
+				Parameters:   map[string]string{"name": name},
+				Environment:  map[string]string{"version": Version},
+			},
+			Metadata: slsaMetadata{
+				BuildStartedOn:  start.UTC().Format(time.RFC3339),
+				BuildFinishedOn: time.Now().UTC().Format(time.RFC3339),
+				Completeness:    slsaCompleteness{Materials: !usesSecrets(m)},
+				Reproducible:    reproducible,
+			},
+			Materials: []slsaMaterial{config},
+		},
+	}
+
+	for _, inc := range src.includes {
+		material, err := fileMaterial(src, inc)
+		if err != nil {
+			return []byte{}, fmt.Errorf("Cannot resolve included config: %v", err)
+		}
+		statement.Predicate.Materials = append(statement.Predicate.Materials, material)
+	}
+	for _, f := range m.Files {
+		if f.Source == "" || f.Secret != "" {
+			continue
+		}
+		material, err := fileMaterial(src, f.Source)
+		if err != nil {
+			return []byte{}, fmt.Errorf("Cannot resolve source of file %s: %v", f.Path, err)
+		}
+		statement.Predicate.Materials = append(statement.Predicate.Materials, material)
+	}
+
+	seen := map[string]bool{}
+	for _, ci := range configImages(m) {
+		if seen[ci.image] {
+			continue
+		}
+		seen[ci.image] = true
+		dgst, err := resolve(ci.image)
+		if err != nil {
+			return []byte{}, fmt.Errorf("Cannot resolve digest of %s: %v", ci.image, err)
+		}
+		digest, err := splitDigest(dgst)
+		if err != nil {
+			return []byte{}, fmt.Errorf("Cannot resolve digest of %s: %v", ci.image, err)
+		}
+		statement.Predicate.Materials = append(statement.Predicate.Materials, slsaMaterial{
+			URI:    "docker://" + ci.image,
+			Digest: digest,
+		})
+	}
+
+	for _, file := range files {
+		sum, err := sha256File(file)
+		if err != nil {
+			return []byte{}, err
+		}
+		statement.Subject = append(statement.Subject, intotoSubject{
+			Name:   file,
+			Digest: map[string]string{"sha256": sum},
+		})
+	}
+
+	return json.MarshalIndent(statement, "", "  ")
+}
+
+// usesSecrets reports whether any file of a config is read from a secret
+func usesSecrets(m Moby) bool {
+	for _, f := range m.Files {
+		if f.Secret != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProvenance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := []byte(`
+kernel:
+  image: "linuxkit/kernel:4.9.x"
+init:
+  - linuxkit/init:1b8a7e394d2ec2f1fdb4d67645829d1b5bdca037
+onboot:
+  - name: dhcpcd
+    image: "linuxkit/dhcpcd:7d2f17a0e5d1ef9a75a527821a9ab0d753b22e7e"
+services:
+  - name: nginx
+    image: "nginx:alpine"
+  - name: nginx2
+    image: "nginx:alpine"
+files:
+  - path: etc/motd
+    source: motd
+`)
+	m, err := NewConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	include := filepath.Join(dir, "include.yml")
+	motd := filepath.Join(dir, "motd")
+	for file, contents := range map[string]string{include: "onboot: []\n", motd: "hello\n"} {
+		if err := ioutil.WriteFile(file, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.Files[0].Source = motd
+	out := outputList{"tar", "kernel+initrd"}
+	o := &outputOpts{}
+	if err := outputs(filepath.Join(dir, "test"), testImage(t), out, o); err != nil {
+		t.Fatal(err)
+	}
+	files := append(o.files["tar"], o.files["kernel+initrd"]...)
+	resolve := func(image string) (string, error) {
+		return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(image))), nil
+	}
+	src := configSource{config: config, name: "test", uri: "test.yml", includes: []string{include}}
+	b, err := provenance("test", src, m, files, resolve, time.Now(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var statement intotoStatement
+	if err := json.Unmarshal(b, &statement); err != nil {
+		t.Fatal(err)
+	}
+	if statement.Type != intotoStatementType || statement.PredicateType != slsaPredicateType {
+		t.Errorf("Unexpected statement type %s %s", statement.Type, statement.PredicateType)
+	}
+	p := statement.Predicate
+	if p.Builder.ID != provenanceBuilder || !p.Metadata.Reproducible || !p.Metadata.Completeness.Materials {
+		t.Errorf("Unexpected provenance builder %v or metadata %v", p.Builder, p.Metadata)
+	}
+	configDigest := fmt.Sprintf("%x", sha256.Sum256(config))
+	if p.Invocation.ConfigSource.URI != "test.yml" || p.Invocation.ConfigSource.Digest["sha256"] != configDigest {
+		t.Errorf("Expected config source test.yml with digest %s, got %v", configDigest, p.Invocation.ConfigSource)
+	}
+
+	// every image is a material once, as are the config, includes and file sources
+	materials := map[string]string{}
+	for _, material := range p.Materials {
+		if _, ok := materials[material.URI]; ok {
+			t.Errorf("Expected material %s once", material.URI)
+		}
+		materials[material.URI] = material.Digest["sha256"]
+	}
+	if materials["test.yml"] != configDigest {
+		t.Errorf("Expected the config as a material, got %v", materials)
+	}
+	for _, ci := range configImages(m) {
+		dgst, _ := resolve(ci.image)
+		if "sha256:"+materials["docker://"+ci.image] != dgst {
+			t.Errorf("Expected material %s with digest %s, got %v", ci.image, dgst, materials)
+		}
+	}
+	for _, file := range []string{include, motd} {
+		sum, err := sha256File(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if materials[file] != sum {
+			t.Errorf("Expected material %s with digest %s, got %v", file, sum, materials)
+		}
+	}
+	if len(p.Materials) != 7 {
+		t.Errorf("Expected 7 materials, got %d", len(p.Materials))
+	}
+
+	// every file written is a subject
+	subjects := map[string]string{}
+	for _, subject := range statement.Subject {
+		subjects[subject.Name] = subject.Digest["sha256"]
+	}
+	if len(subjects) != len(files) || len(files) != 4 {
+		t.Errorf("Expected a subject for each of the files %v, got %v", files, subjects)
+	}
+	for _, file := range files {
+		sum, err := sha256File(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if subjects[file] != sum {
+			t.Errorf("Expected subject %s with digest %s, got %v", file, sum, subjects)
+		}
+	}
+
+	// files in the repository of the config are named relative to it
+	if material, err := fileMaterial(configSource{root: dir}, motd); err != nil || material.URI != "motd" {
+		t.Errorf("Expected material motd relative to the repository, got %v %v", material, err)
+	}
+	if material, err := fileMaterial(configSource{root: filepath.Join(dir, "repo")}, motd); err != nil || material.URI != motd {
+		t.Errorf("Expected material %s outside the repository, got %v %v", motd, material, err)
+	}
+
+	// secrets are not listed, so the materials are incomplete
+	m.Files[0].Secret = "motd"
+	b, err = provenance("test", src, m, files, resolve, time.Now(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statement = intotoStatement{}
+	if err := json.Unmarshal(b, &statement); err != nil {
+		t.Fatal(err)
+	}
+	if p := statement.Predicate; p.Metadata.Completeness.Materials || len(p.Materials) != 6 {
+		t.Errorf("Expected incomplete materials without the secret, got %v %v", p.Metadata.Completeness, p.Materials)
+	}
+	m.Files[0].Secret = ""
+
+	// a digest that cannot be resolved fails
+	bad := func(image string) (string, error) { return "unknown", nil }
+	if _, err := provenance("test", src, m, files, bad, time.Now(), false); err == nil || !strings.Contains(err.Error(), "Invalid digest") {
+		t.Errorf("Expected an error for an invalid digest, got %v", err)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"golang.org/x/net/context"
+)
+
+// PullRetries is the number of times to retry a failed pull
+var PullRetries int
+
+// PullConcurrency is the most pulls from one registry that run at once,
+// unless RegistryConcurrency sets the limit for the registry, 0 for no limit
+var PullConcurrency int
+
+// RegistryConcurrency is the most pulls that run at once from each registry host
+var RegistryConcurrency map[string]int
+
+// registryHost returns the registry host an image is pulled from
+func registryHost(image string) string {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return ""
+	}
+	return reference.Domain(named)
+}
+
+// registryLimit returns the most pulls that run at once from a registry host
+func registryLimit(host string) int {
+	if n, ok := RegistryConcurrency[host]; ok {
+		return n
+	}
+	return PullConcurrency
+}
+
+// parseRegistryConcurrency parses host=N limits on the pulls from registries
+func parseRegistryConcurrency(limits []string) (map[string]int, error) {
+	parsed := map[string]int{}
+	for _, l := range limits {
+		parts := strings.SplitN(l, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid registry concurrency %s, expected host=N", l)
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("Invalid registry concurrency %s, the limit must be at least 1", l)
+		}
+		parsed[parts[0]] = n
+	}
+	return parsed, nil
+}
+
+// pullSlots limits the pulls from each registry that run at once, to the
+// limit the registry had when it was first pulled from
+type pullSlots struct {
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+// registrySlots limits the pulls of all the builds in a batch
+var registrySlots = &pullSlots{}
+
+// run runs the pull of an image once there is a free slot for its registry
+func (p *pullSlots) run(image string, pull func() error) error {
+	host := registryHost(image)
+	limit := registryLimit(host)
+	if limit <= 0 {
+		return pull()
+	}
+	p.mu.Lock()
+	if p.slots == nil {
+		p.slots = map[string]chan struct{}{}
+	}
+	slots, ok := p.slots[host]
+	if !ok {
+		slots = make(chan struct{}, limit)
+		p.slots[host] = slots
+	}
+	p.mu.Unlock()
+	slots <- struct{}{}
+	defer func() { <-slots }()
+	return pull()
+}
+
+// retryPull pulls an image, retrying up to retries times after a failure.
+// The pull is not resumed by moby, a retry only skips the layers the Docker
+// daemon kept from the failed pull, those it fetched in full.
+func retryPull(image string, retries int, pull func(image string) error) error {
+	for attempt := 0; ; attempt++ {
+		err := pull(image)
+		if err == nil {
+			return nil
+		}
+		// retrying at once only makes a rate limit worse
+		if attempt >= retries || asRateLimit("", err) != nil {
+			return err
+		}
+		log.Warnf("Pull of %s failed, retrying: %v", image, err)
+	}
+}
+
+// daemonPuller pulls with the Docker daemon
+func daemonPuller(cli *client.Client) func(image string) error {
+	return func(image string) error {
+		r, err := cli.ImagePull(context.Background(), image, types.ImagePullOptions{})
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return progressStream(r)
+	}
+}
+
+// configPull is the result of pulling an image of a config
+type configPull struct {
+	configImage
+	digest string
+	err    error
+}
+
+// pullConfig pulls each image of a config once, up to jobs at a time, with
+// content trust where the trust section of the config requires it, and
+// resolves the digest of each image pulled
+func pullConfig(m Moby, jobs int, pull func(string, imageTrust) error, resolve func(string) (string, error)) []configPull {
+	results := []configPull{}
+	seen := map[string]bool{}
+	for _, ci := range configImages(m) {
+		if seen[ci.image] {
+			continue
+		}
+		seen[ci.image] = true
+		results = append(results, configPull{configImage: ci})
+	}
+
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for i := range results {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(r *configPull) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			r.err = pull(r.image, contentTrust(r.image, &m.Trust))
+			if r.err == nil {
+				r.digest, r.err = resolve(r.image)
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+// readPullConfig reads a config with the configs it includes, removing the
+// checkout of a config from git once they are read
+func readPullConfig(conf string) (Moby, error) {
+	src, err := readConfig(conf)
+	if err != nil {
+		return Moby{}, err
+	}
+	if src.root != "" {
+		defer os.RemoveAll(src.root)
+	}
+	m, err := NewConfig(src.config)
+	if err == nil {
+		_, err = resolveIncludes(&m, src.path)
+	}
+	if err != nil {
+		return Moby{}, fmt.Errorf("Invalid config: %v", err)
+	}
+	return m, nil
+}
+
+// Process the pull arguments and pull the images of a config
+func pull(args []string) {
+	pullCmd := flag.NewFlagSet("pull", flag.ExitOnError)
+	pullCmd.Usage = func() {
+		fmt.Printf("USAGE: %s pull [options] <file>[.yml]\n\n", os.Args[0])
+		fmt.Printf("Pull the images of a config without building it, to fill the cache or check they are available\n\n")
+		fmt.Printf("Options:\n")
+		pullCmd.PrintDefaults()
+	}
+	pullDisableTrust := pullCmd.Bool("disable-content-trust", false, "Skip image trust verification specified in trust section of config (default false)")
+	pullTrustSoftFail := pullCmd.Bool("trust-soft-fail", false, "Pull without verification if content trust data is unavailable, verification failures are still errors")
+	var pullTrustRootKeys outputList
+	pullCmd.Var(&pullTrustRootKeys, "trust-root-key", "Pin the content trust root key ID of an image repository, as image=keyid, a new root signed by it replaces the cached root")
+	pullWaitOnRateLimit := pullCmd.Bool("wait-on-ratelimit", false, "Wait for the rate limit of a registry to pass and retry, for up to "+rateLimitMaxWait.String()+", rather than failing")
+	pullRetries := pullCmd.Int("pull-retries", 0, "Retry a failed pull this many times, the layers the Docker daemon fetched in full are not downloaded again")
+	pullJobs := pullCmd.Int("jobs", 4, "Number of images to pull at once")
+	pullConcurrency := pullCmd.Int("pull-concurrency", 0, "Most pulls from one registry at once, unless set by -registry-concurrency, 0 for no limit")
+	var pullRegistryConcurrency outputList
+	pullCmd.Var(&pullRegistryConcurrency, "registry-concurrency", "Most pulls at once from a registry, as host=N")
+	var pullProfiles outputList
+	pullCmd.Var(&pullProfiles, "profile", "Profiles to activate, images with profiles are only pulled if one of them is active")
+	var pullRegistryCAs outputList
+	pullCmd.Var(&pullRegistryCAs, "registry-ca", "CA certificate file to trust for content trust servers, in addition to the system CAs")
+	var pullInsecureRegistries outputList
+	pullCmd.Var(&pullInsecureRegistries, "insecure-registry", "Registry host[:port] to connect to without verifying TLS certificates or over plain HTTP, for development only")
+
+	if err := pullCmd.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	remArgs := pullCmd.Args()
+	if len(remArgs) != 1 {
+		fmt.Println("Please specify a configuration file")
+		pullCmd.Usage()
+		os.Exit(1)
+	}
+
+	for _, host := range pullInsecureRegistries {
+		if err := validInsecureRegistry(host); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *pullRetries < 0 {
+		log.Fatalf("Pull retries cannot be negative")
+	}
+	if *pullJobs < 1 {
+		log.Fatalf("Pull jobs must be at least 1")
+	}
+	if *pullConcurrency < 0 {
+		log.Fatalf("Pull concurrency cannot be negative")
+	}
+	registryConcurrency, err := parseRegistryConcurrency(pullRegistryConcurrency)
+	if err != nil {
+		log.Fatal(err)
+	}
+	PullConcurrency = *pullConcurrency
+	RegistryConcurrency = registryConcurrency
+	trustRootKeys, err := parseTrustRootKeys(pullTrustRootKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
+	TrustSoftFail = *pullTrustSoftFail
+	TrustRootKeys = trustRootKeys
+	RegistryCAs = pullRegistryCAs
+	InsecureRegistries = pullInsecureRegistries
+	warnInsecureRegistries()
+	PullRetries = *pullRetries
+	WaitOnRateLimit = *pullWaitOnRateLimit
+
+	m, err := readPullConfig(remArgs[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	selectProfiles(&m, pullProfiles)
+	if *pullDisableTrust {
+		log.Debugf("Disabling content trust checks for this pull")
+		m.Trust = TrustConfig{}
+	}
+
+	imagePuller := func(image string, trust imageTrust) error {
+		_, err := imagePull(image, trust)
+		return err
+	}
+	results := pullConfig(m, *pullJobs, imagePuller, imageRepoDigest)
+	declared := declaredDigests(m)
+	failed := 0
+	log.Infof("Pulled images:")
+	for _, r := range results {
+		if expected, ok := declared[r.image]; ok && r.err == nil {
+			r.err = checkImageDigest(r.image, expected, Images.inspect)
+		}
+		if r.err != nil {
+			failed++
+			log.Errorf("  %s %s: %v", r.section, r.image, r.err)
+			continue
+		}
+		log.Infof("  %s %s %s", r.section, r.image, r.digest)
+	}
+	if failed != 0 {
+		log.Errorf("%d of %d images failed to pull", failed, len(results))
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePuller fails the first failures pulls, counting the attempts
+func fakePuller(failures int, attempts *int) func(string) error {
+	return func(image string) error {
+		*attempts++
+		if *attempts <= failures {
+			return errors.New("connection reset")
+		}
+		return nil
+	}
+}
+
+func TestRetryPull(t *testing.T) {
+	// without retries the failure is returned
+	attempts := 0
+	if err := retryPull("test", 0, fakePuller(1, &attempts)); err == nil || attempts != 1 {
+		t.Errorf("Expected pull to fail without retries, got %d attempts and %v", attempts, err)
+	}
+
+	attempts = 0
+	if err := retryPull("test", 2, fakePuller(1, &attempts)); err != nil || attempts != 2 {
+		t.Errorf("Expected the retry to succeed, got %d attempts and %v", attempts, err)
+	}
+	attempts = 0
+	if err := retryPull("test", 2, fakePuller(5, &attempts)); err == nil || attempts != 3 {
+		t.Errorf("Expected the pull to fail after 2 retries, got %d attempts and %v", attempts, err)
+	}
+}
+
+func TestPullConfig(t *testing.T) {
+	m, err := NewConfig([]byte(`
+kernel:
+  image: "linuxkit/kernel:4.9.x"
+init:
+  - linuxkit/init:1b8a7e394d2ec2f1fdb4d67645829d1b5bdca037
+onboot:
+  - name: dhcpcd
+    image: "linuxkit/dhcpcd:7d2f17a0e5d1ef9a75a527821a9ab0d753b22e7e"
+services:
+  - name: nginx
+    image: "nginx:alpine"
+  - name: nginx2
+    image: "nginx:alpine"
+trust:
+  image:
+    - linuxkit/kernel
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pulled := map[string]bool{}
+	pulls := 0
+	pull := func(image string, trust imageTrust) error {
+		pulls++
+		pulled[image] = trust.verify
+		if image == "nginx:alpine" {
+			return errors.New("manifest unknown")
+		}
+		return nil
+	}
+	resolve := func(image string) (string, error) { return "sha256:" + image, nil }
+	results := pullConfig(m, 1, pull, resolve)
+
+	expected := map[string]bool{
+		"linuxkit/kernel:4.9.x":                                    true,
+		"linuxkit/init:1b8a7e394d2ec2f1fdb4d67645829d1b5bdca037":   false,
+		"linuxkit/dhcpcd:7d2f17a0e5d1ef9a75a527821a9ab0d753b22e7e": false,
+		"nginx:alpine": false,
+	}
+	if !reflect.DeepEqual(pulled, expected) {
+		t.Errorf("Expected images pulled with trust %v, got %v", expected, pulled)
+	}
+	if pulls != 4 {
+		t.Errorf("Expected each image to be pulled once, got %d pulls", pulls)
+	}
+	sections := []string{}
+	for _, r := range results {
+		sections = append(sections, r.section)
+		if r.image == "nginx:alpine" {
+			if r.err == nil || r.digest != "" {
+				t.Errorf("Expected the failed pull of %s to be reported, got %q %v", r.image, r.digest, r.err)
+			}
+			continue
+		}
+		if r.err != nil || r.digest != "sha256:"+r.image {
+			t.Errorf("Expected %s to be pulled with its digest, got %q %v", r.image, r.digest, r.err)
+		}
+	}
+	if expected := []string{"kernel", "init", "onboot", "services"}; !reflect.DeepEqual(sections, expected) {
+		t.Errorf("Expected results for sections %v, got %v", expected, sections)
+	}
+}
+
+func TestParseRegistryConcurrency(t *testing.T) {
+	limits, err := parseRegistryConcurrency([]string{"docker.io=2", "localhost:5000=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]int{"docker.io": 2, "localhost:5000": 1}; !reflect.DeepEqual(limits, expected) {
+		t.Errorf("Expected limits %v, got %v", expected, limits)
+	}
+	for _, l := range []string{"docker.io", "=2", "docker.io=0", "docker.io=-1", "docker.io=two"} {
+		if _, err := parseRegistryConcurrency([]string{l}); err == nil {
+			t.Errorf("Expected an error parsing %q", l)
+		}
+	}
+
+	for image, host := range map[string]string{
+		"alpine":              "docker.io",
+		"linuxkit/init:v1":    "docker.io",
+		"quay.io/coreos/etcd": "quay.io",
+		"localhost:5000/test": "localhost:5000",
+	} {
+		if h := registryHost(image); h != host {
+			t.Errorf("Expected %s to be pulled from %q, got %q", image, host, h)
+		}
+	}
+}
+
+func TestRegistryConcurrency(t *testing.T) {
+	defer func(n int, limits map[string]int) {
+		PullConcurrency = n
+		RegistryConcurrency = limits
+	}(PullConcurrency, RegistryConcurrency)
+	PullConcurrency = 3
+	RegistryConcurrency = map[string]int{"quay.io": 1, "localhost:5000": 2}
+
+	images := map[string]string{
+		"docker.io":      "linuxkit/init:v1",
+		"quay.io":        "quay.io/coreos/etcd",
+		"localhost:5000": "localhost:5000/test",
+	}
+	var mu sync.Mutex
+	running := map[string]int{}
+	most := map[string]int{}
+	slots := &pullSlots{}
+	var wg sync.WaitGroup
+	for host, image := range images {
+		for i := 0; i < 6; i++ {
+			wg.Add(1)
+			go func(host, image string) {
+				defer wg.Done()
+				slots.run(image, func() error {
+					mu.Lock()
+					running[host]++
+					if running[host] > most[host] {
+						most[host] = running[host]
+					}
+					mu.Unlock()
+					time.Sleep(10 * time.Millisecond)
+					mu.Lock()
+					running[host]--
+					mu.Unlock()
+					return nil
+				})
+			}(host, image)
+		}
+	}
+	wg.Wait()
+
+	// each registry reaches its own limit, or the default, but no more
+	if expected := map[string]int{"docker.io": 3, "quay.io": 1, "localhost:5000": 2}; !reflect.DeepEqual(most, expected) {
+		t.Errorf("Expected at most %v pulls at once, got %v", expected, most)
+	}
+
+	// without a limit pulls are not held back
+	PullConcurrency = 0
+	RegistryConcurrency = nil
+	done := make(chan struct{})
+	release := make(chan struct{})
+	slots = &pullSlots{}
+	for i := 0; i < 4; i++ {
+		go slots.run("alpine", func() error {
+			done <- struct{}{}
+			<-release
+			return nil
+		})
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected 4 pulls at once without a limit, got %d", i)
+		}
+	}
+	close(release)
+}
+
+func TestReadPullConfig(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	work := filepath.Join(dir, "work")
+	run := func(args ...string) {
+		args = append([]string{"-c", "user.name=moby", "-c", "user.email=moby@example.com"}, args...)
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+	run("init", "-q", work)
+	if err := os.MkdirAll(filepath.Join(work, "configs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string]string{
+		"configs/test.yml":   "init:\n  - linuxkit/init:v1\ninclude:\n  - onboot.yml\n",
+		"configs/onboot.yml": "onboot:\n  - name: dhcpcd\n    image: linuxkit/dhcpcd:v1\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(work, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run("-C", work, "add", ".")
+	run("-C", work, "commit", "-q", "-m", "test")
+	run("-C", work, "tag", "v1")
+
+	// the includes are read from the checkout before it is removed
+	m, err := readPullConfig("git+file://" + work + "//configs/test.yml@v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Onboot) != 1 || m.Onboot[0].Image != "linuxkit/dhcpcd:v1" {
+		t.Errorf("Expected the included onboot image, got %v", m.Onboot)
+	}
+}
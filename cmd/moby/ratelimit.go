@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// WaitOnRateLimit waits for the rate limit of a registry to pass and retries,
+// rather than failing the pull
+var WaitOnRateLimit bool
+
+const (
+	// rateLimitBackoff is the first wait after a rate limit without a
+	// Retry-After, doubled each time the registry is still limited
+	rateLimitBackoff = 10 * time.Second
+	// rateLimitMaxBackoff is the longest wait without a Retry-After
+	rateLimitMaxBackoff = 5 * time.Minute
+	// rateLimitMaxWait is the longest a pull waits for rate limits in all
+	rateLimitMaxWait = 30 * time.Minute
+)
+
+// rateLimitError is a registry refusing a request for exceeding its rate limit
+type rateLimitError struct {
+	host string
+	// retryAfter is when the registry says to retry, 0 if it did not say
+	retryAfter time.Duration
+	// limit and remaining are the RateLimit headers of the response, if any
+	limit     string
+	remaining string
+	// msg is the error the registry or the Docker daemon gave
+	msg string
+}
+
+func (e *rateLimitError) Error() string {
+	s := "Rate limit of registry " + e.host + " reached"
+	if e.limit != "" {
+		s += fmt.Sprintf(", limit %s remaining %s", e.limit, e.remaining)
+	}
+	if e.retryAfter > 0 {
+		s += fmt.Sprintf(", retry after %s", e.retryAfter)
+	}
+	if e.msg != "" {
+		s += ": " + e.msg
+	}
+	return s
+}
+
+// rateLimitResponse returns the rate limit of a registry response with
+// status 429, from its Retry-After and RateLimit headers
+func rateLimitResponse(host string, resp *http.Response, now time.Time) *rateLimitError {
+	e := &rateLimitError{
+		host:      host,
+		limit:     resp.Header.Get("RateLimit-Limit"),
+		remaining: resp.Header.Get("RateLimit-Remaining"),
+	}
+	retry := resp.Header.Get("Retry-After")
+	if retry == "" {
+		// RateLimit-Reset is the seconds until the window of the limit ends
+		retry = resp.Header.Get("RateLimit-Reset")
+	}
+	if s, err := strconv.Atoi(retry); err == nil && s > 0 {
+		e.retryAfter = time.Duration(s) * time.Second
+	} else if t, err := http.ParseTime(retry); err == nil && t.After(now) {
+		e.retryAfter = t.Sub(now)
+	}
+	return e
+}
+
+// asRateLimit returns the rate limit of an error of a pull, which from the
+// Docker daemon is only its message, nil if it is not a rate limit
+func asRateLimit(host string, err error) *rateLimitError {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*rateLimitError); ok {
+		return e
+	}
+	msg := strings.ToLower(err.Error())
+	if strings.Contains(msg, "toomanyrequests") || strings.Contains(msg, "429 too many requests") {
+		return &rateLimitError{host: host, msg: err.Error()}
+	}
+	return nil
+}
+
+// hostRateLimit is when the rate limit of a registry is expected to pass,
+// and the wait if it is limited again without a Retry-After
+type hostRateLimit struct {
+	until   time.Time
+	backoff time.Duration
+}
+
+// rateLimits holds back the requests to each registry that has refused one
+// for its rate limit, so concurrent pulls wait together rather than each
+// making the limit worse
+type rateLimits struct {
+	mu    sync.Mutex
+	hosts map[string]*hostRateLimit
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// registryRateLimits are the rate limits of the registries of all the pulls
+var registryRateLimits = &rateLimits{now: time.Now, sleep: time.Sleep}
+
+// limited records a rate limit of a registry, returning how long to wait,
+// which backs off further each time without a Retry-After
+func (r *rateLimits) limited(e *rateLimitError) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.hosts == nil {
+		r.hosts = map[string]*hostRateLimit{}
+	}
+	h, ok := r.hosts[e.host]
+	if !ok {
+		h = &hostRateLimit{backoff: rateLimitBackoff}
+		r.hosts[e.host] = h
+	}
+	wait := e.retryAfter
+	if wait == 0 {
+		wait = h.backoff
+		h.backoff *= 2
+		if h.backoff > rateLimitMaxBackoff {
+			h.backoff = rateLimitMaxBackoff
+		}
+	}
+	if until := r.now().Add(wait); until.After(h.until) {
+		h.until = until
+	}
+	return h.until.Sub(r.now())
+}
+
+// passed resets the backoff of a registry after a request is not limited
+func (r *rateLimits) passed(host string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if h, ok := r.hosts[host]; ok {
+		h.backoff = rateLimitBackoff
+	}
+}
+
+// wait sleeps until the rate limit of a registry is expected to have passed
+func (r *rateLimits) wait(host string) {
+	r.mu.Lock()
+	var d time.Duration
+	if h, ok := r.hosts[host]; ok {
+		d = h.until.Sub(r.now())
+	}
+	r.mu.Unlock()
+	if d > 0 {
+		r.sleep(d)
+	}
+}
+
+// retry runs a request to a registry, and if it is refused for the rate
+// limit, fails with the limit or with WaitOnRateLimit waits and runs it again
+func (r *rateLimits) retry(host, what string, req func() error) error {
+	var waited time.Duration
+	for {
+		r.wait(host)
+		err := req()
+		e := asRateLimit(host, err)
+		if e == nil {
+			if err == nil {
+				r.passed(host)
+			}
+			return err
+		}
+		if !WaitOnRateLimit {
+			return fmt.Errorf("%v. Log in with docker login for a higher limit, or use -wait-on-ratelimit to wait for it", e)
+		}
+		d := r.limited(e)
+		if waited+d > rateLimitMaxWait {
+			return fmt.Errorf("%v. Gave up after waiting %s, the next wait of %s is over the %s allowed", e, waited, d, rateLimitMaxWait)
+		}
+		log.Warnf("%v. Waiting %s before retrying %s", e, d, what)
+		waited += d
+	}
+}
+
+// rateLimitTransport retries the requests to a registry refused for its
+// rate limit, apart from those with a body that cannot be sent again
+type rateLimitTransport struct {
+	next http.RoundTripper
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		return t.next.RoundTrip(req)
+	}
+	var resp *http.Response
+	err := registryRateLimits.retry(req.URL.Host, req.URL.String(), func() error {
+		var err error
+		resp, err = t.next.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+			return err
+		}
+		e := rateLimitResponse(req.URL.Host, resp, registryRateLimits.now())
+		resp.Body.Close()
+		resp = nil
+		return e
+	})
+	return resp, err
+}
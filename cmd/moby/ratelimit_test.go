@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock is the time of rate limits in a test, which sleeping advances
+type fakeClock struct {
+	t      time.Time
+	sleeps []time.Duration
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) sleep(d time.Duration) {
+	c.sleeps = append(c.sleeps, d)
+	c.t = c.t.Add(d)
+}
+
+// fakeRegistry refuses the first limited requests with the headers given,
+// then answers them
+func fakeRegistry(limited int, headers map[string]string) (*httptest.Server, *int) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests <= limited {
+			for k, v := range headers {
+				w.Header().Set(k, v)
+			}
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"errors":[{"code":"TOOMANYREQUESTS","message":"You have reached your pull rate limit"}]}`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	return srv, &requests
+}
+
+func TestRateLimitTransport(t *testing.T) {
+	defer func(limits *rateLimits, wait bool) {
+		registryRateLimits = limits
+		WaitOnRateLimit = wait
+	}(registryRateLimits, WaitOnRateLimit)
+
+	headers := map[string]string{"Retry-After": "30", "RateLimit-Limit": "100;w=21600", "RateLimit-Remaining": "0;w=21600"}
+	testCases := []struct {
+		wait     bool
+		limited  int
+		headers  map[string]string
+		sleeps   []time.Duration
+		expected string
+	}{
+		{false, 1, headers, nil, "Rate limit of registry 127.0.0.1"},
+		{false, 1, headers, nil, "limit 100;w=21600 remaining 0;w=21600, retry after 30s. Log in with docker login for a higher limit, or use -wait-on-ratelimit"},
+		{true, 2, headers, []time.Duration{30 * time.Second, 30 * time.Second}, ""},
+		// without a Retry-After the wait backs off
+		{true, 3, nil, []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second}, ""},
+		{true, 1, map[string]string{"RateLimit-Reset": "90"}, []time.Duration{90 * time.Second}, ""},
+		{true, 1, map[string]string{"Retry-After": "7200"}, nil, "Gave up after waiting 0s, the next wait of 2h0m0s is over the 30m0s allowed"},
+	}
+	for _, tc := range testCases {
+		clock := &fakeClock{t: time.Unix(1500000000, 0)}
+		registryRateLimits = &rateLimits{now: clock.now, sleep: clock.sleep}
+		WaitOnRateLimit = tc.wait
+		srv, requests := fakeRegistry(tc.limited, tc.headers)
+		client := &http.Client{Transport: &rateLimitTransport{next: http.DefaultTransport}}
+		resp, err := client.Get(srv.URL + "/v2/library/alpine/manifests/latest")
+		srv.Close()
+		if tc.expected != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Errorf("Expected %q, got %v", tc.expected, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected the request to succeed after waiting, got %v", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || *requests != tc.limited+1 {
+			t.Errorf("Expected %d requests ending with 200, got %d ending with %d", tc.limited+1, *requests, resp.StatusCode)
+		}
+		if !reflect.DeepEqual(clock.sleeps, tc.sleeps) {
+			t.Errorf("Expected to wait %v, got %v", tc.sleeps, clock.sleeps)
+		}
+	}
+}
+
+func TestRateLimitDaemonPull(t *testing.T) {
+	defer func(limits *rateLimits, wait bool) {
+		registryRateLimits = limits
+		WaitOnRateLimit = wait
+	}(registryRateLimits, WaitOnRateLimit)
+	clock := &fakeClock{t: time.Unix(1500000000, 0)}
+	registryRateLimits = &rateLimits{now: clock.now, sleep: clock.sleep}
+	WaitOnRateLimit = true
+
+	// the daemon only gives the message of the registry
+	pulls := 0
+	pull := func() error {
+		pulls++
+		if pulls <= 2 {
+			return errors.New("toomanyrequests: You have reached your pull rate limit. You may increase the limit by authenticating and upgrading")
+		}
+		return nil
+	}
+	if err := registryRateLimits.retry("docker.io", "alpine", pull); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []time.Duration{10 * time.Second, 20 * time.Second}; !reflect.DeepEqual(clock.sleeps, expected) {
+		t.Errorf("Expected to wait %v, got %v", expected, clock.sleeps)
+	}
+
+	// a pull of another image from the registry waits for the limit to pass
+	registryRateLimits.limited(&rateLimitError{host: "docker.io", retryAfter: time.Minute})
+	clock.sleeps = nil
+	if err := registryRateLimits.retry("docker.io", "busybox", func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []time.Duration{time.Minute}; !reflect.DeepEqual(clock.sleeps, expected) {
+		t.Errorf("Expected to wait %v, got %v", expected, clock.sleeps)
+	}
+
+	// a rate limit is not retried by -pull-retries
+	attempts := 0
+	err := retryPull("alpine", 3, func(image string) error {
+		attempts++
+		return errors.New("Error response from daemon: toomanyrequests: rate limit")
+	})
+	if err == nil || attempts != 1 {
+		t.Errorf("Expected the rate limit to fail the pull at once, got %d attempts and %v", attempts, err)
+	}
+	if asRateLimit("docker.io", errors.New("manifest unknown")) != nil {
+		t.Errorf("Expected other errors not to be rate limits")
+	}
+}
+
+func TestRateLimitKernelPull(t *testing.T) {
+	defer func(limits *rateLimits, wait bool) {
+		registryRateLimits = limits
+		WaitOnRateLimit = wait
+	}(registryRateLimits, WaitOnRateLimit)
+	clock := &fakeClock{t: time.Unix(1500000000, 0)}
+	registryRateLimits = &rateLimits{
+		now:   clock.now,
+		sleep: clock.sleep,
+		hosts: map[string]*hostRateLimit{"localhost:1": {until: clock.t.Add(30 * time.Second), backoff: rateLimitBackoff}},
+	}
+	WaitOnRateLimit = true
+
+	// the kernel pull waits for the limit of its registry before it is run,
+	// then fails as nothing listens there
+	m := Moby{Kernel: KernelConfig{Image: "localhost:1/kernel:test"}}
+	if _, _, err := buildInternal(m, buildOpts{pull: true}); err == nil || !strings.Contains(err.Error(), "Could not pull image localhost:1/kernel:test") {
+		t.Errorf("Expected the kernel pull to fail, got %v", err)
+	}
+	if expected := []time.Duration{30 * time.Second}; !reflect.DeepEqual(clock.sleeps, expected) {
+		t.Errorf("Expected the kernel pull to wait %v for the rate limit, got %v", expected, clock.sleeps)
+	}
+}
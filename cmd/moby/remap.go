@@ -0,0 +1,265 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The users and groups of a config give the numeric ids that named users and
+// groups have in every layer of the image, so that images which give the same
+// user different ids can be combined. The ids are found from the passwd and
+// group files of each root filesystem in a layer, which are rewritten along
+// with the ownership of the entries of that root filesystem.
+
+// idKind is the users or groups of a config, with the file in a root
+// filesystem that names them
+type idKind struct {
+	kind string
+	file string
+	ids  map[string]int
+}
+
+// idRemap is the users and groups to give the ids of, nil if there are none
+type idRemap struct {
+	users  idKind
+	groups idKind
+}
+
+// newIDRemap checks the users and groups of a config, which must each have a
+// different id, returning nil if there are none
+func newIDRemap(m Moby) (*idRemap, error) {
+	if len(m.Users) == 0 && len(m.Groups) == 0 {
+		return nil, nil
+	}
+	r := &idRemap{
+		users:  idKind{kind: "user", file: "etc/passwd", ids: m.Users},
+		groups: idKind{kind: "group", file: "etc/group", ids: m.Groups},
+	}
+	for _, k := range []idKind{r.users, r.groups} {
+		names := map[int]string{}
+		for _, name := range sortedIDNames(k.ids) {
+			id := k.ids[name]
+			if name == "" || strings.ContainsAny(name, ":\n") {
+				return nil, fmt.Errorf("Invalid %s name %q", k.kind, name)
+			}
+			if id < 0 {
+				return nil, fmt.Errorf("Invalid id %d of %s %s", id, k.kind, name)
+			}
+			if other, ok := names[id]; ok {
+				return nil, fmt.Errorf("The %ss %s and %s both have id %d", k.kind, other, name, id)
+			}
+			names[id] = name
+		}
+	}
+	return r, nil
+}
+
+// sortedIDNames returns the names of ids in order, so errors are repeatable
+func sortedIDNames(ids map[string]int) []string {
+	names := []string{}
+	for name := range ids {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// rootfsRemap is how the ids are changed in one root filesystem of a layer
+type rootfsRemap struct {
+	// uids and gids map the ids in the layer to the ids in the config
+	uids map[int]int
+	gids map[int]int
+}
+
+// layerRemap is how the ids are changed in a layer, by the path of each
+// root filesystem, with the rewritten passwd and group files
+type layerRemap struct {
+	users  idKind
+	groups idKind
+	roots  map[string]rootfsRemap
+	files  map[string][]byte
+}
+
+// idFileRoot returns the root filesystem of a passwd or group file in a
+// layer, with a trailing slash unless it is the root of the layer
+func idFileRoot(name, file string) (string, bool) {
+	name = cleanPath(name)
+	if name == file {
+		return "", true
+	}
+	if strings.HasSuffix(name, "/"+file) {
+		return strings.TrimSuffix(name, file), true
+	}
+	return "", false
+}
+
+// remapIDFile rewrites the ids of the named entries of a passwd or group
+// file, whose id is the third field, returning the changed ids. An id of the
+// config that another entry in the file already has is a collision.
+func remapIDFile(contents []byte, k idKind, where string) ([]byte, map[int]int, error) {
+	changed := map[int]int{}
+	lines := strings.Split(string(contents), "\n")
+	owners := map[int]string{}
+	for i, line := range lines {
+		fields := strings.Split(line, ":")
+		if len(fields) < 3 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		want, ok := k.ids[fields[0]]
+		if !ok {
+			owners[id] = fields[0]
+			continue
+		}
+		if id != want {
+			changed[id] = want
+			fields[2] = strconv.Itoa(want)
+			lines[i] = strings.Join(fields, ":")
+		}
+	}
+	for _, name := range sortedIDNames(k.ids) {
+		want := k.ids[name]
+		if other, ok := owners[want]; ok {
+			return nil, nil, fmt.Errorf("Cannot give %s %s id %d, it is %s %s in %s", k.kind, name, want, k.kind, other, where)
+		}
+	}
+	return []byte(strings.Join(lines, "\n")), changed, nil
+}
+
+// layer finds the passwd and group files of each root filesystem of a
+// layer, and how the ids in it change
+func (r *idRemap) layer(image []byte, layer string) (*layerRemap, error) {
+	l := &layerRemap{users: r.users, groups: r.groups, roots: map[string]rootfsRemap{}, files: map[string][]byte{}}
+	tr := tar.NewReader(bytes.NewReader(image))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			l.primaryGroups()
+			return l, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		for _, k := range []idKind{r.users, r.groups} {
+			// the passwd file is read for groups alone, for its primary groups
+			root, ok := idFileRoot(hdr.Name, k.file)
+			if !ok {
+				continue
+			}
+			contents, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			rewritten, changed, err := remapIDFile(contents, k, layer+" /"+root+k.file)
+			if err != nil {
+				return nil, err
+			}
+			rr := l.roots[root]
+			if k.kind == "user" {
+				rr.uids = changed
+			} else {
+				rr.gids = changed
+			}
+			l.roots[root] = rr
+			l.files[hdr.Name] = rewritten
+		}
+	}
+}
+
+// primaryGroups rewrites the primary group of each user, the fourth field of
+// a passwd file, by the gids changed in its root filesystem, once the whole
+// layer is read as the group file may come after the passwd file
+func (l *layerRemap) primaryGroups() {
+	for name, contents := range l.files {
+		root, ok := idFileRoot(name, l.users.file)
+		gids := l.roots[root].gids
+		if !ok || len(gids) == 0 {
+			continue
+		}
+		lines := strings.Split(string(contents), "\n")
+		for i, line := range lines {
+			fields := strings.Split(line, ":")
+			if len(fields) < 4 || strings.HasPrefix(line, "#") {
+				continue
+			}
+			gid, err := strconv.Atoi(fields[3])
+			if err != nil {
+				continue
+			}
+			if want, ok := gids[gid]; ok {
+				fields[3] = strconv.Itoa(want)
+				lines[i] = strings.Join(fields, ":")
+			}
+		}
+		l.files[name] = []byte(strings.Join(lines, "\n"))
+	}
+}
+
+// contents returns the rewritten contents of a passwd or group file
+func (l *layerRemap) contents(name string) ([]byte, bool) {
+	if l == nil {
+		return nil, false
+	}
+	b, ok := l.files[name]
+	return b, ok
+}
+
+// header changes the ownership of an entry of the layer, by the ids of the
+// root filesystem it is in, and by its user and group names. An entry that
+// another user or group owns with an id of the config is a collision.
+func (l *layerRemap) header(hdr *tar.Header, layer string) error {
+	name := cleanPath(hdr.Name)
+	root := ""
+	found := false
+	for r := range l.roots {
+		if (r == "" || strings.HasPrefix(name, r)) && (!found || len(r) > len(root)) {
+			root, found = r, true
+		}
+	}
+	rr := l.roots[root]
+	uid, ok := l.users.ids[hdr.Uname]
+	if !ok {
+		uid, ok = rr.uids[hdr.Uid]
+	}
+	if ok {
+		hdr.Uid = uid
+	} else if err := idCollision(l.users, hdr.Uid, hdr.Uname, hdr.Name, layer); err != nil {
+		return err
+	}
+	gid, ok := l.groups.ids[hdr.Gname]
+	if !ok {
+		gid, ok = rr.gids[hdr.Gid]
+	}
+	if ok {
+		hdr.Gid = gid
+	} else if err := idCollision(l.groups, hdr.Gid, hdr.Gname, hdr.Name, layer); err != nil {
+		return err
+	}
+	return nil
+}
+
+// idCollision returns an error if an entry is owned by an id of the config
+// which its owner name shows is another user or group
+func idCollision(k idKind, id int, owner string, path, layer string) error {
+	if owner == "" {
+		return nil
+	}
+	for _, name := range sortedIDNames(k.ids) {
+		if k.ids[name] == id {
+			return fmt.Errorf("Cannot give %s %s id %d, %s in %s is owned by %s %s with that id", k.kind, name, id, path, layer, k.kind, owner)
+		}
+	}
+	return nil
+}
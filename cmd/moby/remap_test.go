@@ -0,0 +1,169 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+// ownedEntry is a regular file in a tarball with an owner
+type ownedEntry struct {
+	name     string
+	uid, gid int
+	uname    string
+	contents string
+}
+
+func ownedTar(t *testing.T, entries []ownedEntry) []byte {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(e.contents)), Uid: e.uid, Gid: e.gid, Uname: e.uname}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRemapIDs(t *testing.T) {
+	images := &fakeImages{
+		exports: map[string][]byte{
+			// the owned files come before the passwd file that names their owner
+			"example/app:v1": ownedTar(t, []ownedEntry{
+				{name: "srv/app/data", uid: 100, gid: 101},
+				{name: "etc/passwd", contents: "root:x:0:0:root:/root:/bin/sh\napp:x:100:101::/srv/app:/sbin/nologin\n"},
+				{name: "etc/group", contents: "root:x:0:\napp:x:101:\n"},
+			}),
+			"example/other:v1": ownedTar(t, []ownedEntry{
+				{name: "etc/passwd", contents: "root:x:0:0:root:/root:/bin/sh\napp:x:1001:1001::/srv/app:/sbin/nologin\n"},
+				{name: "etc/app.conf", uid: 1001, gid: 1001},
+				{name: "var/log/app.log", uname: "app", uid: 5},
+				{name: "etc/motd", contents: "hello"},
+			}),
+			"example/bob:v1": ownedTar(t, []ownedEntry{
+				{name: "etc/passwd", contents: "bob:x:1000:1000::/home/bob:/bin/sh\n"},
+			}),
+			"example/owner:v1": ownedTar(t, []ownedEntry{
+				{name: "home/bob/.profile", uid: 1000, uname: "bob"},
+			}),
+		},
+		inspects: map[string]types.ImageInspect{
+			"example/app:v1":   {ID: "sha256:1111", Os: "linux"},
+			"example/other:v1": {ID: "sha256:2222", Os: "linux"},
+			"example/bob:v1":   {ID: "sha256:3333", Os: "linux"},
+			"example/owner:v1": {ID: "sha256:4444", Os: "linux"},
+		},
+	}
+	defer func(source imageSource) { Images = source }(Images)
+	Images = images
+
+	m, err := NewConfig([]byte("init:\n  - example/app:v1\n  - example/other:v1\nusers:\n  app: 1000\ngroups:\n  app: 1000\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, _, err := buildInternal(m, buildOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdrs, contents := readTar(t, bytes.NewBuffer(image))
+	owners := map[string][2]int{}
+	for name, hdr := range hdrs {
+		owners[name] = [2]int{hdr.Uid, hdr.Gid}
+	}
+	expected := map[string][2]int{
+		"srv/app/data":    {1000, 1000},
+		"etc/app.conf":    {1000, 1001},
+		"var/log/app.log": {1000, 0},
+		"etc/motd":        {0, 0},
+	}
+	for name, ids := range expected {
+		if owners[name] != ids {
+			t.Errorf("Expected %s to be owned by %v, got %v", name, ids, owners[name])
+		}
+	}
+	// the passwd file of the last image replaces the first, both name app with
+	// the id of the config
+	if !strings.Contains(contents["etc/passwd"], "app:x:1000:1001:") || !strings.Contains(contents["etc/group"], "app:x:1000:") {
+		t.Errorf("Expected app to have id 1000, got:\n%s\n%s", contents["etc/passwd"], contents["etc/group"])
+	}
+
+	// the primary group of a user follows its group, which is remapped with
+	// the users or alone
+	for config, expected := range map[string]string{
+		"init:\n  - example/app:v1\nusers:\n  app: 1000\ngroups:\n  app: 1000\n": "app:x:1000:1000:",
+		"init:\n  - example/app:v1\ngroups:\n  app: 1000\n":                      "app:x:100:1000:",
+	} {
+		m, err := NewConfig([]byte(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		image, _, err := buildInternal(m, buildOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, contents := readTar(t, bytes.NewBuffer(image)); !strings.Contains(contents["etc/passwd"], expected) {
+			t.Errorf("Expected the passwd file to have %q for %q, got:\n%s", expected, config, contents["etc/passwd"])
+		}
+	}
+
+	testCases := []struct {
+		config   string
+		expected string
+	}{
+		{"init:\n  - example/bob:v1\nusers:\n  app: 1000\n", "Cannot give user app id 1000, it is user bob in example/bob:v1 /etc/passwd"},
+		{"init:\n  - example/owner:v1\nusers:\n  app: 1000\n", "Cannot give user app id 1000, home/bob/.profile in example/owner:v1 is owned by user bob with that id"},
+	}
+	for _, tc := range testCases {
+		m, err := NewConfig([]byte(tc.config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := buildInternal(m, buildOpts{}); err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("Expected %q, got %v", tc.expected, err)
+		}
+	}
+
+	if _, err := NewConfig([]byte("users:\n  app: 1000\n  db: 1000\n")); err == nil || !strings.Contains(err.Error(), "The users app and db both have id 1000") {
+		t.Errorf("Expected users with the same id to be rejected, got %v", err)
+	}
+}
+
+func TestRemapRootfs(t *testing.T) {
+	r, err := newIDRemap(Moby{Users: map[string]int{"db": 2000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a service has its passwd file in its root filesystem, which only
+	// changes the ids of the entries of that root filesystem
+	layer := ownedTar(t, []ownedEntry{
+		{name: "containers/services/db/rootfs/var/lib/db", uid: 70},
+		{name: "containers/services/db/rootfs/etc/passwd", contents: "db:x:70:70::/var/lib/db:/sbin/nologin\n"},
+		{name: "containers/services/db/config.json", uid: 70},
+	})
+	l, err := r.layer(layer, "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, uid := range map[string]int{"containers/services/db/rootfs/var/lib/db": 2000, "containers/services/db/config.json": 70} {
+		hdr := &tar.Header{Name: name, Uid: 70}
+		if err := l.header(hdr, "db"); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Uid != uid {
+			t.Errorf("Expected %s to be owned by %d, got %d", name, uid, hdr.Uid)
+		}
+	}
+	if contents, ok := l.contents("containers/services/db/rootfs/etc/passwd"); !ok || string(contents) != "db:x:2000:70::/var/lib/db:/sbin/nologin\n" {
+		t.Errorf("Expected the passwd file of the service to be rewritten, got %q", contents)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The remote cache stores the outputs of builds under a key, so that a build
+// done on one machine is downloaded by the same build on another. The files
+// of a build are stored under its key by their digest, then an index listing
+// them, so a build whose files were not all stored is not found.
+const remoteCacheIndex = "index.json"
+
+// uncachedOutputs are the output types that do not write files to store
+var uncachedOutputs = map[string]bool{
+	"dir":        true,
+	"stdout-sha": true,
+}
+
+// remoteCacheFile is a file of an output in the index of a cached build
+type remoteCacheFile struct {
+	Output string `json:"output"`
+	// Suffix is the name of the file after the base name of the outputs
+	Suffix string `json:"suffix"`
+	Size   int64  `json:"size"`
+	Digest string `json:"digest"`
+}
+
+// remoteCacheInput is what the key of a cached build is a hash of
+type remoteCacheInput struct {
+	Version string            `json:"version"`
+	Config  Moby              `json:"config"`
+	Options bundleBuild       `json:"options"`
+	Images  map[string]string `json:"images"`
+}
+
+// remoteStore keeps the objects of a remote cache
+type remoteStore interface {
+	// get copies an object to w, returning false if it is not stored
+	get(name string, w io.Writer) (bool, error)
+	put(name string, r io.Reader, size int64) error
+}
+
+// httpStore is a remote store that objects are fetched from with GET and
+// stored in with PUT, below a base URL
+type httpStore struct {
+	url    string
+	client *http.Client
+}
+
+// newRemoteStore returns the store of a remote cache URL
+func newRemoteStore(cache string) (remoteStore, error) {
+	u, err := url.Parse(cache)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid remote cache %s: must be an http or https URL", cache)
+	}
+	return &httpStore{url: strings.TrimSuffix(cache, "/"), client: &http.Client{}}, nil
+}
+
+func (s *httpStore) get(name string, w io.Writer) (bool, error) {
+	resp, err := s.client.Get(s.url + "/" + name)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("Remote cache returned %s for %s", resp.Status, name)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err == nil, err
+}
+
+func (s *httpStore) put(name string, r io.Reader, size int64) error {
+	req, err := http.NewRequest("PUT", s.url+"/"+name, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Remote cache returned %s storing %s", resp.Status, name)
+	}
+	return nil
+}
+
+// remoteCacheKey returns the key of the outputs of a build, from the config
+// with the contents of its file sources, the digests of its images as
+// returned by resolve, and the options that affect the outputs
+func (c *buildCommand) remoteCacheKey(name string, m Moby, out outputList, resolve func(string) (string, error)) (string, error) {
+	m, err := inlineSources(m)
+	if err != nil {
+		return "", err
+	}
+	options, err := c.bundleOptions(name, out)
+	if err != nil {
+		return "", err
+	}
+	// the outputs fetched are named from the prefix of the build fetching
+	// them, and its cmdline limit is checked as if they were built
+	options.OutputPrefix, options.CmdlineLimit = "", 0
+	input := remoteCacheInput{
+		Version: Version,
+		Config:  m,
+		Options: options,
+		Images:  map[string]string{},
+	}
+	for _, ci := range configImages(m) {
+		if _, ok := input.Images[ci.image]; ok {
+			continue
+		}
+		dgst, err := resolve(ci.image)
+		if err != nil {
+			return "", fmt.Errorf("Cannot resolve digest of %s: %v", ci.image, err)
+		}
+		input.Images[ci.image] = dgst
+	}
+	// encoding/json always writes struct fields in the same order and sorts map keys
+	b, err := json.Marshal(input)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b)), nil
+}
+
+// cachedOutputs reports whether the outputs can be stored in the remote cache
+func cachedOutputs(out outputList) bool {
+	for _, o := range out {
+		if uncachedOutputs[o] {
+			return false
+		}
+	}
+	return true
+}
+
+// fetchOutputs downloads the outputs of a build from the remote cache to
+// files named from base, returning false if the build is not stored
+func fetchOutputs(store remoteStore, key, base string, o *outputOpts) (bool, error) {
+	index := new(bytes.Buffer)
+	found, err := store.get(key+"/"+remoteCacheIndex, index)
+	if err != nil || !found {
+		return false, err
+	}
+	var files []remoteCacheFile
+	if err := json.Unmarshal(index.Bytes(), &files); err != nil {
+		return false, fmt.Errorf("Invalid remote cache index for %s: %v", key, err)
+	}
+	log.Infof("Fetch outputs:")
+	for _, f := range files {
+		if f.Suffix == "" || strings.ContainsAny(f.Suffix, `/\`) {
+			return false, fmt.Errorf("Invalid remote cache index for %s: file suffix %q", key, f.Suffix)
+		}
+		if _, err := hex.DecodeString(f.Digest); err != nil || len(f.Digest) != sha256.Size*2 {
+			return false, fmt.Errorf("Invalid remote cache index for %s: file digest %q", key, f.Digest)
+		}
+		filename := base + f.Suffix
+		if o.maxSize > 0 && o.written+f.Size > o.maxSize {
+			return false, o.errTooLarge(filename)
+		}
+		log.Infof("  %s", filename)
+		if err := fetchFile(store, key+"/"+f.Digest, filename, f.Digest); err != nil {
+			return false, err
+		}
+		o.current = f.Output
+		o.addFile(filename)
+		if err := o.account(filename, f.Size); err != nil {
+			return false, err
+		}
+		if err := o.setMode(filename); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// fetchFile downloads an object to a file, which is only replaced if the
+// object has the digest
+func fetchFile(store remoteStore, name, filename, digest string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), ".moby-cache")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	found, err := store.get(name, io.MultiWriter(tmp, h))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("Remote cache is missing %s", name)
+	}
+	if sum := fmt.Sprintf("%x", h.Sum(nil)); sum != digest {
+		return fmt.Errorf("Remote cache object %s has digest %s", name, sum)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// storeOutputs uploads the files of the outputs of a build named from base
+// to the remote cache, and then the index of them
+func storeOutputs(store remoteStore, key, base string, out outputList, o *outputOpts) error {
+	files := []remoteCacheFile{}
+	for _, output := range out {
+		for _, filename := range o.files[output] {
+			if !strings.HasPrefix(filename, base) || filename == base {
+				return fmt.Errorf("Cannot store %s, it is not named after %s", filename, base)
+			}
+			sum, err := sha256File(filename)
+			if err != nil {
+				return err
+			}
+			f, err := os.Open(filename)
+			if err != nil {
+				return err
+			}
+			fi, err := f.Stat()
+			if err == nil {
+				err = store.put(key+"/"+sum, f, fi.Size())
+			}
+			f.Close()
+			if err != nil {
+				return err
+			}
+			files = append(files, remoteCacheFile{Output: output, Suffix: strings.TrimPrefix(filename, base), Size: fi.Size(), Digest: sum})
+		}
+	}
+	index, err := json.MarshalIndent(files, "", "  ")
+	if err != nil {
+		return err
+	}
+	return store.put(key+"/"+remoteCacheIndex, bytes.NewReader(index), int64(len(index)))
+}
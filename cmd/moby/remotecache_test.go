@@ -0,0 +1,259 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/agl/ed25519"
+	"github.com/docker/docker/api/types"
+)
+
+// fakeRemoteCache is an HTTP remote cache that keeps its objects in memory
+type fakeRemoteCache struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	puts    int
+}
+
+func (f *fakeRemoteCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case "GET":
+		b, ok := f.objects[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(b)
+	case "PUT":
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		f.objects[r.URL.Path] = b
+		f.puts++
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestRemoteCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := filepath.Join(dir, "test.yml")
+	config := `
+kernel:
+  image: linuxkit/kernel:4.9.x
+  cmdline: console=ttyS0
+init:
+  - linuxkit/init:v1
+files:
+  - path: etc/motd
+    contents: cached
+`
+	if err := ioutil.WriteFile(conf, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	exports := map[string][]byte{
+		"linuxkit/kernel:4.9.x": kernelImageTar(t).Bytes(),
+		"linuxkit/init:v1": makeTar(t, []tarEntry{
+			{name: "bin", typeflag: tar.TypeDir},
+			{name: "bin/init", typeflag: tar.TypeReg, contents: "init"},
+		}).Bytes(),
+	}
+	images := &fakeImages{
+		inspects: map[string]types.ImageInspect{
+			"linuxkit/kernel:4.9.x": {ID: "sha256:1111", Os: "linux"},
+			"linuxkit/init:v1":      {ID: "sha256:2222", Os: "linux"},
+		},
+	}
+	defer func(source imageSource) { Images = source }(Images)
+	Images = images
+
+	cache := &fakeRemoteCache{objects: map[string][]byte{}}
+	server := httptest.NewServer(cache)
+	defer server.Close()
+	store, err := newRemoteStore(server.URL + "/builds/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := buildOpts{reproducible: true}
+	build := func(name string) error {
+		out := filepath.Join(dir, name)
+		if err := os.Mkdir(out, 0755); err != nil {
+			t.Fatal(err)
+		}
+		c := &buildCommand{
+			out:           outputList{"tar", "kernel+initrd"},
+			compressLevel: defaultCompressLevel,
+			remoteCache:   store,
+			opts:          opts,
+		}
+		return c.run(conf, out)
+	}
+	names := []string{"test.tar", "test-kernel", "test-initrd.img", "test-cmdline"}
+
+	// a miss builds the outputs and stores them, with the index last
+	images.exports = exports
+	if err := build("miss"); err != nil {
+		t.Fatal(err)
+	}
+	if len(images.used) == 0 || cache.puts != len(names)+1 {
+		t.Fatalf("Expected the build to use the images and store %d objects, used %v and stored %d", len(names)+1, images.used, cache.puts)
+	}
+
+	// a hit downloads the same outputs without the images being exported
+	images.exports = nil
+	images.used = nil
+	if err := build("hit"); err != nil {
+		t.Fatalf("Expected a cache hit not to build: %v", err)
+	}
+	for _, name := range names {
+		want, err := ioutil.ReadFile(filepath.Join(dir, "miss", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadFile(filepath.Join(dir, "hit", name))
+		if err != nil {
+			t.Fatalf("Expected the hit to fetch %s: %v", name, err)
+		}
+		if !bytes.Equal(want, got) {
+			t.Errorf("Expected the fetched %s to be identical to the built one", name)
+		}
+	}
+
+	// the images and cmdline of a hit are still checked
+	logger := log.StandardLogger()
+	defer func(out io.Writer) { logger.Out = out }(logger.Out)
+	logs := new(bytes.Buffer)
+	logger.Out = logs
+	opts.maxImageAge = time.Hour
+	opts.cmdlineLimit = 8
+	if err := build("checked"); err != nil {
+		t.Fatalf("Expected a cache hit not to build: %v", err)
+	}
+	for _, warning := range []string{"has no valid created time", "less than the cmdline limit"} {
+		if !strings.Contains(logs.String(), warning) {
+			t.Errorf("Expected a hit to warn %q, got %q", warning, logs.String())
+		}
+	}
+	opts = buildOpts{reproducible: true}
+
+	// a changed image digest is a miss, which builds again
+	inspect := images.inspects["linuxkit/init:v1"]
+	inspect.ID = "sha256:3333"
+	images.inspects["linuxkit/init:v1"] = inspect
+	if err := build("changed"); err == nil || !strings.Contains(err.Error(), "No such image") {
+		t.Errorf("Expected a changed image to miss the cache and build, got %v", err)
+	}
+
+	// a corrupted object is not used as an output
+	inspect.ID = "sha256:2222"
+	images.inspects["linuxkit/init:v1"] = inspect
+	for path, b := range cache.objects {
+		if !strings.HasSuffix(path, "/"+remoteCacheIndex) {
+			cache.objects[path] = append(b, 'x')
+		}
+	}
+	if err := build("corrupt"); err == nil || !strings.Contains(err.Error(), "No such image") {
+		t.Errorf("Expected a corrupted cache object to be built again, got %v", err)
+	}
+
+	// outputs with secrets are neither fetched nor stored
+	secrets := filepath.Join(dir, "secrets")
+	if err := os.Mkdir(secrets, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(secrets, "token"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config += "  - path: etc/token\n    secret: token\n"
+	if err := ioutil.WriteFile(conf, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	images.exports = exports
+	puts := cache.puts
+	logs.Reset()
+	out := filepath.Join(dir, "secret")
+	if err := os.Mkdir(out, 0755); err != nil {
+		t.Fatal(err)
+	}
+	c := &buildCommand{
+		out:           outputList{"tar"},
+		compressLevel: defaultCompressLevel,
+		remoteCache:   store,
+		secretsDir:    secrets,
+		opts:          opts,
+	}
+	if err := c.run(conf, out); err != nil {
+		t.Fatal(err)
+	}
+	if cache.puts != puts || !strings.Contains(logs.String(), "the files include secrets") {
+		t.Errorf("Expected a build with secrets not to use the remote cache, stored %d objects and logged %q", cache.puts-puts, logs.String())
+	}
+
+	for _, u := range []string{"s3://bucket/builds", "/srv/cache", "http://"} {
+		if _, err := newRemoteStore(u); err == nil {
+			t.Errorf("Expected remote cache %s to be rejected", u)
+		}
+	}
+}
+
+func TestRemoteCacheSignKey(t *testing.T) {
+	m, err := NewConfig([]byte("kernel:\n  image: linuxkit/kernel:4.9.x\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolve := func(image string) (string, error) { return "sha256:" + image, nil }
+	key := func(signKey *[ed25519.PrivateKeySize]byte, signPath string) string {
+		c := &buildCommand{opts: buildOpts{signKey: signKey, signPath: signPath}}
+		k, err := c.remoteCacheKey("test", m, outputList{"kernel+initrd"}, resolve)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	_, first, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, second, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]string{
+		"unsigned":   key(nil, ""),
+		"signed":     key(first, defaultSignPath),
+		"other key":  key(second, defaultSignPath),
+		"other path": key(first, "etc/moby.sig"),
+	}
+	seen := map[string]string{}
+	for name, k := range keys {
+		if other, ok := seen[k]; ok {
+			t.Errorf("Expected the %s and %s builds to have different cache keys", name, other)
+		}
+		seen[k] = name
+	}
+	if key(first, defaultSignPath) != keys["signed"] {
+		t.Errorf("Expected the same signed build to have the same cache key")
+	}
+}
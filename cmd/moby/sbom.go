@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// A minimal CycloneDX software bill of materials, see https://cyclonedx.org/
+
+type cdxBOM struct {
+	BOMFormat    string         `json:"bomFormat"`
+	SpecVersion  string         `json:"specVersion"`
+	SerialNumber string         `json:"serialNumber"`
+	Version      int            `json:"version"`
+	Metadata     cdxMetadata    `json:"metadata"`
+	Components   []cdxComponent `json:"components"`
+}
+
+type cdxMetadata struct {
+	Timestamp string       `json:"timestamp"`
+	Component cdxComponent `json:"component"`
+}
+
+type cdxComponent struct {
+	Type       string        `json:"type"`
+	Name       string        `json:"name"`
+	Version    string        `json:"version,omitempty"`
+	Hashes     []cdxHash     `json:"hashes,omitempty"`
+	Properties []cdxProperty `json:"properties,omitempty"`
+}
+
+type cdxHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// configImage is an image used in a section of a config
+type configImage struct {
+	section string
+	image   string
+}
+
+// configImages lists the images of a config in build order
+func configImages(m Moby) []configImage {
+	images := []configImage{}
+	if m.Kernel.Image != "" {
+		images = append(images, configImage{"kernel", m.Kernel.Image})
+	}
+	for _, ii := range m.Init {
+		images = append(images, configImage{"init", ii})
+	}
+	for _, image := range m.Onboot {
+		images = append(images, configImage{"onboot", image.Image})
+	}
+	for _, image := range m.Services {
+		images = append(images, configImage{"services", image.Image})
+	}
+	return images
+}
+
+// imageLabels returns the labels of each image of a config, from its image
+// config as returned by inspect
+func imageLabels(m Moby, inspect func(string) (types.ImageInspect, error)) (map[string]map[string]string, error) {
+	labels := map[string]map[string]string{}
+	for _, ci := range configImages(m) {
+		if _, ok := labels[ci.image]; ok {
+			continue
+		}
+		info, err := inspect(ci.image)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read labels of %s: %v", ci.image, err)
+		}
+		labels[ci.image] = map[string]string{}
+		if info.Config != nil {
+			for k, v := range info.Config.Labels {
+				labels[ci.image][k] = v
+			}
+		}
+	}
+	return labels, nil
+}
+
+// fileContents returns the contents of a regular file entry in a config
+func fileContents(f File) ([]byte, error) {
+	if f.Contents != "" || f.Source == "" {
+		return []byte(f.Contents), nil
+	}
+	return ioutil.ReadFile(f.Source)
+}
+
+// sbom creates a bill of materials listing the images in a config with the
+// digests returned by resolve and their labels, and the files added with
+// their hashes
+func sbom(name string, m Moby, resolve func(string) (string, error), labels map[string]map[string]string) ([]byte, error) {
+	serial, err := uuid()
+	if err != nil {
+		return []byte{}, err
+	}
+	bom := cdxBOM{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.4",
+		SerialNumber: "urn:uuid:" + serial,
+		Version:      1,
+		Metadata: cdxMetadata{
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+			Component: cdxComponent{Type: "operating-system", Name: name},
+		},
+		Components: []cdxComponent{},
+	}
+
+	for _, ci := range configImages(m) {
+		dgst, err := resolve(ci.image)
+		if err != nil {
+			return []byte{}, fmt.Errorf("Cannot resolve digest of %s: %v", ci.image, err)
+		}
+		c := cdxComponent{
+			Type:       "container",
+			Name:       ci.image,
+			Version:    dgst,
+			Properties: []cdxProperty{{Name: "moby:section", Value: ci.section}},
+		}
+		if parts := strings.SplitN(dgst, ":", 2); len(parts) == 2 && parts[0] == "sha256" {
+			c.Hashes = []cdxHash{{Alg: "SHA-256", Content: parts[1]}}
+		}
+		keys := []string{}
+		for k := range labels[ci.image] {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			c.Properties = append(c.Properties, cdxProperty{Name: "moby:label:" + k, Value: labels[ci.image][k]})
+		}
+		bom.Components = append(bom.Components, c)
+	}
+
+	for _, f := range m.Files {
+		if f.Directory || f.Symlink != "" {
+			continue
+		}
+		// the hash could be used to guess the contents of a sensitive file
+		if f.Sensitive {
+			bom.Components = append(bom.Components, cdxComponent{Type: "file", Name: redacted})
+			continue
+		}
+		contents, err := fileContents(f)
+		if err != nil {
+			return []byte{}, err
+		}
+		bom.Components = append(bom.Components, cdxComponent{
+			Type:   "file",
+			Name:   f.Path,
+			Hashes: []cdxHash{{Alg: "SHA-256", Content: fmt.Sprintf("%x", sha256.Sum256(contents))}},
+		})
+	}
+
+	return json.MarshalIndent(bom, "", "  ")
+}
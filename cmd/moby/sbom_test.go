@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+func TestSBOM(t *testing.T) {
+	m, err := NewConfig([]byte(`
+kernel:
+  image: "linuxkit/kernel:4.9.x"
+init:
+  - linuxkit/init:1b8a7e394d2ec2f1fdb4d67645829d1b5bdca037
+  - linuxkit/runc:3a4e6cbf15470f62501b019b55e1caac5ee7689f
+onboot:
+  - name: dhcpcd
+    image: "linuxkit/dhcpcd:7d2f17a0e5d1ef9a75a527821a9ab0d753b22e7e"
+services:
+  - name: nginx
+    image: "nginx:alpine"
+files:
+  - path: etc/docker
+    directory: true
+  - path: etc/docker/daemon.json
+    contents: '{"debug": true}'
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolve := func(image string) (string, error) {
+		return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(image))), nil
+	}
+	b, err := sbom("test", m, resolve, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bom cdxBOM
+	if err := json.Unmarshal(b, &bom); err != nil {
+		t.Fatal(err)
+	}
+	if bom.BOMFormat != "CycloneDX" || bom.Metadata.Component.Name != "test" {
+		t.Errorf("Unexpected BOM metadata: %v %v", bom.BOMFormat, bom.Metadata)
+	}
+
+	components := map[string]cdxComponent{}
+	for _, c := range bom.Components {
+		components[c.Type+" "+c.Name] = c
+	}
+	for _, ci := range configImages(m) {
+		c, ok := components["container "+ci.image]
+		if !ok {
+			t.Errorf("Expected %s image %s in SBOM", ci.section, ci.image)
+			continue
+		}
+		dgst, _ := resolve(ci.image)
+		if c.Version != dgst || len(c.Hashes) != 1 || "sha256:"+c.Hashes[0].Content != dgst {
+			t.Errorf("Expected digest %s for %s, got %s %v", dgst, ci.image, c.Version, c.Hashes)
+		}
+	}
+	if len(configImages(m)) != 5 {
+		t.Errorf("Expected 5 images in config, got %d", len(configImages(m)))
+	}
+
+	c, ok := components["file etc/docker/daemon.json"]
+	if !ok {
+		t.Fatal("Expected file etc/docker/daemon.json in SBOM")
+	}
+	expected := fmt.Sprintf("%x", sha256.Sum256([]byte(`{"debug": true}`)))
+	if len(c.Hashes) != 1 || c.Hashes[0].Content != expected {
+		t.Errorf("Expected file hash %s, got %v", expected, c.Hashes)
+	}
+	if _, ok := components["file etc/docker"]; ok {
+		t.Error("Did not expect directory in SBOM")
+	}
+}
+
+func TestImageLabels(t *testing.T) {
+	m, err := NewConfig([]byte(`
+kernel:
+  image: "linuxkit/kernel:4.9.x"
+init:
+  - linuxkit/init:1b8a7e394d2ec2f1fdb4d67645829d1b5bdca037
+services:
+  - name: nginx
+    image: "nginx:alpine"
+  - name: nginx2
+    image: "nginx:alpine"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixtures := map[string]types.ImageInspect{
+		"linuxkit/kernel:4.9.x": {Config: &container.Config{Labels: map[string]string{
+			"org.opencontainers.image.source":  "https://github.com/linuxkit/linuxkit",
+			"org.opencontainers.image.version": "4.9.75",
+		}}},
+		"linuxkit/init:1b8a7e394d2ec2f1fdb4d67645829d1b5bdca037": {},
+		"nginx:alpine": {Config: &container.Config{Labels: map[string]string{"maintainer": "NGINX Docker Maintainers"}}},
+	}
+	inspected := 0
+	inspect := func(image string) (types.ImageInspect, error) {
+		inspected++
+		info, ok := fixtures[image]
+		if !ok {
+			return types.ImageInspect{}, fmt.Errorf("No such image: %s", image)
+		}
+		return info, nil
+	}
+	labels, err := imageLabels(m, inspect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]map[string]string{}
+	for image, info := range fixtures {
+		expected[image] = map[string]string{}
+		if info.Config != nil {
+			expected[image] = info.Config.Labels
+		}
+	}
+	if !reflect.DeepEqual(labels, expected) {
+		t.Errorf("Expected labels %v, got %v", expected, labels)
+	}
+	if inspected != 3 {
+		t.Errorf("Expected each image to be inspected once, got %d inspections", inspected)
+	}
+
+	resolve := func(image string) (string, error) { return "sha256:0", nil }
+	b, err := sbom("test", m, resolve, labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bom cdxBOM
+	if err := json.Unmarshal(b, &bom); err != nil {
+		t.Fatal(err)
+	}
+	properties := []cdxProperty{
+		{Name: "moby:section", Value: "kernel"},
+		{Name: "moby:label:org.opencontainers.image.source", Value: "https://github.com/linuxkit/linuxkit"},
+		{Name: "moby:label:org.opencontainers.image.version", Value: "4.9.75"},
+	}
+	if !reflect.DeepEqual(bom.Components[0].Properties, properties) {
+		t.Errorf("Expected kernel properties %v, got %v", properties, bom.Components[0].Properties)
+	}
+
+	delete(fixtures, "nginx:alpine")
+	if _, err := imageLabels(m, inspect); err == nil || !strings.Contains(err.Error(), "nginx:alpine") {
+		t.Errorf("Expected an error naming the missing image, got %v", err)
+	}
+}
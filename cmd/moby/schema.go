@@ -11,7 +11,16 @@ var schema = string(`
       "additionalProperties": false,
       "properties": {
         "image": { "type": "string"},
-        "cmdline": { "type": "string"}
+        "cmdline": { "type": "string"},
+        "cmdlineNewline": { "type": "boolean"},
+        "variant": { "type": "string"},
+        "bootMode": { "type": "string"},
+        "bootFileMode": { "type": "string"},
+        "passthrough": { "type": "boolean"},
+        "cmdlinePath": { "type": "string"},
+        "noCmdlineFile": { "type": "boolean"},
+        "modules": { "$ref": "#/definitions/strings" },
+        "digest": { "type": "string"}
       }
     },
     "file": {
@@ -22,7 +31,12 @@ var schema = string(`
           "directory": {"type": "boolean"},
           "symlink": {"type": "string"},
           "contents": {"type": "string"},
-          "source": {"type": "string"}
+          "source": {"type": "string"},
+          "mtime": {"type": ["string", "integer"]},
+          "sensitive": {"type": "boolean"},
+          "secret": {"type": "string"},
+          "override": {"type": "boolean"},
+          "outputs": { "$ref": "#/definitions/strings" }
         }
     },
     "files": {
@@ -34,7 +48,24 @@ var schema = string(`
       "additionalProperties": false,
       "properties": {
         "image": { "$ref": "#/definitions/strings" },
-        "org": { "$ref": "#/definitions/strings" }
+        "org": { "$ref": "#/definitions/strings" },
+        "defaultOrg": { "type": "string" },
+        "registries": {
+          "type": "array",
+          "items": { "$ref": "#/definitions/registryTrust" }
+        }
+      }
+    },
+    "registryTrust": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "registry": { "type": "string" },
+        "enforce": { "type": "boolean" },
+        "image": { "$ref": "#/definitions/strings" },
+        "org": { "$ref": "#/definitions/strings" },
+        "rootKeys": { "$ref": "#/definitions/strings" },
+        "server": { "type": "string" }
       }
     },
     "strings": {
@@ -48,13 +79,39 @@ var schema = string(`
         "destination": { "type": "string" },
         "type": { "type": "string" },
         "source": { "type": "string" },
-        "options": { "$ref": "#/definitions/strings" }
+        "options": { "$ref": "#/definitions/strings" },
+        "propagation": { "type": "string" },
+        "readonly": { "type": "boolean" }
       }
     },
     "mounts": {
       "type": "array",
       "items": { "$ref": "#/definitions/mount" }
     },
+    "hook": {
+      "type": "object",
+      "additionalProperties": false,
+      "required": ["path"],
+      "properties": {
+        "path": { "type": "string" },
+        "args": { "$ref": "#/definitions/strings" },
+        "env": { "$ref": "#/definitions/strings" },
+        "timeout": { "type": "integer" }
+      }
+    },
+    "hookList": {
+      "type": "array",
+      "items": { "$ref": "#/definitions/hook" }
+    },
+    "hooks": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "prestart": { "$ref": "#/definitions/hookList" },
+        "poststart": { "$ref": "#/definitions/hookList" },
+        "poststop": { "$ref": "#/definitions/hookList" }
+      }
+    },
     "image": {
       "type": "object",
       "additionalProperties": false,
@@ -83,11 +140,17 @@ var schema = string(`
             "items": { "type": "integer" }
         },
         "noNewPrivileges": {"type": "boolean"},
+        "terminal": {"type": "boolean"},
         "hostname": {"type": "string"},
         "oomScoreAdj": {"type": "integer"},
         "disableOOMKiller": {"type": "boolean"},
         "rootfsPropagation": {"type": "string"},
         "cgroupsPath": {"type": "string"},
+        "rootfsPath": {"type": "string"},
+        "profiles": { "$ref": "#/definitions/strings" },
+        "after": { "$ref": "#/definitions/strings" },
+        "digest": {"type": "string"},
+        "hooks": { "$ref": "#/definitions/hooks" },
         "sysctl": {
             "type": "array",
             "items": { "$ref": "#/definitions/strings" }
@@ -97,15 +160,51 @@ var schema = string(`
     "images": {
         "type": "array",
         "items": { "$ref": "#/definitions/image" }
+    },
+    "idmap": {
+        "type": "object",
+        "additionalProperties": { "type": "string" }
+    },
+    "ids": {
+        "type": "object",
+        "additionalProperties": { "type": "integer", "minimum": 0 }
+    },
+    "cloudInit": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "userData": { "type": "string" },
+        "metaData": { "type": "string" },
+        "networkConfig": { "type": "string" }
+      }
+    },
+    "ignition": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "config": { "type": "string" }
+      }
     }
   },
   "properties": {
+    "version": { "type": "integer" },
+    "include": { "$ref": "#/definitions/strings" },
+    "name": { "type": "string" },
+    "outputDir": { "type": "string" },
     "kernel": { "$ref": "#/definitions/kernel" },
     "init": { "$ref": "#/definitions/strings" },
     "onboot": { "$ref": "#/definitions/images" },
     "services": { "$ref": "#/definitions/images" },
     "trust": { "$ref": "#/definitions/trust" },
-    "files": { "$ref": "#/definitions/files" }
+    "files": { "$ref": "#/definitions/files" },
+    "outputs": { "$ref": "#/definitions/strings" },
+    "ociVersion": { "type": "string" },
+    "uidMap": { "$ref": "#/definitions/idmap" },
+    "gidMap": { "$ref": "#/definitions/idmap" },
+    "users": { "$ref": "#/definitions/ids" },
+    "groups": { "$ref": "#/definitions/ids" },
+    "cloudInit": { "$ref": "#/definitions/cloudInit" },
+    "ignition": { "$ref": "#/definitions/ignition" }
   }
 }
 `)
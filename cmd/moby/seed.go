@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The cloudInit or ignition section of a config is written as a seed, a
+// small FAT filesystem that cloud-init or Ignition finds by its label. The
+// seed output is the filesystem on its own, to attach to a VM as a disk, and
+// the ab-raw output has it in its config partition.
+
+const (
+	// seedSize is the size of the seed filesystem, that of the config
+	// partition of the ab-raw output
+	seedSize = abConfigSize * 1024 * 1024
+	// cloudInitLabel is the label of a cloud-init NoCloud seed
+	cloudInitLabel = "cidata"
+	// ignitionLabel and ignitionPath are the label and user data of an
+	// OpenStack config drive, which Ignition reads on that platform
+	ignitionLabel = "config-2"
+	ignitionPath  = "openstack/latest/user_data"
+)
+
+// configSeed is the label and files of the seed filesystem of a config
+type configSeed struct {
+	label string
+	files []fatFile
+}
+
+// validSeed checks the cloudInit and ignition sections of a config
+func validSeed(m Moby) error {
+	if m.CloudInit != nil && m.Ignition != nil {
+		return errors.New("A config can have a cloudInit or an ignition section, not both, the disk outputs have one config partition")
+	}
+	if m.CloudInit != nil && m.CloudInit.UserData == "" {
+		return errors.New("The cloudInit section needs userData")
+	}
+	if m.Ignition != nil {
+		var config struct {
+			Ignition struct {
+				Version string `json:"version"`
+			} `json:"ignition"`
+		}
+		if err := json.Unmarshal([]byte(m.Ignition.Config), &config); err != nil {
+			return fmt.Errorf("Invalid Ignition config: %v", err)
+		}
+		if config.Ignition.Version == "" {
+			return errors.New("Invalid Ignition config: it has no ignition.version")
+		}
+	}
+	return nil
+}
+
+// newConfigSeed returns the seed of a config, nil if it has none
+func newConfigSeed(m Moby) *configSeed {
+	switch {
+	case m.CloudInit != nil:
+		ci := m.CloudInit
+		meta := ci.MetaData
+		if meta == "" {
+			// cloud-init runs again on first boot when the instance-id changes
+			sum := sha256.Sum256([]byte(ci.UserData))
+			meta = fmt.Sprintf("instance-id: moby-%x\n", sum[:6])
+		}
+		s := &configSeed{label: cloudInitLabel, files: []fatFile{
+			{path: "user-data", contents: []byte(ci.UserData)},
+			{path: "meta-data", contents: []byte(meta)},
+		}}
+		if ci.NetworkConfig != "" {
+			s.files = append(s.files, fatFile{path: "network-config", contents: []byte(ci.NetworkConfig)})
+		}
+		return s
+	case m.Ignition != nil:
+		return &configSeed{label: ignitionLabel, files: []fatFile{
+			{path: ignitionPath, contents: []byte(m.Ignition.Config)},
+		}}
+	}
+	return nil
+}
+
+// filesystem formats the seed filesystem
+func (s *configSeed) filesystem() ([]byte, error) {
+	fs, err := fatFilesystem(seedSize, s.label, s.files)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot make the %s seed filesystem: %v", s.label, err)
+	}
+	return fs, nil
+}
+
+// outputSeed writes the seed filesystem of the config
+func outputSeed(base string, o *outputOpts) error {
+	if o.seed == nil {
+		return errors.New("The seed output needs a cloudInit or ignition section in the config")
+	}
+	filename := base + "-seed.img"
+	log.Debugf("output seed: %s label %s", base, o.seed.label)
+	log.Infof("  %s", filename)
+	fs, err := o.seed.filesystem()
+	if err != nil {
+		return err
+	}
+	return o.writeFile(filename, fs)
+}
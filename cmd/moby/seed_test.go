@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// readFAT reads the label and the files by path of a FAT16 filesystem,
+// using their long names
+func readFAT(t *testing.T, fs []byte) (string, map[string]string) {
+	if fs[510] != 0x55 || fs[511] != 0xaa || string(fs[54:62]) != "FAT16   " {
+		t.Fatal("Not a FAT16 filesystem")
+	}
+	bps := int(binary.LittleEndian.Uint16(fs[11:]))
+	spc := int(fs[13])
+	reserved := int(binary.LittleEndian.Uint16(fs[14:]))
+	fatSectors := int(binary.LittleEndian.Uint16(fs[22:]))
+	rootStart := (reserved + int(fs[16])*fatSectors) * bps
+	dataStart := rootStart + int(binary.LittleEndian.Uint16(fs[17:]))*fatEntrySize
+	fat := fs[reserved*bps:]
+	chain := func(cluster int) []byte {
+		b := []byte{}
+		for cluster >= 2 && cluster < 0xfff8 {
+			at := dataStart + (cluster-2)*spc*bps
+			b = append(b, fs[at:at+spc*bps]...)
+			cluster = int(binary.LittleEndian.Uint16(fat[2*cluster:]))
+		}
+		return b
+	}
+	files := map[string]string{}
+	var readDir func(entries []byte, prefix string)
+	readDir = func(entries []byte, prefix string) {
+		long := []uint16{}
+		for i := 0; i+fatEntrySize <= len(entries); i += fatEntrySize {
+			e := entries[i : i+fatEntrySize]
+			if e[0] == 0 {
+				return
+			}
+			if e[11] == fatAttrLFN {
+				part := []uint16{}
+				for _, off := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+					part = append(part, binary.LittleEndian.Uint16(e[off:]))
+				}
+				long = append(part, long...)
+				continue
+			}
+			name := strings.TrimRight(string(utf16.Decode(long)), "\x00￿")
+			long = []uint16{}
+			if e[11]&fatAttrLabel != 0 || e[0] == '.' {
+				continue
+			}
+			if name == "" {
+				t.Errorf("Expected a long name for %q", e[0:11])
+			}
+			cluster := int(binary.LittleEndian.Uint16(e[26:]))
+			if e[11]&fatAttrDir != 0 {
+				readDir(chain(cluster), prefix+name+"/")
+				continue
+			}
+			files[prefix+name] = string(chain(cluster)[:binary.LittleEndian.Uint32(e[28:])])
+		}
+	}
+	readDir(fs[rootStart:dataStart], "")
+	return strings.TrimRight(string(fs[43:54]), " "), files
+}
+
+func TestFATFilesystem(t *testing.T) {
+	files := []fatFile{
+		{path: "docs/a long name.txt", contents: []byte(strings.Repeat("x", 2000))},
+		{path: "empty", contents: []byte{}},
+	}
+	for i := 0; i < 20; i++ {
+		files = append(files, fatFile{path: fmt.Sprintf("docs/file-%d.txt", i), contents: []byte(fmt.Sprint(i))})
+	}
+	fs, err := fatFilesystem(seedSize, "test", files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	label, read := readFAT(t, fs)
+	if label != "TEST" || len(read) != len(files) {
+		t.Fatalf("Expected the label TEST and %d files, got %s and %d", len(files), label, len(read))
+	}
+	for _, f := range files {
+		if read[f.path] != string(f.contents) {
+			t.Errorf("Expected %s to have %d bytes, got %d", f.path, len(f.contents), len(read[f.path]))
+		}
+	}
+	again, err := fatFilesystem(seedSize, "test", files)
+	if err != nil || string(again) != string(fs) {
+		t.Errorf("Expected the same files to give the same filesystem")
+	}
+	if _, err := fatFilesystem(seedSize, "test", []fatFile{{path: "big", contents: make([]byte, seedSize)}}); err == nil {
+		t.Errorf("Expected files larger than the filesystem to be an error")
+	}
+}
+
+func TestSeedOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	image := testImage(t)
+
+	m, err := NewConfig([]byte("cloudInit:\n  userData: |\n    #cloud-config\n    hostname: edge\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := filepath.Join(dir, "test")
+	if err := outFuns["seed"](base, image, &outputOpts{seed: newConfigSeed(m)}); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := ioutil.ReadFile(base + "-seed.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	label, files := readFAT(t, fs)
+	if label != "CIDATA" || files["user-data"] != "#cloud-config\nhostname: edge\n" || !strings.HasPrefix(files["meta-data"], "instance-id: moby-") {
+		t.Errorf("Expected a cidata seed with the user data, got %s %q", label, files)
+	}
+
+	// the ab-raw output has the seed in its config partition
+	m, err = NewConfig([]byte("ignition:\n  config: '{\"ignition\":{\"version\":\"3.3.0\"}}'\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := outFuns["ab-raw"](base, image, &outputOpts{size: 24, seed: newConfigSeed(m)}); err != nil {
+		t.Fatal(err)
+	}
+	disk, err := ioutil.ReadFile(base + "-ab-raw.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := readGPT(t, disk, 1)[2]
+	label, files = readFAT(t, disk[config.first*sectorSize:(config.last+1)*sectorSize])
+	if label != "CONFIG-2" || files[ignitionPath] != `{"ignition":{"version":"3.3.0"}}` {
+		t.Errorf("Expected a config-2 seed with the Ignition config, got %s %q", label, files)
+	}
+
+	if err := outFuns["seed"](base, image, &outputOpts{}); err == nil || !strings.Contains(err.Error(), "needs a cloudInit or ignition section") {
+		t.Errorf("Expected the seed output to need a seed, got %v", err)
+	}
+	for config, expected := range map[string]string{
+		"cloudInit:\n  userData: x\nignition:\n  config: '{}'\n": "not both",
+		"cloudInit:\n  metaData: x\n":                            "needs userData",
+		"ignition:\n  config: 'ignition'\n":                      "Invalid Ignition config",
+		"ignition:\n  config: '{\"storage\":{}}'\n":              "no ignition.version",
+	} {
+		if _, err := NewConfig([]byte(config)); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %q for %q, got %v", expected, config, err)
+		}
+	}
+}
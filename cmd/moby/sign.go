@@ -0,0 +1,237 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/agl/ed25519"
+	"github.com/surma/gocpio"
+)
+
+// defaultSignPath is where the signature of the image is added
+const defaultSignPath = "boot/initrd.sig"
+
+// signPublicKeyPath is where the public key for a signature is added
+func signPublicKeyPath(sigPath string) string {
+	return strings.TrimSuffix(sigPath, ".sig") + ".pub"
+}
+
+// readSignKey reads an ed25519 private key, either the raw 64 bytes or base64 encoded
+func readSignKey(filename string) (*[ed25519.PrivateKeySize]byte, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != ed25519.PrivateKeySize {
+		b, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil || len(b) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("%s is not an ed25519 private key", filename)
+		}
+	}
+	key := new([ed25519.PrivateKeySize]byte)
+	copy(key[:], b)
+	return key, nil
+}
+
+// initrdSplit are the entries of an image that are split out of the initrd
+// by the outputs, as the kernel and cmdline are booted alongside it
+var initrdSplit = map[string]bool{"boot": true, "boot/kernel": true, "boot/cmdline": true}
+
+// initrdTypes are the cpio types the entry types of an image have in the initrd
+var initrdTypes = map[byte]int64{
+	tar.TypeReg:     cpio.TYPE_REG,
+	tar.TypeRegA:    cpio.TYPE_REG,
+	tar.TypeLink:    cpio.TYPE_SYMLINK,
+	tar.TypeSymlink: cpio.TYPE_SYMLINK,
+	tar.TypeChar:    cpio.TYPE_CHAR,
+	tar.TypeBlock:   cpio.TYPE_BLK,
+	tar.TypeDir:     cpio.TYPE_DIR,
+	tar.TypeFifo:    cpio.TYPE_FIFO,
+}
+
+// digestEntry hashes an entry as it is in the initrd: its name, permissions,
+// owner, cpio type, device numbers, and contents, which for a symlink is its
+// target
+func digestEntry(h io.Writer, name string, mode int64, uid, gid int, typ, major, minor int64, contents io.Reader) error {
+	fmt.Fprintf(h, "%s\x00%o %d %d %d %d %d\x00", name, mode&07777, uid, gid, typ, major, minor)
+	n, err := io.Copy(h, contents)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(h, "\x00%d\x00", n)
+	return nil
+}
+
+// imageDigest hashes the entries of an image in order as they are in the
+// initrd the outputs make of it, so the digest of the initrd they ship is
+// the same. The kernel, cmdline and boot directory split out of the initrd,
+// and the signature and public key, are not covered. Hard links are covered
+// as the symlinks to /target the initrd has, and modification times are not
+// covered.
+func imageDigest(image []byte, sigPath string) ([]byte, error) {
+	exclude := map[string]bool{cleanPath(sigPath): true, cleanPath(signPublicKeyPath(sigPath)): true}
+	h := sha256.New()
+	tr := tar.NewReader(bytes.NewReader(image))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if initrdSplit[hdr.Name] || exclude[cleanPath(hdr.Name)] {
+			continue
+		}
+		typ, ok := initrdTypes[hdr.Typeflag]
+		if !ok {
+			return nil, fmt.Errorf("Entry %s of type %c cannot be in an initrd", hdr.Name, hdr.Typeflag)
+		}
+		var contents io.Reader = tr
+		switch hdr.Typeflag {
+		case tar.TypeLink:
+			contents = strings.NewReader("/" + hdr.Linkname)
+		case tar.TypeSymlink:
+			contents = strings.NewReader(hdr.Linkname)
+		}
+		if err := digestEntry(h, hdr.Name, hdr.Mode, hdr.Uid, hdr.Gid, typ, hdr.Devmajor, hdr.Devminor, contents); err != nil {
+			return nil, err
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+// initrdDigest hashes the entries of an initrd made by the outputs, the
+// digest is the imageDigest of the image it was made from, so a signature
+// of the image verifies the initrd
+func initrdDigest(initrd []byte, sigPath string) ([]byte, error) {
+	exclude := map[string]bool{cleanPath(sigPath): true, cleanPath(signPublicKeyPath(sigPath)): true}
+	gr, err := gzip.NewReader(bytes.NewReader(initrd))
+	if err != nil {
+		return nil, err
+	}
+	// the initrd is padded after the compressed archive
+	gr.Multistream(false)
+	h := sha256.New()
+	cr := cpio.NewReader(gr)
+	for {
+		hdr, err := cr.Next()
+		if err != nil {
+			return nil, err
+		}
+		if hdr.IsTrailer() {
+			break
+		}
+		if exclude[cleanPath(hdr.Name)] {
+			continue
+		}
+		if err := digestEntry(h, hdr.Name, hdr.Mode, hdr.Uid, hdr.Gid, hdr.Type, hdr.Devmajor, hdr.Devminor, cr); err != nil {
+			return nil, err
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+// tarNames returns the cleaned names of the entries in a tarball
+func tarNames(image []byte) (map[string]bool, error) {
+	names := map[string]bool{}
+	tr := tar.NewReader(bytes.NewReader(image))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		names[cleanPath(hdr.Name)] = true
+	}
+}
+
+// signImage adds a detached ed25519 signature of the image digest at sigPath,
+// and the public key to check it alongside. The signature verifies the initrd
+// the outputs make of the image, see imageDigest for what it covers.
+func signImage(image []byte, key *[ed25519.PrivateKeySize]byte, sigPath string) ([]byte, error) {
+	// the initrd needs the leading directories, there is no boot without a kernel
+	names, err := tarNames(image)
+	if err != nil {
+		return nil, err
+	}
+	dirs := []signFile{}
+	dir := ""
+	for _, p := range strings.Split(path.Dir(cleanPath(sigPath)), "/") {
+		if p == "." {
+			continue
+		}
+		dir = path.Join(dir, p)
+		if !names[dir] {
+			dirs = append(dirs, signFile{name: dir, dir: true})
+		}
+	}
+	image, err = tarAppend(image, dirs)
+	if err != nil {
+		return nil, err
+	}
+
+	digest, err := imageDigest(image, sigPath)
+	if err != nil {
+		return nil, err
+	}
+	sig := ed25519.Sign(key, digest)
+	return tarAppend(image, []signFile{
+		{name: sigPath, contents: sig[:]},
+		{name: signPublicKeyPath(sigPath), contents: key[32:]},
+	})
+}
+
+// signFile is an entry added to the image when it is signed
+type signFile struct {
+	name     string
+	dir      bool
+	contents []byte
+}
+
+// tarAppend adds entries to the end of a tarball
+func tarAppend(image []byte, files []signFile) ([]byte, error) {
+	if len(files) == 0 {
+		return image, nil
+	}
+	out := new(bytes.Buffer)
+	tw := tar.NewWriter(out)
+	err := initrdAppend(tw, bytes.NewReader(image), appendOpts{})
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name: f.name,
+			Mode: 0644,
+			Size: int64(len(f.contents)),
+		}
+		if f.dir {
+			hdr.Mode = 0755
+			hdr.Typeflag = tar.TypeDir
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tw.Write(f.contents)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
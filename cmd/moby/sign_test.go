@@ -0,0 +1,169 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/agl/ed25519"
+)
+
+func TestSignImage(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		image   []byte
+		sigPath string
+	}{
+		{testImage(t), defaultSignPath},
+		// without a kernel there is no boot directory
+		{makeTar(t, []tarEntry{{name: "etc/motd", typeflag: tar.TypeReg, contents: "hello"}}).Bytes(), "etc/signatures/image.sig"},
+	}
+	for _, testCase := range testCases {
+		signed, err := signImage(testCase.image, key, testCase.sigPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdrs, contents := readTar(t, bytes.NewBuffer(signed))
+		if _, ok := hdrs[filepath.Dir(testCase.sigPath)]; !ok {
+			if _, ok := hdrs[filepath.Dir(testCase.sigPath)+"/"]; !ok {
+				t.Errorf("Expected the directory of %s to be in the image", testCase.sigPath)
+			}
+		}
+
+		// the embedded signature verifies the rest of the image with the embedded key
+		sig := new([ed25519.SignatureSize]byte)
+		pub := new([ed25519.PublicKeySize]byte)
+		if copy(sig[:], contents[testCase.sigPath]) != ed25519.SignatureSize {
+			t.Fatalf("Expected a signature at %s", testCase.sigPath)
+		}
+		if copy(pub[:], contents[signPublicKeyPath(testCase.sigPath)]) != ed25519.PublicKeySize {
+			t.Fatalf("Expected a public key at %s", signPublicKeyPath(testCase.sigPath))
+		}
+		digest, err := imageDigest(signed, testCase.sigPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ed25519.Verify(pub, digest, sig) {
+			t.Error("Expected embedded signature to verify against the public key")
+		}
+
+		// and fails if the image is changed
+		tampered, err := signImage(testCase.image, key, testCase.sigPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tampered = bytes.Replace(tampered, []byte("moby"), []byte("evil"), -1)
+		tampered = bytes.Replace(tampered, []byte("hello"), []byte("evil!"), -1)
+		digest, err = imageDigest(tampered, testCase.sigPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ed25519.Verify(pub, digest, sig) {
+			t.Error("Expected signature not to verify a changed image")
+		}
+	}
+}
+
+func TestSignInitrd(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := makeTar(t, []tarEntry{
+		{name: "boot", typeflag: tar.TypeDir},
+		{name: "boot/kernel", typeflag: tar.TypeReg, contents: "vmlinuz"},
+		{name: "boot/cmdline", typeflag: tar.TypeReg, contents: "console=ttyS0"},
+		{name: "bin", typeflag: tar.TypeDir},
+		{name: "bin/busybox", typeflag: tar.TypeReg, contents: "busybox"},
+		{name: "bin/sh", typeflag: tar.TypeSymlink},
+		{name: "etc/motd", typeflag: tar.TypeReg, contents: "hello"},
+	}).Bytes()
+	signed, err := signImage(image, key, defaultSignPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, contents := readTar(t, bytes.NewBuffer(signed))
+	sig := new([ed25519.SignatureSize]byte)
+	pub := new([ed25519.PublicKeySize]byte)
+	copy(sig[:], contents[defaultSignPath])
+	copy(pub[:], contents[signPublicKeyPath(defaultSignPath)])
+
+	// the signature verifies the initrd that ships, without the kernel and cmdline
+	_, initrd, _, err := tarToInitrd(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := initrdDigest(initrd, defaultSignPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ed25519.Verify(pub, digest, sig) {
+		t.Error("Expected the signature to verify the initrd made from the image")
+	}
+
+	_, initrd, _, err = tarToInitrd(bytes.Replace(signed, []byte("hello"), []byte("evil!"), -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err = initrdDigest(initrd, defaultSignPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ed25519.Verify(pub, digest, sig) {
+		t.Error("Expected the signature not to verify a changed initrd")
+	}
+
+	// a different kernel boots the same signed initrd
+	_, initrd, _, err = tarToInitrd(bytes.Replace(signed, []byte("vmlinuz"), []byte("vmlinuX"), -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest, err = initrdDigest(initrd, defaultSignPath); err != nil || !ed25519.Verify(pub, digest, sig) {
+		t.Errorf("Expected the signature not to cover the kernel, got %v", err)
+	}
+}
+
+func TestReadSignKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"raw":     key[:],
+		"base64":  []byte(base64.StdEncoding.EncodeToString(key[:]) + "\n"),
+		"invalid": []byte("not a key"),
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+		read, err := readSignKey(filepath.Join(dir, name))
+		if name == "invalid" {
+			if err == nil {
+				t.Error("Expected invalid key to be rejected")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error reading %s key: %v", name, err)
+		}
+		if *read != *key {
+			t.Errorf("Expected %s key to match", name)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// defaultSmokeMarker is printed by the kernel just before it runs init
+	defaultSmokeMarker = "Freeing unused kernel memory"
+	// defaultSmokeTimeout is how long the kernel has to print the marker
+	defaultSmokeTimeout = 60 * time.Second
+	// smokeConsoleLines is how much of the console is shown when the marker
+	// is not found
+	smokeConsoleLines = 20
+)
+
+// smokeTest is a boot of the kernel and initrd of a build under qemu, which
+// passes when the console shows the marker before the timeout
+type smokeTest struct {
+	qemu    string
+	machine string
+	console string
+	marker  string
+	timeout time.Duration
+}
+
+// newSmokeTest returns a smoke test with the qemu that boots kernels built
+// for this machine
+func newSmokeTest(marker string, timeout time.Duration) smokeTest {
+	s := smokeTest{
+		qemu:    "qemu-system-x86_64",
+		machine: "accel=kvm:tcg",
+		console: "ttyS0",
+		marker:  marker,
+		timeout: timeout,
+	}
+	if runtime.GOARCH == "arm64" {
+		s.qemu = "qemu-system-aarch64"
+		s.machine = "virt,accel=kvm:tcg"
+		s.console = "ttyAMA0"
+	}
+	return s
+}
+
+// checkSmokeTest fails early if the outputs given with -output or -only leave
+// out the kernel+initrd output that a smoke test boots, or if its qemu is not
+// on the PATH
+func checkSmokeTest(s smokeTest, out, only outputList) error {
+	for _, list := range []outputList{out, only} {
+		if len(list) != 0 && !hasOutput(list, "kernel+initrd") {
+			return fmt.Errorf("-smoke-test boots the kernel+initrd output, which is not in %s", list.String())
+		}
+	}
+	return requireTool("-smoke-test", s.qemu)
+}
+
+// consoleMarker reads a console until it shows the marker, returning false
+// if it ends first, and the last lines it read
+func consoleMarker(r io.Reader, marker string) (bool, []string) {
+	lines := []string{}
+	br := bufio.NewReader(r)
+	line := ""
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			if line != "" {
+				lines = append(lines, line)
+			}
+			if len(lines) > smokeConsoleLines {
+				lines = lines[len(lines)-smokeConsoleLines:]
+			}
+			return false, lines
+		}
+		if b == '\n' {
+			lines = append(lines, strings.TrimSuffix(line, "\r"))
+			if len(lines) > smokeConsoleLines {
+				lines = lines[1:]
+			}
+			line = ""
+			continue
+		}
+		line += string(b)
+		// the marker may be printed without a newline after it
+		if strings.Contains(line, marker) {
+			return true, append(lines, line)
+		}
+	}
+}
+
+// boot runs qemu with the kernel, initrd and cmdline, with the console on the
+// serial port, and stops it once the marker is shown or the timeout passes
+func (s smokeTest) boot(kernel, initrd, cmdline string) error {
+	args := []string{
+		"-machine", s.machine,
+		"-m", "512",
+		"-nographic",
+		"-no-reboot",
+		"-kernel", kernel,
+		"-initrd", initrd,
+		"-append", strings.TrimSpace(cmdline + " console=" + s.console + " panic=-1"),
+	}
+	log.Debugf("smoke test: %s %v", s.qemu, args)
+	cmd := exec.Command(s.qemu, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Cannot run %s: %v", s.qemu, err)
+	}
+	start := time.Now()
+	var once sync.Once
+	stop := func() { once.Do(func() { cmd.Process.Kill() }) }
+	timer := time.AfterFunc(s.timeout, stop)
+	found, lines := consoleMarker(stdout, s.marker)
+	// the timer has fired if it can no longer be stopped
+	timedOut := !timer.Stop()
+	stop()
+	cmd.Wait()
+	if found {
+		log.Infof("Smoke test passed: %q after %.1fs", s.marker, time.Since(start).Seconds())
+		return nil
+	}
+	reason := "qemu exited"
+	if timedOut {
+		reason = fmt.Sprintf("timed out after %s", s.timeout)
+	}
+	console := strings.Join(lines, "\n  ")
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		console += "\n  " + msg
+	}
+	return fmt.Errorf("Smoke test failed, %s before the console showed %q:\n  %s", reason, s.marker, console)
+}
+
+// run boots the kernel+initrd output of a build
+func (s smokeTest) run(o *outputOpts) error {
+	var kernel, initrd, cmdline string
+	for _, file := range o.files["kernel+initrd"] {
+		switch {
+		case strings.HasSuffix(file, "-kernel"):
+			kernel = file
+		case strings.HasSuffix(file, "-initrd.img"):
+			initrd = file
+		case strings.HasSuffix(file, "-cmdline"):
+			cmdline = file
+		}
+	}
+	if kernel == "" || initrd == "" {
+		return fmt.Errorf("The smoke test boots the kernel+initrd output, which was not built")
+	}
+	if cmdline != "" {
+		b, err := ioutil.ReadFile(cmdline)
+		if err != nil {
+			return err
+		}
+		cmdline = strings.TrimSpace(string(b))
+	}
+	log.Infof("Smoke test: boot %s with %s", kernel, s.qemu)
+	return s.boot(kernel, initrd, cmdline)
+}
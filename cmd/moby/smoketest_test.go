@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConsoleMarker(t *testing.T) {
+	testCases := []struct {
+		console string
+		found   bool
+		last    string
+	}{
+		{"SeaBIOS\r\nLinux version 4.9\r\n[    1.0] Freeing unused kernel memory: 1024K\r\n", true, "[    1.0] Freeing unused kernel memory"},
+		// the marker is found without waiting for the end of its line
+		{"Linux version 4.9\nFreeing unused kernel memory", true, "Freeing unused kernel memory"},
+		{"Linux version 4.9\r\nKernel panic - not syncing\r\n", false, "Kernel panic - not syncing"},
+		{"", false, ""},
+	}
+	for _, tc := range testCases {
+		found, lines := consoleMarker(strings.NewReader(tc.console), defaultSmokeMarker)
+		if found != tc.found {
+			t.Errorf("Expected found %v for console %q", tc.found, tc.console)
+		}
+		last := ""
+		if len(lines) != 0 {
+			last = lines[len(lines)-1]
+		}
+		if last != tc.last {
+			t.Errorf("Expected the last line of console %q to be %q, got %q", tc.console, tc.last, last)
+		}
+	}
+
+	// only the end of a long console is kept
+	console := strings.Repeat("booting\n", 100) + "halted\n"
+	found, lines := consoleMarker(strings.NewReader(console), defaultSmokeMarker)
+	if found || len(lines) != smokeConsoleLines || lines[len(lines)-1] != "halted" {
+		t.Errorf("Expected the last %d lines of the console, got %d ending %v", smokeConsoleLines, len(lines), lines[len(lines)-1:])
+	}
+}
+
+func TestSmokeTestBoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	args := filepath.Join(dir, "args")
+	// fakeQemu writes a console then runs the rest of the script, exec keeps
+	// the pid so that killing it closes the console
+	fakeQemu := func(name, console, then string) string {
+		script := filepath.Join(dir, name)
+		contents := "#!/bin/sh\necho \"$@\" > " + args + "\nprintf '" + console + "'\n" + then + "\n"
+		if err := ioutil.WriteFile(script, []byte(contents), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return script
+	}
+
+	base := filepath.Join(dir, "test")
+	o := &outputOpts{files: map[string][]string{
+		"kernel+initrd": {base + "-kernel", base + "-initrd.img", base + "-cmdline"},
+	}}
+	if err := ioutil.WriteFile(base+"-cmdline", []byte("console=tty0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name     string
+		qemu     string
+		timeout  time.Duration
+		expected string
+	}{
+		{"pass", fakeQemu("pass", `Linux version 4.9\r\nFreeing unused kernel memory: 1024K\r\n`, "exec sleep 10"), 10 * time.Second, ""},
+		{"exit", fakeQemu("exit", `Linux version 4.9\r\nKernel panic - not syncing\r\n`, "exit 0"), 10 * time.Second,
+			"qemu exited before the console showed \"Freeing unused kernel memory\":\n  Linux version 4.9\n  Kernel panic - not syncing"},
+		{"timeout", fakeQemu("timeout", `Linux version 4.9\r\n`, "exec sleep 10"), 100 * time.Millisecond, "timed out after 100ms"},
+	}
+	for _, tc := range testCases {
+		s := newSmokeTest(defaultSmokeMarker, tc.timeout)
+		s.qemu = tc.qemu
+		start := time.Now()
+		err := s.run(o)
+		if time.Since(start) > 5*time.Second {
+			t.Errorf("Expected the %s smoke test to stop qemu", tc.name)
+		}
+		if tc.expected == "" && err != nil {
+			t.Errorf("Expected the %s smoke test to pass, got %v", tc.name, err)
+		}
+		if tc.expected != "" && (err == nil || !strings.Contains(err.Error(), tc.expected)) {
+			t.Errorf("Expected the %s smoke test to fail with %q, got %v", tc.name, tc.expected, err)
+		}
+		b, err := ioutil.ReadFile(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, arg := range []string{"-kernel " + base + "-kernel", "-initrd " + base + "-initrd.img", "-append console=tty0 console=" + s.console + " panic=-1"} {
+			if !strings.Contains(string(b), arg) {
+				t.Errorf("Expected qemu to be run with %s, got %s", arg, b)
+			}
+		}
+	}
+
+	if err := newSmokeTest(defaultSmokeMarker, time.Second).run(&outputOpts{}); err == nil || !strings.Contains(err.Error(), "kernel+initrd output, which was not built") {
+		t.Errorf("Expected the smoke test to need the kernel+initrd output, got %v", err)
+	}
+	s := newSmokeTest(defaultSmokeMarker, time.Second)
+	for _, lists := range [][2]outputList{
+		{{"tar"}, nil},
+		{nil, {"iso-bios"}},
+		{{"kernel+initrd", "tar"}, {"tar"}},
+	} {
+		if err := checkSmokeTest(s, lists[0], lists[1]); err == nil || !strings.Contains(err.Error(), "boots the kernel+initrd output") {
+			t.Errorf("Expected -output %v -only %v without kernel+initrd to be an error, got %v", lists[0], lists[1], err)
+		}
+	}
+	defer func(path string) { os.Setenv("PATH", path) }(os.Getenv("PATH"))
+	os.Setenv("PATH", dir)
+	if err := checkSmokeTest(s, outputList{"kernel+initrd"}, nil); err == nil || err.Error() != "-smoke-test requires "+s.qemu+", not found on PATH" {
+		t.Errorf("Expected a missing qemu to be an error, got %v", err)
+	}
+	s.qemu = testCases[0].qemu
+	if err := checkSmokeTest(s, nil, outputList{"kernel+initrd"}); err != nil {
+		t.Errorf("Unexpected error for a smoke test of kernel+initrd with qemu: %v", err)
+	}
+}
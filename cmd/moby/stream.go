@@ -0,0 +1,55 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// errStreamStopped stops the extraction of a tarball that failed to append
+var errStreamStopped = errors.New("the image stopped reading the tarball")
+
+// waitReader records the time spent waiting for reads
+type waitReader struct {
+	r      io.Reader
+	waited time.Duration
+}
+
+func (w *waitReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := w.r.Read(p)
+	w.waited += time.Since(start)
+	return n, err
+}
+
+// appendStream appends the tarball written by extract to the image while it
+// is written, through a pipe, so the tarball is never held in memory. It
+// returns the error extracting the tarball, and the error appending it. The
+// time waiting for the extraction is not part of the assembly of item.
+func appendStream(iw *tar.Writer, ao appendOpts, item string, extract func(w io.Writer) error) (extractErr, err error) {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := extract(pw)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	start := time.Now()
+	r := &waitReader{r: pr}
+	err = initrdAppend(iw, r, ao)
+	if err == nil {
+		// the end of the tarball is not read by its tar reader
+		_, err = io.Copy(ioutil.Discard, r)
+	}
+	ao.timings.add(phaseAssemble, item, time.Since(start)-r.waited)
+	pr.CloseWithError(errStreamStopped)
+
+	extractErr = <-done
+	if extractErr == errStreamStopped {
+		extractErr = nil
+	}
+	return extractErr, err
+}
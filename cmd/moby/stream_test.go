@@ -0,0 +1,111 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+// allocated returns the bytes allocated by f
+func allocated(f func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	f()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+func TestAppendStream(t *testing.T) {
+	const size = 8 * 1024 * 1024
+	defer func(source imageSource) { Images = source }(Images)
+	Images = &fakeImages{
+		exports: map[string][]byte{"example/large:v1": makeTar(t, []tarEntry{
+			{name: "bin", typeflag: tar.TypeDir},
+			{name: "bin/large", typeflag: tar.TypeReg, contents: strings.Repeat("x", size)},
+			{name: "etc/hosts", typeflag: tar.TypeReg, contents: "docker hosts"},
+		}).Bytes()},
+		inspects: map[string]types.ImageInspect{},
+	}
+	path := "containers/services/large"
+	config := []byte(`{"ociVersion":"1.0.0"}`)
+	ao := appendOpts{reproducible: true}
+
+	buffered := func(w io.Writer) error {
+		iw := tar.NewWriter(w)
+		out, err := ImageBundle(path, "example/large:v1", config, imageTrust{}, false, nil)
+		if err != nil {
+			return err
+		}
+		if err := initrdAppend(iw, bytes.NewBuffer(out), ao); err != nil {
+			return err
+		}
+		return iw.Close()
+	}
+	var files int
+	streamed := func(w io.Writer) error {
+		iw := tar.NewWriter(w)
+		extractErr, err := appendStream(iw, ao, "example/large:v1", func(w io.Writer) error {
+			var err error
+			files, err = ImageBundleTo(w, path, "example/large:v1", config, imageTrust{}, false, nil)
+			return err
+		})
+		if extractErr != nil {
+			return extractErr
+		}
+		if err != nil {
+			return err
+		}
+		return iw.Close()
+	}
+
+	want, got := new(bytes.Buffer), new(bytes.Buffer)
+	if err := buffered(want); err != nil {
+		t.Fatal(err)
+	}
+	if err := streamed(got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want.Bytes(), got.Bytes()) {
+		t.Fatal("Expected the streamed image to be the same as the buffered one")
+	}
+	if files != 2 {
+		t.Errorf("Expected 2 files in the root filesystem, got %d", files)
+	}
+
+	var err error
+	bufferedAlloc := allocated(func() { err = buffered(ioutil.Discard) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamedAlloc := allocated(func() { err = streamed(ioutil.Discard) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bufferedAlloc < size || streamedAlloc > size/4 {
+		t.Errorf("Expected streaming to allocate much less than the %d byte image, got %d streamed and %d buffered", size, streamedAlloc, bufferedAlloc)
+	}
+
+	// errors on either side of the pipe stop the other
+	iw := tar.NewWriter(ioutil.Discard)
+	extractErr, err := appendStream(iw, ao, "example/missing:v1", func(w io.Writer) error {
+		return ImageExtractTo(w, "example/missing:v1", "", imageTrust{}, false, nil)
+	})
+	if extractErr == nil || !strings.Contains(extractErr.Error(), "No such image") || err == nil {
+		t.Errorf("Expected an extraction error for a missing image, got %v %v", extractErr, err)
+	}
+	limited := ao
+	limited.files = &fileLimit{max: 1}
+	extractErr, err = appendStream(iw, limited, "example/large:v1", func(w io.Writer) error {
+		return ImageExtractTo(w, "example/large:v1", "", imageTrust{}, false, nil)
+	})
+	if extractErr != nil || err == nil {
+		t.Errorf("Expected an append error for too many files, got %v %v", extractErr, err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// buildSummary is what a build used and wrote, for CI to collect after it
+type buildSummary struct {
+	Name    string          `json:"name"`
+	Images  []summaryImage  `json:"images"`
+	Outputs []summaryOutput `json:"outputs"`
+	Archive *summaryFile    `json:"archive,omitempty"`
+	// KernelVersion is the version of the kernel modules, if known
+	KernelVersion string `json:"kernelVersion,omitempty"`
+	// Duration is the time the build took in seconds
+	Duration float64 `json:"duration"`
+	// Timings are those of this build alone, not the others of a batch
+	Timings timingsReport `json:"timings"`
+}
+
+type summaryImage struct {
+	Section string            `json:"section"`
+	Image   string            `json:"image"`
+	Digest  string            `json:"digest"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+type summaryOutput struct {
+	Type  string        `json:"type"`
+	Files []summaryFile `json:"files"`
+}
+
+type summaryFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Digest string `json:"digest"`
+}
+
+// newSummaryFile returns the size and digest of a file written by a build
+func newSummaryFile(filename string) (summaryFile, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return summaryFile{}, err
+	}
+	sum, err := sha256File(filename)
+	if err != nil {
+		return summaryFile{}, err
+	}
+	return summaryFile{Path: filename, Size: fi.Size(), Digest: "sha256:" + sum}, nil
+}
+
+// summary returns the summary of a build of the images of a config, with
+// the digests returned by resolve and their labels, and the files of the outputs in out
+// unless they were removed once in archive
+func summary(name string, m Moby, out outputList, o *outputOpts, archive string, archiveOnly bool, resolve func(string) (string, error), start time.Time) ([]byte, error) {
+	s := buildSummary{
+		Name:          name,
+		Images:        []summaryImage{},
+		Outputs:       []summaryOutput{},
+		KernelVersion: o.kernelVersion,
+		Duration:      time.Since(start).Seconds(),
+		Timings:       o.timings.report(),
+	}
+	labels, err := imageLabels(m, Images.inspect)
+	if err != nil {
+		return nil, err
+	}
+	for _, ci := range configImages(m) {
+		dgst, err := resolve(ci.image)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot resolve digest of %s: %v", ci.image, err)
+		}
+		si := summaryImage{Section: ci.section, Image: ci.image, Digest: dgst}
+		if len(labels[ci.image]) != 0 {
+			si.Labels = labels[ci.image]
+		}
+		s.Images = append(s.Images, si)
+	}
+	for _, output := range out {
+		so := summaryOutput{Type: output, Files: []summaryFile{}}
+		if !archiveOnly {
+			for _, file := range o.files[output] {
+				f, err := newSummaryFile(file)
+				if err != nil {
+					return nil, err
+				}
+				so.Files = append(so.Files, f)
+			}
+		}
+		s.Outputs = append(s.Outputs, so)
+	}
+	if archive != "" {
+		f, err := newSummaryFile(archive)
+		if err != nil {
+			return nil, err
+		}
+		s.Archive = &f
+	}
+	return json.MarshalIndent(s, "", "  ")
+}
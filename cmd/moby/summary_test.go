@@ -0,0 +1,129 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+func TestSummaryFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := filepath.Join(dir, "test.yml")
+	config := `
+kernel:
+  image: linuxkit/kernel:4.9.x
+  cmdline: console=ttyS0
+init:
+  - linuxkit/init:v1
+`
+	if err := ioutil.WriteFile(conf, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	images := &fakeImages{
+		exports: map[string][]byte{
+			"linuxkit/kernel:4.9.x": kernelImageTar(t).Bytes(),
+			"linuxkit/init:v1": makeTar(t, []tarEntry{
+				{name: "bin", typeflag: tar.TypeDir},
+				{name: "bin/init", typeflag: tar.TypeReg, contents: "init"},
+			}).Bytes(),
+		},
+		inspects: map[string]types.ImageInspect{
+			"linuxkit/kernel:4.9.x": {ID: "sha256:1111", Os: "linux", RepoDigests: []string{"linuxkit/kernel@sha256:aaaa"}, Config: &container.Config{Labels: map[string]string{"org.mobyproject.config": "{}"}}},
+			"linuxkit/init:v1":      {ID: "sha256:2222", Os: "linux"},
+		},
+	}
+	defer func(source imageSource) { Images = source }(Images)
+	Images = images
+	// the timings of other builds in the process are not in the summary
+	defer func(timings *buildTimings) { Timings = timings }(Timings)
+	Timings = newBuildTimings()
+	Timings.add(phasePull, "example/other:v1", time.Second)
+
+	file := filepath.Join(dir, "summary.json")
+	c := &buildCommand{
+		out:           outputList{"tar", "kernel+initrd"},
+		compressLevel: defaultCompressLevel,
+		summaryFile:   file,
+		opts:          buildOpts{reproducible: true},
+	}
+	if err := c.run(conf, dir); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Expected the summary to be written: %v", err)
+	}
+	var s buildSummary
+	if err := json.Unmarshal(b, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Name != "test" || s.Archive != nil || s.KernelVersion != "4.9.0" {
+		t.Errorf("Unexpected summary name %s, archive %v or kernel version %s", s.Name, s.Archive, s.KernelVersion)
+	}
+	expected := []summaryImage{
+		{Section: "kernel", Image: "linuxkit/kernel:4.9.x", Digest: "sha256:aaaa", Labels: map[string]string{"org.mobyproject.config": "{}"}},
+		{Section: "init", Image: "linuxkit/init:v1", Digest: "sha256:2222"},
+	}
+	if !reflect.DeepEqual(s.Images, expected) {
+		t.Errorf("Expected images %v, got %v", expected, s.Images)
+	}
+	files := map[string][]string{
+		"tar":           {"test.tar"},
+		"kernel+initrd": {"test-initrd.img", "test-kernel", "test-cmdline"},
+	}
+	if len(s.Outputs) != len(c.out) {
+		t.Fatalf("Expected outputs %v, got %v", c.out, s.Outputs)
+	}
+	for i, so := range s.Outputs {
+		if so.Type != c.out[i] || len(so.Files) != len(files[so.Type]) {
+			t.Errorf("Expected output %s with files %v, got %v", c.out[i], files[c.out[i]], so)
+			continue
+		}
+		for j, f := range so.Files {
+			want, err := newSummaryFile(filepath.Join(dir, files[so.Type][j]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f != want {
+				t.Errorf("Expected file %v in the summary, got %v", want, f)
+			}
+		}
+	}
+	for _, phase := range timingPhases {
+		if _, ok := s.Timings.Phases[phase]; !ok {
+			t.Errorf("Expected the %s phase in the summary timings, got %v", phase, s.Timings.Phases)
+		}
+	}
+	if _, ok := s.Timings.Items["example/other:v1"]; ok || s.Timings.Phases[phasePull] != 0 {
+		t.Errorf("Expected only the timings of the build in the summary, got %v", s.Timings)
+	}
+	if _, ok := Timings.report().Items["tar"]; !ok {
+		t.Errorf("Expected the timings of the build to be added to those of the process")
+	}
+
+	// a build with a failed output does not write a summary
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	c.out = outputList{"tar", "efi"}
+	c.keepGoing = true
+	if err := c.run(conf, dir); err == nil {
+		t.Fatal("Expected the efi output to fail without an EFI stub")
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("Expected no summary for a failed build, got %v", err)
+	}
+}
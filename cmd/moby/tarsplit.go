@@ -0,0 +1,135 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// tarSplitChunkSize is the largest chunk, larger file contents are split into several
+const tarSplitChunkSize = 1024 * 1024
+
+// tarSplitIndex maps the entries of a tarball to content addressed chunks,
+// concatenating the chunks in order reproduces the tarball
+type tarSplitIndex struct {
+	Size   int64           `json:"size"`
+	Digest string          `json:"digest"`
+	Chunks []tarSplitChunk `json:"chunks"`
+}
+
+// tarSplitChunk is a range of a tarball stored as a blob named by its digest
+type tarSplitChunk struct {
+	Digest string `json:"digest"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	// Entry is the name of the tar entry the chunk is part of, empty for the end of archive
+	Entry string `json:"entry,omitempty"`
+	// Part is header, content or trailer
+	Part string `json:"part"`
+}
+
+// countingReader counts the bytes read, so the offsets of tar entries are known
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// tarSplit splits a tarball into chunks at entry boundaries, with the header
+// and contents of each entry in separate chunks so identical files share
+// chunks between builds, returning the index and the chunks by digest
+func tarSplit(image []byte) (tarSplitIndex, map[string][]byte, error) {
+	index := tarSplitIndex{
+		Size:   int64(len(image)),
+		Digest: fmt.Sprintf("sha256:%x", sha256.Sum256(image)),
+		Chunks: []tarSplitChunk{},
+	}
+	blobs := map[string][]byte{}
+	add := func(start, end int64, entry, part string) {
+		for start < end {
+			size := end - start
+			if size > tarSplitChunkSize {
+				size = tarSplitChunkSize
+			}
+			chunk := image[start : start+size]
+			digest := fmt.Sprintf("sha256:%x", sha256.Sum256(chunk))
+			blobs[digest] = chunk
+			index.Chunks = append(index.Chunks, tarSplitChunk{Digest: digest, Offset: start, Size: size, Entry: entry, Part: part})
+			start += size
+		}
+	}
+
+	cr := &countingReader{r: bytes.NewReader(image)}
+	tr := tar.NewReader(cr)
+	var pos int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return index, nil, err
+		}
+		// the header, including any extended headers and the padding of the
+		// previous entry, ends where the contents start
+		add(pos, cr.n, hdr.Name, "header")
+		pos = cr.n
+		if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+			return index, nil, err
+		}
+		add(pos, cr.n, hdr.Name, "content")
+		pos = cr.n
+	}
+	add(pos, int64(len(image)), "", "trailer")
+	return index, blobs, nil
+}
+
+// outputTarSplit writes the chunks of the image to base-split/blobs and the index to base-split/index.json
+func outputTarSplit(base string, image []byte, o *outputOpts) error {
+	log.Debugf("output tar-split: %s", base)
+	dir := base + "-split"
+	log.Infof("  %s", dir)
+	index, blobs, err := tarSplit(image)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Join(dir, "blobs"), 0755)
+	if err != nil {
+		return err
+	}
+	for _, c := range index.Chunks {
+		blob, ok := blobs[c.Digest]
+		if !ok {
+			// already written
+			continue
+		}
+		err = o.writeFile(filepath.Join(dir, "blobs", tarSplitBlobName(c.Digest)), blob)
+		if err != nil {
+			return err
+		}
+		delete(blobs, c.Digest)
+	}
+	b, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return o.writeFile(filepath.Join(dir, "index.json"), b)
+}
+
+// tarSplitBlobName is the file name of a blob, the digest without the algorithm
+func tarSplitBlobName(digest string) string {
+	return digest[len("sha256:"):]
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOutputTarSplit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	shared := strings.Repeat("shared contents\n", 100)
+	large := strings.Repeat("x", tarSplitChunkSize*2+100)
+	image := makeTar(t, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/a", typeflag: tar.TypeReg, contents: shared},
+		{name: "etc/b", typeflag: tar.TypeReg, contents: shared},
+		{name: "etc/large", typeflag: tar.TypeReg, contents: large},
+		{name: "etc/empty", typeflag: tar.TypeReg},
+	}).Bytes()
+
+	base := filepath.Join(dir, "test")
+	if err := outputs(base, image, outputList{"tar-split"}, &outputOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(base+"-split", "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index tarSplitIndex
+	if err := json.Unmarshal(b, &index); err != nil {
+		t.Fatalf("Invalid index: %v", err)
+	}
+
+	// reassembling the chunks in order reproduces the tarball
+	out := new(bytes.Buffer)
+	contentChunks := map[string][]string{}
+	for _, c := range index.Chunks {
+		if int64(out.Len()) != c.Offset {
+			t.Fatalf("Expected chunk at offset %d, got %d", out.Len(), c.Offset)
+		}
+		blob, err := ioutil.ReadFile(filepath.Join(base+"-split", "blobs", tarSplitBlobName(c.Digest)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(blob)) != c.Size {
+			t.Fatalf("Expected blob %s of size %d, got %d", c.Digest, c.Size, len(blob))
+		}
+		out.Write(blob)
+		if c.Part == "content" {
+			contentChunks[c.Entry] = append(contentChunks[c.Entry], c.Digest)
+		}
+	}
+	if !bytes.Equal(out.Bytes(), image) {
+		t.Fatal("Expected reassembled chunks to reproduce the tarball")
+	}
+	if int64(len(image)) != index.Size {
+		t.Errorf("Expected index size %d, got %d", len(image), index.Size)
+	}
+
+	// identical contents share a chunk and large contents are split
+	if len(contentChunks["etc/a"]) != 1 || contentChunks["etc/a"][0] != contentChunks["etc/b"][0] {
+		t.Errorf("Expected identical contents to share a chunk, got %v and %v", contentChunks["etc/a"], contentChunks["etc/b"])
+	}
+	if len(contentChunks["etc/large"]) != 3 {
+		t.Errorf("Expected large contents to be split into 3 chunks, got %d", len(contentChunks["etc/large"]))
+	}
+	blobs, err := ioutil.ReadDir(filepath.Join(base+"-split", "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) >= len(index.Chunks) {
+		t.Errorf("Expected fewer blobs than chunks, got %d blobs for %d chunks", len(blobs), len(index.Chunks))
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// timingsText writes the timings as a summary for people to read
+	timingsText = "text"
+	// timingsJSON writes the timings as a JSON object
+	timingsJSON = "json"
+
+	phasePull     = "pull"
+	phaseExtract  = "extract"
+	phaseAssemble = "assemble"
+	phaseOutput   = "output"
+)
+
+var timingsModes = []string{timingsText, timingsJSON}
+
+// timingPhases are the phases of a build in the order they happen
+var timingPhases = []string{phasePull, phaseExtract, phaseAssemble, phaseOutput}
+
+func validTimingsMode(mode string) error {
+	if mode == "" {
+		return nil
+	}
+	for _, m := range timingsModes {
+		if mode == m {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown timings format %s, must be one of: %s", mode, strings.Join(timingsModes, ", "))
+}
+
+// buildTimings records the time spent in each phase of a build, in total
+// and by image or output type. Each build has its own timings, which are
+// also added to those of its parent, so parallel batch builds add to the
+// same totals.
+type buildTimings struct {
+	sync.Mutex
+	parent *buildTimings
+	phases map[string]time.Duration
+	// items breaks the phases down by image or output type
+	items map[string]map[string]time.Duration
+}
+
+// Timings is where all phases of the builds in this process are timed
+var Timings = newBuildTimings()
+
+func newBuildTimings() *buildTimings {
+	return &buildTimings{phases: map[string]time.Duration{}, items: map[string]map[string]time.Duration{}}
+}
+
+// child returns the timings of one build, which are also added to t
+func (t *buildTimings) child() *buildTimings {
+	c := newBuildTimings()
+	c.parent = t
+	return c
+}
+
+// since adds the time since start to a phase and item, returning it
+func (t *buildTimings) since(phase, item string, start time.Time) time.Duration {
+	d := time.Since(start)
+	t.add(phase, item, d)
+	return d
+}
+
+// add adds to the time of a phase, and of item if it is not empty, nil
+// timings add to Timings
+func (t *buildTimings) add(phase, item string, d time.Duration) {
+	if t == nil {
+		t = Timings
+	}
+	t.Lock()
+	t.phases[phase] += d
+	if item != "" {
+		if t.items[item] == nil {
+			t.items[item] = map[string]time.Duration{}
+		}
+		t.items[item][phase] += d
+	}
+	t.Unlock()
+	if t.parent != nil {
+		t.parent.add(phase, item, d)
+	}
+}
+
+// timingsReport is the JSON form of the timings, in seconds
+type timingsReport struct {
+	Phases map[string]float64            `json:"phases"`
+	Items  map[string]map[string]float64 `json:"items"`
+}
+
+func (t *buildTimings) report() timingsReport {
+	t.Lock()
+	defer t.Unlock()
+	r := timingsReport{Phases: map[string]float64{}, Items: map[string]map[string]float64{}}
+	// every phase is reported, even if nothing was done in it
+	for _, p := range timingPhases {
+		r.Phases[p] = t.phases[p].Seconds()
+	}
+	for item, phases := range t.items {
+		r.Items[item] = map[string]float64{}
+		for p, d := range phases {
+			r.Items[item][p] = d.Seconds()
+		}
+	}
+	return r
+}
+
+// write writes the timings to w in the given format
+func (t *buildTimings) write(w io.Writer, mode string) error {
+	r := t.report()
+	if mode == timingsJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+	phases := func(m map[string]float64) string {
+		s := []string{}
+		for _, p := range timingPhases {
+			if d, ok := m[p]; ok {
+				s = append(s, fmt.Sprintf("%s %.1fs", p, d))
+			}
+		}
+		return strings.Join(s, ", ")
+	}
+	items := []string{}
+	for item := range r.Items {
+		items = append(items, item)
+	}
+	sort.Strings(items)
+	fmt.Fprintf(w, "Timings: %s\n", phases(r.Phases))
+	for _, item := range items {
+		fmt.Fprintf(w, "  %s: %s\n", item, phases(r.Items[item]))
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimings(t *testing.T) {
+	saved := Timings
+	Timings = newBuildTimings()
+	defer func() { Timings = saved }()
+
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := filepath.Join(dir, "test.yml")
+	if err := ioutil.WriteFile(conf, []byte("files:\n  - path: etc/motd\n    contents: hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &buildCommand{out: outputList{"tar", "kernel+initrd"}}
+	if err := c.run(conf, dir); err != nil {
+		t.Fatal(err)
+	}
+	// pulling and extracting an image need docker, so record one directly
+	Timings.add(phasePull, "nginx:alpine", 2*time.Second)
+	Timings.since(phaseExtract, "nginx:alpine", time.Now())
+
+	buf := new(bytes.Buffer)
+	if err := Timings.write(buf, timingsJSON); err != nil {
+		t.Fatal(err)
+	}
+	var r timingsReport
+	if err := json.Unmarshal(buf.Bytes(), &r); err != nil {
+		t.Fatalf("Timings are not valid JSON: %v\n%s", err, buf.String())
+	}
+	for _, p := range timingPhases {
+		d, ok := r.Phases[p]
+		if !ok {
+			t.Errorf("Expected phase %s in the timings", p)
+		}
+		if d < 0 {
+			t.Errorf("Expected phase %s to have a non-negative duration, got %v", p, d)
+		}
+	}
+	if r.Phases[phasePull] < 2 {
+		t.Errorf("Expected the pull phase to include the pull of nginx:alpine, got %v", r.Phases[phasePull])
+	}
+	items := map[string][]string{
+		"tar":           {phaseOutput},
+		"kernel+initrd": {phaseOutput},
+		"nginx:alpine":  {phasePull, phaseExtract},
+	}
+	for item, phases := range items {
+		for _, p := range phases {
+			if d, ok := r.Items[item][p]; !ok || d < 0 {
+				t.Errorf("Expected %s to have a non-negative %s duration, got %v", item, p, r.Items[item])
+			}
+		}
+	}
+
+	buf.Reset()
+	if err := Timings.write(buf, timingsText); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "Timings: pull 2.0s, extract 0.0s, assemble ") || !strings.Contains(buf.String(), "\n  nginx:alpine: pull 2.0s, extract 0.0s\n") {
+		t.Errorf("Unexpected text timings:\n%s", buf.String())
+	}
+
+	if err := validTimingsMode("yaml"); err == nil {
+		t.Error("Expected unknown timings format to be rejected")
+	}
+}
@@ -14,19 +14,275 @@ import (
 	"strings"
 	"time"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/docker/distribution/reference"
 	"github.com/docker/distribution/registry/client/auth"
 	"github.com/docker/distribution/registry/client/auth/challenge"
 	"github.com/docker/distribution/registry/client/transport"
 	"github.com/docker/docker/cli/trust"
 	notaryClient "github.com/docker/notary/client"
+	"github.com/docker/notary/storage"
 	"github.com/docker/notary/trustpinning"
 	"github.com/docker/notary/tuf/data"
+	"github.com/docker/notary/tuf/signed"
+	"github.com/docker/notary/tuf/validation"
 	"github.com/opencontainers/go-digest"
 )
 
-// TrustedReference parses an image string, and does a notary lookup to verify and retrieve the signed digest reference
-func TrustedReference(image string) (reference.Reference, error) {
+// TrustSoftFail allows pulling an image without verification if its content trust
+// metadata cannot be fetched, a failure to verify the metadata is always an error
+var TrustSoftFail bool
+
+// RegistryCAs are PEM files of extra CA certificates to trust when talking
+// to registry and notary servers directly
+var RegistryCAs []string
+
+// TrustRootKeys are the root key IDs pinned for each repository, a root
+// signed by a pinned key is trusted even if it replaces the cached root
+var TrustRootKeys map[string][]string
+
+// InsecureRegistries are the hosts, each with an optional port, whose TLS
+// certificates are not verified and which may be reached over plain HTTP
+var InsecureRegistries []string
+
+// validInsecureRegistry checks an insecure registry is a host with an optional port
+func validInsecureRegistry(host string) error {
+	u, err := url.Parse("//" + host)
+	if err != nil || host == "" || u.Host != host || u.Hostname() == "" {
+		return fmt.Errorf("Invalid insecure registry %s: must be host[:port]", host)
+	}
+	return nil
+}
+
+// warnInsecureRegistries warns about each registry whose connections are not verified
+func warnInsecureRegistries() {
+	for _, host := range InsecureRegistries {
+		log.Warnf("WARNING: connections to %s are NOT VERIFIED and may use plain HTTP, only use -insecure-registry for development registries", host)
+	}
+}
+
+// insecureRegistry reports whether host, with its port if any, is an insecure
+// registry. An insecure registry without a port matches any port.
+func insecureRegistry(host string) bool {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	for _, r := range InsecureRegistries {
+		if r == host || r == hostname {
+			return true
+		}
+	}
+	return false
+}
+
+// registryTransport only allows connections without TLS verification, or
+// without TLS, to the insecure registries
+type registryTransport struct {
+	secure   http.RoundTripper
+	insecure http.RoundTripper
+}
+
+func (t *registryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if insecureRegistry(req.URL.Host) {
+		return t.insecure.RoundTrip(req)
+	}
+	if req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("Refusing to connect to %s without TLS, use -insecure-registry to allow it", req.URL.Host)
+	}
+	return t.secure.RoundTrip(req)
+}
+
+// isTrustUnavailable reports whether a content trust error means the trust
+// metadata could not be fetched from the server, rather than failing verification
+func isTrustUnavailable(err error) bool {
+	switch err.(type) {
+	case storage.ErrServerUnavailable, storage.ErrOffline, storage.NetworkError, *url.Error:
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// isTrustRootRotation reports whether a content trust error means the root
+// key of the repository is not the one trusted when it was first pulled
+func isTrustRootRotation(err error) bool {
+	switch err.(type) {
+	case trustpinning.ErrRootRotationFail, *trustpinning.ErrRootRotationFail:
+		return true
+	}
+	return false
+}
+
+// isTrustMismatch reports whether a content trust error means the trust
+// metadata or the image failed verification against the trusted keys
+func isTrustMismatch(err error) bool {
+	switch err.(type) {
+	case trustpinning.ErrValidationFail, *trustpinning.ErrValidationFail,
+		validation.ErrValidation, signed.ErrRoleThreshold, signed.ErrInsufficientSignatures,
+		data.ErrMismatchedChecksum:
+		return true
+	}
+	return false
+}
+
+// trustError explains a content trust failure for an image, a changed root
+// key needs the new root to be checked and pinned, a failed verification
+// means the image should not be used
+func trustError(image string, err error) error {
+	if isTrustRootRotation(err) {
+		gun := image
+		if named, perr := reference.ParseNormalizedNamed(image); perr == nil {
+			gun = named.Name()
+		}
+		return fmt.Errorf("The content trust root key of %s changed since it was first trusted, this is expected when the publisher rotates its root key: "+
+			"check the new root key ID with the publisher, then pin it with -trust-root-key %s=<key ID>, "+
+			"or remove %s to trust the new root on first use: %v", gun, gun, filepath.Join(trustDirectory(), "tuf", filepath.FromSlash(gun)), err)
+	}
+	if isTrustMismatch(err) {
+		return fmt.Errorf("Content trust verification of %s failed, the image or its trust data may have been tampered with and must not be used: %v", image, err)
+	}
+	return err
+}
+
+// parseTrustRootKeys parses image=keyid root keys to pin, the image is any
+// reference to the repository
+func parseTrustRootKeys(keys []string) (map[string][]string, error) {
+	parsed := map[string][]string{}
+	for _, k := range keys {
+		parts := strings.SplitN(k, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid trust root key %s, expected image=keyid", k)
+		}
+		named, err := reference.ParseNormalizedNamed(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trust root key %s: %v", k, err)
+		}
+		if _, err := hex.DecodeString(parts[1]); err != nil || len(parts[1]) != 64 {
+			return nil, fmt.Errorf("Invalid trust root key %s, the key ID must be 64 hex characters", k)
+		}
+		gun := named.Name()
+		parsed[gun] = append(parsed[gun], strings.ToLower(parts[1]))
+	}
+	return parsed, nil
+}
+
+// validTrustConfig checks the default org and registry policies of a trust config
+func validTrustConfig(config TrustConfig) error {
+	if config.DefaultOrg != "" && strings.ContainsAny(config.DefaultOrg, "/:@ \t\n") {
+		return fmt.Errorf("Invalid trust defaultOrg %q: must be an org name such as library", config.DefaultOrg)
+	}
+	seen := map[string]bool{}
+	for _, r := range config.Registries {
+		u, err := url.Parse("//" + r.Registry)
+		if err != nil || r.Registry == "" || u.Host != r.Registry || u.Hostname() == "" {
+			return fmt.Errorf("Invalid trust registry %q: must be host[:port]", r.Registry)
+		}
+		if seen[r.Registry] {
+			return fmt.Errorf("Invalid trust config: registry %s has more than one policy", r.Registry)
+		}
+		seen[r.Registry] = true
+		for _, k := range r.RootKeys {
+			if _, err := hex.DecodeString(k); err != nil || len(k) != 64 {
+				return fmt.Errorf("Invalid root key %s for trust registry %s, the key ID must be 64 hex characters", k, r.Registry)
+			}
+		}
+		if r.Server != "" {
+			s, err := url.Parse(r.Server)
+			if err != nil || (s.Scheme != "https" && s.Scheme != "http") || s.Host == "" {
+				return fmt.Errorf("Invalid notary server %q for trust registry %s: must be an https:// URL", r.Server, r.Registry)
+			}
+		} else if r.Registry != hubRegistry && (r.Enforce || len(r.Image) != 0 || len(r.Org) != 0) {
+			return fmt.Errorf("Invalid trust registry %s: images outside Docker Hub can only be verified with the server of their notary", r.Registry)
+		}
+	}
+	return nil
+}
+
+// defaultTrustOrg is the org of single names like nginx on Docker Hub
+const defaultTrustOrg = "library"
+
+// defaultOrg returns the org of single names like nginx, for mirrors of
+// Docker Hub with a different default namespace
+func (config *TrustConfig) defaultOrg() string {
+	if config.DefaultOrg != "" {
+		return config.DefaultOrg
+	}
+	return defaultTrustOrg
+}
+
+// registryPolicy returns the policy of the registry of an image, nil if it
+// has none
+func (config *TrustConfig) registryPolicy(image string) *RegistryTrust {
+	if len(config.Registries) == 0 {
+		return nil
+	}
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil
+	}
+	domain := reference.Domain(named)
+	for i := range config.Registries {
+		if config.Registries[i].Registry == domain {
+			return &config.Registries[i]
+		}
+	}
+	return nil
+}
+
+// imageTrust is how an image is pulled, verified with content trust if
+// verify is set, trusting the root keys pinned for its registry by a config
+// and looked up on the notary server of the registry if it is not Docker Hub
+type imageTrust struct {
+	verify   bool
+	rootKeys []string
+	server   string
+}
+
+// contentTrust returns how an image of a config is pulled, with the root keys
+// of its registry policy, so each config pulls with its own pins
+func contentTrust(fullImageName string, config *TrustConfig) imageTrust {
+	trust := imageTrust{verify: enforceContentTrust(fullImageName, config)}
+	if policy := config.registryPolicy(fullImageName); policy != nil && trust.verify {
+		trust.server = policy.Server
+		for _, k := range policy.RootKeys {
+			trust.rootKeys = append(trust.rootKeys, strings.ToLower(k))
+		}
+	}
+	return trust
+}
+
+// trustPins returns the root keys pinned for each repository, with the
+// registry root keys given for a repository that has none pinned by
+// -trust-root-key
+func trustPins(gun string, registryKeys []string) map[string][]string {
+	pins := map[string][]string{}
+	for k, v := range TrustRootKeys {
+		pins[k] = v
+	}
+	if _, ok := pins[gun]; !ok && len(registryKeys) != 0 {
+		pins[gun] = registryKeys
+	}
+	return pins
+}
+
+// resolveTrusted looks up the verified reference for an image, returning the
+// reference to pull and whether it was verified
+func resolveTrusted(image string, softFail bool, lookup func(string) (reference.Reference, error)) (string, bool, error) {
+	trustedImg, err := lookup(image)
+	if err == nil {
+		return trustedImg.String(), true, nil
+	}
+	if softFail && isTrustUnavailable(err) {
+		log.Warnf("WARNING: content trust data for %s is unavailable, pulling WITHOUT verification: %v", image, err)
+		return image, false, nil
+	}
+	return "", false, trustError(image, err)
+}
+
+// TrustedReference parses an image string, and does a notary lookup to verify and retrieve the signed digest reference,
+// on the notary server given for its registry, or Docker Hub if it is empty, trusting the root keys pinned for its registry
+func TrustedReference(image, server string, registryKeys []string) (reference.Reference, error) {
 	ref, err := reference.ParseAnyReference(image)
 	if err != nil {
 		return nil, err
@@ -52,7 +308,7 @@ func TrustedReference(image string) (reference.Reference, error) {
 
 	gun := taggedRef.Name()
 	targetName := taggedRef.Tag()
-	server, err := getTrustServer(gun)
+	server, err = getTrustServer(gun, server)
 	if err != nil {
 		return nil, err
 	}
@@ -62,18 +318,34 @@ func TrustedReference(image string) (reference.Reference, error) {
 		return nil, err
 	}
 
-	nRepo, err := notaryClient.NewNotaryRepository(
-		trustDirectory(),
-		gun,
-		server,
-		rt,
-		nil,
-		trustpinning.TrustPinConfig{},
-	)
+	pins := trustPins(gun, registryKeys)
+	repo := func() (*notaryClient.NotaryRepository, error) {
+		return notaryClient.NewNotaryRepository(
+			trustDirectory(),
+			gun,
+			server,
+			rt,
+			nil,
+			trustpinning.TrustPinConfig{Certs: pins},
+		)
+	}
+	nRepo, err := repo()
 	if err != nil {
 		return nil, err
 	}
 	target, err := nRepo.GetTargetByName(targetName, trust.ReleasesRole, data.CanonicalTargetsRole)
+	if isTrustRootRotation(err) && len(pins[gun]) != 0 {
+		// the cached root is checked before the pins, so it is replaced by
+		// a root that is only trusted if it is signed by a pinned key
+		log.Infof("Root key of %s changed, trusting the new root only if it matches the pinned root keys", gun)
+		if err := nRepo.DeleteTrustData(false); err != nil {
+			return nil, err
+		}
+		if nRepo, err = repo(); err != nil {
+			return nil, err
+		}
+		target, err = nRepo.GetTargetByName(targetName, trust.ReleasesRole, data.CanonicalTargetsRole)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -94,11 +366,20 @@ func TrustedReference(image string) (reference.Reference, error) {
 	return reference.WithDigest(taggedRef, dgst)
 }
 
-func getTrustServer(gun string) (string, error) {
-	if strings.HasPrefix(gun, "docker.io/") {
+// hubRegistry is the registry of images without one, whose notary server is
+// used unless a trust registry policy gives another
+const hubRegistry = "docker.io"
+
+// getTrustServer returns the notary server of a repository, the server of
+// its registry policy if there is one
+func getTrustServer(gun, server string) (string, error) {
+	if server != "" {
+		return server, nil
+	}
+	if strings.HasPrefix(gun, hubRegistry+"/") {
 		return "https://notary.docker.io", nil
 	}
-	return "", errors.New("non-hub images not yet supported")
+	return "", fmt.Errorf("no notary server for %s, give the server in a trust registries policy of its registry", gun)
 }
 
 func trustDirectory() string {
@@ -128,7 +409,7 @@ func (tcs *credentialStore) SetRefreshToken(u *url.URL, service string, token st
 
 // GetReadOnlyAuthTransport gets the Auth Transport used to communicate with notary
 func GetReadOnlyAuthTransport(server string, scopes []string, username, password, rootCAPath string) (http.RoundTripper, error) {
-	httpsTransport, err := httpsTransport(rootCAPath)
+	httpsTransport, err := registryRoundTripper(rootCAPath)
 	if err != nil {
 		return nil, err
 	}
@@ -175,6 +456,21 @@ func GetReadOnlyAuthTransport(server string, scopes []string, username, password
 	return authedTransport, nil
 }
 
+// registryRoundTripper verifies TLS connections with the CAs apart from those
+// to the insecure registries, and handles the rate limits of the registries
+func registryRoundTripper(caFile string) (http.RoundTripper, error) {
+	secure, err := httpsTransport(caFile)
+	if err != nil {
+		return nil, err
+	}
+	insecure, err := httpsTransport(caFile)
+	if err != nil {
+		return nil, err
+	}
+	insecure.TLSClientConfig.InsecureSkipVerify = true
+	return &rateLimitTransport{next: &registryTransport{secure: secure, insecure: insecure}}, nil
+}
+
 func httpsTransport(caFile string) (*http.Transport, error) {
 	tlsConfig := &tls.Config{}
 	transport := http.Transport{
@@ -202,5 +498,15 @@ func httpsTransport(caFile string) (*http.Transport, error) {
 		certPool.AppendCertsFromPEM(pems)
 		transport.TLSClientConfig.RootCAs = certPool
 	}
+	// the registry CAs are in addition to the others, verification is never disabled
+	for _, ca := range RegistryCAs {
+		pems, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read registry CA: %v", err)
+		}
+		if !transport.TLSClientConfig.RootCAs.AppendCertsFromPEM(pems) {
+			return nil, fmt.Errorf("Registry CA %s contains no PEM certificates", ca)
+		}
+	}
 	return &transport, nil
 }
@@ -1,6 +1,27 @@
 package main
 
-import "testing"
+import (
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	stdlog "log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/notary/storage"
+	"github.com/docker/notary/trustpinning"
+	"github.com/docker/notary/tuf/data"
+	"github.com/docker/notary/tuf/signed"
+	"github.com/docker/notary/tuf/validation"
+)
 
 func TestEnforceContentTrust(t *testing.T) {
 	type enforceContentTrustCase struct {
@@ -49,6 +70,13 @@ func TestEnforceContentTrust(t *testing.T) {
 		{true, "nginx:alpine", &TrustConfig{Image: []string{}, Org: []string{"library"}}},
 		{true, "library/nginx:alpine", &TrustConfig{Image: []string{}, Org: []string{"library"}}},
 		{false, "nginx", &TrustConfig{Image: []string{}, Org: []string{"notLibrary"}}},
+
+		// Tests for Org with a custom default organization
+		{true, "nginx", &TrustConfig{Org: []string{"mirror"}, DefaultOrg: "mirror"}},
+		{true, "nginx:alpine", &TrustConfig{Org: []string{"mirror"}, DefaultOrg: "mirror"}},
+		{false, "nginx", &TrustConfig{Org: []string{"library"}, DefaultOrg: "mirror"}},
+		{true, "library/nginx:alpine", &TrustConfig{Org: []string{"library"}, DefaultOrg: "mirror"}},
+		{false, "linuxkit/image", &TrustConfig{Org: []string{"mirror"}, DefaultOrg: "mirror"}},
 	}
 	for _, testCase := range testCases {
 		if enforceContentTrust(testCase.imageName, testCase.trustConfig) != testCase.result {
@@ -56,3 +84,410 @@ func TestEnforceContentTrust(t *testing.T) {
 		}
 	}
 }
+
+func TestTrustDefaultOrg(t *testing.T) {
+	m, err := NewConfig([]byte("trust:\n  org:\n    - mirror\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Trust.defaultOrg() != "library" || enforceContentTrust("nginx", &m.Trust) {
+		t.Errorf("Expected single names to be in the library org by default, got %s", m.Trust.defaultOrg())
+	}
+	m, err = NewConfig([]byte("trust:\n  defaultOrg: mirror\n  org:\n    - mirror\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !enforceContentTrust("nginx:alpine", &m.Trust) || enforceContentTrust("library/nginx", &m.Trust) {
+		t.Errorf("Expected single names to be in the mirror org with defaultOrg set")
+	}
+	for _, org := range []string{"a/b", "mirror:5000", "my org"} {
+		if _, err := NewConfig([]byte("trust:\n  defaultOrg: " + org + "\n")); err == nil || !strings.Contains(err.Error(), "Invalid trust defaultOrg") {
+			t.Errorf("Expected defaultOrg %q to be invalid, got %v", org, err)
+		}
+	}
+}
+
+func TestRegistryTrust(t *testing.T) {
+	key := strings.Repeat("ab", 32)
+	m, err := NewConfig([]byte(`
+trust:
+  org:
+    - linuxkit
+  registries:
+    - registry: registry.example.com
+      enforce: true
+      server: https://notary.example.com
+      rootKeys:
+        - ` + strings.ToUpper(key) + `
+    - registry: mirror.example.com
+    - registry: localhost:5000
+      server: https://localhost:4443
+      image:
+        - localhost:5000/team/signed
+      org:
+        - platform
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for image, expected := range map[string]bool{
+		// images without a registry policy use the image and org lists
+		"linuxkit/init:v1":                                               true,
+		"docker.io/linuxkit/init:v1":                                     true,
+		"nginx:alpine":                                                   false,
+		"quay.io/linuxkit/init:v1":                                       true,
+		"registry.example.com/app:v1":                                    true,
+		"registry.example.com/a/b:v1":                                    true,
+		"mirror.example.com/linuxkit/init:v1":                            false,
+		"localhost:5000/team/signed:v1":                                  true,
+		"localhost:5000/team/other:v1":                                   false,
+		"localhost:5000/platform/base@sha256:" + strings.Repeat("a", 64): true,
+	} {
+		if enforceContentTrust(image, &m.Trust) != expected {
+			t.Errorf("Expected trust enforcement for %s to be %v", image, expected)
+		}
+	}
+
+	defer func(keys map[string][]string) { TrustRootKeys = keys }(TrustRootKeys)
+	other := strings.Repeat("cd", 32)
+	TrustRootKeys = map[string][]string{"registry.example.com/pinned": {other}}
+	for gun, expected := range map[string][]string{
+		"registry.example.com/app":    {key},
+		"registry.example.com/pinned": {other},
+		"mirror.example.com/app":      nil,
+	} {
+		trust := contentTrust(gun+":v1", &m.Trust)
+		if pins := trustPins(gun, trust.rootKeys)[gun]; !reflect.DeepEqual(pins, expected) {
+			t.Errorf("Expected the root keys of %s to be %v, got %v", gun, expected, pins)
+		}
+	}
+
+	// each config pulls with its own pins, as configs are built together
+	// with -batch-jobs
+	n, err := NewConfig([]byte("trust:\n  registries:\n    - registry: registry.example.com\n      enforce: true\n      server: https://notary.example.com\n      rootKeys:\n        - " + other + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := "registry.example.com/app:v1"
+	if a, b := contentTrust(image, &m.Trust), contentTrust(image, &n.Trust); !a.verify || !b.verify || !reflect.DeepEqual(a.rootKeys, []string{key}) || !reflect.DeepEqual(b.rootKeys, []string{other}) {
+		t.Errorf("Expected each config to pin its own root keys for %s, got %v and %v", image, a, b)
+	}
+	if trust := contentTrust("nginx:alpine", &m.Trust); trust.verify || len(trust.rootKeys) != 0 {
+		t.Errorf("Expected nginx:alpine to be pulled without trust, got %v", trust)
+	}
+
+	for config, expected := range map[string]string{
+		"trust:\n  registries:\n    - enforce: true\n":                                     "Invalid trust registry",
+		"trust:\n  registries:\n    - registry: https://registry.example.com\n":            "must be host[:port]",
+		"trust:\n  registries:\n    - registry: r.io\n    - registry: r.io\n":              "more than one policy",
+		"trust:\n  registries:\n    - registry: r.io\n      rootKeys:\n        - abc\n":    "64 hex characters",
+		"trust:\n  registries:\n    - registry: r.io\n      images:\n        - r.io/app\n": "invalid configuration file",
+		"trust:\n  registries:\n    - registry: r.io\n      enforce: true\n":               "can only be verified with the server of their notary",
+		"trust:\n  registries:\n    - registry: r.io\n      org:\n        - team\n":        "can only be verified with the server of their notary",
+		"trust:\n  registries:\n    - registry: r.io\n      server: notary.r.io\n":         "must be an https:// URL",
+	} {
+		if _, err := NewConfig([]byte(config)); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %q for %q, got %v", expected, config, err)
+		}
+	}
+}
+
+func TestResolveTrusted(t *testing.T) {
+	trusted, err := reference.ParseAnyReference("docker.io/library/nginx:alpine@sha256:" + strings.Repeat("a", 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unavailable := []error{
+		storage.ErrServerUnavailable{},
+		storage.ErrOffline{},
+		storage.NetworkError{Wrapped: errors.New("connection reset")},
+		&url.Error{Op: "Get", URL: "https://notary.docker.io/v2/", Err: errors.New("no route to host")},
+	}
+	mismatch := []error{
+		validation.ErrValidation{Msg: "bad signature"},
+		signed.ErrRoleThreshold{},
+		data.ErrMismatchedChecksum{},
+		errors.New("not signed in valid role"),
+	}
+	lookup := func(lookupErr error) func(string) (reference.Reference, error) {
+		return func(string) (reference.Reference, error) {
+			if lookupErr != nil {
+				return nil, lookupErr
+			}
+			return trusted, nil
+		}
+	}
+
+	for _, softFail := range []bool{false, true} {
+		ref, verified, err := resolveTrusted("nginx:alpine", softFail, lookup(nil))
+		if err != nil || !verified || ref != trusted.String() {
+			t.Errorf("Expected verified reference %s, got %s %v %v", trusted, ref, verified, err)
+		}
+	}
+
+	for _, lookupErr := range unavailable {
+		if !isTrustUnavailable(lookupErr) {
+			t.Errorf("Expected %T to be classed as trust data unavailable", lookupErr)
+		}
+		if _, _, err := resolveTrusted("nginx:alpine", false, lookup(lookupErr)); err == nil {
+			t.Errorf("Expected %T to fail without soft fail", lookupErr)
+		}
+		ref, verified, err := resolveTrusted("nginx:alpine", true, lookup(lookupErr))
+		if err != nil || verified || ref != "nginx:alpine" {
+			t.Errorf("Expected unverified pull of nginx:alpine on %T with soft fail, got %s %v %v", lookupErr, ref, verified, err)
+		}
+	}
+
+	for _, lookupErr := range mismatch {
+		if isTrustUnavailable(lookupErr) {
+			t.Errorf("Expected %T to be classed as a verification failure", lookupErr)
+		}
+		if _, _, err := resolveTrusted("nginx:alpine", true, lookup(lookupErr)); err == nil {
+			t.Errorf("Expected verification failure %T to fail even with soft fail", lookupErr)
+		}
+	}
+}
+
+func TestTrustRootRotation(t *testing.T) {
+	rotated := &trustpinning.ErrRootRotationFail{Reason: "failed to validate data with current trusted certificates"}
+	mismatch := []error{
+		&trustpinning.ErrValidationFail{Reason: "failed to validate integrity of roots"},
+		validation.ErrValidation{Msg: "bad signature"},
+		signed.ErrRoleThreshold{},
+		signed.ErrInsufficientSignatures{},
+		data.ErrMismatchedChecksum{},
+	}
+	lookup := func(lookupErr error) func(string) (reference.Reference, error) {
+		return func(string) (reference.Reference, error) { return nil, lookupErr }
+	}
+
+	// a rotated root is never pulled without verification, and explains how to pin the new root
+	if !isTrustRootRotation(rotated) || !isTrustRootRotation(*rotated) || isTrustUnavailable(rotated) || isTrustMismatch(rotated) {
+		t.Error("Expected a root rotation failure to be classed as a rotation only")
+	}
+	for _, softFail := range []bool{false, true} {
+		_, _, err := resolveTrusted("nginx:alpine", softFail, lookup(rotated))
+		if err == nil || !strings.Contains(err.Error(), "root key of docker.io/library/nginx changed") || !strings.Contains(err.Error(), "-trust-root-key docker.io/library/nginx=") {
+			t.Errorf("Expected a root rotation error with guidance to pin the root, got %v", err)
+		}
+		if strings.Contains(err.Error(), "tampered") {
+			t.Errorf("Expected a root rotation not to be reported as tampering, got %v", err)
+		}
+	}
+
+	for _, lookupErr := range mismatch {
+		if isTrustRootRotation(lookupErr) || !isTrustMismatch(lookupErr) {
+			t.Errorf("Expected %T to be classed as a verification failure", lookupErr)
+		}
+		_, _, err := resolveTrusted("nginx:alpine", true, lookup(lookupErr))
+		if err == nil || !strings.Contains(err.Error(), "tampered") || strings.Contains(err.Error(), "-trust-root-key") {
+			t.Errorf("Expected %T to be reported as tampering, got %v", lookupErr, err)
+		}
+	}
+}
+
+func TestParseTrustRootKeys(t *testing.T) {
+	key := strings.Repeat("ab", 32)
+	keys, err := parseTrustRootKeys([]string{"nginx:alpine=" + key, "docker.io/library/nginx=" + strings.ToUpper(key), "linuxkit/init=" + key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"docker.io/library/nginx": {key, key},
+		"docker.io/linuxkit/init": {key},
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected root keys %v, got %v", expected, keys)
+	}
+	for _, k := range []string{"nginx", "=" + key, "nginx=abc", "nginx=" + strings.Repeat("zz", 32), "Nginx=" + key} {
+		if _, err := parseTrustRootKeys([]string{k}); err == nil {
+			t.Errorf("Expected an error for root key %s", k)
+		}
+	}
+}
+
+func TestRegistryCA(t *testing.T) {
+	defer func(cas []string) { RegistryCAs = cas }(RegistryCAs)
+
+	registry := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	// the handshake fails as intended without the CA
+	registry.Config.ErrorLog = stdlog.New(ioutil.Discard, "", 0)
+	registry.StartTLS()
+	defer registry.Close()
+
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := filepath.Join(dir, "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: registry.Certificate().Raw})
+	if err := ioutil.WriteFile(ca, cert, 0644); err != nil {
+		t.Fatal(err)
+	}
+	notPEM := filepath.Join(dir, "ca.txt")
+	if err := ioutil.WriteFile(notPEM, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pull := func() error {
+		rt, err := GetReadOnlyAuthTransport(registry.URL, []string{"library/test"}, "", "", "")
+		if err != nil {
+			return err
+		}
+		resp, err := (&http.Client{Transport: rt}).Get(registry.URL + "/v2/library/test/manifests/latest")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	RegistryCAs = nil
+	if err := pull(); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("Expected a certificate error without the registry CA, got %v", err)
+	}
+	RegistryCAs = []string{ca}
+	if err := pull(); err != nil {
+		t.Errorf("Expected the pull to succeed with the registry CA: %v", err)
+	}
+	RegistryCAs = []string{ca, notPEM}
+	if err := pull(); err == nil || !strings.Contains(err.Error(), "contains no PEM certificates") {
+		t.Errorf("Expected an error for a registry CA without certificates, got %v", err)
+	}
+	RegistryCAs = []string{filepath.Join(dir, "missing.pem")}
+	if err := pull(); err == nil {
+		t.Error("Expected an error for a missing registry CA")
+	}
+}
+
+func TestInsecureRegistry(t *testing.T) {
+	defer func(hosts []string) { InsecureRegistries = hosts }(InsecureRegistries)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	servers := map[string]*httptest.Server{}
+	for _, name := range []string{"insecure", "other"} {
+		s := httptest.NewUnstartedServer(handler)
+		s.Config.ErrorLog = stdlog.New(ioutil.Discard, "", 0)
+		s.StartTLS()
+		defer s.Close()
+		servers[name] = s
+	}
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	host := func(s *httptest.Server) string {
+		u, err := url.Parse(s.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.Host
+	}
+	ping := func(server string) error {
+		_, err := GetReadOnlyAuthTransport(server, []string{"library/test"}, "", "", "")
+		return err
+	}
+
+	InsecureRegistries = []string{host(servers["insecure"]), host(plain)}
+	if err := ping(servers["insecure"].URL); err != nil {
+		t.Errorf("Expected an insecure registry with a self signed certificate to be allowed: %v", err)
+	}
+	if err := ping(plain.URL); err != nil {
+		t.Errorf("Expected an insecure registry over plain HTTP to be allowed: %v", err)
+	}
+	if err := ping(servers["other"].URL); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("Expected another registry to still be verified, got %v", err)
+	}
+
+	InsecureRegistries = nil
+	if err := ping(servers["insecure"].URL); err == nil {
+		t.Error("Expected a self signed certificate to be rejected without -insecure-registry")
+	}
+	if err := ping(plain.URL); err == nil || !strings.Contains(err.Error(), "without TLS") {
+		t.Errorf("Expected plain HTTP to be refused without -insecure-registry, got %v", err)
+	}
+
+	InsecureRegistries = []string{"registry.local"}
+	for h, expected := range map[string]bool{"registry.local": true, "registry.local:5000": true, "registry.local.example.com": false, "other:5000": false} {
+		if insecureRegistry(h) != expected {
+			t.Errorf("Expected %s insecure to be %v", h, expected)
+		}
+	}
+	for h, valid := range map[string]bool{"localhost:5000": true, "registry.local": true, "[::1]:5000": true, "http://localhost": false, "localhost/v2": false, "": false} {
+		if err := validInsecureRegistry(h); (err == nil) != valid {
+			t.Errorf("Expected %q valid to be %v, got %v", h, valid, err)
+		}
+	}
+}
+
+func TestPrivateRegistryTrust(t *testing.T) {
+	defer func(dir string, hosts []string) {
+		MobyDir = dir
+		InsecureRegistries = hosts
+	}(MobyDir, InsecureRegistries)
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	MobyDir = dir
+
+	// a notary server without any signatures
+	var mu sync.Mutex
+	requests := []string{}
+	notary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.URL.Path)
+		mu.Unlock()
+		if r.URL.Path == "/v2/" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer notary.Close()
+	u, err := url.Parse(notary.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	InsecureRegistries = []string{u.Host}
+
+	key := strings.Repeat("ab", 32)
+	m, err := NewConfig([]byte("trust:\n  registries:\n    - registry: registry.example.com\n      enforce: true\n      server: " + notary.URL + "\n      rootKeys:\n        - " + key + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := "registry.example.com/app:v1"
+	trust := contentTrust(image, &m.Trust)
+	if !trust.verify || trust.server != notary.URL || !reflect.DeepEqual(trust.rootKeys, []string{key}) {
+		t.Fatalf("Expected %s to be verified on %s with root key %s, got %+v", image, notary.URL, key, trust)
+	}
+
+	// the lookup goes to the notary server of the registry, which has no
+	// trust data for the image
+	if _, err := TrustedReference(image, trust.server, trust.rootKeys); err == nil {
+		t.Error("Expected the lookup to fail without trust data")
+	}
+	looked := false
+	mu.Lock()
+	defer mu.Unlock()
+	for _, p := range requests {
+		if strings.HasPrefix(p, "/v2/registry.example.com/app/_trust/") {
+			looked = true
+		}
+	}
+	if !looked {
+		t.Errorf("Expected the trust data of %s to be looked up on its notary server, got requests %v", image, requests)
+	}
+
+	// without a server only Docker Hub images can be verified
+	if server, err := getTrustServer("docker.io/library/nginx", ""); err != nil || server != "https://notary.docker.io" {
+		t.Errorf("Expected the Docker Hub notary server, got %s %v", server, err)
+	}
+	if _, err := getTrustServer("registry.example.com/app", ""); err == nil || !strings.Contains(err.Error(), "no notary server") {
+		t.Errorf("Expected an error without a notary server, got %v", err)
+	}
+}
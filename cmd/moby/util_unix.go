@@ -4,8 +4,28 @@ package main
 
 import (
 	"os"
+	"syscall"
 )
 
 func homeDir() string {
 	return os.Getenv("HOME")
 }
+
+// diskFree returns the space available to unprivileged users on the filesystem of path
+func diskFree(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
+
+// lockFile takes a shared or exclusive lock of an open file, waiting for it
+// to be free, the lock is released when the file is closed
+func lockFile(f *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	return syscall.Flock(int(f.Fd()), how)
+}
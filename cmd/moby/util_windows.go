@@ -1,9 +1,21 @@
 package main
 
 import (
+	"errors"
 	"os"
 )
 
 func homeDir() string {
 	return os.Getenv("USERPROFILE")
 }
+
+// diskFree returns the space available on the filesystem of path
+func diskFree(path string) (uint64, error) {
+	return 0, errors.New("not supported on Windows")
+}
+
+// lockFile does not lock files on Windows, where builds and cache cleans
+// should not run at once
+func lockFile(f *os.File, exclusive bool) error {
+	return nil
+}
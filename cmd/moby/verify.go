@@ -0,0 +1,307 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// outputSuffixes are the file name suffixes of the outputs that write a single file
+var outputSuffixes = map[string]string{
+	"tar":            ".tar",
+	"tar-gz":         ".tar.gz",
+	"initrd":         "-initrd.img",
+	"docker-archive": ".docker.tar",
+	"manifest":       "-manifest.json",
+	"modules":        "-modules.tar",
+	"iso-bios":       ".iso",
+	"iso-efi":        "-efi.iso",
+	"img":            ".img",
+	"ab-raw":         "-ab-raw.img",
+	"efi":            ".efi",
+	"seed":           "-seed.img",
+	"img-gz":         ".img.gz",
+	"gcp-img":        ".img.tar.gz",
+	"qcow2":          ".qcow2",
+	"vhd":            ".vhd",
+	"vmdk":           ".vmdk",
+}
+
+// artifactOutput guesses the output type of an artifact from the longest
+// matching suffix, returning the type and the name it was built with
+func artifactOutput(artifact string) (string, string) {
+	base := filepath.Base(artifact)
+	out, suffix := "", ""
+	for o, s := range outputSuffixes {
+		if strings.HasSuffix(base, s) && len(s) > len(suffix) {
+			out, suffix = o, s
+		}
+	}
+	return out, strings.TrimSuffix(base, suffix)
+}
+
+// Process the verify arguments and execute verify
+func verify(args []string) {
+	verifyCmd := flag.NewFlagSet("verify", flag.ExitOnError)
+	verifyCmd.Usage = func() {
+		fmt.Printf("USAGE: %s verify [options] <file>[.yml] <artifact>\n\n", os.Args[0])
+		fmt.Printf("Rebuild a config reproducibly and check that it matches an existing output\n\n")
+		fmt.Printf("Options:\n")
+		verifyCmd.PrintDefaults()
+	}
+	verifyOutput := verifyCmd.String("output", "", "Output type of the artifact, default guessed from the file name")
+	verifyName := verifyCmd.String("name", "", "Name the artifact was built with, default guessed from the file name")
+	verifySize := verifyCmd.String("size", "1024M", "Size the artifact was built with, if supported and fixed size")
+	verifyPull := verifyCmd.Bool("pull", false, "Always pull images")
+	var verifyProfiles outputList
+	verifyCmd.Var(&verifyProfiles, "profile", "Profiles the artifact was built with")
+	verifyCompressLevel := verifyCmd.Int("compress-level", defaultCompressLevel, "Gzip compression level the artifact was built with, if compressed")
+	verifyEFIStub := verifyCmd.String("efi-stub", "", "EFI stub the artifact was built with, if an efi output")
+	verifyEmbedConfig := verifyCmd.Bool("embed-config", false, "The artifact was built with the config embedded")
+	verifyDisableTrust := verifyCmd.Bool("disable-content-trust", false, "Skip image trust verification specified in trust section of config (default false)")
+
+	if err := verifyCmd.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	remArgs := verifyCmd.Args()
+	if len(remArgs) != 2 {
+		fmt.Println("Please specify a configuration file and an artifact")
+		verifyCmd.Usage()
+		os.Exit(1)
+	}
+
+	size, err := getDiskSizeMB(*verifySize)
+	if err != nil {
+		log.Fatalf("Unable to parse disk size: %v", err)
+	}
+
+	err = validCompressLevel(*verifyCompressLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out, name := artifactOutput(remArgs[1])
+	if *verifyOutput != "" {
+		out = *verifyOutput
+	}
+	if *verifyName != "" {
+		name = *verifyName
+	}
+	if out == "" {
+		log.Fatalf("Cannot tell the output type of %s, please specify it with -output", remArgs[1])
+	}
+
+	c := &buildCommand{
+		name:          name,
+		out:           outputList{out},
+		size:          size,
+		disableTrust:  *verifyDisableTrust,
+		profiles:      verifyProfiles,
+		embedConfig:   *verifyEmbedConfig,
+		compressLevel: *verifyCompressLevel,
+		efiStub:       *verifyEFIStub,
+		opts: buildOpts{
+			pull:         *verifyPull,
+			reproducible: true,
+		},
+	}
+	diff, err := verifyArtifact(c, remArgs[0], remArgs[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if diff != "" {
+		fmt.Printf("%s does not match %s:\n%s", remArgs[1], remArgs[0], diff)
+		os.Exit(1)
+	}
+	fmt.Printf("%s matches %s\n", remArgs[1], remArgs[0])
+}
+
+// verifyArtifact rebuilds a config with a single output into a temporary
+// directory, returning a summary of the differences from the artifact, which
+// is empty if they match
+func verifyArtifact(c *buildCommand, conf, artifact string) (string, error) {
+	if len(c.out) != 1 || outputSuffixes[c.out[0]] == "" {
+		return "", fmt.Errorf("Cannot verify output type %s, it does not write a single file", c.out.String())
+	}
+	dir, err := ioutil.TempDir("", "moby-verify")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	err = c.run(conf, dir)
+	if err != nil {
+		return "", fmt.Errorf("Rebuild failed: %v", err)
+	}
+	rebuilt := filepath.Join(dir, c.name+outputSuffixes[c.out[0]])
+
+	want, err := sha256File(artifact)
+	if err != nil {
+		return "", err
+	}
+	got, err := sha256File(rebuilt)
+	if err != nil {
+		return "", err
+	}
+	if want == got {
+		return "", nil
+	}
+
+	diff := fmt.Sprintf("  artifact: sha256:%s\n  rebuilt:  sha256:%s\n", want, got)
+	entries := tarDiff(artifact, rebuilt)
+	for _, e := range entries {
+		diff += "  " + e + "\n"
+	}
+	return diff, nil
+}
+
+// maxTarDiff is the most differing entries shown in a verify summary
+const maxTarDiff = 10
+
+// tarDiff lists the entries that differ between two tarballs, nothing if either is not a tarball
+func tarDiff(a, b string) []string {
+	as, err := tarEntries(a)
+	if err != nil {
+		return nil
+	}
+	bs, err := tarEntries(b)
+	if err != nil {
+		return nil
+	}
+	diff := []string{}
+	for name, sum := range as {
+		other, ok := bs[name]
+		if !ok {
+			diff = append(diff, name+": missing from rebuild")
+		} else if other != sum {
+			diff = append(diff, name+": changed")
+		}
+	}
+	for name := range bs {
+		if _, ok := as[name]; !ok {
+			diff = append(diff, name+": only in rebuild")
+		}
+	}
+	sort.Strings(diff)
+	if len(diff) > maxTarDiff {
+		diff = append(diff[:maxTarDiff], fmt.Sprintf("... and %d more", len(diff)-maxTarDiff))
+	}
+	return diff
+}
+
+// tarEntries hashes the header and contents of each entry in a tarball by name
+func tarEntries(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries := map[string]string{}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		fmt.Fprintf(h, "%o %d %d %s %s %d %d\n", hdr.Mode, hdr.Uid, hdr.Gid, hdr.Linkname, hdr.ModTime.UTC(), hdr.Typeflag, hdr.Size)
+		if _, err := io.Copy(h, tr); err != nil {
+			return nil, err
+		}
+		entries[hdr.Name] = fmt.Sprintf("%x", h.Sum(nil))
+	}
+	return entries, nil
+}
+
+// readFileHashes reads a JSON object of paths in an image to the sha256 of
+// their contents, which may have a sha256: prefix
+func readFileHashes(filename string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read file hashes: %v", err)
+	}
+	raw := map[string]string{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("Invalid file hashes %s: %v", filename, err)
+	}
+	hashes := map[string]string{}
+	for p, sum := range raw {
+		sum = strings.ToLower(strings.TrimPrefix(sum, "sha256:"))
+		if len(sum) != sha256.Size*2 || strings.Trim(sum, "0123456789abcdef") != "" {
+			return nil, fmt.Errorf("Invalid sha256 %s for %s in %s", raw[p], p, filename)
+		}
+		hashes[cleanPath(p)] = sum
+	}
+	return hashes, nil
+}
+
+// checkFileHashes checks the contents of files in an image tarball against
+// their expected hashes, following hard links, returning the paths that are
+// missing or differ
+func checkFileHashes(image []byte, hashes map[string]string) ([]string, error) {
+	sums := map[string]string{}
+	links := map[string]string{}
+	others := map[string]bool{}
+	tr := tar.NewReader(bytes.NewReader(image))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := cleanPath(hdr.Name)
+		if _, ok := hashes[name]; !ok && hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		// a later entry replaces an earlier one
+		delete(sums, name)
+		delete(links, name)
+		delete(others, name)
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			h := sha256.New()
+			if _, err := io.Copy(h, tr); err != nil {
+				return nil, err
+			}
+			sums[name] = fmt.Sprintf("%x", h.Sum(nil))
+		case tar.TypeLink:
+			links[name] = cleanPath(hdr.Linkname)
+		default:
+			others[name] = true
+		}
+	}
+
+	diff := []string{}
+	for name, want := range hashes {
+		got, ok := sums[name]
+		if target, link := links[name]; link {
+			got, ok = sums[target]
+		}
+		switch {
+		case others[name]:
+			diff = append(diff, name+": not a regular file")
+		case !ok:
+			diff = append(diff, name+": missing")
+		case got != want:
+			diff = append(diff, fmt.Sprintf("%s: sha256:%s, expected sha256:%s", name, got, want))
+		}
+	}
+	sort.Strings(diff)
+	return diff, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVerifyArtifact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := filepath.Join(dir, "test.yml")
+	config := "files:\n  - path: etc/motd\n    contents: hello\n  - path: etc/issue\n    contents: moby\n"
+	if err := ioutil.WriteFile(conf, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	built := filepath.Join(dir, "built")
+	if err := os.Mkdir(built, 0755); err != nil {
+		t.Fatal(err)
+	}
+	c := &buildCommand{out: outputList{"tar"}, opts: buildOpts{reproducible: true}}
+	if err := c.run(conf, built); err != nil {
+		t.Fatal(err)
+	}
+	artifact := filepath.Join(built, "test.tar")
+
+	out, name := artifactOutput(artifact)
+	if out != "tar" || name != "test" {
+		t.Fatalf("Expected artifact to be a tar output named test, got %s named %s", out, name)
+	}
+
+	verifyCmd := &buildCommand{name: name, out: outputList{out}, opts: buildOpts{reproducible: true}}
+	diff, err := verifyArtifact(verifyCmd, conf, artifact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff != "" {
+		t.Errorf("Expected rebuild to match, got:\n%s", diff)
+	}
+
+	// a changed config no longer matches and the summary names the entry
+	config = strings.Replace(config, "hello", "goodbye", 1)
+	if err := ioutil.WriteFile(conf, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	diff, err = verifyArtifact(verifyCmd, conf, artifact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(diff, "etc/motd: changed") {
+		t.Errorf("Expected mismatch summary to name etc/motd, got:\n%s", diff)
+	}
+	if strings.Contains(diff, "etc/issue") {
+		t.Errorf("Expected unchanged entries not to be listed, got:\n%s", diff)
+	}
+}
+
+func TestArtifactOutput(t *testing.T) {
+	testCases := []struct {
+		artifact string
+		out      string
+		name     string
+	}{
+		{"dir/linuxkit.tar", "tar", "linuxkit"},
+		{"linuxkit.docker.tar", "docker-archive", "linuxkit"},
+		{"linuxkit-efi.iso", "iso-efi", "linuxkit"},
+		{"linuxkit.img.tar.gz", "gcp-img", "linuxkit"},
+		{"linuxkit.tar.gz", "tar-gz", "linuxkit"},
+		{"linuxkit-initrd.img", "initrd", "linuxkit"},
+		{"linuxkit.unknown", "", "linuxkit.unknown"},
+	}
+	for _, testCase := range testCases {
+		out, name := artifactOutput(testCase.artifact)
+		if out != testCase.out || name != testCase.name {
+			t.Errorf("Expected %s to be %s named %s, got %s named %s", testCase.artifact, testCase.out, testCase.name, out, name)
+		}
+	}
+}
+
+func TestVerifyFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := filepath.Join(dir, "test.yml")
+	config := "files:\n  - path: etc/motd\n    contents: hello\n  - path: etc/issue\n    contents: moby\n"
+	if err := ioutil.WriteFile(conf, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	manifest := filepath.Join(dir, "hashes.json")
+	hashes := fmt.Sprintf(`{"/etc/motd": "sha256:%x", "etc/issue": "%x"}`, sha256.Sum256([]byte("hello")), sha256.Sum256([]byte("moby")))
+	if err := ioutil.WriteFile(manifest, []byte(hashes), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &buildCommand{out: outputList{"tar"}, verifyFiles: manifest}
+	if err := c.run(conf, dir); err != nil {
+		t.Fatalf("Expected matching files to verify: %v", err)
+	}
+
+	// a tampered file fails the build naming only that file
+	config = strings.Replace(config, "hello", "tampered", 1)
+	if err := ioutil.WriteFile(conf, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = c.run(conf, dir)
+	if err == nil || !strings.Contains(err.Error(), "etc/motd: sha256:") {
+		t.Fatalf("Expected an error naming the tampered file, got %v", err)
+	}
+	if strings.Contains(err.Error(), "etc/issue") {
+		t.Errorf("Expected matching files not to be listed, got %v", err)
+	}
+
+	for _, invalid := range []string{`{"etc/motd": "1234"}`, `{"etc/motd": "sha512:` + strings.Repeat("0", 64) + `"}`, `["etc/motd"]`} {
+		if err := ioutil.WriteFile(manifest, []byte(invalid), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readFileHashes(manifest); err == nil {
+			t.Errorf("Expected an error reading file hashes %s", invalid)
+		}
+	}
+}
+
+func TestCheckFileHashes(t *testing.T) {
+	sum := func(s string) string { return fmt.Sprintf("%x", sha256.Sum256([]byte(s))) }
+	image := makeLinkTar(t, []linkEntry{
+		{name: "bin/", typeflag: tar.TypeDir},
+		{name: "bin/busybox", typeflag: tar.TypeReg, contents: "busybox"},
+		{name: "bin/sh", typeflag: tar.TypeLink, linkname: "bin/busybox"},
+		{name: "bin/ash", typeflag: tar.TypeSymlink, linkname: "busybox"},
+		{name: "etc/passwd", typeflag: tar.TypeReg, contents: "root:x:0:0"},
+		{name: "etc/passwd", typeflag: tar.TypeReg, contents: "root::0:0"},
+	}).Bytes()
+	diff, err := checkFileHashes(image, map[string]string{
+		"bin/busybox": sum("busybox"),
+		"bin/sh":      sum("busybox"),
+		"bin/ash":     sum("busybox"),
+		"bin":         sum(""),
+		"etc/passwd":  sum("root:x:0:0"),
+		"etc/shadow":  sum(""),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"bin/ash: not a regular file",
+		"bin: not a regular file",
+		fmt.Sprintf("etc/passwd: sha256:%s, expected sha256:%s", sum("root::0:0"), sum("root:x:0:0")),
+		"etc/shadow: missing",
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("Expected differences %q, got %q", expected, diff)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"path"
+	"strings"
+)
+
+const (
+	// whiteoutPrefix marks an overlay whiteout, deleting the path without the prefix
+	whiteoutPrefix = ".wh."
+	// whiteoutOpaque marks a directory whose contents in lower layers are hidden
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// whiteout is a whiteout marker found in a layer of the image
+type whiteout struct {
+	layer  int
+	path   string
+	opaque bool
+}
+
+// whiteouts records the layers of an image as they are appended and the
+// whiteout markers in them, which are applied once the image is assembled
+type whiteouts struct {
+	// starts is the index of the first entry of each layer
+	starts  []int
+	entries int
+	markers []whiteout
+}
+
+// cleanPath normalises a tar entry name
+func cleanPath(name string) string {
+	return strings.Trim(path.Clean("/"+name), "/")
+}
+
+// startLayer is called before the entries of a layer are appended
+func (w *whiteouts) startLayer() {
+	w.starts = append(w.starts, w.entries)
+}
+
+// add records an entry of the current layer, returning false if it is a
+// whiteout marker that should not be written to the image
+func (w *whiteouts) add(hdr *tar.Header) bool {
+	dir, base := path.Split(cleanPath(hdr.Name))
+	if !strings.HasPrefix(base, whiteoutPrefix) {
+		w.entries++
+		return true
+	}
+	layer := len(w.starts) - 1
+	if base == whiteoutOpaque {
+		w.markers = append(w.markers, whiteout{layer: layer, path: cleanPath(dir), opaque: true})
+	} else {
+		w.markers = append(w.markers, whiteout{layer: layer, path: cleanPath(dir + strings.TrimPrefix(base, whiteoutPrefix))})
+	}
+	return false
+}
+
+// layer returns the layer an entry was appended in
+func (w *whiteouts) layer(entry int) int {
+	l := 0
+	for i, start := range w.starts {
+		if entry >= start {
+			l = i
+		}
+	}
+	return l
+}
+
+// deleted reports whether a whiteout in a later layer removes an entry
+func (w *whiteouts) deleted(name string, layer int) bool {
+	for _, m := range w.markers {
+		if m.layer <= layer {
+			continue
+		}
+		under := m.path == "" || strings.HasPrefix(name, m.path+"/")
+		if under || (!m.opaque && name == m.path) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply removes the entries deleted by whiteouts in later layers from an image
+func (w *whiteouts) apply(image []byte) ([]byte, error) {
+	if len(w.markers) == 0 {
+		return image, nil
+	}
+	out := new(bytes.Buffer)
+	tw := tar.NewWriter(out)
+	tr := tar.NewReader(bytes.NewReader(image))
+	for entry := 0; ; entry++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if w.deleted(cleanPath(hdr.Name), w.layer(entry)) {
+			continue
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(tw, tr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestApplyWhiteouts(t *testing.T) {
+	lower := makeTar(t, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/motd", typeflag: tar.TypeReg, contents: "lower"},
+		{name: "etc/issue", typeflag: tar.TypeReg, contents: "lower"},
+		{name: "var/", typeflag: tar.TypeDir},
+		{name: "var/cache/", typeflag: tar.TypeDir},
+		{name: "var/cache/old", typeflag: tar.TypeReg, contents: "lower"},
+		{name: "usr/share/doc/", typeflag: tar.TypeDir},
+		{name: "usr/share/doc/README", typeflag: tar.TypeReg, contents: "lower"},
+	})
+	upper := makeTar(t, []tarEntry{
+		{name: "etc/.wh.motd", typeflag: tar.TypeReg},
+		// an opaque directory hides the lower contents but keeps its own
+		{name: "var/cache/new", typeflag: tar.TypeReg, contents: "upper"},
+		{name: "var/cache/.wh..wh..opq", typeflag: tar.TypeReg},
+		{name: "./usr/share/.wh.doc", typeflag: tar.TypeReg},
+	})
+
+	testCases := []struct {
+		apply    bool
+		expected []string
+	}{
+		{true, []string{"etc/", "etc/issue", "var/", "var/cache/", "var/cache/new"}},
+		{false, []string{
+			"./usr/share/.wh.doc", "etc/", "etc/.wh.motd", "etc/issue", "etc/motd", "usr/share/doc/",
+			"usr/share/doc/README", "var/", "var/cache/", "var/cache/.wh..wh..opq", "var/cache/new", "var/cache/old",
+		}},
+	}
+	for _, testCase := range testCases {
+		ao := appendOpts{}
+		if testCase.apply {
+			ao.whiteouts = &whiteouts{}
+		}
+		buf := new(bytes.Buffer)
+		iw := tar.NewWriter(buf)
+		for _, layer := range []*bytes.Buffer{bytes.NewBuffer(lower.Bytes()), bytes.NewBuffer(upper.Bytes())} {
+			if err := initrdAppend(iw, layer, ao); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := iw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		image := buf.Bytes()
+		if ao.whiteouts != nil {
+			var err error
+			image, err = ao.whiteouts.apply(image)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		hdrs, contents := readTar(t, bytes.NewBuffer(image))
+		names := []string{}
+		for name := range hdrs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, testCase.expected) {
+			t.Errorf("Expected entries %v with apply %v, got %v", testCase.expected, testCase.apply, names)
+		}
+		if contents["var/cache/new"] != "upper" {
+			t.Error("Expected entries in the whiteout layer to be kept")
+		}
+	}
+}